@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// auditLog appends the audit records of the dests written to -audit-log,
+// and writes each to -audit-oss too
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File // nil if no -audit-log
+	oss  string   // bucket/prefix/, "" if no -audit-oss
+}
+
+// setAudit sets the Audit of opts to write the records to -audit-log and
+// -audit-oss, and the caller of the commands run from the shell
+func setAudit() {
+	if u, err := user.Current(); err == nil {
+		opts.Caller = "cli:" + u.Username
+	}
+	if auditLogPath == "" && auditOSS == "" {
+		return
+	}
+	a := &auditLog{}
+	if auditLogPath != "" {
+		f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			perror("-audit-log: %v", err)
+		}
+		a.file = f
+	}
+	if auditOSS != "" {
+		if !strings.HasPrefix(auditOSS, repack.OSSScheme) {
+			perror("-audit-oss: expect oss://bucket/prefix/: %s", auditOSS)
+		}
+		a.oss = strings.TrimPrefix(auditOSS, repack.OSSScheme)
+		if !strings.Contains(a.oss, "/") {
+			a.oss += "/"
+		}
+	}
+	opts.Audit = a.write
+}
+
+// write appends r as a json line to the file, synced to disk, and writes it
+// to an object of its own under the OSS prefix, named by its date
+func (a *auditLog) write(r repack.AuditRecord) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if a.file != nil {
+		a.mu.Lock()
+		_, err := a.file.Write(buf)
+		if err == nil {
+			err = a.file.Sync()
+		}
+		a.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("-audit-log: %v", err)
+		}
+	}
+	if a.oss != "" {
+		b := make([]byte, 4)
+		rand.Read(b)
+		name := fmt.Sprintf("%s%s/%s-%s.json", a.oss, r.Time.Format("2006/01/02"), r.Time.Format("150405.000000000"), hex.EncodeToString(b))
+		if err := repack.WriteObject(serverOSSConfig(), name, buf); err != nil {
+			return fmt.Errorf("-audit-oss: %v", err)
+		}
+	}
+	return nil
+}
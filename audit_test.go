@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+func TestAuditLog(t *testing.T) {
+	fake := newFakeOSS()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	defer func(o repack.Options) { opts = o }(opts)
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = srv.URL, "id", "secret"
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{file: f, oss: "audit/records/"}
+	now := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	for _, dest := range []string{"bucket/a.apk", "bucket/b.apk"} {
+		if err := a.write(repack.AuditRecord{Time: now, Dest: dest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	f, _ = os.Open(path)
+	defer f.Close()
+	var dests []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var r repack.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		dests = append(dests, r.Dest)
+	}
+	if strings.Join(dests, ",") != "bucket/a.apk,bucket/b.apk" {
+		t.Errorf("records of %v", dests)
+	}
+	// an object of each record, even of the same time
+	objects := 0
+	for path := range fake.objects {
+		if strings.HasPrefix(path, "/audit/records/2026/10/17/080000.") {
+			objects++
+		}
+	}
+	if objects != 2 {
+		t.Errorf("%d objects in %v", objects, fake.objects)
+	}
+}
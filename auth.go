@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers of a request signed with HMAC
+const (
+	hmacScheme      = "HMAC-SHA256"
+	hmacTimestamp   = "X-Repack-Timestamp" // unix seconds of the signature
+	hmacNonce       = "X-Repack-Nonce"     // unique per request of a caller, against replays
+	maxNonceLen     = 128
+	maxClockSkew    = 5 * time.Minute // between the signature and now
+	maxSignedBody   = 1 << 20         // read before the signature is checked
+	jwksRefreshWait = time.Minute     // between fetches of unknown key ids
+)
+
+// authenticator checks the credentials of the requests to the API, and
+// returns the identity of the caller
+type authenticator struct {
+	oidc *oidcVerifier // nil if no -oidc-issuer
+
+	mu       sync.Mutex
+	hmacKeys map[string][]byte    // secret by caller, of -hmac-keys
+	nonces   map[string]time.Time // of the signed requests, by caller and nonce, until they expire
+	swept    time.Time            // when the expired nonces were last removed
+}
+
+// newAuthenticator returns the authenticator of the flags, nil if no
+// authentication is configured
+func newAuthenticator() (*authenticator, error) {
+	if hmacKeysPath == "" && oidcIssuer == "" {
+		return nil, nil
+	}
+	a := &authenticator{}
+	if err := a.loadHMACKeys(); err != nil {
+		return nil, err
+	}
+	if oidcIssuer != "" {
+		if oidcAudience == "" {
+			return nil, fmt.Errorf("-oidc-audience is required with -oidc-issuer")
+		}
+		a.oidc = &oidcVerifier{issuer: strings.TrimSuffix(oidcIssuer, "/"), audience: oidcAudience}
+	}
+	return a, nil
+}
+
+// loadHMACKeys reads the secrets of -hmac-keys, if set, and uses them
+// instead of those read before
+func (a *authenticator) loadHMACKeys() error {
+	if hmacKeysPath == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(hmacKeysPath)
+	if err != nil {
+		return fmt.Errorf("-hmac-keys: %v", err)
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(buf, &secrets); err != nil {
+		return fmt.Errorf("-hmac-keys: %v", err)
+	}
+	keys := make(map[string][]byte, len(secrets))
+	for caller, secret := range secrets {
+		if secret == "" {
+			return fmt.Errorf("-hmac-keys: empty secret of %s", caller)
+		}
+		keys[caller] = []byte(secret)
+	}
+	a.mu.Lock()
+	a.hmacKeys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+// callerKey is the context key of the caller of a request
+type callerKey struct{}
+
+// callerOf returns the caller of the request of ctx, "" if anonymous
+func callerOf(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// wrap returns h, rejecting the requests without valid credentials with
+// status 401, and passing the caller in the context of the others
+func (a *authenticator) wrap(h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", hmacScheme+", Bearer")
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	}
+}
+
+// authenticate returns the caller of r, hmac:<caller> or oidc:<subject>
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, hmacScheme+" "):
+		caller, err := a.verifyHMAC(r, strings.TrimPrefix(auth, hmacScheme+" "))
+		return "hmac:" + caller, err
+	case strings.HasPrefix(auth, "Bearer ") && a.oidc != nil:
+		subject, err := a.oidc.verify(strings.TrimPrefix(auth, "Bearer "))
+		return "oidc:" + subject, err
+	case auth == "":
+		return "", errors.New("no Authorization header")
+	}
+	return "", errors.New("unsupported Authorization scheme")
+}
+
+// verifyHMAC checks the signature of r, the credential <caller>:<hex of
+// the HMAC-SHA256 of stringToSign with the secret of caller>
+func (a *authenticator) verifyHMAC(r *http.Request, credential string) (string, error) {
+	i := strings.LastIndex(credential, ":")
+	if i < 0 {
+		return "", errors.New("expect <caller>:<signature>")
+	}
+	caller, signature := credential[:i], credential[i+1:]
+	a.mu.Lock()
+	secret, ok := a.hmacKeys[caller]
+	a.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown caller %q", caller)
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(hmacTimestamp), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s header", hmacTimestamp)
+	}
+	signed := time.Unix(ts, 0)
+	if skew := time.Since(signed); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", fmt.Errorf("%s is more than %v away", hmacTimestamp, maxClockSkew)
+	}
+	nonce := r.Header.Get(hmacNonce)
+	if nonce == "" || len(nonce) > maxNonceLen {
+		return "", fmt.Errorf("expect a %s header of up to %d bytes", hmacNonce, maxNonceLen)
+	}
+	// the body is hashed before the signature can be checked, so only so
+	// much of it is read from anyone
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return "", fmt.Errorf("body over %d bytes", maxSignedBody)
+		}
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign(r, body)))
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return "", errors.New("signature mismatch")
+	}
+	if !a.useNonce(caller, nonce, signed.Add(maxClockSkew)) {
+		return "", fmt.Errorf("%s already used", hmacNonce)
+	}
+	return caller, nil
+}
+
+// useNonce records the nonce of caller until expires, when its timestamp
+// is too old to replay, and reports whether it wasn't used yet
+func (a *authenticator) useNonce(caller, nonce string, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.nonces == nil {
+		a.nonces = make(map[string]time.Time)
+	}
+	if now.Sub(a.swept) > time.Minute {
+		for key, t := range a.nonces {
+			if now.After(t) {
+				delete(a.nonces, key)
+			}
+		}
+		a.swept = now
+	}
+	key := caller + "\n" + nonce
+	if t, ok := a.nonces[key]; ok && !now.After(t) {
+		return false
+	}
+	a.nonces[key] = expires
+	return true
+}
+
+// stringToSign is the method, path with the query, timestamp, nonce and
+// hex of the SHA256 of the body of r, one per line
+func stringToSign(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{r.Method, r.URL.RequestURI(), r.Header.Get(hmacTimestamp), r.Header.Get(hmacNonce), hex.EncodeToString(sum[:])}, "\n")
+}
+
+// oidcVerifier checks the RS256 ID tokens of an OIDC issuer, with the keys
+// of its discovery document
+type oidcVerifier struct {
+	issuer   string
+	audience string
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey // by key id
+	fetched  time.Time
+	fetching chan struct{} // closed once the keys being fetched are set, nil if none
+}
+
+// verify checks the signature, issuer, audience and expiry of token, and
+// returns its subject
+func (v *oidcVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported token alg %q, expect RS256", header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", errors.New("invalid token signature")
+	}
+
+	var claims struct {
+		Issuer    string          `json:"iss"`
+		Subject   string          `json:"sub"`
+		Audience  json.RawMessage `json:"aud"`
+		Expires   int64           `json:"exp"`
+		NotBefore int64           `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("token claims: %v", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return "", fmt.Errorf("token issuer %q, expect %s", claims.Issuer, v.issuer)
+	case !hasAudience(claims.Audience, v.audience):
+		return "", fmt.Errorf("token not for audience %s", v.audience)
+	case claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(maxClockSkew)):
+		return "", errors.New("token expired")
+	case claims.NotBefore != 0 && now.Add(maxClockSkew).Before(time.Unix(claims.NotBefore, 0)):
+		return "", errors.New("token not valid yet")
+	case claims.Subject == "":
+		return "", errors.New("token without subject")
+	}
+	return claims.Subject, nil
+}
+
+// decodeSegment decodes a base64url json segment of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// hasAudience reports whether aud, a string or an array of strings,
+// contains audience
+func hasAudience(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	json.Unmarshal(aud, &many)
+	for _, a := range many {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the key of id, fetching the keys of the issuer if unknown, at
+// most once in jwksRefreshWait and without holding v.mu
+func (v *oidcVerifier) key(id string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	if key, ok := v.keys[id]; ok {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if fetching := v.fetching; fetching != nil {
+		v.mu.Unlock()
+		<-fetching
+		return v.knownKey(id)
+	}
+	if time.Since(v.fetched) < jwksRefreshWait {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown token key %q", id)
+	}
+	v.fetched = time.Now()
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.mu.Unlock()
+
+	keys, err := v.fetchKeys()
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetching = nil
+	v.mu.Unlock()
+	close(fetching)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys of %s: %v", v.issuer, err)
+	}
+	return v.knownKey(id)
+}
+
+// knownKey returns the key of id among those fetched
+func (v *oidcVerifier) knownKey(id string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown token key %q", id)
+}
+
+// fetchKeys returns the RSA keys of the JWKS of the discovery document of
+// the issuer
+func (v *oidcVerifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			return nil, fmt.Errorf("invalid key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// getJSON gets url and decodes its json body into v
+func getJSON(url string, v interface{}) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
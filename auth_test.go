@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request of body signed by caller with secret
+func signedRequest(caller, secret, nonce string, ts time.Time, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/repack?wait=1", strings.NewReader(body))
+	r.Header.Set(hmacTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	if nonce != "" {
+		r.Header.Set(hmacNonce, nonce)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign(r, []byte(body))))
+	r.Header.Set("Authorization", hmacScheme+" "+caller+":"+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	a := &authenticator{hmacKeys: map[string][]byte{"platform": []byte("secret"), "other": []byte("other secret")}}
+	now := time.Now()
+	body := `{"source":"bucket/a.apk"}`
+	tampered := signedRequest("platform", "secret", "n9", now, body)
+	tampered.Body = ioutil.NopCloser(strings.NewReader(`{"source":"bucket/b.apk"}`))
+	tests := []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"valid", signedRequest("platform", "secret", "n1", now, body), true},
+		{"replayed", signedRequest("platform", "secret", "n1", now, body), false},
+		{"nonce of another caller", signedRequest("other", "other secret", "n1", now, body), true},
+		{"new nonce", signedRequest("platform", "secret", "n2", now, body), true},
+		{"no nonce", signedRequest("platform", "secret", "", now, body), false},
+		{"long nonce", signedRequest("platform", "secret", strings.Repeat("n", maxNonceLen+1), now, body), false},
+		{"wrong secret", signedRequest("platform", "guess", "n3", now, body), false},
+		{"unknown caller", signedRequest("nobody", "secret", "n4", now, body), false},
+		{"old", signedRequest("platform", "secret", "n5", now.Add(-maxClockSkew-time.Minute), body), false},
+		{"future", signedRequest("platform", "secret", "n6", now.Add(maxClockSkew+time.Minute), body), false},
+		{"large body", signedRequest("platform", "secret", "n7", now, strings.Repeat(" ", maxSignedBody+1)), false},
+		{"body of maximum size", signedRequest("platform", "secret", "n8", now, strings.Repeat(" ", maxSignedBody)), true},
+		{"tampered body", tampered, false},
+		{"nonce of a failed signature", signedRequest("platform", "secret", "n9", now, body), true},
+	}
+	for _, tt := range tests {
+		credential := strings.TrimPrefix(tt.r.Header.Get("Authorization"), hmacScheme+" ")
+		caller, err := a.verifyHMAC(tt.r, credential)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %q, %v, want ok %v", tt.name, caller, err, tt.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if buf, _ := ioutil.ReadAll(tt.r.Body); len(buf) == 0 {
+			t.Errorf("%s: body %q not kept for the handler", tt.name, buf)
+		}
+	}
+}
+
+func TestUseNonceExpires(t *testing.T) {
+	a := &authenticator{}
+	if !a.useNonce("platform", "n", time.Now().Add(-time.Second)) {
+		t.Fatal("first use rejected")
+	}
+	if !a.useNonce("platform", "n", time.Now().Add(time.Minute)) {
+		t.Error("expired nonce rejected")
+	}
+	if a.useNonce("platform", "n", time.Now().Add(time.Minute)) {
+		t.Error("nonce used twice")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	defer func(header string) { tenantHeader = header }(tenantHeader)
+	tenantHeader = "X-Tenant"
+	a := &authenticator{hmacKeys: map[string][]byte{"platform": []byte("secret")}}
+	s := newServer(context.Background())
+	s.queue = newScheduler(10, 0, 0)
+	repackHandler, jobHandler := a.wrap(s.handleRepack), a.wrap(s.handleJob)
+	body := `{"source":"bucket/a.apk","dest":"bucket/b.apk"}`
+
+	w := httptest.NewRecorder()
+	repackHandler(w, httptest.NewRequest(http.MethodPost, "/repack", strings.NewReader(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned: %d", w.Code)
+	}
+
+	// the tenant is the caller, whatever the header
+	r := signedRequest("platform", "secret", "n1", time.Now(), body)
+	r.Header.Set("X-Tenant", "other")
+	w = httptest.NewRecorder()
+	repackHandler(w, r)
+	var j job
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil || w.Code != http.StatusAccepted {
+		t.Fatalf("signed: %d %s", w.Code, w.Body)
+	}
+	if j.Caller != "hmac:platform" || j.Tenant != "hmac:platform" {
+		t.Errorf("caller %q, tenant %q", j.Caller, j.Tenant)
+	}
+
+	// the jobs of other callers are not shown
+	r = httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID, nil)
+	w = httptest.NewRecorder()
+	s.handleJob(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, "hmac:other")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("job of another caller: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	jobHandler(w, httptest.NewRequest(http.MethodGet, "/jobs/"+j.ID, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned job: %d", w.Code)
+	}
+}
+
+// testIssuer is an OIDC issuer with one RSA key per key id, whose JWKS
+// requests wait on block if set
+type testIssuer struct {
+	*httptest.Server
+	keys    map[string]*rsa.PrivateKey
+	block   chan struct{}
+	fetches int
+}
+
+func newTestIssuer(t *testing.T, kids ...string) *testIssuer {
+	iss := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	for _, kid := range kids {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iss.keys[kid] = key
+	}
+	iss.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"jwks_uri":%q}`, iss.URL+"/jwks")
+		case "/jwks":
+			iss.fetches++
+			if iss.block != nil {
+				<-iss.block
+			}
+			var jwks struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			for kid, key := range iss.keys {
+				jwks.Keys = append(jwks.Keys, map[string]string{
+					"kty": "RSA",
+					"kid": kid,
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				})
+			}
+			json.NewEncoder(w).Encode(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return iss
+}
+
+// token returns an RS256 token of kid with the claims
+func (iss *testIssuer) token(t *testing.T, kid string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		buf, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	key := iss.keys[kid]
+	if key == nil {
+		key = iss.keys["k1"]
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	iss := newTestIssuer(t, "k1", "k2")
+	defer iss.Close()
+	v := &oidcVerifier{issuer: iss.URL, audience: "repack"}
+	claims := func(f func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"iss": iss.URL, "sub": "platform", "aud": "repack", "exp": time.Now().Add(time.Hour).Unix()}
+		if f != nil {
+			f(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", iss.token(t, "k1", claims(nil)), true},
+		{"audience in a list", iss.token(t, "k2", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "repack"} })), true},
+		{"other audience", iss.token(t, "k1", claims(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"other issuer", iss.token(t, "k1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil" })), false},
+		{"expired", iss.token(t, "k1", claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), false},
+		{"not valid yet", iss.token(t, "k1", claims(func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), false},
+		{"no subject", iss.token(t, "k1", claims(func(c map[string]interface{}) { delete(c, "sub") })), false},
+		{"unknown key", iss.token(t, "k3", claims(nil)), false},
+		{"malformed", "a.b", false},
+	}
+	for _, tt := range tests {
+		subject, err := v.verify(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %q, %v, want ok %v", tt.name, subject, err, tt.ok)
+		}
+	}
+	if iss.fetches != 1 {
+		t.Errorf("%d fetches of the keys, want 1 in %v", iss.fetches, jwksRefreshWait)
+	}
+}
+
+func TestOIDCFetchUnlocked(t *testing.T) {
+	iss := newTestIssuer(t, "k1")
+	defer iss.Close()
+	v := &oidcVerifier{issuer: iss.URL, audience: "repack"}
+	claims := map[string]interface{}{"iss": iss.URL, "sub": "platform", "aud": "repack", "exp": time.Now().Add(time.Hour).Unix()}
+	known := iss.token(t, "k1", claims)
+	if _, err := v.verify(known); err != nil {
+		t.Fatal(err)
+	}
+
+	// a token of a new key fetches the keys again, and waits for the issuer
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.keys["k2"] = key
+	iss.block = make(chan struct{})
+	v.mu.Lock()
+	v.fetched = time.Time{}
+	v.mu.Unlock()
+	fresh := iss.token(t, "k2", claims)
+	done := make(chan error, 2)
+	go func() {
+		_, err := v.verify(fresh)
+		done <- err
+	}()
+	go func() {
+		_, err := v.verify(fresh)
+		done <- err
+	}()
+	for {
+		v.mu.Lock()
+		fetching := v.fetching != nil
+		v.mu.Unlock()
+		if fetching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.verify(known)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("known key during the fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("token of a known key waits for the fetch")
+	}
+
+	close(iss.block)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("new key: %v", err)
+		}
+	}
+	if iss.fetches != 2 {
+		t.Errorf("%d fetches of the keys, want 2", iss.fetches)
+	}
+}
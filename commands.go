@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// command is a subcommand with its own flags
+type command struct {
+	name  string
+	usage string // one line
+	flags []func(*flag.FlagSet)
+	run   func(ctx context.Context) error
+}
+
+var commands = []*command{
+	{
+		name:  "repack",
+		usage: "repack an apk with a cpid, one for each of -channels, or the rows of -batch (default)",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, cpidFlags, fanOutFlags, resultFlags},
+		run:   runRepack,
+	},
+	{
+		name:  "sign",
+		usage: "sign an apk again without cpid, e.g. with another key",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, resultFlags},
+		run:   runSign,
+	},
+	{
+		name:  "sign-local",
+		usage: "sign a local apk file again without cpid and write the signed apk to a local file",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, signLocalFlags, resultFlags},
+		run:   runSignLocal,
+	},
+	{
+		name:  "verify",
+		usage: "check the entries and signature files of an apk, and its cpid",
+		flags: []func(*flag.FlagSet){commonFlags, verifyFlags},
+		run:   runVerify,
+	},
+	{
+		name:  "verify-remote",
+		usage: "check an apk like verify, reading only its signature files and a sample of its entries",
+		flags: []func(*flag.FlagSet){commonFlags, verifyRemoteFlags},
+		run:   runVerifyRemote,
+	},
+	{
+		name:  "extract-cpid",
+		usage: "print the cpid of an apk, reading only its cpid entry, and its meta-data or signing block if asked",
+		flags: []func(*flag.FlagSet){commonFlags, extractCPIDFlags, resultFlags},
+		run:   runExtractCPID,
+	},
+	{
+		name:  "compare-signers",
+		usage: "compare the signing certs of two apks, e.g. to catch an apk signed with the wrong key",
+		flags: []func(*flag.FlagSet){commonFlags, compareSignersFlags, resultFlags},
+		run:   runCompareSigners,
+	},
+	{
+		name:  "inspect",
+		usage: "print the entries, signatures and channel of an apk",
+		flags: []func(*flag.FlagSet){commonFlags, inspectFlags},
+		run: func(ctx context.Context) error {
+			return repack.Inspect(ctx, opts, os.Stdout)
+		},
+	},
+	{
+		name:  "seal-key",
+		usage: "encrypt a private key pem with a data key of KMS, and print the envelope for -priv-pem or -priv-blob",
+		flags: []func(*flag.FlagSet){commonFlags, sealKeyFlags},
+		run:   runSealKey,
+	},
+	{
+		name:  "clean",
+		usage: "abort the multipart uploads and delete the temp objects left behind by killed processes",
+		flags: []func(*flag.FlagSet){commonFlags, cleanFlags},
+		run:   runClean,
+	},
+	{
+		name:  "self-test",
+		usage: "check the OSS endpoint, the credentials and the signing keys, as /readyz does",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, selfTestFlags},
+		run:   runSelfTest,
+	},
+	{
+		name:  "fc",
+		usage: "run as a Function Compute custom runtime",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, cpidFlags},
+		run:   serveFC,
+	},
+	{
+		name:  "serve",
+		usage: "run the REST API",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, cpidFlags, serveFlags, selfTestFlags, jobStoreFlags, lockFlags},
+		run:   serve,
+	},
+	{
+		name:  "worker",
+		usage: "consume repack events from an MNS queue",
+		flags: []func(*flag.FlagSet){commonFlags, keyFlags, apkFlags, cpidFlags, workerFlags, jobStoreFlags, lockFlags},
+		run:   runWorker,
+	},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// parse parses args with the flags of cmd, it exits with 2 on bad flags
+func (cmd *command) parse(args []string) {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	for _, f := range cmd.flags {
+		f(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: repack %s [flags]\n\n%s\n\nflags:\n", cmd.name, cmd.usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+}
+
+// usage prints the commands
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: repack [command] [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'repack <command> -h' for the flags of a command.")
+}
+
+func runRepack(ctx context.Context) error {
+	slog.Info("using config", "options", opts)
+	opts.SHA256 = resultPath != ""
+
+	if opts.Batch != "" {
+		rows, err := repack.RepackBatch(ctx, opts)
+		if resultPath != "-" {
+			printRows(rows)
+		}
+		writeResult(rows)
+		return err
+	}
+
+	if opts.Channels != "" {
+		results, err := repack.RepackChannels(ctx, opts)
+		writeResult(results)
+		return err
+	}
+
+	result, err := repack.Repack(ctx, opts)
+	if err != nil {
+		return err
+	}
+	writeResult(result)
+	return nil
+}
+
+func runSign(ctx context.Context) error {
+	slog.Info("using config", "options", opts)
+	opts.SHA256 = resultPath != ""
+	result, err := repack.Sign(ctx, opts)
+	if err != nil {
+		return err
+	}
+	writeResult(result)
+	return nil
+}
+
+func runSignLocal(ctx context.Context) error {
+	slog.Info("using config", "options", opts)
+	opts.SHA256 = resultPath != ""
+	result, err := repack.SignLocal(ctx, opts)
+	if err != nil {
+		return err
+	}
+	writeResult(result)
+	return nil
+}
+
+func runVerify(ctx context.Context) error {
+	if err := repack.Verify(ctx, opts); err != nil {
+		return err
+	}
+	slog.Info("verified", "apk", opts.SourceAPK)
+	return nil
+}
+
+func runVerifyRemote(ctx context.Context) error {
+	verify := repack.VerifyRemote
+	if verifyFull {
+		opts.VerifySignature = true
+		verify = repack.Verify
+	}
+	if err := verify(ctx, opts); err != nil {
+		return err
+	}
+	slog.Info("verified", "apk", opts.SourceAPK)
+	return nil
+}
+
+func runExtractCPID(ctx context.Context) error {
+	e, err := repack.ExtractCPID(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if resultPath != "" {
+		writeResult(e)
+		return nil
+	}
+	if e.Path != "" {
+		fmt.Printf("%s: %s\n", e.Path, e.CPID)
+	}
+	if e.Comment != "" {
+		fmt.Printf("comment: %s\n", e.Comment)
+	}
+	if e.MetaData != "" {
+		fmt.Printf("meta-data %s: %s\n", opts.MetaDataName, e.MetaData)
+	}
+	if e.Channel != "" {
+		fmt.Printf("channel: %s\n", e.Channel)
+	}
+	return nil
+}
+
+func runCompareSigners(ctx context.Context) error {
+	c, err := repack.CompareSigners(ctx, opts, otherAPK)
+	if resultPath != "" {
+		writeResult(c)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "apk\tscheme\tcert sha256\tsubject")
+		for _, apk := range []struct {
+			location string
+			signers  []repack.Signer
+		}{{c.Source, c.Signers}, {c.Other, c.OtherSigners}} {
+			for _, s := range apk.signers {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", apk.location, s.Scheme, s.CertSHA256, s.Subject)
+			}
+		}
+		w.Flush()
+	}
+	return err
+}
+
+func runSealKey(ctx context.Context) error {
+	env, err := repack.SealPrivateKey(ctx, opts, kmsKeyID)
+	if err != nil {
+		return err
+	}
+	buf, _ := json.Marshal(env)
+	fmt.Println(string(buf))
+	return nil
+}
+
+func runSelfTest(ctx context.Context) error {
+	checks, err := repack.SelfTest(ctx, opts, probePrefix)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "check\tok\tms\terror")
+	for _, c := range checks {
+		fmt.Fprintf(w, "%s\t%v\t%d\t%s\n", c.Name, c.OK, c.DurationMS, c.Error)
+	}
+	w.Flush()
+	return err
+}
+
+func runClean(ctx context.Context) error {
+	uploads, err := repack.CleanUploads(ctx, opts, cleanPrefix, cleanOlderThan, cleanDryRun)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "key\tupload id\tinitiated")
+	for _, u := range uploads {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", u.Key, u.UploadID, u.Initiated.Format(time.RFC3339))
+	}
+	w.Flush()
+	if err != nil {
+		return err
+	}
+
+	objects, err := repack.CleanTempObjects(ctx, opts, cleanPrefix, cleanOlderThan, cleanDryRun)
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "key\tsize\tlast modified")
+	for _, o := range objects {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", o.Key, o.Size, o.LastModified.Format(time.RFC3339))
+	}
+	w.Flush()
+	if err != nil || !cleanExpired {
+		return err
+	}
+
+	expired, err := repack.CleanExpired(ctx, opts, cleanPrefix, cleanDryRun)
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "key\tsize\tdelete after")
+	for _, o := range expired {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", o.Key, o.Size, o.DeleteAfter.Format(time.RFC3339))
+	}
+	w.Flush()
+	return err
+}
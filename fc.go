@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// FC custom runtime headers
+const (
+	fcRequestID       = "x-fc-request-id"
+	fcAccessKeyID     = "x-fc-access-key-id"
+	fcAccessKeySecret = "x-fc-access-key-secret"
+	fcSecurityToken   = "x-fc-security-token"
+	fcFunctionTimeout = "x-fc-function-timeout"
+	traceparent       = "traceparent"
+)
+
+// fcResult is the response of an invocation
+type fcResult struct {
+	RequestID string `json:"request_id"`
+	repack.Result
+	Error     string `json:"error,omitempty"`
+	ErrorKind string `json:"error_kind,omitempty"`
+}
+
+// timeoutMargin is the time left to abort the upload before the function
+// times out
+const timeoutMargin = 5 * time.Second
+
+// serveFC runs as a Function Compute custom runtime, repacking an apk for
+// each event posted to /invoke, with the STS credentials of the function.
+// The invocations are canceled when ctx is done, as on SIGTERM.
+func serveFC(ctx context.Context) error {
+	port := os.Getenv("FC_SERVER_PORT")
+	if port == "" {
+		port = "9000"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/initialize", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/invoke", invoke)
+	slog.Info("fc runtime listening", "port", port)
+	return listenAndServe(ctx, &http.Server{
+		Addr:        ":" + port,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	})
+}
+
+func invoke(w http.ResponseWriter, r *http.Request) {
+	res := fcResult{RequestID: r.Header.Get(fcRequestID)}
+	status := http.StatusOK
+	if err := handleEvent(r, &res); err != nil {
+		slog.Error("request failed", append([]interface{}{"request-id", res.RequestID, "error", err}, repack.RequestAttrs(err)...)...)
+		res.Error, res.ErrorKind = err.Error(), repack.KindOf(err).String()
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func handleEvent(r *http.Request, res *fcResult) error {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	event, err := repack.ParseEvent(buf)
+	if err != nil {
+		return err
+	}
+	creds := repack.Credentials{
+		AccessKeyID:     r.Header.Get(fcAccessKeyID),
+		AccessKeySecret: r.Header.Get(fcAccessKeySecret),
+		SecurityToken:   r.Header.Get(fcSecurityToken),
+	}
+	logger := slog.Default().With("request-id", res.RequestID)
+	logger.Info("repack", "source", event.Source, "dest", event.Dest)
+	o := event.Options(opts, creds)
+	o.Logger = logger
+	o.JobID = res.RequestID
+	o.Caller = "fc"
+	ctx := traceContext(r)
+	if s, err := strconv.Atoi(r.Header.Get(fcFunctionTimeout)); err == nil {
+		if timeout := time.Duration(s)*time.Second - timeoutMargin; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+	res.Result, err = repack.Repack(ctx, o)
+	return err
+}
+
+// traceContext returns the context of r with the span of its traceparent
+// header, if any
+func traceContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if h := r.Header.Get(traceparent); h != "" {
+		if span, err := repack.ParseTraceparent(h); err == nil {
+			ctx = repack.ContextWithSpan(ctx, span)
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInvoke(t *testing.T) {
+	tests := []struct {
+		event string
+		error string
+	}{
+		{`{"source":"bucket/a.apk"}`, "source and dest are required"},
+		{`not json`, "invalid event"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/invoke", strings.NewReader(tt.event))
+		r.Header.Set(fcRequestID, "req-1")
+		w := httptest.NewRecorder()
+		invoke(w, r)
+
+		var res fcResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %v", tt.event, err)
+		}
+		if w.Code != http.StatusInternalServerError || res.RequestID != "req-1" || !strings.Contains(res.Error, tt.error) {
+			t.Errorf("%s: %d %+v", tt.event, w.Code, res)
+		}
+	}
+}
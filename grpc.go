@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+	"github.com/aliyun-fc/repack-apk/repack/repackpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcServer is the Repacker service of repack/repack.proto, which posts
+// the jobs of server like POST /repack
+type grpcServer struct {
+	repackpb.UnimplementedRepackerServer
+	s *server
+}
+
+// serveGRPC runs the Repacker service on lis until ctx is done, then waits
+// for the running calls
+func serveGRPC(ctx context.Context, s *server, lis net.Listener) error {
+	srv := grpc.NewServer()
+	repackpb.RegisterRepackerServer(srv, &grpcServer{s: s})
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	log.Printf("serving grpc on %s", lis.Addr())
+	return srv.Serve(lis)
+}
+
+// Repack authenticates the call and queues its job, then streams the phases
+// of the job and its result. The job keeps running if the call is canceled.
+func (g *grpcServer) Repack(req *repackpb.RepackRequest, stream repackpb.Repacker_RepackServer) error {
+	s := g.s
+	ctx := stream.Context()
+	r, err := grpcRequest(ctx, req)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	var caller string
+	if s.auth != nil {
+		if caller, err = s.auth.authenticate(r); err != nil {
+			return status.Error(codes.Unauthenticated, "unauthorized: "+err.Error())
+		}
+	}
+	event, err := eventOf(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	creds, err := credentialsOf(r)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if requireCredentials && creds.AccessKeyID == "" {
+		return status.Errorf(codes.Unauthenticated, "the OSS credentials of the job are required: set %s and %s", ossAccessKeyIDHeader, ossAccessKeySecretHeader)
+	}
+	s.mu.Lock()
+	scopes := s.scopes
+	s.mu.Unlock()
+	if err := scopes.check(caller, event, creds); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	j := &job{ID: newJobID(), State: jobQueued, Event: event, Created: time.Now(), Tenant: tenantOf(r, event), Caller: caller, feed: newProgressFeed()}
+	j.creds, j.OwnCredentials = creds, creds.AccessKeyID != ""
+	j.ctx = s.jobContext(traceContext(r))
+	if err := s.enqueue(j); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err := stream.Send(&repackpb.RepackProgress{Phase: jobQueued, JobId: j.ID}); err != nil {
+		return err
+	}
+
+	for {
+		phases, finished := j.feed.take()
+		for _, p := range phases {
+			if p.Phase == repack.PhaseDone {
+				// sent once with the result
+				continue
+			}
+			if err := stream.Send(&repackpb.RepackProgress{Phase: p.Phase, Dest: p.Dest, JobId: j.ID}); err != nil {
+				return err
+			}
+		}
+		if finished {
+			break
+		}
+		select {
+		case <-j.feed.notify:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.ctx.Done():
+			return status.Error(codes.Unavailable, "shutting down")
+		}
+	}
+
+	s.mu.Lock()
+	state, result, msg, kind := j.State, j.Result, j.Error, j.Kind
+	s.mu.Unlock()
+	if state != jobDone {
+		return status.Error(codeOf(kind), msg)
+	}
+	return stream.Send(&repackpb.RepackProgress{Phase: repack.PhaseDone, Dest: result.Dest, Result: resultOf(result), JobId: j.ID})
+}
+
+// grpcRequest returns the request of POST /repack matching the call, with the
+// metadata as headers and the deterministic encoding of req as signed body
+func grpcRequest(ctx context.Context, req *repackpb.RepackRequest) (*http.Request, error) {
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	method, _ := grpc.Method(ctx)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(key, v)
+		}
+	}
+	return r, nil
+}
+
+// eventOf returns the event of req, checked like the body of POST /repack
+func eventOf(req *repackpb.RepackRequest) (repack.Event, error) {
+	buf, err := json.Marshal(repack.Event{
+		Source:         req.GetSource(),
+		Dest:           req.GetDest(),
+		CPID:           req.GetCpid(),
+		Channel:        req.GetChannel(),
+		CertPEM:        req.GetCertPem(),
+		PrivateKeyPEM:  req.GetPrivPem(),
+		PrivateKeyBlob: req.GetPrivBlob(),
+		KeySecretName:  req.GetKeySecretName(),
+		CertSecretName: req.GetCertSecretName(),
+		Tags:           req.GetTags(),
+		DeleteAfter:    req.GetDeleteAfter(),
+		OSSEndpoint:    req.GetOssEndpoint(),
+		SourceEndpoint: req.GetSourceOssEndpoint(),
+		Force:          req.GetForce(),
+	})
+	if err != nil {
+		return repack.Event{}, fmt.Errorf("invalid event: %v", err)
+	}
+	return repack.ParseEvent(buf)
+}
+
+// resultOf returns the message of result
+func resultOf(result *repack.Result) *repackpb.RepackResult {
+	m := &repackpb.RepackResult{
+		Dest:      result.Dest,
+		Cpid:      result.CPID,
+		Skipped:   result.Skipped,
+		Appended:  result.Appended,
+		Etag:      result.ETag,
+		VersionId: result.VersionID,
+		Size:      result.Size,
+		Sha256:    result.SHA256,
+		Md5:       result.MD5,
+		Crc64:     result.CRC64,
+	}
+	if i := result.Info; i != nil {
+		m.Info = &repackpb.ApkInfo{
+			PackageName: i.PackageName,
+			VersionCode: i.VersionCode,
+			VersionName: i.VersionName,
+			MinSdk:      i.MinSdk,
+			TargetSdk:   i.TargetSdk,
+		}
+	}
+	if result.Next != nil {
+		m.Next = resultOf(result.Next)
+	}
+	return m
+}
+
+// codeOf returns the status code of a job failed with the error kind
+func codeOf(kind string) codes.Code {
+	switch kind {
+	case repack.KindConfig.String():
+		return codes.InvalidArgument
+	case repack.KindSource.String():
+		return codes.FailedPrecondition
+	case "locked":
+		return codes.Aborted
+	case repack.KindCanceled.String():
+		return codes.Canceled
+	case repack.KindThrottled.String():
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// progressFeed passes the phases of a job to the call that posted it, which
+// may lag behind the job
+type progressFeed struct {
+	mu       sync.Mutex
+	phases   []repack.Progress // not taken yet
+	finished bool
+	notify   chan struct{} // signaled on each change
+}
+
+func newProgressFeed() *progressFeed {
+	return &progressFeed{notify: make(chan struct{}, 1)}
+}
+
+// add appends the phase p
+func (f *progressFeed) add(p repack.Progress) {
+	f.mu.Lock()
+	f.phases = append(f.phases, p)
+	f.mu.Unlock()
+	f.signal()
+}
+
+// finish marks the job as finished, after its last phase
+func (f *progressFeed) finish() {
+	f.mu.Lock()
+	f.finished = true
+	f.mu.Unlock()
+	f.signal()
+}
+
+func (f *progressFeed) signal() {
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the phases added since the last take, and whether the job
+// is finished
+func (f *progressFeed) take() ([]repack.Progress, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	phases := f.phases
+	f.phases = nil
+	return phases, f.finished
+}
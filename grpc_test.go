@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+	"github.com/aliyun-fc/repack-apk/repack/repackpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// signedContext returns ctx with the metadata of req signed by caller with
+// secret, like a signed POST /repack
+func signedContext(ctx context.Context, caller, secret, nonce string, req *repackpb.RepackRequest) context.Context {
+	body, _ := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	r, _ := http.NewRequest(http.MethodPost, "/repack.Repacker/Repack", bytes.NewReader(body))
+	r.Header.Set(hmacTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set(hmacNonce, nonce)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign(r, body)))
+	return metadata.AppendToOutgoingContext(ctx,
+		hmacTimestamp, r.Header.Get(hmacTimestamp),
+		hmacNonce, nonce,
+		"authorization", hmacScheme+" "+caller+":"+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestGRPCRepack(t *testing.T) {
+	oss := httptest.NewServer(http.NotFoundHandler())
+	defer oss.Close()
+	defer func(o repack.Options) { opts = o }(opts)
+	// the endpoint of the flags, as the scopes only allow those of OSS in a request
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = oss.URL, "id", "secret"
+	// the cpid as the comment, with no keys to sign
+	opts.CPIDFile, opts.CPIDComment = false, true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newServer(ctx)
+	s.queue = newScheduler(10, 0, 0)
+	s.auth = &authenticator{hmacKeys: map[string][]byte{"games": []byte("secret")}}
+	s.scopes = bucketScopes{"hmac:games": {"bucket"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.work()
+	}()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- serveGRPC(ctx, s, lis) }()
+	defer func() {
+		cancel()
+		s.queue.close()
+		<-done
+		if err := <-served; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := repackpb.NewRepackerClient(conn)
+
+	// the job fails as the source is not found
+	failed := &repackpb.RepackRequest{Source: "bucket/a.apk", Dest: "bucket/b.apk", Cpid: "c1"}
+	tests := []struct {
+		name   string
+		req    *repackpb.RepackRequest
+		signed bool
+		md     []string // more metadata of the call
+		phases []string
+		code   codes.Code
+	}{
+		{"unsigned", failed, false, nil, nil, codes.Unauthenticated},
+		{"invalid event", &repackpb.RepackRequest{Source: "bucket/a.apk"}, true, nil, nil, codes.InvalidArgument},
+		{"out of scope", &repackpb.RepackRequest{Source: "music/a.apk", Dest: "bucket/b.apk", Cpid: "c1"}, true, nil, nil, codes.PermissionDenied},
+		{"partial credentials", failed, true, []string{ossAccessKeyIDHeader, "id"}, nil, codes.InvalidArgument},
+		{"failed job", failed, true, nil, []string{jobQueued, repack.PhaseOpen}, codes.FailedPrecondition},
+	}
+	for i, tt := range tests {
+		callCtx, callCancel := context.WithTimeout(ctx, 30*time.Second)
+		if tt.signed {
+			callCtx = signedContext(callCtx, "games", "secret", strconv.Itoa(i), tt.req)
+		}
+		callCtx = metadata.AppendToOutgoingContext(callCtx, tt.md...)
+		stream, err := client.Repack(callCtx, tt.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var phases []string
+		var id string
+		for {
+			p, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				if got := status.Code(err); got != tt.code {
+					t.Errorf("%s: code %v (%v), want %v", tt.name, got, err, tt.code)
+				}
+				break
+			}
+			phases, id = append(phases, p.GetPhase()), p.GetJobId()
+		}
+		callCancel()
+		if len(phases) != len(tt.phases) || (len(phases) > 0 && (phases[0] != tt.phases[0] || phases[1] != tt.phases[1])) {
+			t.Errorf("%s: phases %v, want %v", tt.name, phases, tt.phases)
+		}
+		if len(phases) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		j := s.jobs[id]
+		s.mu.Unlock()
+		if j == nil || j.Caller != "hmac:games" || j.State != jobFailed {
+			t.Errorf("%s: job %+v, want failed job of hmac:games", tt.name, j)
+		}
+	}
+}
+
+func TestGRPCRequest(t *testing.T) {
+	const h = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparent, h))
+	r, err := grpcRequest(ctx, &repackpb.RepackRequest{Source: "bucket/a.apk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	span, ok := repack.SpanFromContext(traceContext(r))
+	if !ok || span.Traceparent() != h {
+		t.Errorf("span %v %v, want %s", span, ok, h)
+	}
+}
+
+func TestCodeOf(t *testing.T) {
+	for kind, want := range map[string]codes.Code{
+		repack.KindConfig.String():    codes.InvalidArgument,
+		repack.KindSource.String():    codes.FailedPrecondition,
+		"locked":                      codes.Aborted,
+		repack.KindThrottled.String(): codes.Unavailable,
+		"":                            codes.Internal,
+	} {
+		if code := codeOf(kind); code != want {
+			t.Errorf("%q: %v, want %v", kind, code, want)
+		}
+	}
+}
+
+func TestResultOf(t *testing.T) {
+	info := &repack.ApkInfo{PackageName: "com.example.game", VersionCode: 42, MinSdk: 21, TargetSdk: 34}
+	buf, err := proto.Marshal(resultOf(&repack.Result{Dest: "bucket/b.apk", Info: info}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m repackpb.RepackResult
+	if err := proto.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	if i := m.GetInfo(); m.GetDest() != "bucket/b.apk" || i.GetMinSdk() != 21 || i.GetTargetSdk() != 34 {
+		t.Errorf("result %v", &m)
+	}
+	if f := m.ProtoReflect().Descriptor().Fields().ByName("info").Message().Fields().ByName("target_sdk"); f == nil || f.Number() != 5 {
+		t.Errorf("target_sdk %v", f)
+	}
+}
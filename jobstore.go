@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// jobStore persists the state of the jobs, to show their progress from any
+// instance and run the unfinished ones again after a restart
+type jobStore interface {
+	// save writes the state of j
+	save(j *job) error
+	// load returns the job of id, nil if not found
+	load(id string) (*job, error)
+	// pending returns the jobs queued or running
+	pending() ([]*job, error)
+}
+
+// newJobStore returns the store of location, oss://bucket/prefix/ or
+// redis://[:password@]host:port[/db][?prefix=repack:]
+func newJobStore(location string) (jobStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "oss":
+		prefix := strings.TrimPrefix(location, repack.OSSScheme)
+		if !strings.Contains(prefix, "/") {
+			prefix += "/"
+		}
+		return &ossJobStore{prefix: prefix}, nil
+	case "redis":
+		client, prefix, err := newRedisClient(u)
+		if err != nil {
+			return nil, err
+		}
+		return &redisJobStore{client: client, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("expect oss:// or redis://: %s", location)
+}
+
+// jobLease is how long an unfinished job is left to its owner after its
+// last save, which the owner repeats every jobLease/3
+const jobLease = time.Minute
+
+// instanceID is the owner of the jobs of this process
+var instanceID = hostname() + "-" + newJobID()
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "repack"
+	}
+	return name
+}
+
+// saveJob saves j owned by this instance, renewing its lease
+func saveJob(store jobStore, j *job) error {
+	j.Owner, j.Heartbeat = instanceID, time.Now()
+	return store.save(j)
+}
+
+// ownerGone reports whether the owner of j didn't save it within jobLease
+func (j *job) ownerGone() bool {
+	return time.Since(j.Heartbeat) > jobLease
+}
+
+// finished reports whether j is done or failed
+func (j *job) finished() bool {
+	return j.State == jobDone || j.State == jobFailed
+}
+
+// ossJobStore keeps each job as json in jobs/<id>.json under prefix, and the
+// unfinished ones in pending/<id>.json too, until a lifecycle rule deletes them
+type ossJobStore struct {
+	prefix string // bucket/prefix/
+}
+
+// serverOSSConfig returns the OSS config of the credentials of the flags
+func serverOSSConfig() repack.OSSConfig {
+	return repack.OSSConfig{
+		Endpoint:        opts.OSSEndpoint,
+		AccessKeyID:     opts.OSSAccessKeyID,
+		AccessKeySecret: opts.OSSAccessKeySecret,
+		SecurityToken:   opts.OSSSecurityToken,
+	}
+}
+
+func (s *ossJobStore) save(j *job) error {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := repack.WriteObject(serverOSSConfig(), s.prefix+"jobs/"+j.ID+".json", buf); err != nil {
+		return err
+	}
+	pending := s.prefix + "pending/" + j.ID + ".json"
+	if !j.finished() {
+		return repack.WriteObject(serverOSSConfig(), pending, buf)
+	}
+	r, err := repack.NewReader(serverOSSConfig(), pending)
+	if err != nil {
+		return err
+	}
+	return r.Client.DeleteObject(r.Object)
+}
+
+func (s *ossJobStore) load(id string) (*job, error) {
+	return s.read(s.prefix + "jobs/" + id + ".json")
+}
+
+// read returns the job of the object at location, nil if not found
+func (s *ossJobStore) read(location string) (*job, error) {
+	r, err := repack.NewReader(serverOSSConfig(), location)
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.Client.GetObject(r.Object)
+	if statusOf(err) == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return nil, fmt.Errorf("%s: %v", location, err)
+	}
+	return &j, nil
+}
+
+func (s *ossJobStore) pending() ([]*job, error) {
+	r, err := repack.NewReader(serverOSSConfig(), s.prefix+"pending/")
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*job
+	marker := ""
+	for {
+		list, err := r.Client.ListObjects(oss.Prefix(r.Object), oss.Marker(marker))
+		if err != nil {
+			return jobs, err
+		}
+		for _, o := range list.Objects {
+			j, err := s.read(r.Bucket + "/" + o.Key)
+			if err != nil {
+				return jobs, err
+			}
+			if j != nil && path.Ext(o.Key) == ".json" {
+				jobs = append(jobs, j)
+			}
+		}
+		if !list.IsTruncated {
+			return jobs, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// redisJobStore keeps each job as json at <prefix>job:<id>, expiring jobTTL
+// after it finished, and the ids of the unfinished ones in <prefix>pending
+type redisJobStore struct {
+	client *redisClient
+	prefix string
+}
+
+func (s *redisJobStore) save(j *job) error {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	key := s.prefix + "job:" + j.ID
+	if !j.finished() {
+		if _, err := s.client.do("SET", key, string(buf)); err != nil {
+			return err
+		}
+		_, err = s.client.do("SADD", s.prefix+"pending", j.ID)
+		return err
+	}
+	if _, err := s.client.do("SET", key, string(buf), "EX", strconv.Itoa(int(jobTTL.Seconds()))); err != nil {
+		return err
+	}
+	_, err = s.client.do("SREM", s.prefix+"pending", j.ID)
+	return err
+}
+
+func (s *redisJobStore) load(id string) (*job, error) {
+	reply, err := s.client.do("GET", s.prefix+"job:"+id)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal([]byte(reply.(string)), &j); err != nil {
+		return nil, fmt.Errorf("job %s: %v", id, err)
+	}
+	return &j, nil
+}
+
+func (s *redisJobStore) pending() ([]*job, error) {
+	reply, err := s.client.do("SMEMBERS", s.prefix+"pending")
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*job
+	for _, id := range reply.([]interface{}) {
+		j, err := s.load(id.(string))
+		if err != nil {
+			return jobs, err
+		}
+		if j != nil {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
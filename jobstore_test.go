@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// memStore is a jobStore in memory
+type memStore struct {
+	mu   sync.Mutex
+	jobs map[string]job
+}
+
+func (s *memStore) save(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = *j
+	return nil
+}
+
+func (s *memStore) load(id string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		return &j, nil
+	}
+	return nil, nil
+}
+
+func (s *memStore) pending() ([]*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*job
+	for _, j := range s.jobs {
+		if !j.finished() {
+			j := j
+			jobs = append(jobs, &j)
+		}
+	}
+	return jobs, nil
+}
+
+func TestResume(t *testing.T) {
+	event := repack.Event{Source: "bucket/a.apk", Dest: "bucket/b.apk"}
+	store := &memStore{jobs: map[string]job{
+		"live": {ID: "live", State: jobRunning, Event: event, Owner: "other", Heartbeat: time.Now()},
+		"gone": {ID: "gone", State: jobRunning, Event: event, Owner: "other", Heartbeat: time.Now().Add(-2 * jobLease)},
+		"done": {ID: "done", State: jobDone, Event: event, Owner: "other", Heartbeat: time.Now().Add(-2 * jobLease)},
+		"own":  {ID: "own", State: jobQueued, Event: event, Owner: "other", Heartbeat: time.Now().Add(-2 * jobLease), OwnCredentials: true},
+	}}
+	s := newServer(context.Background())
+	s.store, s.queue = store, newScheduler(3, 0, 0)
+	s.resume()
+	if len(s.queue.queue) != 1 {
+		t.Fatalf("%d jobs queued", len(s.queue.queue))
+	}
+	if j := s.queue.next(); j.ID != "gone" || j.State != jobQueued {
+		t.Errorf("resumed %s %s", j.ID, j.State)
+	}
+	if j, _ := store.load("gone"); j.Owner != instanceID || j.ownerGone() {
+		t.Errorf("resumed job owned by %s at %v", j.Owner, j.Heartbeat)
+	}
+	if j, _ := store.load("live"); j.Owner != "other" {
+		t.Errorf("live job owned by %s", j.Owner)
+	}
+	// never run with the credentials of the server
+	if j, _ := store.load("own"); j.State != jobFailed {
+		t.Errorf("job of lost credentials %s", j.State)
+	}
+}
+
+// redisServer is a fake Redis of the commands of redisJobStore and
+// redisLocker, replying to GET bad with an array holding an error
+type redisServer struct {
+	net.Listener
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	sets    map[string]map[string]bool
+	conns   int
+}
+
+func newRedisServer(t *testing.T) *redisServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &redisServer{Listener: l, values: map[string]string{}, expires: map[string]time.Time{}, sets: map[string]map[string]bool{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ := r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			io.ReadFull(r, buf)
+			args[i] = string(buf[:size])
+		}
+		io.WriteString(conn, s.reply(args))
+	}
+}
+
+// get returns the value of key, if not expired
+func (s *redisServer) get(key string) (string, bool) {
+	if exp, ok := s.expires[key]; ok && time.Now().After(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	v, ok := s.values[key]
+	return v, ok
+}
+
+func (s *redisServer) reply(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch args[0] {
+	case "SET":
+		if len(args) == 6 && args[3] == "NX" {
+			if _, ok := s.get(args[1]); ok {
+				return "$-1\r\n"
+			}
+			ms, _ := strconv.Atoi(args[5])
+			s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		if args[1] == "bad" {
+			return "*2\r\n-ERR item\r\n$1\r\nx\r\n"
+		}
+		v, ok := s.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SADD", "SREM":
+		if s.sets[args[1]] == nil {
+			s.sets[args[1]] = map[string]bool{}
+		}
+		s.sets[args[1]][args[2]] = args[0] == "SADD"
+		return ":1\r\n"
+	case "SMEMBERS":
+		var members []string
+		for m, ok := range s.sets[args[1]] {
+			if ok {
+				members = append(members, fmt.Sprintf("$%d\r\n%s\r\n", len(m), m))
+			}
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(members), strings.Join(members, ""))
+	case "EVAL":
+		if v, ok := s.get(args[3]); !ok || v != args[4] {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case refreshScript:
+			ms, _ := strconv.Atoi(args[5])
+			s.expires[args[3]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		case releaseScript:
+			delete(s.values, args[3])
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisJobStore(t *testing.T) {
+	server := newRedisServer(t)
+	store, err := newJobStore("redis://" + server.Addr().String() + "?prefix=test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := repack.Event{Source: "bucket/a.apk", Dest: "bucket/b.apk"}
+	for _, j := range []*job{{ID: "j1", State: jobRunning, Event: event}, {ID: "j2", State: jobDone, Event: event}} {
+		if err := saveJob(store, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending, err := store.pending()
+	if err != nil || len(pending) != 1 || pending[0].ID != "j1" || pending[0].Owner != instanceID {
+		t.Errorf("pending %v: %v", pending, err)
+	}
+	if j, err := store.load("j2"); err != nil || j == nil || j.State != jobDone || j.Event.Dest != "bucket/b.apk" {
+		t.Errorf("job %+v: %v", j, err)
+	}
+	if j, err := store.load("unknown"); err != nil || j != nil {
+		t.Errorf("unknown job %+v: %v", j, err)
+	}
+
+	// an error reply keeps the connection, an error in an array doesn't
+	client := store.(*redisJobStore).client
+	if _, err := client.do("PING"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("error reply: %v", err)
+	}
+	if _, err := client.do("GET", "bad"); err == nil || client.conn != nil {
+		t.Errorf("error in an array: %v, connection kept", err)
+	}
+	if _, err := client.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.conns != 2 {
+		t.Errorf("%d connections, want 2", server.conns)
+	}
+}
+
+func TestNewJobStore(t *testing.T) {
+	for location, ok := range map[string]bool{
+		"oss://bucket/jobs/":       true,
+		"redis://:pw@host:6379/2":  true,
+		"redis://host:6379/db":     false,
+		"tablestore://instance/t1": false,
+	} {
+		if _, err := newJobStore(location); (err == nil) != ok {
+			t.Errorf("%s: %v, want ok %v", location, err, ok)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// lockTTL is how long a lock outlives its holder, if it crashed. The lock
+// is refreshed every third of it while held.
+var lockTTL = time.Minute
+
+// errLocked is returned by lock if another job holds the lock of the dest
+var errLocked = errors.New("dest locked by another job")
+
+// errLockLost is returned by refresh if the lock is no longer held, and is
+// the cause of the cancel of a job that lost the lock of its dest
+var errLockLost = errors.New("lock of the dest lost")
+
+// destLocker locks the dests, so two instances receiving the same event
+// don't repack it at the same time and interleave their uploads
+type destLocker interface {
+	// acquire takes the lock of key for holder, errLocked if held
+	acquire(key, holder string) error
+	// refresh extends the lock of key held by holder by lockTTL,
+	// errLockLost if no longer held
+	refresh(key, holder string) error
+	// release drops the lock of key if still held by holder
+	release(key, holder string) error
+}
+
+// newDestLocker returns the locker of location, oss://bucket/prefix/ or
+// redis://[:password@]host:port[/db][?prefix=repack:]
+func newDestLocker(location string) (destLocker, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "oss":
+		prefix := strings.TrimPrefix(location, repack.OSSScheme)
+		if !strings.Contains(prefix, "/") {
+			prefix += "/"
+		}
+		return &ossLocker{prefix: prefix, config: serverOSSConfig}, nil
+	case "redis":
+		client, prefix, err := newRedisClient(u)
+		if err != nil {
+			return nil, err
+		}
+		return &redisLocker{client: client, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("expect oss:// or redis://: %s", location)
+}
+
+// destLock returns the LockDest of a job, which calls cancel with
+// errLockLost if a lock of its dests is lost
+func destLock(ctx context.Context, locker destLocker, logger *slog.Logger, cancel context.CancelCauseFunc) func(dest string) (func(), error) {
+	return func(dest string) (func(), error) {
+		return lockDest(ctx, locker, dest, logger, func() { cancel(errLockLost) })
+	}
+}
+
+// lockDest takes the lock of dest, errLocked if held, and refreshes it until
+// unlock, calling lost if taken by another job or not refreshed for lockTTL
+func lockDest(ctx context.Context, locker destLocker, dest string, logger *slog.Logger, lost func()) (unlock func(), err error) {
+	sum := sha1.Sum([]byte(dest))
+	key := hex.EncodeToString(sum[:])
+	holder := newHolderID()
+	if err := locker.acquire(key, holder); err != nil {
+		return nil, err
+	}
+	logger.Debug("locked dest", "dest", dest, "lock", key)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockTTL / 3)
+		defer ticker.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := locker.refresh(key, holder)
+				if err == nil {
+					refreshed = time.Now()
+					continue
+				}
+				if errors.Is(err, errLockLost) || time.Since(refreshed) >= lockTTL {
+					logger.Error("lock lost, stop the job", "dest", dest, "lock", key, "error", err)
+					lost()
+					return
+				}
+				logger.Warn("refresh lock", "dest", dest, "lock", key, "error", err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if err := locker.release(key, holder); err != nil {
+			logger.Warn("release lock", "dest", dest, "lock", key, "error", err)
+		}
+	}, nil
+}
+
+// newHolderID returns the id of a lock holder, the host and pid with a
+// random suffix
+func newHolderID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(b)
+}
+
+// forbidOverwriteHeader makes a PutObject fail with 409 if the object
+// exists. OSS ignores If-None-Match on PutObject.
+const forbidOverwriteHeader = "x-oss-forbid-overwrite"
+
+// ossLocker keeps each lock as the object locks/<key>.json under prefix, an
+// expired one replaced with If-Match of its ETag so only one job takes it
+type ossLocker struct {
+	prefix string                  // bucket/prefix/
+	config func() repack.OSSConfig // of the server, read again on reload
+}
+
+// ossLock is the content of a lock object
+type ossLock struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// bucket returns the bucket and object of the lock of key
+func (l *ossLocker) bucket(key string) (*oss.Bucket, string, error) {
+	config := l.config()
+	client, err := oss.New(config.Endpoint, config.AccessKeyID, config.AccessKeySecret, oss.SecurityToken(config.SecurityToken))
+	if err != nil {
+		return nil, "", err
+	}
+	location := strings.SplitN(l.prefix+"locks/"+key+".json", "/", 2)
+	b, err := client.Bucket(location[0])
+	return b, location[1], err
+}
+
+// do sends a request of the lock object, as the SDK has no option of
+// x-oss-forbid-overwrite, and returns its status code, 0 if none
+func (l *ossLocker) do(b *oss.Bucket, method, object string, headers map[string]string, body []byte) (int, error) {
+	resp, err := b.Client.Conn.Do(method, b.BucketName, object, "", "", headers, bytes.NewReader(body), 0, nil)
+	if resp == nil {
+		return statusOf(err), err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, err
+}
+
+// put writes the lock of holder: only if there is none if etag is empty,
+// else only if it is still the lock of etag. It returns errLocked if not.
+func (l *ossLocker) put(b *oss.Bucket, object, holder, etag string) error {
+	buf, _ := json.Marshal(ossLock{Holder: holder, Expires: time.Now().Add(lockTTL)})
+	headers := map[string]string{oss.HTTPHeaderContentType: "application/json"}
+	if etag == "" {
+		headers[forbidOverwriteHeader] = "true"
+	} else {
+		headers[oss.HTTPHeaderIfMatch] = etag
+	}
+	status, err := l.do(b, "PUT", object, headers, buf)
+	if status == 409 || status == 412 {
+		return errLocked
+	}
+	return err
+}
+
+// get returns the lock and its ETag, nil if none
+func (l *ossLocker) get(b *oss.Bucket, object string) (*ossLock, string, error) {
+	result, err := b.DoGetObject(&oss.GetObjectRequest{ObjectKey: object}, nil)
+	if statusOf(err) == 404 {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer result.Response.Body.Close()
+	buf, err := ioutil.ReadAll(result.Response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	var lock ossLock
+	if err := json.Unmarshal(buf, &lock); err != nil {
+		return nil, "", fmt.Errorf("%s/%s: %v", b.BucketName, object, err)
+	}
+	return &lock, result.Response.Headers.Get(oss.HTTPHeaderEtag), nil
+}
+
+func (l *ossLocker) acquire(key, holder string) error {
+	b, object, err := l.bucket(key)
+	if err != nil {
+		return err
+	}
+	if err := l.put(b, object, holder, ""); err != errLocked {
+		return err
+	}
+	lock, etag, err := l.get(b, object)
+	if err != nil {
+		return err
+	}
+	if lock != nil && time.Now().Before(lock.Expires) {
+		return errLocked
+	}
+	// released in between, or expired: replaced only if no other job did
+	// since it was read
+	return l.put(b, object, holder, etag)
+}
+
+func (l *ossLocker) refresh(key, holder string) error {
+	b, object, err := l.bucket(key)
+	if err != nil {
+		return err
+	}
+	lock, etag, err := l.get(b, object)
+	if err != nil {
+		return err
+	}
+	if lock == nil || lock.Holder != holder {
+		return errLockLost
+	}
+	if err := l.put(b, object, holder, etag); err != errLocked {
+		return err
+	}
+	return errLockLost
+}
+
+func (l *ossLocker) release(key, holder string) error {
+	b, object, err := l.bucket(key)
+	if err != nil {
+		return err
+	}
+	lock, etag, err := l.get(b, object)
+	if err != nil || lock == nil || lock.Holder != holder {
+		return err
+	}
+	status, err := l.do(b, "DELETE", object, map[string]string{oss.HTTPHeaderIfMatch: etag}, nil)
+	if status == 404 || status == 412 {
+		// taken by another job in between
+		return nil
+	}
+	return err
+}
+
+// statusOf returns the status code of an OSS error, 0 if none
+func statusOf(err error) int {
+	var se oss.ServiceError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return 0
+}
+
+// the scripts of the redis locks, comparing the holder and changing the
+// lock at once
+const (
+	// refreshScript extends the lock KEYS[1] by ARGV[2] ms if held by
+	// ARGV[1], and returns 1, else 0
+	refreshScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	// releaseScript deletes the lock KEYS[1] if held by ARGV[1], and
+	// returns 1, else 0
+	releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+// redisLocker keeps each lock as <prefix>lock:<key>, set with NX and PX
+// lockTTL, refreshed and released by scripts checking the holder
+type redisLocker struct {
+	client *redisClient
+	prefix string
+}
+
+func (l *redisLocker) ttl() string {
+	return strconv.FormatInt(lockTTL.Milliseconds(), 10)
+}
+
+func (l *redisLocker) acquire(key, holder string) error {
+	reply, err := l.client.do("SET", l.prefix+"lock:"+key, holder, "NX", "PX", l.ttl())
+	if err == nil && reply == nil {
+		return errLocked
+	}
+	return err
+}
+
+func (l *redisLocker) refresh(key, holder string) error {
+	reply, err := l.client.do("EVAL", refreshScript, "1", l.prefix+"lock:"+key, holder, l.ttl())
+	if err == nil && reply != int64(1) {
+		return errLockLost
+	}
+	return err
+}
+
+func (l *redisLocker) release(key, holder string) error {
+	_, err := l.client.do("EVAL", releaseScript, "1", l.prefix+"lock:"+key, holder)
+	return err
+}
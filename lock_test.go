@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// fakeOSS keeps objects in memory, with the conditions of PutObject and
+// DeleteObject the lock relies on
+type fakeOSS struct {
+	mu      sync.Mutex
+	objects map[string][]byte // by path
+}
+
+func newFakeOSS() *fakeOSS {
+	return &fakeOSS{objects: make(map[string][]byte)}
+}
+
+func etagOf(buf []byte) string {
+	return fmt.Sprintf(`"%X"`, md5.Sum(buf))
+}
+
+func ossError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	buf, ok := f.objects[r.URL.Path]
+	if match := r.Header.Get("If-Match"); match != "" && (!ok || match != etagOf(buf)) && r.Method != http.MethodGet {
+		ossError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if ok && r.Header.Get(forbidOverwriteHeader) == "true" {
+			ossError(w, http.StatusConflict, "FileAlreadyExists")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", etagOf(body))
+	case http.MethodGet:
+		if !ok {
+			ossError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etagOf(buf))
+		w.Write(buf)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newTestOSSLocker(t *testing.T) (*ossLocker, *fakeOSS) {
+	fake := newFakeOSS()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	config := repack.OSSConfig{Endpoint: srv.URL, AccessKeyID: "id", AccessKeySecret: "secret"}
+	return &ossLocker{prefix: "bucket/jobs/", config: func() repack.OSSConfig { return config }}, fake
+}
+
+func TestDestLockers(t *testing.T) {
+	oss, _ := newTestOSSLocker(t)
+	lockers := map[string]destLocker{
+		"oss":   oss,
+		"redis": &redisLocker{client: &redisClient{Addr: newRedisServer(t).Addr().String()}, prefix: "repack:"},
+	}
+	for name, l := range lockers {
+		steps := []struct {
+			op     string
+			holder string
+			want   error
+		}{
+			{"acquire", "a", nil},
+			{"acquire", "b", errLocked},
+			{"refresh", "a", nil},
+			{"refresh", "b", errLockLost},
+			{"release", "b", nil},
+			{"acquire", "b", errLocked},
+			{"release", "a", nil},
+			{"refresh", "a", errLockLost},
+			{"acquire", "b", nil},
+			{"acquire", "a", errLocked},
+		}
+		for i, step := range steps {
+			var err error
+			switch step.op {
+			case "acquire":
+				err = l.acquire("key", step.holder)
+			case "refresh":
+				err = l.refresh("key", step.holder)
+			case "release":
+				err = l.release("key", step.holder)
+			}
+			if err != step.want {
+				t.Errorf("%s: step %d: %s by %s = %v, want %v", name, i, step.op, step.holder, err, step.want)
+			}
+		}
+	}
+}
+
+func TestOSSLockerExpired(t *testing.T) {
+	l, fake := newTestOSSLocker(t)
+	fake.objects["/bucket/jobs/locks/key.json"] = []byte(`{"holder":"crashed","expires":"2000-01-01T00:00:00Z"}`)
+
+	// of the jobs seeing the lock expired, only one takes it
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = l.acquire("key", fmt.Sprintf("holder-%d", i))
+		}(i)
+	}
+	wg.Wait()
+	held := 0
+	for i, err := range errs {
+		switch err {
+		case nil:
+			held++
+		case errLocked:
+		default:
+			t.Errorf("holder-%d: %v", i, err)
+		}
+	}
+	if held != 1 {
+		t.Errorf("%d holders took the expired lock, want 1", held)
+	}
+	if err := l.refresh("key", "crashed"); err != errLockLost {
+		t.Errorf("refresh by the crashed holder = %v, want errLockLost", err)
+	}
+}
+
+func TestLockDestLost(t *testing.T) {
+	defer func(ttl time.Duration) { lockTTL = ttl }(lockTTL)
+	lockTTL = 30 * time.Millisecond
+	l, fake := newTestOSSLocker(t)
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	lock := destLock(ctx, l, logger, cancel)
+	unlock, err := lock("bucket/dest.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, err := lock("bucket/dest.apk"); err != errLocked {
+		t.Errorf("lock again = %v, want errLocked", err)
+	}
+
+	// taken by another job, as if it had expired
+	fake.mu.Lock()
+	for path := range fake.objects {
+		fake.objects[path] = []byte(`{"holder":"other","expires":"2100-01-01T00:00:00Z"}`)
+	}
+	fake.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), errLockLost) {
+			t.Errorf("cause %v, want errLockLost", context.Cause(ctx))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job not canceled once the lock was lost")
+	}
+}
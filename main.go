@@ -1,110 +1,453 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/rsc/zipmerge/zip"
+	"github.com/aliyun-fc/repack-apk/repack"
 )
 
-// Config ...
-type Config struct {
-	SigFileName        string // auto detect from *.SF
-	PrivateKeyPEM      string // /path/to/private_key.pem
-	CertPEM            string // /path/to/cert.pem
-	SourceAPK          string // my-bucket/origin.apk
-	DestAPK            string // my-bucket/dest.apk
-	CPIDContent        string // cpid content
-	OSSEndpoint        string
-	OSSAccessKeyID     string
-	OSSAccessKeySecret string
-	OSSSecurityToken   string
-	WorkDir            string // working dir to save temp files
-}
-
-func (c Config) String() string {
-	buf, _ := json.MarshalIndent(c, "", "  ")
-	return string(buf)
-}
-
-var g Config
-
-func init() {
-	flag.StringVar(&g.CertPEM, "cert-pem", "", "cert pem")
-	flag.StringVar(&g.PrivateKeyPEM, "priv-pem", "", "private key pem")
-	flag.StringVar(&g.SourceAPK, "source", "", "source apk")
-	flag.StringVar(&g.DestAPK, "dest", "", "dest apk")
-	flag.StringVar(&g.CPIDContent, "cpid", "", "cpid content")
-	flag.StringVar(&g.OSSEndpoint, "oss-ep", "", "oss endpoint")
-	flag.StringVar(&g.OSSAccessKeyID, "oss-id", "", "oss access key id")
-	flag.StringVar(&g.OSSAccessKeySecret, "oss-key", "", "oss access key secret")
-	flag.StringVar(&g.OSSSecurityToken, "oss-token", "", "oss security token")
-	flag.StringVar(&g.WorkDir, "work-dir", "", "working dir")
+// replaceFiles implements flag.Value for repeatable -replace flags
+type replaceFiles struct {
+	*repack.ExtraFiles
 }
 
-// print error and exit
-func perror(msg string, args ...interface{}) {
-	log.Printf(msg, args...)
-	os.Exit(1)
+// Set parses path=source
+func (f replaceFiles) Set(value string) error {
+	return f.Add(value, true)
 }
 
-func main() {
-	flag.Parse()
-	log.Printf("using config: %s", g.String())
-
-	ossReader, err := NewReader(
-		OSSConfig{
-			Endpoint:        g.OSSEndpoint,
-			AccessKeyID:     g.OSSAccessKeyID,
-			AccessKeySecret: g.OSSAccessKeySecret,
-			SecurityToken:   g.OSSSecurityToken,
-		}, g.SourceAPK)
-	if err != nil {
-		perror("oss reader: %v", err)
-	}
-	objectSize, err := ossReader.Size()
-	if err != nil {
-		perror("object size: %v", err)
+var opts = repack.DefaultOptions()
+
+// logFormat is text or json
+var logFormat string
+
+// trace logs the spans of the jobs
+var trace bool
+
+// retryPolicy is the backoff of the OSS requests, with ossAttempts tries
+// of each
+var retryPolicy = repack.DefaultRetryPolicy
+var ossAttempts = repack.DefaultRetryPolicy.Retries + 1
+
+// resultPath is where to write the json result, - for stdout
+var resultPath string
+
+// flags of serve
+var (
+	serveListen  string
+	grpcListen   string
+	serveWorkers int
+	serveQueue   int
+
+	tenantHeader  string
+	tenantWorkers int
+	tenantJobs    int
+	ossQPS        float64
+	tenantOSSQPS  float64
+
+	hmacKeysPath string
+	oidcIssuer   string
+	oidcAudience string
+
+	requireCredentials bool
+	bucketScopesPath   string
+	watchInterval      time.Duration
+)
+
+// flags of worker
+var (
+	mnsEndpoint  string
+	mnsQueueName string
+	mnsDeadQueue string
+)
+
+// jobStoreURL is where serve and worker persist the state of the jobs
+var jobStoreURL string
+
+// lockURL is where serve and worker lock the dests of the jobs
+var lockURL string
+
+// where to write the audit records of the dests
+var (
+	auditLogPath string
+	auditOSS     string
+)
+
+// kmsKeyID is the KMS key of seal-key
+var kmsKeyID string
+
+// probePrefix is the bucket/prefix listed by /readyz and self-test
+var probePrefix string
+
+// verifyFull makes verify-remote read all of the apk, like verify
+var verifyFull bool
+
+// otherAPK is the apk compare-signers compares the source with
+var otherAPK string
+
+// flags of clean
+var (
+	cleanPrefix    string
+	cleanOlderThan time.Duration
+	cleanDryRun    bool
+	cleanExpired   bool
+)
+
+// flag groups of the commands, each registers its flags to fs
+
+// commonFlags are the OSS and log flags of all commands
+func commonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.OSSEndpoint, "oss-ep", "", "oss endpoint")
+	fs.StringVar(&opts.OSSAccessKeyID, "oss-id", "", "oss access key id")
+	fs.StringVar(&opts.OSSAccessKeySecret, "oss-key", "", "oss access key secret")
+	fs.StringVar(&opts.OSSSecurityToken, "oss-token", "", "oss security token")
+	fs.StringVar(&logFormat, "log-format", "text", "text, or json for structured logs")
+	fs.BoolVar(&trace, "trace", false, "log the spans of the phases, OSS requests and signing, with W3C trace ids")
+	fs.DurationVar(&retryPolicy.Delay, "oss-retry-delay", retryPolicy.Delay, "delay before the first retry of a throttled OSS request or failed part")
+	fs.Float64Var(&retryPolicy.Multiplier, "oss-retry-multiplier", retryPolicy.Multiplier, "multiplier of the delay for each next retry")
+	fs.IntVar(&ossAttempts, "oss-attempts", ossAttempts, "max attempts of an OSS request or part, 1 for no retry")
+	fs.DurationVar(&retryPolicy.MaxElapsed, "oss-retry-max-elapsed", 0, "no retry that would end later than this after the first attempt, 0 for no limit")
+}
+
+func keyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.CertPEM, "cert-pem", "", "cert pem, a local file or oss://bucket/object")
+	fs.StringVar(&opts.PrivateKeyPEM, "priv-pem", "", "private key pem, a local file or oss://bucket/object")
+	fs.StringVar(&opts.PrivateKeyBlob, "priv-blob", "", "private key encrypted by KMS, inline in place of -priv-pem, see seal-key")
+	fs.StringVar(&opts.KeySecretName, "key-secret-name", "", "secret of Secrets Manager holding the private key pem, in place of -priv-pem")
+	fs.StringVar(&opts.CertSecretName, "cert-secret-name", "", "secret of Secrets Manager holding the cert pem, in place of -cert-pem")
+	fs.StringVar(&opts.KeyMap, "key-map", "", "json rules choosing the key and cert by package name and channel, a local file or oss://bucket/object")
+	fs.StringVar(&opts.NextCertPEM, "next-cert-pem", "", "cert pem of the next key of a rotation, each dest apk is signed with it again to a dest with -next-suffix")
+	fs.StringVar(&opts.NextPrivateKeyPEM, "next-priv-pem", "", "private key pem of the next key of a rotation, a local file or oss://bucket/object")
+	fs.StringVar(&opts.NextSuffix, "next-suffix", opts.NextSuffix, "suffix of the dest apks signed with the next key, before the extension")
+	fs.StringVar(&opts.KMSEndpoint, "kms-ep", "", "kms endpoint to decrypt -priv-pem or -priv-blob with if not a pem, and to read the secrets from")
+	fs.StringVar(&auditLogPath, "audit-log", "", "append a json line of each dest written, with the caller, digests and cert, to this file")
+	fs.StringVar(&auditOSS, "audit-oss", "", "write the audit record of each dest written to an object under oss://bucket/prefix/ too")
+}
+
+// sealKeyFlags are the flags of encrypting a private key with KMS
+func sealKeyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.PrivateKeyPEM, "priv-pem", "", "private key pem to encrypt, a local file or oss://bucket/object")
+	fs.StringVar(&opts.KMSEndpoint, "kms-ep", "", "kms endpoint, e.g. kms.cn-hangzhou.aliyuncs.com")
+	fs.StringVar(&kmsKeyID, "kms-key-id", "", "id or alias of the KMS key to generate the data key with")
+}
+
+// apkFlags are the flags of building and uploading a dest apk
+func apkFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "source apk")
+	fs.StringVar(&opts.DestAPK, "dest", "", "dest apk, a template like -cpid")
+	fs.StringVar(&opts.SourceEndpoint, "source-oss-ep", "", "oss endpoint of the source bucket if in another region than the dest, -oss-ep by default")
+	fs.BoolVar(&opts.SourceAccelerate, "source-accelerate", false, "read the source through -accelerate-ep, e.g. for a bucket far from this process")
+	fs.BoolVar(&opts.DestAccelerate, "dest-accelerate", false, "write the dest apks through -accelerate-ep, e.g. for a bucket far from this process")
+	fs.StringVar(&opts.AccelerateEndpoint, "accelerate-ep", repack.DefaultAccelerateEndpoint, "transfer acceleration endpoint of -source-accelerate and -dest-accelerate, e.g. oss-accelerate-overseas.aliyuncs.com")
+	fs.StringVar(&opts.WorkDir, "work-dir", "", "dir to create the temp dirs of the jobs in, the system temp dir by default")
+	fs.BoolVar(&opts.InMemory, "in-memory", false, "keep the signature files in memory, without a work dir, e.g. on a read-only file system")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+	fs.BoolVar(&opts.DownloadSource, "download-source", false, "download the source to the work dir once and read it from there, e.g. for many -channels on a machine with disk")
+	fs.Int64Var(&opts.MaxMemory, "max-memory", 0, "MB of memory a job may hold, the dest apk is then written to the work dir, or the job fails with -in-memory, 0 for no limit")
+	fs.BoolVar(&opts.DropStale, "drop-stale", false, "drop the data of superseded META-INF and cpid entries")
+	fs.BoolVar(&opts.MinimalManifest, "minimal-manifest", false, "in the sections of MANIFEST.MF changed, only write again the lines of the digests changed, keeping the wrapping, order and line endings of the others")
+	fs.BoolVar(&opts.StrictManifest, "strict", false, "reject a MANIFEST.MF of the source the JAR File Specification doesn't allow, e.g. with lines over 72 bytes or an entry twice")
+	fs.BoolVar(&opts.LenientManifest, "lenient", false, "drop the lines and sections of a malformed MANIFEST.MF of the source with a warning, rather than fail")
+	fs.Var(&opts.ManifestAttrs, "manifest-attr", "add or override a main attribute of MANIFEST.MF as name=value, e.g. Built-By=ci, repeatable")
+	fs.Var(&opts.EntryRules, "entry-rule", "remove or keep the entries of the source matching a glob, or a regexp after re:, like \"remove META-INF/*.kotlin_module\" or \"keep assets/**\", repeatable, the last rule matching an entry decides")
+	fs.StringVar(&opts.Schemes, "schemes", repack.SchemesAuto, "comma separated signature schemes of the dest apks signed again, v1, v2 and v3, or auto to choose them from the minSdkVersion and targetSdkVersion of the apk like apksigner")
+	fs.StringVar(&opts.SignatureArtifacts, "signature-artifacts", repack.ArtifactsWarn, "what to do with the signature files of other signers and the source stamp of the source apk, which the new signature invalidates: warn, keep, drop or fail")
+	fs.Int64Var(&opts.PageAlign, "page-align", 0, "align stored entries to this power of two boundary, up to 32768, e.g. 16384")
+	fs.StringVar(&opts.StoreEntries, "store", "", "comma separated entries to store uncompressed, e.g. cpid")
+	fs.IntVar(&opts.CompressionLevel, "level", opts.CompressionLevel, "compression level of deflated entries, 1-9")
+	fs.Var(&opts.ExtraFiles, "add", "add file to apk as path=source, source is a local file or oss://bucket/object, repeatable")
+	fs.Var(replaceFiles{&opts.ExtraFiles}, "replace", "replace existing entry of apk as path=source, repeatable")
+	fs.BoolVar(&opts.Deterministic, "deterministic", false, "stamp entries with SOURCE_DATE_EPOCH or 2008-01-01 for reproducible output")
+	fs.BoolVar(&opts.Validate, "validate", opts.Validate, "re-open the dest apk after upload and check its entries")
+	fs.BoolVar(&opts.VerifySignature, "verify-signature", opts.VerifySignature, "with -validate, check the v1 and v2 signatures of the dest apk like Android does, reading all of it")
+	fs.IntVar(&opts.DigestJobs, "digest-jobs", repack.DefaultDigestJobs, "number of ranges read at the same time to compute the digests of entries, for unsigned apks and -verify-signature")
+	fs.BoolVar(&opts.Atomic, "atomic", false, "upload to a temp object next to the dest apk and copy it to the dest once validated")
+	fs.BoolVar(&opts.Resume, "resume", false, "with -atomic and -job-id, continue the upload of each dest apk left by a failed attempt of the same job, skipping the parts already copied")
+	fs.StringVar(&opts.CopyStrategy, "copy-strategy", repack.CopyAuto, "how the ranges of the source kept in each dest apk are copied: parts copied on the OSS side in parallel, single part copies for the fewest requests, local to read and upload them, or auto to choose from their size and the number of dest apks")
+	fs.StringVar(&opts.PreSignHook, "pre-sign-hook", "", "command, or http(s) url to post to, before building each dest apk, fails the job if it fails")
+	fs.StringVar(&opts.Checksums, "checksum", "", "comma separated checksums of each dest apk, sha256 or md5, read back once after upload and added to the result")
+	fs.BoolVar(&opts.ChecksumSidecar, "checksum-sidecar", false, "write the -checksum of each dest apk to <dest>.sha256 or <dest>.md5, in the format of sha256sum")
+	fs.BoolVar(&opts.ChecksumMeta, "checksum-meta", false, "set the -checksum of each dest apk as its x-oss-meta-sha256 or x-oss-meta-md5")
+	fs.BoolVar(&opts.Tagging, "tag", false, "tag each dest apk with its channel, source-version, cert-sha256 and job-id")
+	fs.StringVar(&opts.JobID, "job-id", "", "job-id tag of the dest apks with -tag, the request id in fc mode")
+	fs.StringVar(&opts.Tags, "tags", "", "comma separated key=value tags of each dest apk, e.g. env=test to match a lifecycle rule")
+	fs.DurationVar(&opts.DeleteAfter, "delete-after", 0, "tag each dest apk with the time after which clean -expired deletes it, e.g. 72h")
+	fs.StringVar(&opts.Callback, "callback", "", "http(s) url OSS posts to once each dest apk is committed, with the upload callback of CompleteMultipartUpload")
+	fs.StringVar(&opts.CallbackBody, "callback-body", "", "body of -callback, with OSS variables like ${size} and ${x:channel}, form encoded or json if it starts with {, the default has bucket, object, etag, size, channel, package, version_code and job_id")
+	fs.StringVar(&opts.PostUploadHook, "post-upload-hook", "", "command, or http(s) url to post to, after uploading each dest apk")
+}
+
+func cpidFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.CPIDContent, "cpid", "", "cpid content, may use {{.Channel}}, {{.PackageName}}, {{.VersionCode}}, {{.VersionName}}, {{.Timestamp}}, {{.Bucket}}, {{.Key}}, {{.Dir}} and {{.Name}}")
+	fs.StringVar(&opts.CPIDJSON, "cpid-json", "", "cpid content as a json object, validated with -cpid-schema and written with sorted keys")
+	fs.StringVar(&opts.CPIDSchema, "cpid-schema", "", "json schema of -cpid-json, a local file or oss://bucket/object, requires a string channel by default")
+	fs.StringVar(&opts.CPIDSeal, "cpid-seal", "", "encrypt the cpid content with aes-gcm, or sign it with hmac")
+	fs.StringVar(&opts.CPIDKey, "cpid-key", "", "hex encoded key of -cpid-seal, a local file or oss://bucket/object")
+	fs.StringVar(&opts.Channel, "channel", "", "channel of {{.Channel}} in -cpid and -dest")
+	fs.BoolVar(&opts.CPIDFile, "cpid-file", opts.CPIDFile, "add cpid content as the files of -cpid-path")
+	fs.StringVar(&opts.CPIDPaths, "cpid-path", opts.CPIDPaths, "comma separated paths to write cpid content to, e.g. cpid,assets/channel")
+	fs.BoolVar(&opts.CPIDComment, "cpid-comment", false, "set cpid content as the zip archive comment")
+	fs.BoolVar(&opts.V2Channel, "v2-channel", false, "set cpid content as the Walle channel in the APK Signing Block, without signing again")
+	fs.StringVar(&opts.MetaDataName, "meta-data", "", "set cpid content to the meta-data of this name in AndroidManifest.xml")
+	fs.BoolVar(&opts.Force, "force", false, "repack even if dest already has the same cpid")
+}
+
+// fanOutFlags are the flags of repacking many dest apks
+func fanOutFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.Channels, "channels", "", "repack one dest apk for each channel in this file, a local file or oss://bucket/object")
+	fs.IntVar(&opts.Jobs, "jobs", opts.Jobs, "number of dest apks to upload at the same time with -channels")
+	fs.BoolVar(&opts.SharedPrefix, "shared-prefix", false, "with -channels, copy the ranges of the source kept in every dest apk to a stage object once, and copy the dest apks from it")
+	fs.StringVar(&opts.Batch, "batch", "", "repack each row of this file, a json event per line or csv with a header like source,dest,cpid, a local file or oss://bucket/object")
+	fs.IntVar(&opts.Retries, "retries", opts.Retries, "number of retries of a failed row of -batch")
+}
+
+func resultFlags(fs *flag.FlagSet) {
+	fs.StringVar(&resultPath, "result", "", "write the result as json to this file, oss://bucket/object or - for stdout")
+}
+
+// signLocalFlags are the flags of signing a local apk file
+func signLocalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "local apk file to sign")
+	fs.StringVar(&opts.DestAPK, "dest", "", "local file to write the signed apk to, replaced once signed")
+	fs.StringVar(&opts.WorkDir, "work-dir", "", "dir to create the temp dir of the signature files in, the system temp dir by default")
+	fs.BoolVar(&opts.InMemory, "in-memory", false, "keep the signature files in memory, without a work dir")
+	fs.BoolVar(&opts.MinimalManifest, "minimal-manifest", false, "in the sections of MANIFEST.MF changed, only write again the lines of the digests changed, keeping the wrapping, order and line endings of the others")
+	fs.BoolVar(&opts.StrictManifest, "strict", false, "reject a MANIFEST.MF of the source the JAR File Specification doesn't allow, e.g. with lines over 72 bytes or an entry twice")
+	fs.BoolVar(&opts.LenientManifest, "lenient", false, "drop the lines and sections of a malformed MANIFEST.MF of the source with a warning, rather than fail")
+	fs.Var(&opts.ManifestAttrs, "manifest-attr", "add or override a main attribute of MANIFEST.MF as name=value, e.g. Built-By=ci, repeatable")
+	fs.Var(&opts.EntryRules, "entry-rule", "remove or keep the entries of the source matching a glob, or a regexp after re:, like \"remove META-INF/*.kotlin_module\" or \"keep assets/**\", repeatable, the last rule matching an entry decides")
+	fs.StringVar(&opts.Schemes, "schemes", repack.SchemesAuto, "comma separated signature schemes, v1, v2 and v3, or auto to choose them from the minSdkVersion and targetSdkVersion of the apk like apksigner")
+	fs.StringVar(&opts.SignatureArtifacts, "signature-artifacts", repack.ArtifactsWarn, "what to do with the signature files of other signers and the source stamp of the source apk: warn, keep, drop or fail")
+	fs.BoolVar(&opts.DropStale, "drop-stale", false, "drop the data of superseded META-INF entries")
+	fs.Int64Var(&opts.PageAlign, "page-align", 0, "align stored entries to this boundary, e.g. 16384")
+	fs.IntVar(&opts.CompressionLevel, "level", opts.CompressionLevel, "compression level of deflated entries, 1-9")
+	fs.Var(&opts.ExtraFiles, "add", "add file to apk as path=source, source is a local file or oss://bucket/object, repeatable")
+	fs.Var(replaceFiles{&opts.ExtraFiles}, "replace", "replace existing entry of apk as path=source, repeatable")
+	fs.BoolVar(&opts.Deterministic, "deterministic", false, "stamp entries with SOURCE_DATE_EPOCH or 2008-01-01 for reproducible output")
+	fs.BoolVar(&opts.VerifySignature, "verify-signature", opts.VerifySignature, "check the v1, v2 and v3 signatures of the signed apk like Android does")
+	fs.StringVar(&opts.Checksums, "checksum", "", "comma separated checksums of the signed apk, sha256 or md5, added to the result")
+}
+
+func inspectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "apk to inspect")
+	fs.StringVar(&opts.CPIDPaths, "cpid-path", opts.CPIDPaths, "comma separated paths of the cpid files")
+	fs.StringVar(&opts.MetaDataName, "meta-data", "", "meta-data of this name in AndroidManifest.xml to print")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+}
+
+func verifyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "apk to verify")
+	fs.StringVar(&opts.CPIDContent, "cpid", "", "check that the apk is signed with this cpid content")
+	fs.StringVar(&opts.CPIDPaths, "cpid-path", opts.CPIDPaths, "comma separated paths of the cpid files")
+	fs.BoolVar(&opts.VerifySignature, "verify-signature", opts.VerifySignature, "check the v1 and v2 signatures like Android does, reading all of the apk")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+	fs.IntVar(&opts.DigestJobs, "digest-jobs", repack.DefaultDigestJobs, "number of ranges read at the same time to compute the digests of entries")
+}
+
+func verifyRemoteFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "apk to verify")
+	fs.StringVar(&opts.CPIDContent, "cpid", "", "check that the apk is signed with this cpid content")
+	fs.StringVar(&opts.CPIDPaths, "cpid-path", opts.CPIDPaths, "comma separated paths of the cpid files")
+	fs.IntVar(&opts.VerifySample, "sample", repack.DefaultVerifySample, "number of entries chosen at random to check the digests of, besides the signature, cpid and AndroidManifest.xml entries")
+	fs.BoolVar(&verifyFull, "full", false, "check the digests of every entry and of the whole apk, reading all of it like verify")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+	fs.IntVar(&opts.DigestJobs, "digest-jobs", repack.DefaultDigestJobs, "number of ranges read at the same time to compute the digests of entries")
+}
+
+func extractCPIDFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "apk to read the cpid of")
+	fs.StringVar(&opts.CPIDPaths, "cpid-path", opts.CPIDPaths, "comma separated paths of the cpid files, the first found is printed")
+	fs.StringVar(&opts.MetaDataName, "meta-data", "", "also print the meta-data of this name in AndroidManifest.xml")
+	fs.BoolVar(&opts.V2Channel, "v2-channel", false, "also print the walle channel of the APK Signing Block")
+	fs.BoolVar(&opts.CPIDComment, "cpid-comment", false, "also print the zip comment")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+}
+
+func compareSignersFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.SourceAPK, "source", "", "apk to compare, e.g. the source apk")
+	fs.StringVar(&otherAPK, "other", "", "apk to compare with, e.g. the dest apk")
+	fs.StringVar(&opts.CacheDir, "cache-dir", "", "keep the blocks read of the apks in this dir, keyed by their etag, to read them again without requests")
+}
+
+func cleanFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cleanPrefix, "prefix", "", "abort the multipart uploads and delete the temp objects under this bucket/prefix")
+	fs.DurationVar(&cleanOlderThan, "older-than", 24*time.Hour, "abort the multipart uploads initiated, and delete the temp objects last modified, longer ago")
+	fs.BoolVar(&cleanDryRun, "dry-run", false, "only list the multipart uploads and temp objects")
+	fs.BoolVar(&cleanExpired, "expired", false, "also delete the objects under -prefix past the time of -delete-after, reading the tags of each")
+}
+
+// selfTestFlags are the flags of the checks of /readyz and self-test
+func selfTestFlags(fs *flag.FlagSet) {
+	fs.StringVar(&probePrefix, "probe-prefix", "", "bucket/prefix to list to check the OSS endpoint and credentials, the bucket of -dest or -source by default")
+}
+
+func serveFlags(fs *flag.FlagSet) {
+	fs.StringVar(&serveListen, "listen", ":8080", "address of the REST API")
+	fs.StringVar(&grpcListen, "grpc-listen", "", "address of the gRPC API of repack/repack.proto, e.g. :9090, none if empty")
+	fs.IntVar(&serveWorkers, "workers", 2, "number of jobs to run at the same time")
+	fs.IntVar(&serveQueue, "queue", 100, "number of jobs to wait in the queue")
+	fs.StringVar(&tenantHeader, "tenant-header", "", "header of the tenant of a job, e.g. X-Tenant set by a gateway, the bucket of the dest if empty")
+	fs.IntVar(&tenantWorkers, "tenant-workers", 0, "number of jobs of a tenant to run at the same time, 0 for -workers")
+	fs.IntVar(&tenantJobs, "tenant-queue", 0, "number of queued and running jobs of a tenant, 0 for no limit")
+	fs.Float64Var(&ossQPS, "oss-qps", 0, "OSS requests per second of all jobs, 0 for no limit")
+	fs.Float64Var(&tenantOSSQPS, "tenant-oss-qps", 0, "OSS requests per second of the jobs of a tenant, 0 for no limit")
+	fs.StringVar(&hmacKeysPath, "hmac-keys", "", "json of the HMAC secret of each caller, to accept the requests signed with it")
+	fs.StringVar(&oidcIssuer, "oidc-issuer", "", "OIDC issuer, to accept the requests with its ID tokens")
+	fs.StringVar(&oidcAudience, "oidc-audience", "", "audience of the OIDC ID tokens")
+	fs.BoolVar(&requireCredentials, "require-credentials", false, "reject the jobs without OSS credentials of their own, so the credentials of the server are never used for them")
+	fs.StringVar(&bucketScopesPath, "bucket-scopes", "", "json of the patterns of the buckets each caller may use")
+	fs.DurationVar(&watchInterval, "watch-keys", 30*time.Second, "interval to check the keys, certs, key map, -hmac-keys and -bucket-scopes for changes to reload, 0 to reload on SIGHUP only")
+}
+
+func workerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&mnsEndpoint, "mns-ep", "", "mns endpoint, e.g. https://<account id>.mns.cn-hangzhou.aliyuncs.com")
+	fs.StringVar(&mnsQueueName, "mns-queue", "", "mns queue of the repack events")
+	fs.StringVar(&mnsDeadQueue, "mns-dead-queue", "", "mns queue to send the events that failed for good to")
+	fs.IntVar(&serveWorkers, "workers", 2, "number of messages to repack at the same time")
+	fs.IntVar(&opts.Retries, "retries", opts.Retries, "number of retries of a failed message")
+}
+
+func jobStoreFlags(fs *flag.FlagSet) {
+	fs.StringVar(&jobStoreURL, "job-store", "", "persist the state of the jobs to oss://bucket/prefix/ or redis://[:password@]host:port[/db]")
+}
+
+func lockFlags(fs *flag.FlagSet) {
+	fs.StringVar(&lockURL, "lock", "", "lock the dest of each job in oss://bucket/prefix/ or redis://[:password@]host:port[/db], so no two jobs repack it at the same time")
+}
+
+// printRows prints the summary of a batch
+func printRows(rows []repack.Row) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "line\tdest\tstatus\tattempts\terror")
+	for _, row := range rows {
+		status := "repacked"
+		if row.Error != "" {
+			status = "failed"
+		} else if row.Result.Skipped {
+			status = "skipped"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", row.Line, row.Event.Dest, status, row.Attempts, row.Error)
 	}
+	w.Flush()
+}
 
-	zipReader, err := zip.NewReader(ossReader, objectSize)
-	if err != nil {
-		perror("zip reader: %v", err)
+// setLogger sets the default logger of -log-format, and the tracer of -trace
+func setLogger() {
+	if logFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
 	}
+	if trace {
+		opts.Tracer = repack.LogTracer{}
+	}
+}
 
-	err = changeManifest(zipReader)
-	if err != nil {
-		perror("change manifest: %v", err)
+// setRetry sets the retry policy of the -oss-retry flags
+func setRetry() {
+	retryPolicy.Retries = ossAttempts - 1
+	opts.Retry = &retryPolicy
+}
+
+// writeResult writes v as json to -result
+func writeResult(v interface{}) {
+	if resultPath == "" {
+		return
 	}
+	buf, _ := json.MarshalIndent(v, "", "  ")
+	buf = append(buf, '\n')
 
-	ossWriter, err := NewWriter(
-		OSSConfig{
-			Endpoint:        g.OSSEndpoint,
-			AccessKeyID:     g.OSSAccessKeyID,
-			AccessKeySecret: g.OSSAccessKeySecret,
-			SecurityToken:   g.OSSSecurityToken,
-		}, g.DestAPK, g.SourceAPK, zipReader.AppendOffset())
+	var err error
+	switch {
+	case resultPath == "-":
+		_, err = os.Stdout.Write(buf)
+	case strings.HasPrefix(resultPath, repack.OSSScheme):
+		config := repack.OSSConfig{
+			Endpoint:        opts.OSSEndpoint,
+			AccessKeyID:     opts.OSSAccessKeyID,
+			AccessKeySecret: opts.OSSAccessKeySecret,
+			SecurityToken:   opts.OSSSecurityToken,
+		}
+		err = repack.WriteObject(config, strings.TrimPrefix(resultPath, repack.OSSScheme), buf)
+	default:
+		err = ioutil.WriteFile(resultPath, buf, 0644)
+	}
 	if err != nil {
-		perror("oss writer: %v", err)
+		perror("write result: %v", err)
 	}
-	defer func() {
-		err := ossWriter.Flush()
-		if err != nil {
-			perror("flush oss: %v", err)
-		}
-	}()
+}
 
-	writer := zipReader.Append(ossWriter)
-	defer writer.Close()
+// signalContext returns a context done on SIGINT or SIGTERM, so that
+// uploads are aborted and work dirs removed before exiting. A second
+// signal kills the process.
+func signalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	context.AfterFunc(ctx, func() {
+		stop()
+		slog.Warn("interrupted, cleaning up")
+	})
+	return ctx
+}
 
-	// copy cpid file
-	if err := copyCPID(writer); err != nil {
-		perror("copy cpid: %v", err)
+// print error and exit
+func perror(msg string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(msg, args...))
+	os.Exit(1)
+}
+
+// exit codes by the kind of error, flag already exits with 2 on bad flags
+var exitCodes = map[repack.Kind]int{
+	repack.KindUnknown:   1,
+	repack.KindConfig:    2,
+	repack.KindSource:    3,
+	repack.KindSign:      4,
+	repack.KindThrottled: 5,
+	repack.KindVerify:    6,
+	repack.KindCanceled:  7,
+	repack.KindHook:      8,
+}
+
+// print error and exit with the code of its kind
+func exit(err error) {
+	kind := repack.KindOf(err)
+	slog.Error(err.Error(), append([]interface{}{"kind", kind.String()}, repack.RequestAttrs(err)...)...)
+	os.Exit(exitCodes[kind])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	// repack is the default command, for the flags without a command
+	name, args := "repack", os.Args[1:]
+	if !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		usage()
+		os.Exit(2)
 	}
-	// copy meta files: MANIFEST.MF/CERT.SF/CERT.RSA
-	if err := copyMeta(writer); err != nil {
-		perror("copy meta: %v", err)
+	cmd.parse(args)
+	setLogger()
+	setRetry()
+	setAudit()
+	if err := cmd.run(signalContext()); err != nil {
+		exit(err)
 	}
 }
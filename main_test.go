@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+func TestReplaceFilesSet(t *testing.T) {
+	var files repack.ExtraFiles
+	files.Set("assets/a.json=/tmp/a.json")
+	if err := (replaceFiles{&files}).Set("assets/b.json=oss://bucket/b.json"); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Replace || !files[1].Replace {
+		t.Errorf("files %+v", files)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	defer func(o repack.Options) { opts = o }(opts)
+	cmd := findCommand("serve")
+	if cmd == nil {
+		t.Fatal("no serve command")
+	}
+	cmd.parse([]string{"-listen", ":9000", "-grpc-listen", ":9090", "-cpid", "{{.Channel}}"})
+	if serveListen != ":9000" || grpcListen != ":9090" || opts.CPIDContent != "{{.Channel}}" {
+		t.Errorf("listen %q, grpc %q, cpid %q", serveListen, grpcListen, opts.CPIDContent)
+	}
+	if findCommand("deploy") != nil {
+		t.Error("unknown command found")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// durationBuckets are the upper bounds in seconds of the duration histograms
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// histogram counts observations in durationBuckets
+type histogram struct {
+	counts []int64 // per bucket, not cumulative, the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(durationBuckets)+1)
+	}
+	i := sort.SearchFloat64s(durationBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// write writes h in the prometheus text format, labels is like phase="build"
+func (h *histogram) write(w io.Writer, name, labels string) {
+	bucket := func(le string) string {
+		if labels == "" {
+			return fmt.Sprintf("le=%q", le)
+		}
+		return fmt.Sprintf("%s,le=%q", labels, le)
+	}
+	var cumulative int64
+	for i, le := range durationBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, bucket(fmt.Sprint(le)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, bucket("+Inf"), h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// metrics of the jobs of serve
+type metrics struct {
+	mu       sync.Mutex
+	jobs     map[string]int64 // by final state
+	failures map[string]int64 // by phase
+	duration histogram
+	phases   map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		jobs:     make(map[string]int64),
+		failures: make(map[string]int64),
+		phases:   make(map[string]*histogram),
+	}
+}
+
+// finish records a finished job
+func (m *metrics) finish(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[j.State]++
+	if j.State == jobFailed {
+		m.failures[j.Phase]++
+	}
+	m.duration.observe(j.Finished.Sub(j.Started).Seconds())
+	if j.Result != nil {
+		for phase, ms := range j.Result.PhasesMS {
+			h := m.phases[phase]
+			if h == nil {
+				h = &histogram{}
+				m.phases[phase] = h
+			}
+			h.observe(float64(ms) / float64(time.Second/time.Millisecond))
+		}
+	}
+}
+
+// write writes the metrics of the jobs and the OSS requests
+func (m *metrics) write(w io.Writer, queued, running int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP repack_jobs_total Finished jobs by state.")
+	fmt.Fprintln(w, "# TYPE repack_jobs_total counter")
+	for _, state := range []string{jobDone, jobFailed} {
+		fmt.Fprintf(w, "repack_jobs_total{state=%q} %d\n", state, m.jobs[state])
+	}
+	fmt.Fprintln(w, "# HELP repack_job_failures_total Failed jobs by the phase they failed in.")
+	fmt.Fprintln(w, "# TYPE repack_job_failures_total counter")
+	writeCounters(w, "repack_job_failures_total", "phase", m.failures)
+
+	fmt.Fprintln(w, "# HELP repack_jobs_queued Jobs waiting in the queue.")
+	fmt.Fprintln(w, "# TYPE repack_jobs_queued gauge")
+	fmt.Fprintf(w, "repack_jobs_queued %d\n", queued)
+	fmt.Fprintln(w, "# HELP repack_jobs_running Jobs running.")
+	fmt.Fprintln(w, "# TYPE repack_jobs_running gauge")
+	fmt.Fprintf(w, "repack_jobs_running %d\n", running)
+
+	fmt.Fprintln(w, "# HELP repack_job_duration_seconds Duration of finished jobs.")
+	fmt.Fprintln(w, "# TYPE repack_job_duration_seconds histogram")
+	m.duration.write(w, "repack_job_duration_seconds", "")
+	fmt.Fprintln(w, "# HELP repack_phase_duration_seconds Duration of the phases of done jobs.")
+	fmt.Fprintln(w, "# TYPE repack_phase_duration_seconds histogram")
+	var phases []string
+	for phase := range m.phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		m.phases[phase].write(w, "repack_phase_duration_seconds", fmt.Sprintf("phase=%q", phase))
+	}
+
+	stats := repack.ReadStats()
+	fmt.Fprintln(w, "# HELP repack_bytes_copied_total Bytes copied on the OSS side from the source apks.")
+	fmt.Fprintln(w, "# TYPE repack_bytes_copied_total counter")
+	fmt.Fprintf(w, "repack_bytes_copied_total %d\n", stats.BytesCopied)
+	fmt.Fprintln(w, "# HELP repack_bytes_uploaded_total Bytes uploaded to OSS.")
+	fmt.Fprintln(w, "# TYPE repack_bytes_uploaded_total counter")
+	fmt.Fprintf(w, "repack_bytes_uploaded_total %d\n", stats.BytesUploaded)
+	fmt.Fprintln(w, "# HELP repack_bytes_read_total Bytes of apks read from OSS.")
+	fmt.Fprintln(w, "# TYPE repack_bytes_read_total counter")
+	fmt.Fprintf(w, "repack_bytes_read_total %d\n", stats.BytesRead)
+	fmt.Fprintln(w, "# HELP repack_oss_requests_total OSS requests by operation.")
+	fmt.Fprintln(w, "# TYPE repack_oss_requests_total counter")
+	writeCounters(w, "repack_oss_requests_total", "op", stats.Requests)
+	fmt.Fprintln(w, "# HELP repack_oss_errors_total Failed OSS requests by operation.")
+	fmt.Fprintln(w, "# TYPE repack_oss_errors_total counter")
+	writeCounters(w, "repack_oss_errors_total", "op", stats.Errors)
+	fmt.Fprintln(w, "# HELP repack_oss_retries_total Retried OSS requests by operation.")
+	fmt.Fprintln(w, "# TYPE repack_oss_retries_total counter")
+	writeCounters(w, "repack_oss_retries_total", "op", stats.Retries)
+	fmt.Fprintln(w, "# HELP repack_oss_retry_wait_seconds_total Seconds slept before the retries of OSS requests by operation.")
+	fmt.Fprintln(w, "# TYPE repack_oss_retry_wait_seconds_total counter")
+	for _, op := range sortedKeys(stats.RetryWait) {
+		fmt.Fprintf(w, "repack_oss_retry_wait_seconds_total{op=%q} %g\n", op, float64(stats.RetryWait[op])/1000)
+	}
+}
+
+// writeCounters writes the counters of m sorted by label value
+func writeCounters(w io.Writer, name, label string, m map[string]int64) {
+	for _, k := range sortedKeys(m) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, m[k])
+	}
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]int64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var queued, running int
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		switch j.State {
+		case jobQueued:
+			queued++
+		case jobRunning:
+			running++
+		}
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, queued, running)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	start := time.Now()
+	m.finish(&job{State: jobDone, Started: start, Finished: start.Add(2 * time.Second),
+		Result: &repack.Result{PhasesMS: map[string]int64{repack.PhaseUpload: 700}}})
+	m.finish(&job{State: jobFailed, Phase: repack.PhaseBuild, Started: start, Finished: start.Add(40 * time.Second)})
+
+	var buf bytes.Buffer
+	m.write(&buf, 3, 1)
+	for _, line := range []string{
+		`repack_jobs_total{state="done"} 1`,
+		`repack_jobs_total{state="failed"} 1`,
+		`repack_job_failures_total{phase="build"} 1`,
+		`repack_jobs_queued 3`,
+		`repack_jobs_running 1`,
+		`repack_job_duration_seconds_bucket{le="2.5"} 1`,
+		`repack_job_duration_seconds_bucket{le="60"} 2`,
+		`repack_job_duration_seconds_bucket{le="+Inf"} 2`,
+		`repack_job_duration_seconds_sum 42`,
+		`repack_phase_duration_seconds_bucket{phase="upload",le="0.5"} 0`,
+		`repack_phase_duration_seconds_bucket{phase="upload",le="1"} 1`,
+		`repack_phase_duration_seconds_count{phase="upload"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("no %s in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mnsVersion is the version of the MNS HTTP API
+const mnsVersion = "2015-06-06"
+
+// mnsQueue is a client of an MNS queue over the HTTP API, as there is no
+// vendored MNS SDK
+type mnsQueue struct {
+	Endpoint        string // https://<account id>.mns.<region>.aliyuncs.com
+	Name            string
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+	Client          *http.Client
+}
+
+// mnsMessage is a received message
+type mnsMessage struct {
+	MessageID     string `xml:"MessageId"`
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	MessageBody   string `xml:"MessageBody"`
+	DequeueCount  int    `xml:"DequeueCount"`
+}
+
+// mnsError is the error body of the MNS API
+type mnsError struct {
+	Status    int    `xml:"-"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+	RequestID string `xml:"RequestId"`
+}
+
+func (e *mnsError) Error() string {
+	return fmt.Sprintf("mns: %d %s: %s, request id: %s", e.Status, e.Code, e.Message, e.RequestID)
+}
+
+// receive long-polls a message for up to wait, it returns nil if the queue
+// stays empty
+func (q *mnsQueue) receive(ctx context.Context, wait time.Duration) (*mnsMessage, error) {
+	query := fmt.Sprintf("waitseconds=%d", int(wait/time.Second))
+	resp, err := q.do(ctx, "GET", "/messages", query, nil)
+	if err != nil {
+		if e, ok := err.(*mnsError); ok && e.Code == "MessageNotExist" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m mnsMessage
+	if err := xml.Unmarshal(resp, &m); err != nil {
+		return nil, fmt.Errorf("mns: invalid message: %v", err)
+	}
+	return &m, nil
+}
+
+// delete acknowledges a received message
+func (q *mnsQueue) delete(m *mnsMessage) error {
+	_, err := q.do(context.Background(), "DELETE", "/messages", "ReceiptHandle="+url.QueryEscape(m.ReceiptHandle), nil)
+	return err
+}
+
+// send sends a message with body, visible after delay
+func (q *mnsQueue) send(body string, delay time.Duration) error {
+	buf, _ := xml.Marshal(struct {
+		XMLName      xml.Name `xml:"http://mns.aliyuncs.com/doc/v1/ Message"`
+		MessageBody  string   `xml:"MessageBody"`
+		DelaySeconds int      `xml:"DelaySeconds,omitempty"`
+	}{MessageBody: body, DelaySeconds: int(delay / time.Second)})
+	_, err := q.do(context.Background(), "POST", "/messages", "", append([]byte(xml.Header), buf...))
+	return err
+}
+
+// do sends a signed request to resource of the queue
+func (q *mnsQueue) do(ctx context.Context, method, resource, query string, body []byte) ([]byte, error) {
+	path := "/queues/" + q.Name + resource
+	if query != "" {
+		path += "?" + query
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(q.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	contentType := "text/xml;charset=utf-8"
+	req.Header.Set("Date", date)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("x-mns-version", mnsVersion)
+	headers := "x-mns-version:" + mnsVersion + "\n"
+	if q.SecurityToken != "" {
+		req.Header.Set("x-mns-security-token", q.SecurityToken)
+		headers = "x-mns-security-token:" + q.SecurityToken + "\n" + headers
+	}
+	mac := hmac.New(sha1.New, []byte(q.AccessKeySecret))
+	mac.Write([]byte(method + "\n\n" + contentType + "\n" + date + "\n" + headers + path))
+	req.Header.Set("Authorization", "MNS "+q.AccessKeyID+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	client := q.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("mns: %v", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("mns: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		e := &mnsError{Status: resp.StatusCode}
+		xml.Unmarshal(buf, e)
+		return nil, e
+	}
+	return buf, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout is the timeout of a redis command
+const redisTimeout = 5 * time.Second
+
+// redisClient is a client of the RESP protocol, as no Redis client is
+// vendored, running one command at a time on one connection
+type redisClient struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient returns the client of u, redis://[:password@]host:port[/db],
+// and the prefix of the keys, ?prefix= or repack:
+func newRedisClient(u *url.URL) (*redisClient, string, error) {
+	c := &redisClient{Addr: u.Host}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		db, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid redis db: %s", p)
+		}
+		c.DB = db
+	}
+	c.Password, _ = u.User.Password()
+	prefix := u.Query().Get("prefix")
+	if prefix == "" {
+		prefix = "repack:"
+	}
+	return c, prefix, nil
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do runs a command and returns its reply, a string, an int64, nil or a
+// []interface{} of them, closing the connection on any error but a redisError
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.command(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// dial connects to Addr, and selects DB with Password
+func (c *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", c.Addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("redis: %v", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	if c.Password != "" {
+		if _, err := c.command("AUTH", c.Password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.DB != 0 {
+		if _, err := c.command("SELECT", strconv.Itoa(c.DB)); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// command writes a command as an array of bulk strings and reads the reply
+func (c *redisClient) command(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	return c.reply()
+}
+
+// reply reads a reply
+func (c *redisClient) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply: %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %v", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				// the rest of the array is unread, so not a redisError
+				return nil, fmt.Errorf("redis: item %d of %d: %v", i, n, err)
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply: %q", line)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// watch reloads the keys and config of the server on SIGHUP, and when their
+// sources change, checked every -watch-keys, until ctx is done
+func (s *server) watch(ctx context.Context, auth *authenticator) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if watchInterval > 0 {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := keySourcesSum()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last = keySourcesSum()
+			s.reload(auth, "SIGHUP")
+		case <-tick:
+			if sum := keySourcesSum(); sum != last {
+				last = sum
+				s.reload(auth, "changed")
+			}
+		}
+	}
+}
+
+// reload reloads the keys and config, keeping those of before that fail
+// to load, and runs the checks of /readyz on the new keys
+func (s *server) reload(auth *authenticator, reason string) {
+	slog.Info("reloading keys and config", "reason", reason)
+	// the jobs read the key files and the key map as they start
+	repack.ForgetSecrets()
+	if auth != nil {
+		if err := auth.loadHMACKeys(); err != nil {
+			slog.Error("reload, keep the previous -hmac-keys", "error", err)
+		}
+	}
+	if scopes, err := loadBucketScopes(); err != nil {
+		slog.Error("reload, keep the previous -bucket-scopes", "error", err)
+	} else {
+		s.mu.Lock()
+		s.scopes = scopes
+		s.mu.Unlock()
+	}
+
+	checks, err := repack.SelfTest(s.ctx, opts, probePrefix)
+	s.readyMu.Lock()
+	s.ready = readiness{Ready: err == nil, Checks: checks, Checked: time.Now()}
+	if err != nil {
+		s.ready.Error = err.Error()
+	}
+	s.readyMu.Unlock()
+	if err != nil {
+		// not ready until fixed, so no job is routed here meanwhile
+		slog.Error("reloaded keys failed the checks", "error", err)
+		return
+	}
+	slog.Info("reloaded keys and config")
+}
+
+// keySourcesSum returns a sum of the files and OSS etags of the keys, certs
+// and key map of the flags and key map rules, -hmac-keys and -bucket-scopes
+func keySourcesSum() string {
+	locations := []string{opts.PrivateKeyPEM, opts.CertPEM, opts.NextPrivateKeyPEM, opts.NextCertPEM, opts.KeyMap, hmacKeysPath, bucketScopesPath}
+	if opts.KeyMap != "" {
+		var rules []repack.KeyRule
+		if buf, err := readSource(opts.KeyMap); err == nil && json.Unmarshal(buf, &rules) == nil {
+			for _, r := range rules {
+				locations = append(locations, r.PrivateKeyPEM, r.CertPEM, r.NextPrivateKeyPEM, r.NextCertPEM)
+			}
+		}
+	}
+	h := sha256.New()
+	for _, location := range locations {
+		if location == "" {
+			continue
+		}
+		h.Write([]byte(location + "\n"))
+		if strings.HasPrefix(location, repack.OSSScheme) {
+			h.Write([]byte(objectETag(strings.TrimPrefix(location, repack.OSSScheme)) + "\n"))
+			continue
+		}
+		buf, err := ioutil.ReadFile(location)
+		if err != nil {
+			h.Write([]byte(err.Error()))
+		}
+		sum := sha256.Sum256(buf)
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readSource reads a local file or an oss:// object
+func readSource(location string) ([]byte, error) {
+	if strings.HasPrefix(location, repack.OSSScheme) {
+		return repack.ReadObject(serverOSSConfig(), strings.TrimPrefix(location, repack.OSSScheme))
+	}
+	return ioutil.ReadFile(location)
+}
+
+// objectETag returns the etag of the object at location, or the status of
+// the error getting it
+func objectETag(location string) string {
+	r, err := repack.NewReader(serverOSSConfig(), location)
+	if err != nil {
+		return err.Error()
+	}
+	meta, err := r.Client.GetObjectDetailedMeta(r.Object)
+	if err != nil {
+		// not the message, whose request id changes every time
+		return fmt.Sprintf("error %d", statusOf(err))
+	}
+	return meta.Get("Etag")
+}
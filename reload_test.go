@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeySourcesSum(t *testing.T) {
+	defer func(key string) { opts.PrivateKeyPEM = key }(opts.PrivateKeyPEM)
+	opts.PrivateKeyPEM = filepath.Join(t.TempDir(), "key.pem")
+	ioutil.WriteFile(opts.PrivateKeyPEM, []byte("key 1"), 0600)
+	sum := keySourcesSum()
+	if keySourcesSum() != sum {
+		t.Error("sum changed without a change")
+	}
+	ioutil.WriteFile(opts.PrivateKeyPEM, []byte("key 2"), 0600)
+	if keySourcesSum() == sum {
+		t.Error("sum unchanged with a new key")
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer func(keys, scopes string) { hmacKeysPath, bucketScopesPath = keys, scopes }(hmacKeysPath, bucketScopesPath)
+	dir := t.TempDir()
+	hmacKeysPath, bucketScopesPath = filepath.Join(dir, "keys.json"), filepath.Join(dir, "scopes.json")
+	ioutil.WriteFile(hmacKeysPath, []byte(`{"platform":"secret 1"}`), 0600)
+	ioutil.WriteFile(bucketScopesPath, []byte(`{"hmac:platform":["games-*"]}`), 0600)
+	auth, err := newAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(context.Background())
+
+	ioutil.WriteFile(hmacKeysPath, []byte(`{"platform":"secret 2"}`), 0600)
+	s.reload(auth, "test")
+	if string(auth.hmacKeys["platform"]) != "secret 2" || len(s.scopes["hmac:platform"]) != 1 || !s.ready.Ready {
+		t.Errorf("reloaded keys %q, scopes %v, ready %+v", auth.hmacKeys, s.scopes, s.ready)
+	}
+
+	// the previous ones are kept if they fail to load
+	ioutil.WriteFile(hmacKeysPath, []byte(`{`), 0600)
+	ioutil.WriteFile(bucketScopesPath, []byte(`{`), 0600)
+	s.reload(auth, "test")
+	if string(auth.hmacKeys["platform"]) != "secret 2" || len(s.scopes["hmac:platform"]) != 1 {
+		t.Errorf("kept keys %q, scopes %v", auth.hmacKeys, s.scopes)
+	}
+}
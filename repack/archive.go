@@ -0,0 +1,768 @@
+package repack
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// zip format consts ...
+const (
+	fileHeaderSignature      = 0x04034b50
+	directoryHeaderSignature = 0x02014b50
+	directoryEndSignature    = 0x06054b50
+	directory64LocSignature  = 0x07064b50
+	directory64EndSignature  = 0x06064b50
+	fileHeaderLen            = 30 // + filename + extra
+	directoryHeaderLen       = 46 // + filename + extra + comment
+	directoryEndLen          = 22 // + comment
+	directory64LocLen        = 20
+	directory64EndLen        = 56
+	zipVersion20             = 20
+	zipVersion45             = 45
+	uint16max                = (1 << 16) - 1
+	uint32max                = (1 << 32) - 1
+	dataDescriptorSignature  = 0x08074b50
+	zip64ExtraID             = 0x0001
+	alignExtraID             = 0xd935 // same as apksigner/zipalign
+	maxCommentLen            = uint16max
+	defaultLevel             = 5 // same as zipmerge
+)
+
+// Directory is the central directory of an existing zip archive
+type Directory struct {
+	Offset  int64 // offset of the central directory, new entries go here
+	Size    int64
+	End     int64 // offset of the end record after the central directory, the zip64 one if any
+	Comment string
+	Records []*Record
+}
+
+// Clone returns a copy of d that can be changed without affecting d
+func (d *Directory) Clone() *Directory {
+	c := *d
+	c.Records = make([]*Record, len(d.Records))
+	for i, rec := range d.Records {
+		r := *rec
+		r.raw = append([]byte(nil), rec.raw...)
+		c.Records[i] = &r
+	}
+	return &c
+}
+
+// Record is a central directory record, kept as raw bytes so that the flags,
+// extra fields and timestamps of existing entries survive the append as is
+type Record struct {
+	Name   string
+	Offset int64 // offset of the local file header
+
+	raw    []byte
+	header *zip.FileHeader
+}
+
+// ReadDirectory reads the central directory of the zip archive in r
+func ReadDirectory(r io.ReaderAt, size int64) (*Directory, error) {
+	tailLen := int64(directoryEndLen + maxCommentLen)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil {
+		return nil, err
+	}
+
+	p := -1
+	for i := len(tail) - directoryEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == directoryEndSignature {
+			n := int(binary.LittleEndian.Uint16(tail[i+directoryEndLen-2:]))
+			if i+directoryEndLen+n <= len(tail) {
+				p = i
+				break
+			}
+		}
+	}
+	if p < 0 {
+		return nil, fmt.Errorf("end of central directory not found")
+	}
+
+	end := tail[p:]
+	endOffset := size - tailLen + int64(p)
+	records := uint64(binary.LittleEndian.Uint16(end[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(end[12:]))
+	dirOffset := uint64(binary.LittleEndian.Uint32(end[16:]))
+	commentLen := int(binary.LittleEndian.Uint16(end[20:]))
+	comment := string(end[directoryEndLen : directoryEndLen+commentLen])
+
+	dirEnd := endOffset
+	zip64 := records == uint16max || dirSize == uint32max || dirOffset == uint32max
+	if zip64 {
+		end64, end64Offset, err := readDirectory64End(r, endOffset)
+		if err != nil {
+			return nil, err
+		}
+		dirEnd = end64Offset
+		records = binary.LittleEndian.Uint64(end64[32:])
+		dirSize = binary.LittleEndian.Uint64(end64[40:])
+		dirOffset = binary.LittleEndian.Uint64(end64[48:])
+	}
+	// compared without adding the 64 bit values
+	if dirOffset > uint64(dirEnd) || dirSize > uint64(dirEnd)-dirOffset {
+		return nil, fmt.Errorf("invalid central directory: offset %d, size %d", dirOffset, dirSize)
+	}
+
+	buf := make([]byte, dirSize)
+	if _, err := r.ReadAt(buf, int64(dirOffset)); err != nil {
+		return nil, err
+	}
+
+	d := &Directory{
+		Offset:  int64(dirOffset),
+		Size:    int64(dirSize),
+		End:     dirEnd,
+		Comment: comment,
+	}
+	for len(buf) > 0 {
+		rec, n, err := parseRecord(buf)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Offset < 0 || rec.Offset >= d.Offset {
+			return nil, fmt.Errorf("invalid local header offset of %s: %d", rec.Name, rec.Offset)
+		}
+		d.Records = append(d.Records, rec)
+		buf = buf[n:]
+	}
+	// the 16 bit count of the end record may have wrapped without zip64
+	if zip64 && uint64(len(d.Records)) != records || !zip64 && uint16(len(d.Records)) != uint16(records) {
+		return nil, fmt.Errorf("expect %d central directory records, got: %d", records, len(d.Records))
+	}
+
+	return d, nil
+}
+
+// readDirectory64End reads the zip64 end of central directory record, and its
+// offset, through the locator right before the end of central directory
+func readDirectory64End(r io.ReaderAt, endOffset int64) ([]byte, int64, error) {
+	if endOffset < directory64LocLen {
+		return nil, 0, fmt.Errorf("zip64 locator not found")
+	}
+	loc := make([]byte, directory64LocLen)
+	if _, err := r.ReadAt(loc, endOffset-directory64LocLen); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(loc) != directory64LocSignature {
+		return nil, 0, fmt.Errorf("zip64 locator not found")
+	}
+	if disks := binary.LittleEndian.Uint32(loc[16:]); disks != 1 {
+		return nil, 0, fmt.Errorf("multi-disk zip64 archive not supported: %d disks", disks)
+	}
+
+	end64 := make([]byte, directory64EndLen)
+	offset := binary.LittleEndian.Uint64(loc[8:])
+	if locOffset := uint64(endOffset - directory64LocLen); offset > locOffset || locOffset-offset < directory64EndLen {
+		return nil, 0, fmt.Errorf("invalid zip64 end of central directory offset: %d", offset)
+	}
+	if _, err := r.ReadAt(end64, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(end64) != directory64EndSignature {
+		return nil, 0, fmt.Errorf("invalid zip64 end of central directory")
+	}
+	return end64, int64(offset), nil
+}
+
+// parseRecord parses the central directory record at the start of buf and
+// returns it with its length in bytes
+func parseRecord(buf []byte) (*Record, int, error) {
+	if len(buf) < directoryHeaderLen ||
+		binary.LittleEndian.Uint32(buf) != directoryHeaderSignature {
+		return nil, 0, fmt.Errorf("invalid central directory record")
+	}
+	nameLen := int(binary.LittleEndian.Uint16(buf[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(buf[30:]))
+	commentLen := int(binary.LittleEndian.Uint16(buf[32:]))
+	n := directoryHeaderLen + nameLen + extraLen + commentLen
+	if len(buf) < n {
+		return nil, 0, fmt.Errorf("truncated central directory record")
+	}
+
+	name := string(buf[directoryHeaderLen : directoryHeaderLen+nameLen])
+	raw := make([]byte, n)
+	copy(raw, buf)
+	rec := &Record{
+		Name: name,
+		raw:  raw,
+	}
+
+	pos, wide, err := rec.offsetField()
+	if err != nil {
+		return nil, 0, err
+	}
+	if wide {
+		rec.Offset = int64(binary.LittleEndian.Uint64(raw[pos:]))
+	} else {
+		rec.Offset = int64(binary.LittleEndian.Uint32(raw[pos:]))
+	}
+
+	return rec, n, nil
+}
+
+// offsetField returns the position of the local header offset in the raw
+// record, which is in the zip64 extra when the 32 bit field overflows
+func (rec *Record) offsetField() (int, bool, error) {
+	raw := rec.raw
+	if binary.LittleEndian.Uint32(raw[42:]) != uint32max {
+		return 42, false, nil
+	}
+
+	// the zip64 extra holds the sizes first, but only those that overflow
+	nameLen := int(binary.LittleEndian.Uint16(raw[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(raw[30:]))
+	extraStart := directoryHeaderLen + nameLen
+	extra := raw[extraStart : extraStart+extraLen]
+	skip := 0
+	if binary.LittleEndian.Uint32(raw[24:]) == uint32max {
+		skip += 8
+	}
+	if binary.LittleEndian.Uint32(raw[20:]) == uint32max {
+		skip += 8
+	}
+	start, size := indexExtra(extra, zip64ExtraID)
+	if start < 0 || size < skip+8 {
+		return 0, false, fmt.Errorf("missing zip64 offset: %s", rec.Name)
+	}
+	return extraStart + start + skip, true, nil
+}
+
+// compressedSize returns the compressed size of the entry
+func (rec *Record) compressedSize() (int64, error) {
+	raw := rec.raw
+	if size := binary.LittleEndian.Uint32(raw[20:]); size != uint32max {
+		return int64(size), nil
+	}
+
+	nameLen := int(binary.LittleEndian.Uint16(raw[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(raw[30:]))
+	extraStart := directoryHeaderLen + nameLen
+	extra := raw[extraStart : extraStart+extraLen]
+	skip := 0
+	if binary.LittleEndian.Uint32(raw[24:]) == uint32max {
+		skip += 8
+	}
+	start, size := indexExtra(extra, zip64ExtraID)
+	if start < 0 || size < skip+8 {
+		return 0, fmt.Errorf("missing zip64 compressed size: %s", rec.Name)
+	}
+	compressed := binary.LittleEndian.Uint64(extra[start+skip:])
+	if compressed > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid zip64 compressed size of %s: %d", rec.Name, compressed)
+	}
+	return int64(compressed), nil
+}
+
+// setOffset moves the local header offset of an existing entry
+func (rec *Record) setOffset(offset int64) error {
+	pos, wide, err := rec.offsetField()
+	if err != nil {
+		return err
+	}
+	if wide {
+		binary.LittleEndian.PutUint64(rec.raw[pos:], uint64(offset))
+	} else {
+		binary.LittleEndian.PutUint32(rec.raw[pos:], uint32(offset))
+	}
+	rec.Offset = offset
+	return nil
+}
+
+// end returns the offset right after the data, and the data descriptor if
+// any, of an existing entry by reading its local header
+func (rec *Record) end(r io.ReaderAt) (int64, error) {
+	var buf [fileHeaderLen]byte
+	if _, err := r.ReadAt(buf[:], rec.Offset); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != fileHeaderSignature {
+		return 0, fmt.Errorf("invalid local file header: %s", rec.Name)
+	}
+	nameLen := int64(binary.LittleEndian.Uint16(buf[26:]))
+	extraLen := int64(binary.LittleEndian.Uint16(buf[28:]))
+	compressedSize, err := rec.compressedSize()
+	if err != nil {
+		return 0, err
+	}
+
+	start := rec.Offset + fileHeaderLen + nameLen + extraLen
+	if compressedSize > math.MaxInt64-start {
+		return 0, fmt.Errorf("invalid compressed size of %s: %d", rec.Name, compressedSize)
+	}
+	end := start + compressedSize
+	if binary.LittleEndian.Uint16(rec.raw[8:])&0x8 != 0 {
+		// crc32 and sizes, optionally led by a signature, with sizes of 8
+		// bytes if the local header has a zip64 extra
+		descLen := int64(12)
+		extra := make([]byte, extraLen)
+		if _, err := r.ReadAt(extra, rec.Offset+fileHeaderLen+nameLen); err != nil {
+			return 0, err
+		}
+		if start, _ := indexExtra(extra, zip64ExtraID); start >= 0 {
+			descLen = 20
+		}
+		var sig [4]byte
+		if _, err := r.ReadAt(sig[:], end); err != nil {
+			return 0, err
+		}
+		if binary.LittleEndian.Uint32(sig[:]) == dataDescriptorSignature {
+			descLen += 4
+		}
+		end += descLen
+	}
+	return end, nil
+}
+
+// Segment is a byte range of the source archive
+type Segment struct {
+	Offset int64
+	Size   int64
+}
+
+// segmentsSize returns the total size of segments
+func segmentsSize(segments []Segment) int64 {
+	size := int64(0)
+	for _, s := range segments {
+		size += s.Size
+	}
+	return size
+}
+
+// Remove drops the entries names with their data, logging them to log, and
+// returns the ranges of the source archive to keep
+func (d *Directory) Remove(r io.ReaderAt, names map[string]bool, log *slog.Logger) ([]Segment, error) {
+	var stale []Segment
+	var records []*Record
+	for _, rec := range d.Records {
+		if !names[rec.Name] {
+			records = append(records, rec)
+			continue
+		}
+
+		end, err := rec.end(r)
+		if err != nil {
+			return nil, err
+		}
+		if end > d.Offset {
+			return nil, fmt.Errorf("data of %s past the central directory: %d", rec.Name, end)
+		}
+		log.Debug("drop stale entry", "phase", PhaseBuild, "name", rec.Name, "bytes", end-rec.Offset)
+		stale = append(stale, Segment{Offset: rec.Offset, Size: end - rec.Offset})
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Offset < stale[j].Offset
+	})
+
+	var segments []Segment
+	start, removed := int64(0), int64(0)
+	for _, s := range stale {
+		if s.Offset > start {
+			segments = append(segments, Segment{Offset: start, Size: s.Offset - start})
+		}
+		start = s.Offset + s.Size
+		removed += s.Size
+	}
+	if start < d.Offset {
+		segments = append(segments, Segment{Offset: start, Size: d.Offset - start})
+	}
+
+	for _, rec := range records {
+		shift := int64(0)
+		for _, s := range stale {
+			if s.Offset < rec.Offset {
+				shift += s.Size
+			}
+		}
+		if shift > 0 {
+			if err := rec.setOffset(rec.Offset - shift); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	d.Offset -= removed
+	d.Records = records
+	return segments, nil
+}
+
+// indexExtra returns the start and size of the data of the extra field
+// with the given id, or -1 if not found
+func indexExtra(extra []byte, id uint16) (int, int) {
+	p := 0
+	for p+4 <= len(extra) {
+		tag := binary.LittleEndian.Uint16(extra[p:])
+		size := int(binary.LittleEndian.Uint16(extra[p+2:]))
+		if p+4+size > len(extra) {
+			break
+		}
+		if tag == id {
+			return p + 4, size
+		}
+		p += 4 + size
+	}
+	return -1, 0
+}
+
+// Appender appends entries at the offset of the central directory, which
+// it writes again on Close
+type Appender struct {
+	PageAlign int64 // align the data of stored entries, 0 to disable
+	Level     int   // flate compression level of deflated entries
+
+	w       *countWriter
+	comment string
+	records []*Record
+	names   map[string]int
+	closed  bool
+}
+
+// Append returns an Appender writing to w, which must be positioned at
+// d.Offset of the archive
+func (d *Directory) Append(w io.Writer) *Appender {
+	a := &Appender{
+		Level:   defaultLevel,
+		w:       &countWriter{w: w, count: d.Offset},
+		comment: d.Comment,
+		records: make([]*Record, len(d.Records)),
+		names:   make(map[string]int),
+	}
+	for i, rec := range d.Records {
+		a.records[i] = rec
+		a.names[rec.Name] = i
+	}
+	return a
+}
+
+// WriteEntry appends a file with the given content. fh.Method selects
+// between zip.Store and zip.Deflate; sizes and checksum are filled in.
+func (a *Appender) WriteEntry(fh *zip.FileHeader, content []byte) error {
+	if a.closed {
+		return fmt.Errorf("write to closed appender")
+	}
+
+	data := content
+	switch fh.Method {
+	case zip.Store:
+	case zip.Deflate:
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, a.Level)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(content); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	default:
+		return zip.ErrAlgorithm
+	}
+
+	fh.Flags &^= 0x8 // sizes are known, no data descriptor
+	if !isASCII(fh.Name) && utf8.ValidString(fh.Name) {
+		fh.Flags |= 0x800 // name is utf-8
+	}
+	// zip64 and alignment fields inherited from an old entry are rebuilt
+	fh.Extra = removeExtra(fh.Extra, zip64ExtraID, alignExtraID)
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20
+	fh.ReaderVersion = zipVersion20
+	fh.CRC32 = crc32.ChecksumIEEE(content)
+	fh.CompressedSize64 = uint64(len(data))
+	fh.UncompressedSize64 = uint64(len(content))
+
+	offset := a.w.count
+	extra := fh.Extra
+	zip64 := fh.CompressedSize64 >= uint32max || fh.UncompressedSize64 >= uint32max
+	if zip64 {
+		fh.ReaderVersion = zipVersion45
+		var eb [20]byte
+		b := writeBuf(eb[:])
+		b.uint16(zip64ExtraID)
+		b.uint16(16)
+		b.uint64(fh.UncompressedSize64)
+		b.uint64(fh.CompressedSize64)
+		extra = append(extra[:len(extra):len(extra)], eb[:]...)
+	}
+	if fh.Method == zip.Store && a.PageAlign != 0 {
+		if err := checkPageAlign(a.PageAlign); err != nil {
+			return fmt.Errorf("page align: %v", err)
+		}
+		extra = alignExtra(extra, offset+fileHeaderLen+int64(len(fh.Name)), a.PageAlign)
+	}
+	if len(extra) > uint16max {
+		return fmt.Errorf("%s: extra fields too long: %d bytes", fh.Name, len(extra))
+	}
+
+	var buf [fileHeaderLen]byte
+	b := writeBuf(buf[:])
+	b.uint32(fileHeaderSignature)
+	b.uint16(fh.ReaderVersion)
+	b.uint16(fh.Flags)
+	b.uint16(fh.Method)
+	b.uint16(fh.ModifiedTime)
+	b.uint16(fh.ModifiedDate)
+	b.uint32(fh.CRC32)
+	if zip64 {
+		b.uint32(uint32max)
+		b.uint32(uint32max)
+	} else {
+		b.uint32(uint32(fh.CompressedSize64))
+		b.uint32(uint32(fh.UncompressedSize64))
+	}
+	b.uint16(uint16(len(fh.Name)))
+	b.uint16(uint16(len(extra)))
+	for _, p := range [][]byte{buf[:], []byte(fh.Name), extra, data} {
+		if _, err := a.w.Write(p); err != nil {
+			return err
+		}
+	}
+
+	rec := &Record{
+		Name:   fh.Name,
+		Offset: offset,
+		header: fh,
+	}
+	if i, ok := a.names[fh.Name]; ok {
+		a.records[i] = nil
+	}
+	a.names[fh.Name] = len(a.records)
+	a.records = append(a.records, rec)
+	return nil
+}
+
+// checkPageAlign checks that align is 0 or a power of two that fits the
+// 16 bits of the alignment field
+func checkPageAlign(align int64) error {
+	if align < 0 || align > uint16max || align&(align-1) != 0 {
+		return fmt.Errorf("expect 0 or a power of two up to 32768: %d", align)
+	}
+	return nil
+}
+
+// Appended returns the names of the entries written by WriteEntry
+func (a *Appender) Appended() []string {
+	var names []string
+	for _, rec := range a.records {
+		if rec != nil && rec.header != nil {
+			names = append(names, rec.Name)
+		}
+	}
+	return names
+}
+
+// removeExtra returns extra without the fields of the given ids
+func removeExtra(extra []byte, ids ...uint16) []byte {
+	var kept []byte
+	p := 0
+	for p+4 <= len(extra) {
+		tag := binary.LittleEndian.Uint16(extra[p:])
+		size := int(binary.LittleEndian.Uint16(extra[p+2:]))
+		if p+4+size > len(extra) {
+			break
+		}
+		keep := true
+		for _, id := range ids {
+			keep = keep && tag != id
+		}
+		if keep {
+			kept = append(kept, extra[p:p+4+size]...)
+		}
+		p += 4 + size
+	}
+	return kept
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// alignExtra appends an alignment extra field to extra, padded so that the
+// data following a local header extra at offset starts on a multiple of align
+func alignExtra(extra []byte, offset, align int64) []byte {
+	start := offset + int64(len(extra)) + 6 // id, size, alignment
+	pad := (align - start%align) % align
+
+	field := make([]byte, 6+pad)
+	b := writeBuf(field)
+	b.uint16(alignExtraID)
+	b.uint16(uint16(2 + pad))
+	b.uint16(uint16(align))
+	return append(extra[:len(extra):len(extra)], field...)
+}
+
+// Close writes the central directory and the end of central directory
+func (a *Appender) Close() error {
+	if a.closed {
+		return fmt.Errorf("appender closed twice")
+	}
+	a.closed = true
+	if len(a.comment) > maxCommentLen {
+		return fmt.Errorf("archive comment too long: %d bytes", len(a.comment))
+	}
+
+	start := a.w.count
+	records := uint64(0)
+	for _, rec := range a.records {
+		if rec == nil {
+			continue
+		}
+		records++
+		raw := rec.raw
+		if raw == nil {
+			raw = directoryRecord(rec.header, rec.Offset)
+		}
+		if _, err := a.w.Write(raw); err != nil {
+			return err
+		}
+	}
+	end := a.w.count
+
+	size := uint64(end - start)
+	offset := uint64(start)
+	if records >= uint16max || size >= uint32max || offset >= uint32max {
+		var buf [directory64EndLen + directory64LocLen]byte
+		b := writeBuf(buf[:])
+		b.uint32(directory64EndSignature)
+		b.uint64(directory64EndLen - 12)
+		b.uint16(zipVersion45)
+		b.uint16(zipVersion45)
+		b.uint32(0)
+		b.uint32(0)
+		b.uint64(records)
+		b.uint64(records)
+		b.uint64(size)
+		b.uint64(offset)
+
+		b.uint32(directory64LocSignature)
+		b.uint32(0)
+		b.uint64(uint64(end))
+		b.uint32(1)
+		if _, err := a.w.Write(buf[:]); err != nil {
+			return err
+		}
+
+		records = uint16max
+		size = uint32max
+		offset = uint32max
+	}
+
+	var buf [directoryEndLen]byte
+	b := writeBuf(buf[:])
+	b.uint32(directoryEndSignature)
+	b.uint16(0)
+	b.uint16(0)
+	b.uint16(uint16(records))
+	b.uint16(uint16(records))
+	b.uint32(uint32(size))
+	b.uint32(uint32(offset))
+	b.uint16(uint16(len(a.comment)))
+	if _, err := a.w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := io.WriteString(a.w, a.comment)
+	return err
+}
+
+// directoryRecord builds the central directory record of an appended entry
+func directoryRecord(fh *zip.FileHeader, offset int64) []byte {
+	extra := fh.Extra
+	version := fh.ReaderVersion
+	zip64 := fh.CompressedSize64 >= uint32max || fh.UncompressedSize64 >= uint32max ||
+		offset >= uint32max
+	if zip64 {
+		// with the zip64 extra, even if only the offset needs it
+		version = zipVersion45
+		var eb [28]byte
+		b := writeBuf(eb[:])
+		b.uint16(zip64ExtraID)
+		b.uint16(24)
+		b.uint64(fh.UncompressedSize64)
+		b.uint64(fh.CompressedSize64)
+		b.uint64(uint64(offset))
+		extra = append(extra[:len(extra):len(extra)], eb[:]...)
+	}
+
+	buf := make([]byte, directoryHeaderLen+len(fh.Name)+len(extra)+len(fh.Comment))
+	b := writeBuf(buf)
+	b.uint32(directoryHeaderSignature)
+	b.uint16(fh.CreatorVersion)
+	b.uint16(version)
+	b.uint16(fh.Flags)
+	b.uint16(fh.Method)
+	b.uint16(fh.ModifiedTime)
+	b.uint16(fh.ModifiedDate)
+	b.uint32(fh.CRC32)
+	if zip64 {
+		b.uint32(uint32max)
+		b.uint32(uint32max)
+	} else {
+		b.uint32(uint32(fh.CompressedSize64))
+		b.uint32(uint32(fh.UncompressedSize64))
+	}
+	b.uint16(uint16(len(fh.Name)))
+	b.uint16(uint16(len(extra)))
+	b.uint16(uint16(len(fh.Comment)))
+	b.uint16(0) // disk number start
+	b.uint16(0) // internal file attributes
+	b.uint32(fh.ExternalAttrs)
+	if zip64 {
+		b.uint32(uint32max)
+	} else {
+		b.uint32(uint32(offset))
+	}
+	copy(b, fh.Name)
+	copy(b[len(fh.Name):], extra)
+	copy(b[len(fh.Name)+len(extra):], fh.Comment)
+	return buf
+}
+
+type countWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+type writeBuf []byte
+
+func (b *writeBuf) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(*b, v)
+	*b = (*b)[2:]
+}
+
+func (b *writeBuf) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(*b, v)
+	*b = (*b)[4:]
+}
+
+func (b *writeBuf) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(*b, v)
+	*b = (*b)[8:]
+}
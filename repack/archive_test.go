@@ -0,0 +1,294 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestCheckPageAlign(t *testing.T) {
+	tests := []struct {
+		align int64
+		ok    bool
+	}{
+		{0, true},
+		{1, true},
+		{4, true},
+		{16384, true},
+		{32768, true},
+		{-4096, false},
+		{3, false},
+		{12288, false},
+		{65535, false},
+		{65536, false},
+		{1 << 20, false},
+	}
+	for _, tt := range tests {
+		if err := checkPageAlign(tt.align); (err == nil) != tt.ok {
+			t.Errorf("checkPageAlign(%d) = %v, want ok %v", tt.align, err, tt.ok)
+		}
+	}
+}
+
+func TestAlignExtra(t *testing.T) {
+	tests := []struct {
+		extra  int
+		offset int64
+		align  int64
+	}{
+		{0, 0, 4},
+		{0, 30 + 7, 4},
+		{20, 30 + 11, 4096},
+		{0, 1<<32 + 30 + 3, 16384},
+		{9, 30 + 1, 32768},
+		{0, 32768 - 6, 32768}, // no padding
+	}
+	for _, tt := range tests {
+		extra := alignExtra(make([]byte, tt.extra), tt.offset, tt.align)
+		if (tt.offset+int64(len(extra)))%tt.align != 0 {
+			t.Errorf("%+v: data at %d", tt, tt.offset+int64(len(extra)))
+		}
+		field := extra[tt.extra:]
+		if id := binary.LittleEndian.Uint16(field); id != alignExtraID {
+			t.Errorf("%+v: field id %#x", tt, id)
+		}
+		if n := binary.LittleEndian.Uint16(field[2:]); int(n) != len(field)-4 {
+			t.Errorf("%+v: field size %d, want %d", tt, n, len(field)-4)
+		}
+		if align := binary.LittleEndian.Uint16(field[4:]); int64(align) != tt.align {
+			t.Errorf("%+v: field alignment %d", tt, align)
+		}
+	}
+}
+
+func TestAppenderPageAlign(t *testing.T) {
+	var src bytes.Buffer
+	w := stdzip.NewWriter(&src)
+	for _, name := range []string{"classes.dex", "res/a.png"} {
+		f, _ := w.CreateHeader(&stdzip.FileHeader{Name: name, Method: stdzip.Store})
+		f.Write([]byte(name))
+	}
+	w.Close()
+
+	tests := []struct {
+		align int64
+		ok    bool
+	}{
+		{0, true},
+		{4, true},
+		{16384, true},
+		{32768, true},
+		{-4096, false},
+		{12288, false},
+		{65536, false}, // doesn't fit the alignment field
+	}
+	for _, tt := range tests {
+		d, err := ReadDirectory(bytes.NewReader(src.Bytes()), int64(src.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		out.Write(src.Bytes()[:d.Offset])
+		a := d.Append(&out)
+		a.PageAlign = tt.align
+		err = a.WriteEntry(&zip.FileHeader{Name: "lib/arm64-v8a/libx.so", Method: zip.Store}, []byte("elf"))
+		if err == nil {
+			err = a.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("align %d: %v, want ok %v", tt.align, err, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+
+		r, err := stdzip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		if err != nil {
+			t.Fatalf("align %d: %v", tt.align, err)
+		}
+		f := r.File[len(r.File)-1]
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatalf("align %d: %v", tt.align, err)
+		}
+		if tt.align > 0 && offset%tt.align != 0 {
+			t.Errorf("align %d: data at %d", tt.align, offset)
+		}
+		if tt.align > 0 {
+			// the field of zipalign: id, size, alignment and padding
+			name := bytes.Index(out.Bytes(), []byte(f.Name))
+			extraLen := int64(binary.LittleEndian.Uint16(out.Bytes()[name-2:]))
+			extra := out.Bytes()[offset-extraLen : offset]
+			if id, align := binary.LittleEndian.Uint16(extra), binary.LittleEndian.Uint16(extra[4:]); id != alignExtraID || int64(align) != tt.align {
+				t.Errorf("align %d: extra field %#x of alignment %d", tt.align, id, align)
+			}
+		}
+	}
+}
+
+func TestDirectoryRemove(t *testing.T) {
+	names := []string{"AndroidManifest.xml", "META-INF/CERT.SF", "classes.dex", "cpid", "res/a.png"}
+	var src bytes.Buffer
+	w := stdzip.NewWriter(&src)
+	for _, name := range names {
+		f, _ := w.Create(name)
+		f.Write(bytes.Repeat([]byte(name), 10))
+	}
+	w.Close()
+
+	tests := []struct {
+		name   string
+		remove []string
+	}{
+		{"none", nil},
+		{"first", []string{"AndroidManifest.xml"}},
+		{"stale signature and cpid", []string{"META-INF/CERT.SF", "cpid"}},
+		{"last", []string{"res/a.png"}},
+		{"unknown", []string{"META-INF/CERT.RSA"}},
+	}
+	for _, tt := range tests {
+		d, err := ReadDirectory(bytes.NewReader(src.Bytes()), int64(src.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remove := make(map[string]bool)
+		for _, name := range tt.remove {
+			remove[name] = true
+		}
+		segments, err := d.Remove(bytes.NewReader(src.Bytes()), remove, slog.Default())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var out bytes.Buffer
+		for _, s := range segments {
+			out.Write(src.Bytes()[s.Offset : s.Offset+s.Size])
+		}
+		if int64(out.Len()) != d.Offset {
+			t.Fatalf("%s: %d bytes kept, directory at %d", tt.name, out.Len(), d.Offset)
+		}
+		if err := d.Append(&out).Close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		r, err := stdzip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, f := range r.File {
+			got = append(got, f.Name)
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("%s: %s: %v", tt.name, f.Name, err)
+			}
+			buf, err := ioutil.ReadAll(rc)
+			if err != nil || !bytes.Equal(buf, bytes.Repeat([]byte(f.Name), 10)) {
+				t.Errorf("%s: %s: %q, %v", tt.name, f.Name, buf, err)
+			}
+		}
+		var want []string
+		for _, name := range names {
+			if !remove[name] {
+				want = append(want, name)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: entries %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+// sparseArchive is an archive of zeros up to the bytes of its tail
+type sparseArchive struct {
+	base int64
+	tail []byte
+}
+
+func (s sparseArchive) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		switch pos := off + int64(i); {
+		case pos < s.base:
+			p[i] = 0
+		case pos-s.base < int64(len(s.tail)):
+			p[i] = s.tail[pos-s.base]
+		default:
+			return i, io.EOF
+		}
+	}
+	return len(p), nil
+}
+
+func TestReadDirectoryZip64(t *testing.T) {
+	// an entry appended past 4GB, so only its offset needs zip64
+	const base = 5 << 30
+	var buf bytes.Buffer
+	a := (&Directory{Offset: base}).Append(&buf)
+	if err := a.WriteEntry(&zip.FileHeader{Name: "a", Method: zip.Store}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tail := buf.Bytes()
+	localLen := fileHeaderLen + 1 + 1
+	end64 := len(tail) - directoryEndLen - directory64LocLen - directory64EndLen
+	loc := end64 + directory64EndLen
+	le := binary.LittleEndian
+
+	tests := []struct {
+		name   string
+		change func(tail []byte)
+		ok     bool
+	}{
+		{"valid", func([]byte) {}, true},
+		{"directory over the zip64 end record", func(b []byte) { le.PutUint64(b[end64+40:], le.Uint64(b[end64+40:])+1) }, false},
+		{"directory past the end", func(b []byte) { le.PutUint64(b[end64+48:], 1<<40) }, false},
+		{"size wrapping around", func(b []byte) { le.PutUint64(b[end64+40:], math.MaxUint64-10) }, false},
+		{"no records", func(b []byte) { le.PutUint64(b[end64+32:], 0) }, false},
+		{"records over 16 bits", func(b []byte) { le.PutUint64(b[end64+32:], 1<<16+1) }, false},
+		{"zip64 end record past the locator", func(b []byte) { le.PutUint64(b[loc+8:], le.Uint64(b[loc+8:])+8) }, false},
+		{"zip64 end record offset wrapping around", func(b []byte) { le.PutUint64(b[loc+8:], math.MaxUint64-4) }, false},
+		{"local header in the directory", func(b []byte) { le.PutUint64(b[localLen+directoryHeaderLen+1+20:], base+uint64(localLen)) }, false},
+		{"negative local header offset", func(b []byte) { le.PutUint64(b[localLen+directoryHeaderLen+1+20:], 1<<63) }, false},
+	}
+	for _, tt := range tests {
+		b := append([]byte(nil), tail...)
+		tt.change(b)
+		d, err := ReadDirectory(sparseArchive{base, b}, base+int64(len(b)))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+		if d.Offset != base+int64(localLen) || len(d.Records) != 1 || d.Records[0].Offset != base {
+			t.Fatalf("%s: directory at %d, records %+v", tt.name, d.Offset, d.Records)
+		}
+		if version := le.Uint16(d.Records[0].raw[6:]); version != zipVersion45 {
+			t.Errorf("%s: version needed %d with a zip64 extra, want 45", tt.name, version)
+		}
+	}
+}
+
+func TestDirectoryClone(t *testing.T) {
+	src := zipOf("classes.dex", "dex", "cpid", "c0")
+	d, err := ReadDirectory(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := d.Clone()
+	c.Comment = "c1"
+	c.Records[0].raw[0] = 0
+	c.Records = c.Records[:1]
+	if d.Comment != "" || len(d.Records) != 2 || binary.LittleEndian.Uint32(d.Records[0].raw) != directoryHeaderSignature {
+		t.Errorf("directory changed with its clone: %q, %d records", d.Comment, len(d.Records))
+	}
+}
@@ -0,0 +1,88 @@
+package repack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// modes of -signature-artifacts, what to do with the signature artifacts of
+// the source that the new signature invalidates without replacing them
+const (
+	ArtifactsWarn = "warn" // keep them as is and log a warning, the default
+	ArtifactsKeep = "keep" // keep them as is
+	ArtifactsDrop = "drop" // remove them, and their sections of the manifest
+	ArtifactsFail = "fail" // fail the job
+)
+
+// signatureArtifacts returns the entries of META-INF of other signers, tools
+// and source stamps the new signature invalidates, but those of skip
+func (p *packer) signatureArtifacts(r *zip.Reader, skip map[string]bool) []string {
+	stale := p.staleEntries()
+	var names []string
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, MetaInfoPath)
+		if !strings.HasPrefix(f.Name, MetaInfoPath) || strings.Contains(name, "/") || stale[f.Name] || skip[f.Name] {
+			continue
+		}
+		upper := strings.ToUpper(name)
+		if isV1File(upper) || strings.HasPrefix(upper, "SOURCESTAMP") || upper == "STAMP-CERT-SHA256" {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// isV1File reports whether name, in upper case and without META-INF/, is a
+// file of v1 signatures
+func isV1File(name string) bool {
+	return isSignatureFile(name) || strings.HasPrefix(name, "SIG-")
+}
+
+// v1Files returns MANIFEST.MF and the v1 signature files of every signer
+// of r, removed from the dests signed without v1
+func v1Files(r *zip.Reader) map[string]bool {
+	names := map[string]bool{}
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, MetaInfoPath)
+		if f.Name == ManifestPath || strings.HasPrefix(f.Name, MetaInfoPath) && !strings.Contains(name, "/") && isV1File(strings.ToUpper(name)) {
+			names[f.Name] = true
+		}
+	}
+	return names
+}
+
+// checkArtifacts handles the signature artifacts of r as SignatureArtifacts
+// says, and returns the entries to drop, with the v1 files if signed without v1
+func (p *packer) checkArtifacts(r *zip.Reader) (map[string]bool, error) {
+	mode := p.SignatureArtifacts
+	if mode == "" {
+		mode = ArtifactsWarn
+	}
+	switch mode {
+	case ArtifactsWarn, ArtifactsKeep, ArtifactsDrop, ArtifactsFail:
+	default:
+		return nil, errorOf(KindConfig, fmt.Errorf("unknown -signature-artifacts: %s", mode))
+	}
+	drop := map[string]bool{}
+	if !p.schemes.v1 {
+		drop = v1Files(r)
+	}
+	names := p.signatureArtifacts(r, drop)
+	if len(names) == 0 {
+		return drop, nil
+	}
+	switch mode {
+	case ArtifactsWarn:
+		p.log().Warn("signature artifacts invalidated by the new signature, kept as is", "phase", PhaseBuild, "entries", names)
+	case ArtifactsFail:
+		return nil, errorOf(KindSource, fmt.Errorf("signature artifacts the new signature invalidates: %s", strings.Join(names, ", ")))
+	case ArtifactsDrop:
+		p.log().Info("drop signature artifacts", "phase", PhaseBuild, "entries", names)
+		for _, name := range names {
+			drop[name] = true
+		}
+	}
+	return drop, nil
+}
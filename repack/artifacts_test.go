@@ -0,0 +1,53 @@
+package repack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestCheckArtifacts(t *testing.T) {
+	apk := zipOf(
+		ManifestPath, "m",
+		"META-INF/CERT.SF", "own",
+		"META-INF/CERT.RSA", "own",
+		"META-INF/OTHER.SF", "other",
+		"META-INF/OTHER.EC", "other",
+		"META-INF/SIG-TOOL", "tool",
+		"META-INF/SOURCESTAMP.SF", "stamp",
+		"META-INF/stamp-cert-sha256", "stamp",
+		"META-INF/services/a.b.C", "service",
+		"classes.dex", "dex",
+	)
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packer{Options: DefaultOptions()}
+	p.SigFileName, p.schemes = "CERT", schemes{v1: true, v2: true}
+	p.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	want := "META-INF/OTHER.SF,META-INF/OTHER.EC,META-INF/SIG-TOOL,META-INF/SOURCESTAMP.SF,META-INF/stamp-cert-sha256"
+	if names := p.signatureArtifacts(r, nil); strings.Join(names, ",") != want {
+		t.Errorf("artifacts %v", names)
+	}
+
+	for mode, wantDrop := range map[string]int{"": 0, ArtifactsWarn: 0, ArtifactsKeep: 0, ArtifactsDrop: 5} {
+		p.SignatureArtifacts = mode
+		drop, err := p.checkArtifacts(r)
+		if err != nil || len(drop) != wantDrop {
+			t.Errorf("%s: drop %v, %v", mode, drop, err)
+		}
+	}
+	p.SignatureArtifacts = ArtifactsFail
+	if _, err := p.checkArtifacts(r); KindOf(err) != KindSource || !strings.Contains(err.Error(), "SIG-TOOL") {
+		t.Errorf("fail: %v", err)
+	}
+	p.SignatureArtifacts = "ignore"
+	if _, err := p.checkArtifacts(r); KindOf(err) != KindConfig {
+		t.Errorf("unknown mode: %v", err)
+	}
+}
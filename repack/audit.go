@@ -0,0 +1,79 @@
+package repack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// AuditRecord is the record of a dest apk written, for the audit log of a
+// signing service. It names the key but never holds it.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	JobID         string    `json:"job_id,omitempty"`
+	Caller        string    `json:"caller,omitempty"` // who asked for the job
+	Source        string    `json:"source"`
+	SourceVersion string    `json:"source_version,omitempty"`
+	SourceCRC64   string    `json:"source_crc64,omitempty"`
+	Dest          string    `json:"dest"`
+	DestVersion   string    `json:"dest_version,omitempty"`
+	DestETag      string    `json:"dest_etag,omitempty"`
+	DestCRC64     string    `json:"dest_crc64,omitempty"`
+	DestSHA256    string    `json:"dest_sha256,omitempty"` // with Checksums or SHA256
+	Package       string    `json:"package,omitempty"`
+	VersionCode   int64     `json:"version_code,omitempty"`
+	Channel       string    `json:"channel,omitempty"`
+	CPIDSHA256    string    `json:"cpid_sha256"`
+	Signed        bool      `json:"signed"`           // signed again, or only the cpid added
+	Signer        string    `json:"signer,omitempty"` // where the key is from, like key_secret:name
+	CertSHA256    string    `json:"cert_sha256,omitempty"`
+}
+
+// audit passes the record of the dest of result to Audit
+func (p *packer) audit(channel string, result Result) error {
+	if p.Audit == nil {
+		return nil
+	}
+	cpid := sha256.Sum256([]byte(result.CPID))
+	record := AuditRecord{
+		Time:          time.Now().UTC(),
+		JobID:         p.JobID,
+		Caller:        p.Caller,
+		Source:        p.SourceAPK,
+		SourceVersion: result.SourceVersion,
+		SourceCRC64:   result.SourceCRC64,
+		Dest:          result.Dest,
+		DestVersion:   result.VersionID,
+		DestETag:      result.ETag,
+		DestCRC64:     result.CRC64,
+		DestSHA256:    result.SHA256,
+		Channel:       channel,
+		CPIDSHA256:    hex.EncodeToString(cpid[:]),
+		Signed:        result.CertSHA256 != "",
+		CertSHA256:    result.CertSHA256,
+	}
+	if result.Info != nil {
+		record.Package, record.VersionCode = result.Info.PackageName, result.Info.VersionCode
+	}
+	if record.Signed {
+		record.Signer = p.signer()
+	}
+	if err := p.Audit(record); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	return nil
+}
+
+// signer describes where the key of the job is from, without the key: the
+// secret or file of the key, or the sha-256 of a KMS blob
+func (p *packer) signer() string {
+	switch {
+	case p.KeySecretName != "":
+		return "key_secret:" + p.KeySecretName
+	case p.PrivateKeyBlob != "":
+		sum := sha256.Sum256([]byte(p.PrivateKeyBlob))
+		return "priv_blob:" + hex.EncodeToString(sum[:8])
+	}
+	return "priv_pem:" + p.PrivateKeyPEM
+}
@@ -0,0 +1,84 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, dir)
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	opts.JobID, opts.Caller = "job 1", "cli:me"
+	var mu sync.Mutex
+	var records []AuditRecord
+	opts.Audit = func(r AuditRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, r)
+		return nil
+	}
+
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("%d records", len(records))
+	}
+	r := records[0]
+	if r.JobID != "job 1" || r.Caller != "cli:me" || r.Dest != "bucket/b.apk" || !r.Signed || r.CertSHA256 == "" ||
+		r.Signer != "priv_pem:"+opts.PrivateKeyPEM || len(r.CPIDSHA256) != 64 || strings.Contains(r.CPIDSHA256, "c1") {
+		t.Errorf("record %+v", r)
+	}
+
+	// a record of each channel, and a failed record fails its dest
+	channels := filepath.Join(dir, "channels.txt")
+	ioutil.WriteFile(channels, []byte("huawei\nxiaomi\n"), 0644)
+	opts.Channels, opts.CPIDContent, opts.DestAPK = channels, "{{.Channel}}", "bucket/{{.Channel}}.apk"
+	records = nil
+	opts.Audit = func(r AuditRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, r)
+		if r.Channel == "xiaomi" {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	_, err := RepackChannels(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 channels failed: xiaomi") {
+		t.Errorf("error %v", err)
+	}
+	var dests []string
+	for _, r := range records {
+		dests = append(dests, r.Channel+" "+r.Dest)
+	}
+	sort.Strings(dests)
+	if strings.Join(dests, ",") != "huawei bucket/huawei.apk,xiaomi bucket/xiaomi.apk" {
+		t.Errorf("records of %v", dests)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	p := &packer{Options: Options{PrivateKeyPEM: "oss://bucket/key.pem", PrivateKeyBlob: "blob"}}
+	if s := p.signer(); !strings.HasPrefix(s, "priv_blob:") || strings.Contains(s, "blob:blob") {
+		t.Errorf("signer %s", s)
+	}
+	p.KeySecretName = "games/key"
+	if s := p.signer(); s != "key_secret:games/key" {
+		t.Errorf("signer %s", s)
+	}
+}
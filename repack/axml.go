@@ -0,0 +1,667 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// binary xml consts ...
+const (
+	AndroidManifestPath = "AndroidManifest.xml"
+	AndroidNamespace    = "http://schemas.android.com/apk/res/android"
+
+	resStringPoolType    = 0x0001
+	resXMLType           = 0x0003
+	resXMLStartNamespace = 0x0100
+	resXMLEndNamespace   = 0x0101
+	resXMLStartElement   = 0x0102
+	resXMLEndElement     = 0x0103
+	resXMLCDATA          = 0x0104
+	resXMLResourceMap    = 0x0180
+	resStringPoolUTF8    = 1 << 8
+	resValueTypeString   = 0x03
+	resValueTypeRef      = 0x01
+	resValueTypeIntBool  = 0x12
+	noIndex              = 0xffffffff
+	attrName             = 0x01010003
+	attrValue            = 0x01010024
+	attrVersionCode      = 0x0101021b
+	attrVersionName      = 0x0101021c
+	attrMinSdkVersion    = 0x0101020c
+	attrTargetSdkVersion = 0x01010270
+	chunkHeaderLen       = 8
+	nodeHeaderLen        = 16
+	attrExtLen           = 20
+	endElementLen        = nodeHeaderLen + 8
+	namespaceLen         = nodeHeaderLen + 8
+	cdataLen             = nodeHeaderLen + 12
+	xmlAttributeLen      = 20
+	stringPoolHeaderSize = 28
+	resValueSize         = 8
+	maxUTF8StringLen     = 0x7fff
+)
+
+// ApkInfo is the package info from AndroidManifest.xml
+type ApkInfo struct {
+	PackageName string
+	VersionCode int64
+	VersionName string
+	MinSdk      int64
+	TargetSdk   int64 // MinSdk if not set
+}
+
+func (i ApkInfo) String() string {
+	buf, _ := json.Marshal(i)
+	return string(buf)
+}
+
+// axmlDoc is a binary xml document, its first strings are the resource mapped
+// attribute names
+type axmlDoc struct {
+	utf8    bool
+	strings []string
+	resMap  []uint32
+	nodes   []*axmlNode
+}
+
+// axmlNode is a chunk of the xml tree. For namespaces NS and Name are the
+// prefix and the uri, for cdata Name is the data.
+type axmlNode struct {
+	Type    uint16
+	Line    uint32
+	Comment uint32
+	NS      uint32
+	Name    uint32
+	Attrs   []*axmlAttr
+
+	// start element
+	IDIndex    uint16
+	ClassIndex uint16
+	StyleIndex uint16
+
+	// cdata typed value
+	ValueType uint8
+	ValueData uint32
+
+	raw []byte // chunk of other types, kept as is
+}
+
+// axmlAttr is an attribute of a start element
+type axmlAttr struct {
+	NS   uint32
+	Name uint32
+	Raw  uint32
+	Type uint8
+	Data uint32
+}
+
+// readApkInfo reads AndroidManifest.xml from r and parses the package info
+func readApkInfo(r *zip.Reader) (*ApkInfo, error) {
+	buf, err := readAndroidManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseApkInfo(buf)
+}
+
+// readAndroidManifest reads the binary AndroidManifest.xml from r
+func readAndroidManifest(r *zip.Reader) ([]byte, error) {
+	f := findFile(r, AndroidManifestPath)
+	if f == nil {
+		return nil, fmt.Errorf("%s not found", AndroidManifestPath)
+	}
+
+	return readEntry(f)
+}
+
+// parseApkInfo parses the package info from binary AndroidManifest.xml
+func parseApkInfo(buf []byte) (*ApkInfo, error) {
+	d, err := parseAXML(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ApkInfo{}
+	for _, n := range d.nodes {
+		if n.Type != resXMLStartElement {
+			continue
+		}
+		switch d.str(n.Name) {
+		case "manifest":
+			for _, a := range n.Attrs {
+				switch {
+				case d.str(a.Name) == "package":
+					info.PackageName = d.value(a)
+				case d.is(a, attrVersionCode, "versionCode"):
+					info.VersionCode = int64(a.Data)
+				case d.is(a, attrVersionName, "versionName"):
+					info.VersionName = d.value(a)
+				}
+			}
+		case "uses-sdk":
+			for _, a := range n.Attrs {
+				switch {
+				case d.is(a, attrMinSdkVersion, "minSdkVersion"):
+					info.MinSdk = int64(a.Data)
+				case d.is(a, attrTargetSdkVersion, "targetSdkVersion"):
+					info.TargetSdk = int64(a.Data)
+				}
+			}
+		}
+	}
+	if info.TargetSdk == 0 {
+		info.TargetSdk = info.MinSdk
+	}
+
+	if info.PackageName == "" {
+		return nil, fmt.Errorf("package name not found")
+	}
+	return info, nil
+}
+
+// str returns the string at index i of the string pool
+func (d *axmlDoc) str(i uint32) string {
+	if i == noIndex || int(i) >= len(d.strings) {
+		return ""
+	}
+	return d.strings[i]
+}
+
+// is reports whether a is the android attribute of the resource id, or
+// has the name when the resource map doesn't tell
+func (d *axmlDoc) is(a *axmlAttr, resID uint32, name string) bool {
+	if int(a.Name) < len(d.resMap) {
+		return d.resMap[a.Name] == resID
+	}
+	return d.str(a.Name) == name
+}
+
+// value returns the attribute value as a string
+func (d *axmlDoc) value(a *axmlAttr) string {
+	switch a.Type {
+	case resValueTypeString:
+		if a.Raw != noIndex {
+			return d.str(a.Raw)
+		}
+		return d.str(a.Data)
+	case resValueTypeRef:
+		return fmt.Sprintf("@0x%08x", a.Data)
+	case resValueTypeIntBool:
+		return fmt.Sprintf("%t", a.Data != 0)
+	default:
+		if a.Raw != noIndex {
+			return d.str(a.Raw)
+		}
+		return fmt.Sprintf("%d", a.Data)
+	}
+}
+
+// parseAXML parses a binary xml document
+func parseAXML(buf []byte) (*axmlDoc, error) {
+	if len(buf) < chunkHeaderLen || binary.LittleEndian.Uint16(buf) != resXMLType {
+		return nil, fmt.Errorf("not a binary xml")
+	}
+	headerSize := int(binary.LittleEndian.Uint16(buf[2:]))
+	size := int(binary.LittleEndian.Uint32(buf[4:]))
+	if size > len(buf) || headerSize > size {
+		return nil, fmt.Errorf("truncated binary xml")
+	}
+
+	d := &axmlDoc{}
+	for p := headerSize; p+chunkHeaderLen <= size; {
+		chunkType := binary.LittleEndian.Uint16(buf[p:])
+		chunkSize := int(binary.LittleEndian.Uint32(buf[p+4:]))
+		if chunkSize < chunkHeaderLen || p+chunkSize > size {
+			return nil, fmt.Errorf("invalid chunk at %d", p)
+		}
+		chunk := buf[p : p+chunkSize]
+
+		switch chunkType {
+		case resStringPoolType:
+			if err := d.parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case resXMLResourceMap:
+			chunkHeaderSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+			for i := chunkHeaderSize; i+4 <= len(chunk); i += 4 {
+				d.resMap = append(d.resMap, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		default:
+			n, err := parseNode(chunk)
+			if err != nil {
+				return nil, err
+			}
+			d.nodes = append(d.nodes, n)
+		}
+		p += chunkSize
+	}
+	return d, nil
+}
+
+// parseNode parses a chunk of the xml tree
+func parseNode(chunk []byte) (*axmlNode, error) {
+	n := &axmlNode{
+		Type: binary.LittleEndian.Uint16(chunk),
+	}
+	minLen := map[uint16]int{
+		resXMLStartNamespace: namespaceLen,
+		resXMLEndNamespace:   namespaceLen,
+		resXMLStartElement:   nodeHeaderLen + attrExtLen,
+		resXMLEndElement:     endElementLen,
+		resXMLCDATA:          cdataLen,
+	}[n.Type]
+	if minLen == 0 {
+		n.raw = append([]byte(nil), chunk...)
+		return n, nil
+	}
+	if len(chunk) < minLen {
+		return nil, fmt.Errorf("truncated xml node: 0x%04x", n.Type)
+	}
+
+	n.Line = binary.LittleEndian.Uint32(chunk[8:])
+	n.Comment = binary.LittleEndian.Uint32(chunk[12:])
+	ext := chunk[nodeHeaderLen:]
+	switch n.Type {
+	case resXMLCDATA:
+		n.Name = binary.LittleEndian.Uint32(ext)
+		n.ValueType = ext[7]
+		n.ValueData = binary.LittleEndian.Uint32(ext[8:])
+	case resXMLStartElement:
+		n.NS = binary.LittleEndian.Uint32(ext)
+		n.Name = binary.LittleEndian.Uint32(ext[4:])
+		attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+		attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+		attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+		n.IDIndex = binary.LittleEndian.Uint16(ext[14:])
+		n.ClassIndex = binary.LittleEndian.Uint16(ext[16:])
+		n.StyleIndex = binary.LittleEndian.Uint16(ext[18:])
+		if attrSize < xmlAttributeLen || attrStart+attrSize*attrCount > len(ext) {
+			return nil, fmt.Errorf("invalid attributes at line %d", n.Line)
+		}
+		for i := 0; i < attrCount; i++ {
+			b := ext[attrStart+i*attrSize:]
+			n.Attrs = append(n.Attrs, &axmlAttr{
+				NS:   binary.LittleEndian.Uint32(b),
+				Name: binary.LittleEndian.Uint32(b[4:]),
+				Raw:  binary.LittleEndian.Uint32(b[8:]),
+				Type: b[15],
+				Data: binary.LittleEndian.Uint32(b[16:]),
+			})
+		}
+	default:
+		n.NS = binary.LittleEndian.Uint32(ext)
+		n.Name = binary.LittleEndian.Uint32(ext[4:])
+	}
+	return n, nil
+}
+
+// parseStringPool decodes all strings of a string pool chunk
+func (d *axmlDoc) parseStringPool(chunk []byte) error {
+	if len(chunk) < stringPoolHeaderSize {
+		return fmt.Errorf("truncated string pool")
+	}
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	count := int(binary.LittleEndian.Uint32(chunk[8:]))
+	styleCount := binary.LittleEndian.Uint32(chunk[12:])
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	if headerSize+count*4 > len(chunk) || stringsStart > len(chunk) {
+		return fmt.Errorf("invalid string pool")
+	}
+	if styleCount != 0 {
+		return fmt.Errorf("styled strings not supported")
+	}
+
+	d.utf8 = flags&resStringPoolUTF8 != 0
+	d.strings = make([]string, count)
+	for i := 0; i < count; i++ {
+		p := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if p >= len(chunk) {
+			return fmt.Errorf("invalid string offset: %d", p)
+		}
+		var err error
+		if d.utf8 {
+			d.strings[i], err = decodeUTF8String(chunk[p:])
+		} else {
+			d.strings[i], err = decodeUTF16String(chunk[p:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeUTF8String decodes a string led by its utf16 and utf8 lengths
+func decodeUTF8String(b []byte) (string, error) {
+	lengths := [2]int{}
+	for i := range lengths {
+		if len(b) < 1 {
+			return "", fmt.Errorf("truncated string")
+		}
+		n := int(b[0])
+		b = b[1:]
+		if n&0x80 != 0 {
+			if len(b) < 1 {
+				return "", fmt.Errorf("truncated string")
+			}
+			n = (n&0x7f)<<8 | int(b[0])
+			b = b[1:]
+		}
+		lengths[i] = n
+	}
+	if lengths[1] > len(b) {
+		return "", fmt.Errorf("truncated string")
+	}
+	return string(b[:lengths[1]]), nil
+}
+
+// decodeUTF16String decodes a string led by its length in utf16 units
+func decodeUTF16String(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", fmt.Errorf("truncated string")
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	if n&0x8000 != 0 {
+		if len(b) < 2 {
+			return "", fmt.Errorf("truncated string")
+		}
+		n = (n&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b))
+		b = b[2:]
+	}
+	if n*2 > len(b) {
+		return "", fmt.Errorf("truncated string")
+	}
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// stringIndex returns the index of s in the string pool, adding it to the
+// end of the pool if missing
+func (d *axmlDoc) stringIndex(s string) uint32 {
+	for i, v := range d.strings {
+		if v == s {
+			return uint32(i)
+		}
+	}
+	d.strings = append(d.strings, s)
+	return uint32(len(d.strings) - 1)
+}
+
+// attrNameIndex returns the index of the attribute name of the resource id,
+// inserting a missing one after the resource mapped strings
+func (d *axmlDoc) attrNameIndex(name string, resID uint32) uint32 {
+	for i, id := range d.resMap {
+		if id == resID {
+			return uint32(i)
+		}
+	}
+
+	pos := uint32(len(d.resMap))
+	shift := func(i *uint32) {
+		if *i != noIndex && *i >= pos {
+			*i++
+		}
+	}
+	for _, n := range d.nodes {
+		shift(&n.Comment)
+		shift(&n.NS)
+		shift(&n.Name)
+		for _, a := range n.Attrs {
+			shift(&a.NS)
+			shift(&a.Name)
+			shift(&a.Raw)
+			if a.Type == resValueTypeString {
+				shift(&a.Data)
+			}
+		}
+		if n.Type == resXMLCDATA && n.ValueType == resValueTypeString {
+			shift(&n.ValueData)
+		}
+	}
+
+	d.strings = append(d.strings[:pos], append([]string{name}, d.strings[pos:]...)...)
+	d.resMap = append(d.resMap, resID)
+	return pos
+}
+
+// metaData returns the value of <meta-data android:name="name">
+func (d *axmlDoc) metaData(name string) (string, bool) {
+	for _, n := range d.nodes {
+		if n.Type != resXMLStartElement || d.str(n.Name) != "meta-data" {
+			continue
+		}
+		found, value := false, ""
+		for _, a := range n.Attrs {
+			switch {
+			case d.is(a, attrName, "name"):
+				found = d.value(a) == name
+			case d.is(a, attrValue, "value"):
+				value = d.value(a)
+			}
+		}
+		if found {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// setMetaData sets the value of <meta-data android:name="name"> under
+// <application>, adding the element if missing
+func (d *axmlDoc) setMetaData(name, value string) error {
+	ns := uint32(noIndex)
+	for i, s := range d.strings {
+		if s == AndroidNamespace {
+			ns = uint32(i)
+		}
+	}
+	if ns == noIndex {
+		return fmt.Errorf("android namespace not found")
+	}
+	nameAttr := d.attrNameIndex("name", attrName)
+	valueAttr := d.attrNameIndex("value", attrValue)
+
+	app := -1
+	for i, n := range d.nodes {
+		if n.Type == resXMLStartElement && d.str(n.Name) == "application" {
+			app = i
+			break
+		}
+	}
+	if app < 0 {
+		return fmt.Errorf("application element not found")
+	}
+
+	// look for the meta-data among the direct children of application
+	depth := 0
+	for _, n := range d.nodes[app+1:] {
+		if n.Type == resXMLEndElement {
+			if depth == 0 {
+				break
+			}
+			depth--
+			continue
+		}
+		if n.Type != resXMLStartElement {
+			continue
+		}
+		depth++
+		if depth != 1 || d.str(n.Name) != "meta-data" {
+			continue
+		}
+
+		var nameValue string
+		var valueAttrs []*axmlAttr
+		for _, a := range n.Attrs {
+			if a.Name == nameAttr {
+				nameValue = d.value(a)
+			}
+			if a.Name == valueAttr {
+				valueAttrs = append(valueAttrs, a)
+			}
+		}
+		if nameValue != name {
+			continue
+		}
+
+		if len(valueAttrs) == 0 {
+			a := &axmlAttr{NS: ns, Name: valueAttr}
+			n.Attrs = append(n.Attrs, a)
+			valueAttrs = append(valueAttrs, a)
+		}
+		v := d.stringIndex(value)
+		for _, a := range valueAttrs {
+			a.Raw, a.Type, a.Data = v, resValueTypeString, v
+		}
+		return nil
+	}
+
+	nameValue := d.stringIndex(name)
+	v := d.stringIndex(value)
+	metaData := d.stringIndex("meta-data")
+	line := d.nodes[app].Line
+	nodes := []*axmlNode{{
+		Type:    resXMLStartElement,
+		Line:    line,
+		Comment: noIndex,
+		NS:      noIndex,
+		Name:    metaData,
+		Attrs: []*axmlAttr{
+			{NS: ns, Name: nameAttr, Raw: nameValue, Type: resValueTypeString, Data: nameValue},
+			{NS: ns, Name: valueAttr, Raw: v, Type: resValueTypeString, Data: v},
+		},
+	}, {
+		Type:    resXMLEndElement,
+		Line:    line,
+		Comment: noIndex,
+		NS:      noIndex,
+		Name:    metaData,
+	}}
+	d.nodes = append(d.nodes[:app+1], append(nodes, d.nodes[app+1:]...)...)
+	return nil
+}
+
+// encode returns the binary xml of the document
+func (d *axmlDoc) encode() ([]byte, error) {
+	var body bytes.Buffer
+	pool, err := d.encodeStringPool()
+	if err != nil {
+		return nil, err
+	}
+	body.Write(pool)
+
+	if len(d.resMap) > 0 {
+		le(&body, uint16(resXMLResourceMap), uint16(chunkHeaderLen),
+			uint32(chunkHeaderLen+4*len(d.resMap)))
+		le(&body, d.resMap)
+	}
+
+	for _, n := range d.nodes {
+		if n.raw != nil {
+			body.Write(n.raw)
+			continue
+		}
+		switch n.Type {
+		case resXMLStartElement:
+			size := nodeHeaderLen + attrExtLen + xmlAttributeLen*len(n.Attrs)
+			le(&body, n.Type, uint16(nodeHeaderLen), uint32(size), n.Line, n.Comment)
+			le(&body, n.NS, n.Name, uint16(attrExtLen), uint16(xmlAttributeLen),
+				uint16(len(n.Attrs)), n.IDIndex, n.ClassIndex, n.StyleIndex)
+			for _, a := range n.Attrs {
+				le(&body, a.NS, a.Name, a.Raw, uint16(resValueSize), uint8(0), a.Type, a.Data)
+			}
+		case resXMLCDATA:
+			le(&body, n.Type, uint16(nodeHeaderLen), uint32(cdataLen), n.Line, n.Comment)
+			le(&body, n.Name, uint16(resValueSize), uint8(0), n.ValueType, n.ValueData)
+		default:
+			le(&body, n.Type, uint16(nodeHeaderLen), uint32(namespaceLen), n.Line, n.Comment)
+			le(&body, n.NS, n.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	le(&buf, uint16(resXMLType), uint16(chunkHeaderLen), uint32(chunkHeaderLen+body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// encodeStringPool returns the string pool chunk
+func (d *axmlDoc) encodeStringPool() ([]byte, error) {
+	var offsets []uint32
+	var data bytes.Buffer
+	for _, s := range d.strings {
+		offsets = append(offsets, uint32(data.Len()))
+		units := utf16.Encode([]rune(s))
+		if d.utf8 {
+			if len(units) > maxUTF8StringLen || len(s) > maxUTF8StringLen {
+				return nil, fmt.Errorf("string too long: %d", len(s))
+			}
+			for _, n := range []int{len(units), len(s)} {
+				if n > 0x7f {
+					data.WriteByte(byte(n>>8 | 0x80))
+				}
+				data.WriteByte(byte(n))
+			}
+			data.WriteString(s)
+			data.WriteByte(0)
+		} else {
+			if len(units) > 0x7fff {
+				le(&data, uint16(len(units)>>16|0x8000))
+			}
+			le(&data, uint16(len(units)), units, uint16(0))
+		}
+	}
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+
+	flags := uint32(0)
+	if d.utf8 {
+		flags = resStringPoolUTF8
+	}
+	stringsStart := stringPoolHeaderSize + 4*len(d.strings)
+
+	var buf bytes.Buffer
+	le(&buf, uint16(resStringPoolType), uint16(stringPoolHeaderSize),
+		uint32(stringsStart+data.Len()), uint32(len(d.strings)), uint32(0),
+		flags, uint32(stringsStart), uint32(0))
+	le(&buf, offsets)
+	buf.Write(data.Bytes())
+	return buf.Bytes(), nil
+}
+
+// le writes values in little endian
+func le(w *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+}
+
+// changeAndroidManifest sets the meta-data of -meta-data to the cpid
+// content and returns the new AndroidManifest.xml
+func (p *packer) changeAndroidManifest(r *zip.Reader) ([]byte, error) {
+	buf, err := readAndroidManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseAXML(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	p.log().Info("set meta-data", "phase", PhaseBuild, "name", p.MetaDataName)
+	if err := d.setMetaData(p.MetaDataName, p.CPIDContent); err != nil {
+		return nil, err
+	}
+	return d.encode()
+}
@@ -0,0 +1,233 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+type testAttr struct {
+	name, raw int // string indexes, -1 for none
+	typ       uint8
+	data      uint32
+}
+
+// testNode is a start element, or an end element or namespace of typ
+type testNode struct {
+	typ      uint16
+	ns, name int
+	attrs    []testAttr
+}
+
+// buildAXML encodes a binary xml of the string pool, resource map and nodes
+func buildAXML(strs []string, utf8 bool, resMap []uint32, nodes []testNode) []byte {
+	le := binary.LittleEndian
+	u16 := func(b *bytes.Buffer, v uint16) { binary.Write(b, le, v) }
+	u32 := func(b *bytes.Buffer, v uint32) { binary.Write(b, le, v) }
+	index := func(i int) uint32 {
+		if i < 0 {
+			return noIndex
+		}
+		return uint32(i)
+	}
+	chunk := func(typ, headerSize uint16, body []byte) []byte {
+		var b bytes.Buffer
+		u16(&b, typ)
+		u16(&b, headerSize)
+		u32(&b, uint32(chunkHeaderLen+len(body)))
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	var data bytes.Buffer
+	var offsets []uint32
+	for _, s := range strs {
+		offsets = append(offsets, uint32(data.Len()))
+		if utf8 {
+			data.WriteByte(byte(len(utf16.Encode([]rune(s)))))
+			data.WriteByte(byte(len(s)))
+			data.WriteString(s)
+			data.WriteByte(0)
+		} else {
+			units := utf16.Encode([]rune(s))
+			u16(&data, uint16(len(units)))
+			binary.Write(&data, le, units)
+			u16(&data, 0)
+		}
+	}
+	var pool bytes.Buffer
+	var flags uint32
+	if utf8 {
+		flags = resStringPoolUTF8
+	}
+	u32(&pool, uint32(len(strs)))
+	u32(&pool, 0)
+	u32(&pool, flags)
+	u32(&pool, uint32(stringPoolHeaderSize+4*len(strs)))
+	u32(&pool, 0)
+	for _, o := range offsets {
+		u32(&pool, o)
+	}
+	pool.Write(data.Bytes())
+
+	var ids bytes.Buffer
+	for _, id := range resMap {
+		u32(&ids, id)
+	}
+
+	var body bytes.Buffer
+	body.Write(chunk(resStringPoolType, stringPoolHeaderSize, pool.Bytes()))
+	body.Write(chunk(resXMLResourceMap, chunkHeaderLen, ids.Bytes()))
+	for _, e := range nodes {
+		var b bytes.Buffer
+		u32(&b, 1)       // line number
+		u32(&b, noIndex) // comment
+		u32(&b, index(e.ns))
+		u32(&b, index(e.name))
+		if e.typ != 0 {
+			body.Write(chunk(e.typ, nodeHeaderLen, b.Bytes()))
+			continue
+		}
+		u16(&b, 20)
+		u16(&b, xmlAttributeLen)
+		u16(&b, uint16(len(e.attrs)))
+		u16(&b, 0)
+		u16(&b, 0)
+		u16(&b, 0)
+		for _, a := range e.attrs {
+			u32(&b, noIndex)
+			u32(&b, index(a.name))
+			u32(&b, index(a.raw))
+			u16(&b, 8)
+			b.WriteByte(0)
+			b.WriteByte(a.typ)
+			u32(&b, a.data)
+		}
+		body.Write(chunk(resXMLStartElement, nodeHeaderLen, b.Bytes()))
+	}
+	return chunk(resXMLType, chunkHeaderLen, body.Bytes())
+}
+
+func TestParseApkInfo(t *testing.T) {
+	// attribute names with resource ids come first, as aapt writes them
+	strs := []string{"versionCode", "versionName", "minSdkVersion", "package", "manifest", "uses-sdk", "com.example.app", "1.2.3"}
+	resMap := []uint32{attrVersionCode, attrVersionName, attrMinSdkVersion}
+	elements := []testNode{
+		{name: 4, ns: -1, attrs: []testAttr{
+			{0, -1, 0x10, 42},
+			{1, 7, resValueTypeString, 7},
+			{3, 6, resValueTypeString, 6},
+		}},
+		{name: 5, ns: -1, attrs: []testAttr{{2, -1, 0x10, 21}}},
+	}
+	want := ApkInfo{PackageName: "com.example.app", VersionCode: 42, VersionName: "1.2.3", MinSdk: 21, TargetSdk: 21}
+
+	for _, utf8 := range []bool{false, true} {
+		buf := buildAXML(strs, utf8, resMap, elements)
+		info, err := parseApkInfo(buf)
+		if err != nil {
+			t.Fatalf("utf8 %v: %v", utf8, err)
+		}
+		if *info != want {
+			t.Errorf("utf8 %v: %s, want %s", utf8, info, want)
+		}
+
+		for _, n := range []int{0, chunkHeaderLen, len(buf) / 2, len(buf) - 1} {
+			if _, err := parseApkInfo(buf[:n]); err == nil {
+				t.Errorf("utf8 %v: no error of %d bytes out of %d", utf8, n, len(buf))
+			}
+		}
+	}
+
+	noPackage := buildAXML(strs, false, resMap, elements[1:])
+	if _, err := parseApkInfo(noPackage); err == nil {
+		t.Error("no error without the package name")
+	}
+	if _, err := parseApkInfo([]byte("<manifest package=\"com.example.app\"/>")); err == nil {
+		t.Error("no error of a text xml")
+	}
+}
+
+func TestSetMetaData(t *testing.T) {
+	strs := []string{"name", "value", "android", AndroidNamespace, "manifest", "application", "meta-data", "package", "com.example.app", "UMENG_CHANNEL", "old"}
+	nodes := []testNode{
+		{typ: resXMLStartNamespace, ns: 2, name: 3},
+		{name: 4, ns: -1, attrs: []testAttr{{7, 8, resValueTypeString, 8}}},
+		{name: 5, ns: -1},
+		{name: 6, ns: -1, attrs: []testAttr{{0, 9, resValueTypeString, 9}, {1, 10, resValueTypeString, 10}}},
+		{typ: resXMLEndElement, ns: -1, name: 6},
+		{typ: resXMLEndElement, ns: -1, name: 5},
+		{typ: resXMLEndElement, ns: -1, name: 4},
+		{typ: resXMLEndNamespace, ns: 2, name: 3},
+	}
+
+	tests := []struct {
+		name   string
+		resMap []uint32
+		nodes  []testNode
+		set    string
+		want   map[string]string
+	}{
+		{"update", []uint32{attrName, attrValue}, nodes, "UMENG_CHANNEL", map[string]string{"UMENG_CHANNEL": "new"}},
+		{"add", []uint32{attrName, attrValue}, nodes, "OTHER_CHANNEL", map[string]string{"UMENG_CHANNEL": "old", "OTHER_CHANNEL": "new"}},
+		// the names are added to the resource map, moving the other strings
+		{"add without resource map", nil, append(nodes[:3:3], nodes[5:]...), "UMENG_CHANNEL", map[string]string{"UMENG_CHANNEL": "new"}},
+	}
+	for _, tt := range tests {
+		for _, utf8 := range []bool{false, true} {
+			d, err := parseAXML(buildAXML(strs, utf8, tt.resMap, tt.nodes))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if err := d.setMetaData(tt.set, "new"); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			buf, err := d.encode()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			info, err := parseApkInfo(buf)
+			if err != nil || info.PackageName != "com.example.app" {
+				t.Errorf("%s, utf8 %v: package %v, %v", tt.name, utf8, info, err)
+			}
+			d, err = parseAXML(buf)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got := make(map[string]string)
+			for _, n := range d.nodes {
+				if n.Type != resXMLStartElement || d.str(n.Name) != "meta-data" {
+					continue
+				}
+				var name, value string
+				for _, a := range n.Attrs {
+					if d.is(a, attrName, "name") {
+						name = d.value(a)
+					}
+					if d.is(a, attrValue, "value") {
+						value = d.value(a)
+					}
+				}
+				got[name] = value
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("%s, utf8 %v: meta-data %v, want %v", tt.name, utf8, got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s, utf8 %v: meta-data %v, want %v", tt.name, utf8, got, tt.want)
+				}
+			}
+		}
+	}
+
+	d, err := parseAXML(buildAXML(strs, false, nil, nodes[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.setMetaData("UMENG_CHANNEL", "new"); err == nil {
+		t.Error("no error without application")
+	}
+}
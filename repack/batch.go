@@ -0,0 +1,209 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Row is a job of -batch with its outcome
+type Row struct {
+	Line     int    `json:"line"` // line of the row in the batch file
+	Event    Event  `json:"event"`
+	Result   Result `json:"result"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	Kind     string `json:"error_kind,omitempty"`
+
+	err error
+}
+
+func (row *Row) setError(err error) {
+	row.err, row.Error, row.Kind = err, "", ""
+	if err != nil {
+		row.Error, row.Kind = err.Error(), KindOf(err).String()
+	}
+}
+
+// readBatch reads the rows of -batch, a json event per line, or csv with a
+// header of the event fields if it ends with .csv
+func (p *packer) readBatch() ([]Row, error) {
+	var buf []byte
+	var err error
+	if strings.HasPrefix(p.Batch, OSSScheme) {
+		buf, err = ReadObject(p.ossConfig(), strings.TrimPrefix(p.Batch, OSSScheme))
+	} else {
+		buf, err = ioutil.ReadFile(p.Batch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(p.Batch, ".csv") {
+		return parseCSV(buf)
+	}
+
+	var rows []Row
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := ParseEvent([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		rows = append(rows, Row{Line: i + 1, Event: e})
+	}
+	return rows, nil
+}
+
+// parseCSV parses rows with a header such as source,dest,cpid
+func parseCSV(buf []byte) ([]Row, error) {
+	r := csv.NewReader(bytes.NewReader(buf))
+	r.Comment = '#'
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		var e Event
+		for j, value := range record {
+			switch strings.TrimSpace(header[j]) {
+			case "source":
+				e.Source = value
+			case "dest":
+				e.Dest = value
+			case "cpid":
+				e.CPID = value
+			case "channel":
+				e.Channel = value
+			case "cert_pem":
+				e.CertPEM = value
+			case "priv_pem":
+				e.PrivateKeyPEM = value
+			case "priv_blob":
+				e.PrivateKeyBlob = value
+			case "key_secret_name":
+				e.KeySecretName = value
+			case "cert_secret_name":
+				e.CertSecretName = value
+			case "oss_endpoint":
+				e.OSSEndpoint = value
+			case "force":
+				e.Force, _ = strconv.ParseBool(value)
+			case "tags":
+				e.Tags = value
+			case "delete_after":
+				e.DeleteAfter = value
+			default:
+				return nil, fmt.Errorf("unknown column: %s", header[j])
+			}
+		}
+		if e.Source == "" || e.Dest == "" {
+			return nil, fmt.Errorf("line %d: source and dest are required", line)
+		}
+		if err := e.check(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rows = append(rows, Row{Line: line, Event: e})
+	}
+	return rows, nil
+}
+
+// RepackBatch repacks every row of opts.Batch with up to opts.Jobs workers,
+// retrying a failed row up to opts.Retries times
+func RepackBatch(ctx context.Context, opts Options) ([]Row, error) {
+	p := &packer{Options: opts, ctx: ctx}
+	rows, err := p.readBatch()
+	if err != nil {
+		return nil, errorOf(KindConfig, fmt.Errorf("read batch: %v", err))
+	}
+	p.log().Info("repack batch", "rows", len(rows))
+
+	jobs := p.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	queue := make(chan *Row)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := range queue {
+				p.runRow(ctx, row)
+			}
+		}()
+	}
+	for i := range rows {
+		queue <- &rows[i]
+	}
+	close(queue)
+	wg.Wait()
+
+	var errs []error
+	for _, row := range rows {
+		if row.Error != "" {
+			errs = append(errs, row.err)
+		}
+	}
+	if len(errs) > 0 {
+		// the kind of the failures if they are all the same
+		return rows, &Error{Kind: kindOfAll(errs), Err: fmt.Errorf("%d of %d rows failed", len(errs), len(rows))}
+	}
+	return rows, nil
+}
+
+// runRow repacks row with the retries
+func (p *packer) runRow(ctx context.Context, row *Row) {
+	opts := row.Event.Options(p.Options, Credentials{})
+	opts.Logger = p.log().With("line", row.Line)
+
+	delay := time.Second
+	for {
+		row.Attempts++
+		var err error
+		row.Result, err = Repack(ctx, opts)
+		if err == nil {
+			row.setError(nil)
+			return
+		}
+		row.setError(err)
+		opts.Logger.Error("row failed", append([]interface{}{"attempt", row.Attempts, "error", err}, RequestAttrs(err)...)...)
+		// config, source and sign errors fail again
+		kind := KindOf(err)
+		if kind != KindUnknown && kind != KindThrottled && kind != KindVerify {
+			return
+		}
+		if row.Attempts > p.Retries || ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			row.setError(errorOf(KindCanceled, ctx.Err()))
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,43 @@
+package repack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch string
+		lines []int
+		ok    bool
+	}{
+		{"jobs.jsonl", "# release\n{\"source\":\"b/a.apk\",\"dest\":\"b/1.apk\",\"cpid\":\"c1\"}\n\n{\"source\":\"b/a.apk\",\"dest\":\"b/2.apk\"}\n", []int{2, 4}, true},
+		{"jobs.jsonl", "{\"source\":\"b/a.apk\"}\n", nil, false},
+		{"jobs.csv", "source,dest,cpid,force\n# release\nb/a.apk,b/1.apk,c1,true\nb/a.apk,b/2.apk,c2,false\n", []int{3, 4}, true},
+		{"jobs.csv", "source,dest,md5\nb/a.apk,b/1.apk,x\n", nil, false},
+		{"jobs.csv", "source,cpid\nb/a.apk,c1\n", nil, false},
+	}
+	for _, tt := range tests {
+		p := &packer{Options: DefaultOptions()}
+		p.Batch = filepath.Join(t.TempDir(), tt.name)
+		if err := os.WriteFile(p.Batch, []byte(tt.batch), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := p.readBatch()
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: %v, want ok %v", tt.batch, err, tt.ok)
+			continue
+		}
+		if len(rows) != len(tt.lines) {
+			t.Errorf("%q: %d rows, want %d", tt.batch, len(rows), len(tt.lines))
+			continue
+		}
+		for i, row := range rows {
+			if row.Line != tt.lines[i] || row.Event.Source != "b/a.apk" {
+				t.Errorf("%q: row %+v, want line %d", tt.batch, row, tt.lines[i])
+			}
+		}
+	}
+}
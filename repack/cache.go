@@ -0,0 +1,292 @@
+package repack
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// consts of CachedReader
+const (
+	CacheBlockSize = 256 * 1024 // bytes of a block, read with one request
+	CacheBlocks    = 64         // blocks kept in memory
+)
+
+// CachedReader reads an OSS object in blocks of CacheBlockSize, the last
+// CacheBlocks kept in memory and all on disk with a dir, ReadAt concurrently
+type CachedReader struct {
+	r    *Reader
+	size int64
+	dir  string // of the blocks of this object on disk, "" if none
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element // of lru, by index
+	lru    *list.List              // of *cacheBlock, the most recent first
+	pos    int64                   // of Read and Seek
+}
+
+// cacheBlock is a block being read or read
+type cacheBlock struct {
+	index int64
+	data  []byte
+	err   error
+	done  chan struct{} // closed once read
+}
+
+// NewCachedReader returns a CachedReader of r, keeping the blocks under dir
+// if set, keyed by the ETag of the object and checked with their CRC32
+func NewCachedReader(r *Reader, dir string) (*CachedReader, error) {
+	meta, err := r.Client.GetObjectDetailedMeta(r.Object)
+	if err != nil {
+		return nil, err
+	}
+	return newCachedReader(r, meta, dir)
+}
+
+// newCachedReader returns a CachedReader of r with the meta of the object
+func newCachedReader(r *Reader, meta http.Header, dir string) (*CachedReader, error) {
+	size, err := contentLength(meta)
+	if err != nil {
+		return nil, err
+	}
+	c := &CachedReader{r: r, size: size, blocks: make(map[int64]*list.Element), lru: list.New()}
+	if dir != "" {
+		etag := meta.Get("Etag")
+		if etag == "" {
+			return nil, fmt.Errorf("no etag to key the cache of %s", r.Object)
+		}
+		key := sha256.Sum256([]byte(r.Bucket + "/" + r.Object + "\n" + etag))
+		c.dir = filepath.Join(dir, hex.EncodeToString(key[:16]))
+		if err := os.MkdirAll(c.dir, 0755); err != nil {
+			return nil, fmt.Errorf("cache dir: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Size returns the size of the object
+func (c *CachedReader) Size() int64 {
+	return c.size
+}
+
+// ReadAt reads len(buf) bytes at off from the cache, requesting the missing
+// blocks next to each other at once
+func (c *CachedReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(buf))
+	if end > c.size {
+		end = c.size
+	}
+	if end == off {
+		return 0, nil
+	}
+
+	blocks, claimed := c.claim(off/CacheBlockSize, (end-1)/CacheBlockSize)
+	c.load(claimed)
+
+	n := 0
+	for _, b := range blocks {
+		<-b.done
+		if b.err != nil {
+			return n, b.err
+		}
+		start := off + int64(n) - b.index*CacheBlockSize
+		n += copy(buf[n:end-off], b.data[start:])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// claim returns the blocks first to last, and those not in memory yet,
+// which the caller must load
+func (c *CachedReader) claim(first, last int64) ([]*cacheBlock, []*cacheBlock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var blocks, claimed []*cacheBlock
+	for i := first; i <= last; i++ {
+		if e, ok := c.blocks[i]; ok {
+			c.lru.MoveToFront(e)
+			blocks = append(blocks, e.Value.(*cacheBlock))
+			continue
+		}
+		b := &cacheBlock{index: i, done: make(chan struct{})}
+		c.blocks[i] = c.lru.PushFront(b)
+		blocks = append(blocks, b)
+		claimed = append(claimed, b)
+	}
+	// the blocks evicted while being read are still returned to their readers
+	for c.lru.Len() > CacheBlocks && c.lru.Len() > len(blocks) {
+		e := c.lru.Back()
+		delete(c.blocks, e.Value.(*cacheBlock).index)
+		c.lru.Remove(e)
+	}
+	return blocks, claimed
+}
+
+// load reads the claimed blocks from disk, or else from OSS, one request
+// for each run of blocks next to each other
+func (c *CachedReader) load(claimed []*cacheBlock) {
+	var run []*cacheBlock
+	for _, b := range claimed {
+		if len(run) > 0 && b.index != run[len(run)-1].index+1 {
+			c.fetch(run)
+			run = nil
+		}
+		if b.data = c.readDisk(b.index); b.data != nil {
+			close(b.done)
+			continue
+		}
+		run = append(run, b)
+	}
+	if len(run) > 0 {
+		c.fetch(run)
+	}
+}
+
+// fetch reads the blocks of run, next to each other, with one request
+func (c *CachedReader) fetch(run []*cacheBlock) {
+	off := run[0].index * CacheBlockSize
+	end := (run[len(run)-1].index + 1) * CacheBlockSize
+	if end > c.size {
+		end = c.size
+	}
+	buf := make([]byte, end-off)
+	_, err := c.r.ReadAt(buf, off)
+	for _, b := range run {
+		if err != nil {
+			b.err = err
+		} else {
+			start := b.index*CacheBlockSize - off
+			stop := start + CacheBlockSize
+			if stop > int64(len(buf)) {
+				stop = int64(len(buf))
+			}
+			b.data = buf[start:stop:stop]
+			c.writeDisk(b.index, b.data)
+		}
+		close(b.done)
+	}
+	if err != nil {
+		// read the failed blocks again next time
+		c.mu.Lock()
+		for _, b := range run {
+			if e, ok := c.blocks[b.index]; ok && e.Value == b {
+				delete(c.blocks, b.index)
+				c.lru.Remove(e)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// blockPath returns the file of the block index on disk, made of its data
+// and the CRC32 of it
+func (c *CachedReader) blockPath(index int64) string {
+	return filepath.Join(c.dir, strconv.FormatInt(CacheBlockSize, 10)+"-"+strconv.FormatInt(index, 10))
+}
+
+// readDisk returns the block index on disk, nil if not there or corrupt
+func (c *CachedReader) readDisk(index int64) []byte {
+	if c.dir == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.blockPath(index))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.r.logger().Warn("read cached block", "object", c.r.Object, "block", index, "error", err)
+		}
+		return nil
+	}
+	if len(buf) < 4 {
+		c.r.logger().Warn("cached block corrupt, read again", "object", c.r.Object, "block", index)
+		return nil
+	}
+	data, sum := buf[:len(buf)-4], binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(data) != sum || int64(len(data)) != c.blockSize(index) {
+		c.r.logger().Warn("cached block corrupt, read again", "object", c.r.Object, "block", index)
+		return nil
+	}
+	return data
+}
+
+// writeDisk keeps the block index on disk, written to a temp file first so
+// that it is never read half written
+func (c *CachedReader) writeDisk(index int64, data []byte) {
+	if c.dir == "" {
+		return
+	}
+	err := func() error {
+		f, err := ioutil.TempFile(c.dir, ".block-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+		_, err = f.Write(append(data[:len(data):len(data)], sum[:]...))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), c.blockPath(index))
+	}()
+	if err != nil {
+		c.r.logger().Warn("write cached block", "object", c.r.Object, "block", index, "error", err)
+	}
+}
+
+// blockSize returns the size of the block index, smaller at the end
+func (c *CachedReader) blockSize(index int64) int64 {
+	if rest := c.size - index*CacheBlockSize; rest < CacheBlockSize {
+		return rest
+	}
+	return CacheBlockSize
+}
+
+// Read reads from the offset of the last Read or Seek
+func (c *CachedReader) Read(buf []byte) (int, error) {
+	n, err := c.ReadAt(buf, c.pos)
+	c.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read
+func (c *CachedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	c.pos = offset
+	return offset, nil
+}
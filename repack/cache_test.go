@@ -0,0 +1,103 @@
+package repack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedReader(t *testing.T) {
+	object := make([]byte, 3*CacheBlockSize+100)
+	for i := range object {
+		object[i] = byte(i * 13)
+	}
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		mu.Unlock()
+		w.Header().Set("ETag", `"e1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	}))
+	defer server.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := ranges
+		ranges = nil
+		return got
+	}
+
+	var logs bytes.Buffer
+	dir := t.TempDir()
+	open := func() *CachedReader {
+		r, err := NewReader(OSSConfig{Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret",
+			Log: slog.New(slog.NewTextHandler(&logs, nil))}, "bucket/a.apk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewCachedReader(r, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c := open()
+	if c.Size() != int64(len(object)) {
+		t.Fatalf("size %d", c.Size())
+	}
+
+	// the blocks missing are requested at once, then read from memory
+	buf := make([]byte, 2*CacheBlockSize)
+	if n, err := c.ReadAt(buf, 10); n != len(buf) || err != nil || !bytes.Equal(buf, object[10:10+len(buf)]) {
+		t.Fatalf("read %d: %v", n, err)
+	}
+	if got := requests(); len(got) != 1 || got[0] != "bytes=0-786431" {
+		t.Errorf("ranges %v", got)
+	}
+	if _, err := c.ReadAt(buf[:100], CacheBlockSize); err != nil || len(requests()) != 0 {
+		t.Errorf("cached block requested again: %v", err)
+	}
+
+	// the end of the object, with Seek and Read
+	if _, err := c.Seek(-150, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(c)
+	if err != nil || !bytes.Equal(tail, object[len(object)-150:]) {
+		t.Errorf("tail of %d bytes: %v", len(tail), err)
+	}
+	requests()
+
+	// the blocks on disk are read by another reader, but a corrupt one
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*-0"))
+	if len(files) != 1 {
+		t.Fatalf("blocks on disk %v", files)
+	}
+	if err := os.WriteFile(files[0], []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c = open()
+	all := make([]byte, len(object))
+	if _, err := c.ReadAt(all, 0); err != nil || !bytes.Equal(all, object) {
+		t.Fatalf("read all: %v", err)
+	}
+	if got := requests(); len(got) != 1 || got[0] != "bytes=0-262143" {
+		t.Errorf("ranges %v, want the corrupt block only", got)
+	}
+	if !strings.Contains(logs.String(), "cached block corrupt") {
+		t.Errorf("corrupt block not logged to the logger of the config: %s", logs.String())
+	}
+}
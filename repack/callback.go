@@ -0,0 +1,115 @@
+package repack
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// DefaultCallbackBody is the body of the upload callback if not set, with
+// the system variables of OSS and the custom variables of the dest
+const DefaultCallbackBody = "bucket=${bucket}&object=${object}&etag=${etag}&size=${size}" +
+	"&channel=${x:channel}&package=${x:package}&version_code=${x:version_code}&job_id=${x:job_id}"
+
+// Callback is an upload callback: OSS posts Body to URL once the object
+// is committed, and returns the response of the app server
+type Callback struct {
+	URL  string
+	Body string            // with variables like ${size} and ${x:channel}
+	Vars map[string]string // custom variables, x:channel
+}
+
+// CallbackError is the error of a failed callback. The object is
+// committed all the same.
+type CallbackError struct {
+	Message   string
+	RequestID string
+}
+
+// errCallback is in the message of a CallbackError, see kindOfMessage
+const errCallback = "upload callback failed"
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("%s, the object is uploaded: %s, request id: %s", errCallback, e.Message, e.RequestID)
+}
+
+// headers returns the x-oss-callback and x-oss-callback-var headers of c
+func (c *Callback) headers() (map[string]string, error) {
+	bodyType := "application/x-www-form-urlencoded"
+	if strings.HasPrefix(strings.TrimSpace(c.Body), "{") {
+		bodyType = "application/json"
+	}
+	callback, err := json.Marshal(map[string]string{
+		"callbackUrl":      c.URL,
+		"callbackBody":     c.Body,
+		"callbackBodyType": bodyType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	vars, err := json.Marshal(c.Vars)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"x-oss-callback":     base64.StdEncoding.EncodeToString(callback),
+		"x-oss-callback-var": base64.StdEncoding.EncodeToString(vars),
+	}, nil
+}
+
+// completeXML returns the body of CompleteMultipartUpload with parts in
+// order
+func completeXML(parts []oss.UploadPart) ([]byte, error) {
+	var complete struct {
+		XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+		Parts   []oss.UploadPart `xml:"Part"`
+	}
+	complete.Parts = append(complete.Parts, parts...)
+	sort.Slice(complete.Parts, func(i, j int) bool {
+		return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber
+	})
+	return xml.Marshal(complete)
+}
+
+// callback returns the upload callback of the dest, nil without Callback
+func (p *packer) callback() *Callback {
+	if p.Callback == "" {
+		return nil
+	}
+	body := p.CallbackBody
+	if body == "" {
+		body = DefaultCallbackBody
+	}
+	return &Callback{
+		URL:  p.Callback,
+		Body: body,
+		Vars: map[string]string{
+			"x:channel":      p.job.Channel,
+			"x:package":      p.job.PackageName,
+			"x:version_code": strconv.FormatInt(p.job.VersionCode, 10),
+			"x:version_name": p.job.VersionName,
+			"x:cpid":         p.CPIDContent,
+			"x:job_id":       p.JobID,
+		},
+	}
+}
+
+// checkCallback checks the url of the upload callback
+func (p *packer) checkCallback(add func(format string, args ...interface{})) {
+	if p.Callback == "" {
+		if p.CallbackBody != "" {
+			add("-callback-body needs -callback")
+		}
+		return
+	}
+	if u, err := url.Parse(p.Callback); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("-callback: expect an http(s) url: %s", p.Callback)
+	}
+}
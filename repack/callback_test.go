@@ -0,0 +1,123 @@
+package repack
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// newCallbackServer serves the multipart uploads of OSS, answering the
+// completion with the callback headers it got with status
+func newCallbackServer(status int, callback *http.Header, aborted *bool) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><Key>dest.apk</Key><UploadId>u1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut:
+			ioutil.ReadAll(r.Body)
+			w.Header().Set("ETag", `"part"`)
+		case r.Method == http.MethodPost:
+			*callback = r.Header.Clone()
+			w.WriteHeader(status)
+			if status == http.StatusNonAuthoritativeInfo {
+				fmt.Fprint(w, "<Error><Code>CallbackFailed</Code><Message>Error status : 502.</Message></Error>")
+				return
+			}
+			fmt.Fprint(w, `{"ok":true}`)
+		case r.Method == http.MethodDelete:
+			*aborted = true
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestUploadCallback(t *testing.T) {
+	p := &packer{Options: DefaultOptions(), job: Job{Channel: "huawei", PackageName: "com.a", VersionCode: 42}}
+	p.Callback, p.JobID = "https://app.example.com/repacked", "j1"
+	c := p.callback()
+
+	for _, tt := range []struct {
+		status int
+		kind   Kind
+	}{
+		{http.StatusOK, KindUnknown},
+		{http.StatusNonAuthoritativeInfo, KindHook},
+	} {
+		var headers http.Header
+		aborted := false
+		server := newCallbackServer(tt.status, &headers, &aborted)
+		w, err := NewWriter(OSSConfig{Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret"}, "bucket/dest.apk", "bucket/src.apk", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Callback = c
+		w.Write([]byte("small apk"))
+		err = w.Flush()
+		server.Close()
+		var ce *CallbackError
+		if tt.status == http.StatusOK && err != nil || tt.status != http.StatusOK && (!errors.As(err, &ce) || ce.Message != "Error status : 502.") {
+			t.Errorf("%d: %v", tt.status, err)
+		}
+		if KindOf(err) != tt.kind || aborted {
+			t.Errorf("%d: kind %v, aborted %v", tt.status, KindOf(err), aborted)
+		}
+
+		// the callback of the dest, with its variables
+		buf, _ := base64.StdEncoding.DecodeString(headers.Get("X-Oss-Callback"))
+		var callback map[string]string
+		json.Unmarshal(buf, &callback)
+		if callback["callbackUrl"] != p.Callback || callback["callbackBody"] != DefaultCallbackBody ||
+			callback["callbackBodyType"] != "application/x-www-form-urlencoded" {
+			t.Errorf("callback %v", callback)
+		}
+		buf, _ = base64.StdEncoding.DecodeString(headers.Get("X-Oss-Callback-Var"))
+		var vars map[string]string
+		json.Unmarshal(buf, &vars)
+		if vars["x:channel"] != "huawei" || vars["x:version_code"] != "42" || vars["x:job_id"] != "j1" {
+			t.Errorf("vars %v", vars)
+		}
+	}
+}
+
+func TestCompleteXML(t *testing.T) {
+	buf, err := completeXML([]oss.UploadPart{{PartNumber: 2, ETag: "b"}, {PartNumber: 1, ETag: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>a</ETag></Part>" +
+		"<Part><PartNumber>2</PartNumber><ETag>b</ETag></Part></CompleteMultipartUpload>"; string(buf) != want {
+		t.Errorf("%s", buf)
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	for _, tt := range []struct {
+		url, body string
+		problem   string
+	}{
+		{"https://app.example.com/cb", "", ""},
+		{"", "size=${size}", "-callback-body needs -callback"},
+		{"ftp://app.example.com", "", "-callback: expect an http(s) url"},
+		{"https://", "", "-callback: expect an http(s) url"},
+	} {
+		p := &packer{Options: Options{Callback: tt.url, CallbackBody: tt.body}}
+		var problems []string
+		p.checkCallback(func(format string, args ...interface{}) { problems = append(problems, fmt.Sprintf(format, args...)) })
+		if tt.problem == "" && len(problems) > 0 || tt.problem != "" && (len(problems) != 1 || !strings.HasPrefix(problems[0], tt.problem)) {
+			t.Errorf("%s %s: %v", tt.url, tt.body, problems)
+		}
+	}
+}
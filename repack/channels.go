@@ -0,0 +1,348 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// DefaultCPIDTemplate is the cpid content when -cpid is not set
+const DefaultCPIDTemplate = "{{.Channel}}"
+
+// Job is the data of the templates in -cpid and -dest
+type Job struct {
+	Channel     string
+	PackageName string
+	VersionCode int64
+	VersionName string
+	Timestamp   int64
+
+	// of the source apk my-bucket/apks/qq.apk
+	Bucket string // my-bucket
+	Key    string // apks/qq.apk
+	Dir    string // apks/, empty at the root of the bucket
+	Name   string // qq
+}
+
+// newJob returns the template data of the channel
+func (p *packer) newJob(src *Source, channel string) Job {
+	job := Job{
+		Channel:   channel,
+		Timestamp: p.modTime().Unix(),
+	}
+	if i := strings.Index(p.SourceAPK, "/"); i >= 0 {
+		job.Bucket, job.Key = p.SourceAPK[:i], p.SourceAPK[i+1:]
+		job.Dir = job.Key[:strings.LastIndex(job.Key, "/")+1]
+		job.Name = strings.TrimSuffix(path.Base(job.Key), path.Ext(job.Key))
+	}
+	if src.Info != nil {
+		job.PackageName = src.Info.PackageName
+		job.VersionCode = src.Info.VersionCode
+		job.VersionName = src.Info.VersionName
+	}
+	return job
+}
+
+// render executes the template text with job
+func render(text string, job Job) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, job); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templates keeps -cpid and -dest as given, to be rendered for each job
+type templates struct {
+	cpid   string
+	dest   string
+	schema *Schema // validates the cpid rendered from -cpid-json
+	sealer *sealer // encrypts or signs the cpid
+}
+
+func (p *packer) newTemplates() (templates, error) {
+	t := templates{cpid: p.CPIDContent, dest: p.DestAPK}
+	if p.CPIDJSON != "" {
+		if p.CPIDContent != "" {
+			return t, fmt.Errorf("-cpid and -cpid-json can't be used together")
+		}
+		schema, err := p.loadSchema()
+		if err != nil {
+			return t, fmt.Errorf("cpid schema: %v", err)
+		}
+		t.cpid, t.schema = p.CPIDJSON, schema
+	}
+	if t.cpid == "" {
+		t.cpid = DefaultCPIDTemplate
+	}
+
+	var err error
+	t.sealer, err = p.loadSealer()
+	if err != nil {
+		return t, fmt.Errorf("cpid key: %v", err)
+	}
+	return t, nil
+}
+
+// apply sets the cpid content and dest apk of the job
+func (t templates) apply(p *packer, job Job) error {
+	cpid, err := render(t.cpid, job)
+	if err != nil {
+		return fmt.Errorf("cpid template: %v", err)
+	}
+	if t.schema != nil {
+		cpid, err = canonicalJSON(cpid, t.schema)
+		if err != nil {
+			return err
+		}
+	}
+	if t.sealer != nil {
+		cpid, err = t.sealer.seal(cpid)
+		if err != nil {
+			return err
+		}
+	}
+	dest, err := render(t.dest, job)
+	if err != nil {
+		return fmt.Errorf("dest template: %v", err)
+	}
+	if err := checkLocation(dest); err != nil {
+		return fmt.Errorf("dest template: %v", err)
+	}
+	p.CPIDContent, p.DestAPK = cpid, dest
+	return nil
+}
+
+// readChannels reads the channels of -channels, one per line. Empty lines
+// and lines starting with # are skipped.
+func (p *packer) readChannels() ([]string, error) {
+	var buf []byte
+	var err error
+	if strings.HasPrefix(p.Channels, OSSScheme) {
+		buf, err = ReadObject(p.ossConfig(), strings.TrimPrefix(p.Channels, OSSScheme))
+	} else {
+		buf, err = ioutil.ReadFile(p.Channels)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		channels = append(channels, line)
+	}
+	return channels, nil
+}
+
+// fanOut repacks the source apk, read once, for every channel of -channels,
+// uploaded by up to -jobs workers, with SharedPrefix from a prefixStage
+func (p *packer) fanOut(ctx context.Context) ([]Result, error) {
+	channels, err := p.readChannels()
+	if err != nil {
+		return nil, errorOf(KindConfig, fmt.Errorf("read channels: %v", err))
+	}
+	p.log().Info("repack channels", "channels", len(channels))
+
+	p.progress(PhaseOpen, p.SourceAPK)
+	src, err := p.openSource()
+	if err != nil {
+		return nil, errorOf(KindSource, err)
+	}
+	defer src.close()
+	p.endPhase(nil)
+	// the requests of reading the source once, in none of the results
+	var total Result
+	p.addUsage(&total)
+	p.log().Info("source read", "phase", PhaseOpen, "requests", total.Requests, "bytes_read", total.BytesRead)
+
+	jobs := p.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	var errs []error
+	var results []Result
+	fail := func(channel string, err error) {
+		p.log().Error("channel failed", append([]interface{}{"channel", channel, "error", err}, RequestAttrs(err)...)...)
+		mu.Lock()
+		failed = append(failed, channel)
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	done := func(result Result) {
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	}
+
+	t, err := p.newTemplates()
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+	dests := make(map[string]string)
+	var stage *prefixStage
+	staged := false
+	defer func() {
+		if stage != nil {
+			// the uploads copying from it must be done
+			wg.Wait()
+			p.removeTemp(stage.location)
+		}
+	}()
+	for _, channel := range channels {
+		if err := ctx.Err(); err != nil {
+			fail(channel, err)
+			continue
+		}
+		// with a next key, each channel is repacked again with it
+		for _, next := range []bool{false, true} {
+			// each channel has its own packer, as the uploads run in the
+			// background while the next channel is built
+			q := &packer{Options: p.Options, ctx: p.ctx, memory: p.memory, keyPEM: p.keyPEM, certPEM: p.certPEM, keyRules: p.keyRules, schemes: src.Schemes, outputs: len(channels)}
+			q.Logger = p.log().With("channel", channel)
+			job := q.newJob(src, channel)
+			q.job = job
+			if err := t.apply(q, job); err != nil {
+				return nil, errorOf(KindConfig, err)
+			}
+			if err := q.selectKey(job); err != nil {
+				return nil, errorOf(KindConfig, err)
+			}
+			if next {
+				if !q.hasNextKey() {
+					continue
+				}
+				q.useNextKey()
+				q.Logger = q.log().With("key", "next")
+			}
+			if other, ok := dests[q.DestAPK]; ok {
+				return nil, errorOf(KindConfig, fmt.Errorf("channels %s and %s have the same dest: %s", other, channel, q.DestAPK))
+			}
+			dests[q.DestAPK] = channel
+			end := q.startJob(p.jobContext(), slog.String("channel", channel), slog.String("dest", q.DestAPK))
+			unlock, err := q.lockDest()
+			if err != nil {
+				end(err)
+				fail(channel, err)
+				continue
+			}
+
+			result := Result{Dest: q.DestAPK, CPID: q.CPIDContent, Info: src.Info, SourceSize: src.Size, SourceVersion: src.Version, SourceCRC64: src.CRC64}
+			if !q.Force && !src.Container {
+				q.progress(PhaseCheck, q.DestAPK)
+				if repacked, err := q.isRepacked(); err == nil && repacked {
+					q.log().Info("channel already repacked, skip", "phase", PhaseCheck)
+					result.Skipped = true
+					unlock()
+					end(nil)
+					done(result)
+					continue
+				}
+			}
+
+			if err := q.runHook(HookPreSign, channel, result); err != nil {
+				unlock()
+				end(err)
+				fail(channel, err)
+				continue
+			}
+			sem <- struct{}{}
+			q.progress(PhaseBuild, q.DestAPK)
+			w, appended, err := q.repack(src)
+			if err == nil {
+				err = q.checkSourceUnchanged(src)
+			}
+			if err != nil {
+				<-sem
+				unlock()
+				end(err)
+				fail(channel, err)
+				continue
+			}
+			result.Appended = appended
+			if p.SharedPrefix && len(channels) > 1 {
+				if !staged {
+					staged = true
+					q.progress(PhaseStage, q.DestAPK)
+					if stage, err = q.newStage(q.DestAPK, w); err != nil {
+						q.log().Warn("stage prefix, copy from the source", "phase", PhaseStage, "error", err)
+					}
+				}
+				if stage != nil {
+					if ok, err := stage.use(q, w); err != nil {
+						q.log().Warn("copy from the source", "phase", PhaseStage, "error", err)
+					} else if !ok {
+						q.log().Warn("prefix differs from the stage, copy from the source", "phase", PhaseStage)
+					}
+				}
+			}
+
+			wg.Add(1)
+			go func(channel string, result Result) {
+				defer func() {
+					unlock()
+					<-sem
+					wg.Done()
+				}()
+				if err := q.upload(w, appended); err != nil {
+					end(err)
+					fail(channel, err)
+					return
+				}
+				q.log().Info("channel uploaded", "phase", PhaseDone, "dest", result.Dest)
+				q.progress(PhaseDone, result.Dest)
+				if err := q.tagDest(channel, result); err != nil {
+					end(err)
+					fail(channel, err)
+					return
+				}
+				if err := q.describe(&result); err != nil {
+					end(err)
+					fail(channel, fmt.Errorf("describe dest: %v", err))
+					return
+				}
+				if err := q.audit(channel, result); err != nil {
+					end(err)
+					fail(channel, err)
+					return
+				}
+				if err := q.runHook(HookPostUpload, channel, result); err != nil {
+					end(err)
+					fail(channel, err)
+					return
+				}
+				end(nil)
+				done(result)
+			}(channel, result)
+		}
+	}
+	wg.Wait()
+	for _, result := range results {
+		total.addUsage(result)
+	}
+	p.log().Info("requests of the channels", "channels", len(channels), "requests", total.Requests,
+		"bytes_read", total.BytesRead, "bytes_copied", total.BytesCopied, "bytes_uploaded", total.BytesUploaded)
+
+	if len(failed) > 0 {
+		// the kind of the failures if they are all the same
+		return results, &Error{Kind: kindOfAll(errs), Err: fmt.Errorf("%d of %d channels failed: %s",
+			len(failed), len(channels), strings.Join(failed, ","))}
+	}
+	return results, nil
+}
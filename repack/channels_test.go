@@ -0,0 +1,121 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadChannels(t *testing.T) {
+	list := "# channels of 2026\nhuawei\n\n  xiaomi \r\n#oppo\nvivo"
+	path := filepath.Join(t.TempDir(), "channels.txt")
+	if err := ioutil.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := newOSSServer(map[string][]byte{"bucket/channels.txt": []byte(list)})
+	defer server.Close()
+	p := &packer{Options: DefaultOptions()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+
+	for _, location := range []string{path, OSSScheme + "bucket/channels.txt"} {
+		p.Channels = location
+		channels, err := p.readChannels()
+		if err != nil {
+			t.Fatalf("%s: %v", location, err)
+		}
+		if got := strings.Join(channels, ","); got != "huawei,xiaomi,vivo" {
+			t.Errorf("%s: channels %s", location, got)
+		}
+	}
+
+}
+
+func TestTemplates(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	p.Deterministic, p.SourceAPK = true, "src-bucket/apks/qq.apk"
+	src := &Source{Info: &ApkInfo{PackageName: "com.example.app", VersionCode: 42, VersionName: "1.2"}}
+
+	tests := []struct {
+		cpid, dest         string
+		wantCPID, wantDest string
+		ok                 bool
+	}{
+		{"", "bucket/{{.Channel}}.apk", "huawei", "bucket/huawei.apk", true},
+		{"{{.Channel}}-{{.VersionCode}}", "bucket/{{.PackageName}}/{{.VersionName}}/{{.Channel}}.apk",
+			"huawei-42", "bucket/com.example.app/1.2/huawei.apk", true},
+		{"{{.Timestamp}}", "bucket/dest.apk", fmt.Sprint(DefaultModTime.Unix()), "bucket/dest.apk", true},
+		{"c1", "{{.Bucket}}/{{.Dir}}{{.Name}}-{{.Channel}}.apk", "c1", "src-bucket/apks/qq-huawei.apk", true},
+		{"{{.Channel", "bucket/dest.apk", "", "", false},
+		{"c1", "bucket/{{.Version}}.apk", "", "", false},
+	}
+	for _, tt := range tests {
+		p.CPIDContent, p.DestAPK = tt.cpid, tt.dest
+		tmpl, err := p.newTemplates()
+		if err == nil {
+			err = tmpl.apply(p, p.newJob(src, "huawei"))
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s: %v, want ok %v", tt.cpid, tt.dest, err, tt.ok)
+		}
+		if err == nil && (p.CPIDContent != tt.wantCPID || p.DestAPK != tt.wantDest) {
+			t.Errorf("%s %s: %s %s, want %s %s", tt.cpid, tt.dest, p.CPIDContent, p.DestAPK, tt.wantCPID, tt.wantDest)
+		}
+	}
+}
+
+func TestLockDest(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	dir := t.TempDir()
+	channels := filepath.Join(dir, "channels.txt")
+	ioutil.WriteFile(channels, []byte("huawei\nxiaomi\noppo\n"), 0644)
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/{{.Channel}}.apk", "{{.Channel}}"
+	opts.Channels = channels
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, dir)
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	var mu sync.Mutex
+	var locked, unlocked []string
+	opts.LockDest = func(dest string) (func(), error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if dest == "bucket/oppo.apk" {
+			return nil, errors.New("locked")
+		}
+		locked = append(locked, dest)
+		return func() {
+			mu.Lock()
+			unlocked = append(unlocked, dest)
+			mu.Unlock()
+		}, nil
+	}
+	results, err := RepackChannels(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "oppo") {
+		t.Errorf("oppo locked: %v", err)
+	}
+	if _, ok := objects["bucket/oppo.apk"]; ok || len(results) != 2 {
+		t.Errorf("results %+v, locked dest written", results)
+	}
+	sort.Strings(locked)
+	sort.Strings(unlocked)
+	if got := strings.Join(locked, ","); got != "bucket/huawei.apk,bucket/xiaomi.apk" || strings.Join(unlocked, ",") != got {
+		t.Errorf("locked %v, unlocked %v", locked, unlocked)
+	}
+
+	// skipped as repacked, still unlocked
+	locked, unlocked = nil, nil
+	opts.Channels, opts.Channel, opts.DestAPK = "", "huawei", "bucket/huawei.apk"
+	if result, err := Repack(context.Background(), opts); err != nil || !result.Skipped || len(locked) != 1 || len(unlocked) != 1 {
+		t.Errorf("result %+v: %v, locked %v, unlocked %v", result, err, locked, unlocked)
+	}
+}
@@ -0,0 +1,294 @@
+package repack
+
+import (
+	"compress/flate"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// bucketPattern is the name of an OSS bucket
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// checkLocation checks the syntax of an OSS location my-bucket/object
+func checkLocation(location string) error {
+	i := strings.Index(location, "/")
+	if i < 0 {
+		return fmt.Errorf("expect bucket/object: %s", location)
+	}
+	bucket, object := location[:i], location[i+1:]
+	if !bucketPattern.MatchString(bucket) {
+		return fmt.Errorf("invalid bucket name %q: expect 3 to 63 lowercase letters, digits or hyphens", bucket)
+	}
+	switch {
+	case object == "" || strings.HasSuffix(object, "/"):
+		return fmt.Errorf("no object name: %s", location)
+	case strings.HasPrefix(object, "/") || strings.HasPrefix(object, `\`):
+		return fmt.Errorf("object name starts with a slash: %s", location)
+	case len(object) > 1023 || !utf8.ValidString(object):
+		return fmt.Errorf("invalid object name: %s", location)
+	}
+	return nil
+}
+
+// checkConfig loads the extra files and checks the options of the job up
+// front, returning every problem found at once
+func (p *packer) checkConfig() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if p.OSSEndpoint == "" {
+		add("-oss-ep is required")
+	}
+	if p.SourceAPK == "" {
+		add("-source is required")
+	} else if err := checkLocation(p.SourceAPK); err != nil {
+		add("-source: %v", err)
+	}
+	switch {
+	case p.DestAPK == "":
+		add("-dest is required")
+	case strings.Contains(p.DestAPK, "{{"):
+		if _, err := template.New("").Parse(p.DestAPK); err != nil {
+			add("-dest template: %v", err)
+		}
+	case p.DestAPK == p.SourceAPK:
+		add("-dest is the source: %s", p.DestAPK)
+	default:
+		if err := checkLocation(p.DestAPK); err != nil {
+			add("-dest: %v", err)
+		}
+	}
+
+	if err := p.loadExtraFiles(); err != nil {
+		add("load extra files: %v", err)
+	}
+	if p.V2Channel && (p.needSign() || p.CPIDComment) {
+		add("-v2-channel can't be used with -meta-data, -add, -replace or -cpid-comment, which break v2 signatures")
+	}
+	if _, _, err := parseSchemes(p.Schemes); err != nil {
+		add("-schemes: %v", err)
+	}
+	if p.StrictManifest && p.LenientManifest {
+		add("-strict and -lenient can't be used together")
+	}
+	for _, a := range p.ManifestAttrs {
+		if err := checkMainAttr(a.Name, a.Value); err != nil {
+			add("-manifest-attr: %v", err)
+		}
+	}
+	if p.DownloadSource && p.InMemory {
+		add("-download-source needs a work dir, not -in-memory")
+	}
+	for _, rule := range p.EntryRules {
+		if _, err := rule.regexp(); err != nil {
+			add("-entry-rule: %v", err)
+		}
+	}
+	if p.Resume && (!p.Atomic || p.JobID == "") {
+		add("-resume needs -atomic and -job-id")
+	}
+	if p.SharedPrefix && p.Channels == "" {
+		add("-shared-prefix needs -channels")
+	}
+	if err := checkCopyStrategy(p.CopyStrategy); err != nil {
+		add("-copy-strategy: %v", err)
+	}
+	if p.KeyMap != "" {
+		p.loadKeyMap(add)
+	}
+	if p.needSign() && (p.KeyMap == "" || p.hasKey()) {
+		p.checkKeys(add)
+	}
+	p.checkNextKey(add)
+	p.checkCallback(add)
+	p.checkTags(add)
+
+	if _, err := p.newTemplates(); err != nil {
+		add("%v", err)
+	} else if p.CPIDContent != "" {
+		if _, err := template.New("").Parse(p.CPIDContent); err != nil {
+			add("-cpid template: %v", err)
+		}
+	}
+	if p.usesCPID() && p.Channels == "" && p.CPIDContent == "" && p.CPIDJSON == "" && p.Channel == "" {
+		add("the cpid is empty: set -cpid, -cpid-json or -channel")
+	}
+
+	if _, err := flate.NewWriter(ioutil.Discard, p.CompressionLevel); err != nil {
+		add("-level: %v", err)
+	}
+	if r := p.Retry; r != nil {
+		if r.Delay < 0 || r.MaxElapsed < 0 {
+			add("the delays of the retries must not be negative")
+		}
+		if r.Multiplier != 0 && r.Multiplier < 1 {
+			add("-oss-retry-multiplier must be at least 1: %g", r.Multiplier)
+		}
+		if r.Retries < 0 {
+			add("-oss-attempts must be at least 1: %d", r.Retries+1)
+		}
+	}
+	for _, name := range p.checksums() {
+		if checksumHashes[name] == nil {
+			add("-checksum: unknown %q, expect sha256 or md5", name)
+		}
+	}
+	if (p.ChecksumSidecar || p.ChecksumMeta) && p.Checksums == "" {
+		add("-checksum-sidecar and -checksum-meta need -checksum")
+	}
+	if err := checkPageAlign(p.PageAlign); err != nil {
+		add("-page-align: %v", err)
+	}
+	if p.MaxMemory < 0 {
+		add("-max-memory must not be negative: %d", p.MaxMemory)
+	}
+	if !p.InMemory {
+		if err := checkWritable(p.WorkDir); err != nil {
+			add("-work-dir: %v", err)
+		}
+	}
+	if p.CacheDir != "" {
+		if err := checkWritable(p.CacheDir); err != nil {
+			add("-cache-dir: %v", err)
+		}
+	}
+
+	// the endpoint and credentials, once the rest is known to be fine
+	if len(problems) == 0 {
+		if err := p.checkEndpoint(); err != nil {
+			add("%v", err)
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return &Error{Kind: KindConfig, Err: fmt.Errorf("%s", problems[0])}
+	}
+	return &Error{Kind: KindConfig, Err: fmt.Errorf("%d config problems: %s", len(problems), strings.Join(problems, "; "))}
+}
+
+// checkKeys checks that the private key and cert can be read and parsed,
+// and that they are a pair
+func (p *packer) checkKeys(add func(format string, args ...interface{})) {
+	flag, certFlag := "-priv-pem", "-cert-pem"
+	switch {
+	case p.KeySecretName != "":
+		flag = "-key-secret-name"
+	case p.PrivateKeyBlob != "":
+		flag = "-priv-blob"
+	}
+	if p.CertSecretName != "" {
+		certFlag = "-cert-secret-name"
+	}
+	missing := false
+	if p.PrivateKeyPEM == "" && p.PrivateKeyBlob == "" && p.KeySecretName == "" {
+		add("-priv-pem is required to sign")
+		missing = true
+	}
+	if p.CertPEM == "" && p.CertSecretName == "" {
+		add("-cert-pem is required to sign")
+		missing = true
+	}
+	var needKMS []string
+	for flag, value := range map[string]string{"-priv-blob": p.PrivateKeyBlob, "-key-secret-name": p.KeySecretName, "-cert-secret-name": p.CertSecretName} {
+		if value != "" {
+			needKMS = append(needKMS, flag)
+		}
+	}
+	if len(needKMS) > 0 && p.KMSEndpoint == "" {
+		sort.Strings(needKMS)
+		add("-kms-ep is required with %s", strings.Join(needKMS, " and "))
+		missing = true
+	}
+	if missing {
+		return
+	}
+
+	var key, cert interface{}
+	if buf, err := p.readPrivateKey(); err != nil {
+		add("%s: %v", flag, err)
+	} else if block, _ := pem.Decode(buf); block == nil {
+		add("%s: no pem block in the private key", flag)
+	} else if priv, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		add("%s: expect a PKCS#1 RSA private key: %v", flag, err)
+	} else {
+		key = priv.Public()
+	}
+	if buf, err := p.readCert(); err != nil {
+		add("%s: %v", certFlag, err)
+	} else if block, _ := pem.Decode(buf); block == nil {
+		add("%s: no pem block in the cert", certFlag)
+	} else if c, err := x509.ParseCertificate(block.Bytes); err != nil {
+		add("%s: %v", certFlag, err)
+	} else {
+		cert = c.PublicKey
+	}
+	if key != nil && cert != nil && !reflect.DeepEqual(key, cert) {
+		add("%s is not the key of %s", flag, certFlag)
+	}
+}
+
+// usesCPID reports whether the cpid content goes into the dest apk
+func (p *packer) usesCPID() bool {
+	return len(p.cpidPaths()) > 0 || p.CPIDComment || p.V2Channel || p.MetaDataName != ""
+}
+
+// checkWritable checks that a file can be created in dir, the system temp
+// dir if empty
+func checkWritable(dir string) error {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkEndpoint requests the meta of the source, failing if the endpoint
+// can't be reached or the access is denied, left to opening the source else
+func (p *packer) checkEndpoint() error {
+	flag, endpoint := "-oss-ep", p.sourceEndpoint()
+	switch {
+	case p.SourceAccelerate:
+		flag = "-accelerate-ep"
+	case p.SourceEndpoint != "":
+		flag = "-source-oss-ep"
+	}
+	r, err := NewReader(p.sourceConfig(), p.SourceAPK)
+	if err != nil {
+		return fmt.Errorf("%s: %v", flag, err)
+	}
+	_, err = r.Client.GetObjectDetailedMeta(r.Object)
+	var ue *url.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &ue):
+		return fmt.Errorf("%s %s can't be reached: %v", flag, endpoint, ue.Err)
+	case strings.Contains(err.Error(), "403"):
+		// a HEAD request has no error code in the body
+		return fmt.Errorf("access to %s denied: %v", p.SourceAPK, err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package repack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		ok       bool
+	}{
+		{"my-bucket/apks/a.apk", true},
+		{"my-bucket/渠道/a.apk", true},
+		{"my-bucket", false},
+		{"my-bucket/", false},
+		{"my-bucket/apks/", false},
+		{"my-bucket//a.apk", false},
+		{"My_Bucket/a.apk", false},
+		{"ab/a.apk", false},
+		{"my-bucket/" + strings.Repeat("a", 1024), false},
+	}
+	for _, tt := range tests {
+		if err := checkLocation(tt.location); (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %v", tt.location, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	keyPEM, certPEM := writeKeyPair(t, t.TempDir())
+	_, otherCert := writeKeyPair(t, t.TempDir())
+
+	// every problem at once, without requesting the endpoint
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.SourceAPK, opts.DestAPK = "http://127.0.0.1:1", "Bucket/a.apk", "bucket/{{.Channel"
+	opts.PrivateKeyPEM, opts.CertPEM, opts.CPIDContent = keyPEM, otherCert, "c1"
+	opts.CompressionLevel, opts.PageAlign = 10, 3
+	_, err := newPacker(context.Background(), opts)
+	if KindOf(err) != KindConfig {
+		t.Fatalf("kind of %v", err)
+	}
+	for _, want := range []string{"5 config problems", "-source: invalid bucket name", "-dest template", "-priv-pem is not the key of -cert-pem", "-level", "-page-align"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%v, want %s", err, want)
+		}
+	}
+
+	// then the endpoint
+	opts = DefaultOptions()
+	opts.OSSEndpoint, opts.SourceAPK, opts.DestAPK = "http://127.0.0.1:1", "bucket/a.apk", "bucket/b.apk"
+	opts.PrivateKeyPEM, opts.CertPEM, opts.CPIDContent = keyPEM, certPEM, "c1"
+	if _, err := newPacker(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "can't be reached") {
+		t.Errorf("unreachable endpoint: %v", err)
+	}
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer denied.Close()
+	opts.OSSEndpoint = denied.URL
+	if _, err := newPacker(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("denied: %v", err)
+	}
+}
+
+func TestCheckRetry(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Retry = &RetryPolicy{Delay: -time.Second, Multiplier: 0.5, Retries: -1}
+	_, err := newPacker(context.Background(), opts)
+	for _, want := range []string{"the delays of the retries must not be negative", "-oss-retry-multiplier must be at least 1: 0.5", "-oss-attempts must be at least 1: 0"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%v, want %s", err, want)
+		}
+	}
+}
+
+func TestCheckConfigResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		atomic bool
+		jobID  string
+		ok     bool
+	}{
+		{"atomic with job id", true, "job", true},
+		{"no job id", true, "", false},
+		{"not atomic", false, "job", false},
+		{"neither", false, "", false},
+	}
+	for _, tt := range tests {
+		p := &packer{Options: Options{SourceAPK: "oss://bucket/a.apk", DestAPK: "oss://bucket/b.apk", Resume: true, Atomic: tt.atomic, JobID: tt.jobID}}
+		err := p.checkConfig()
+		if err == nil {
+			t.Fatalf("%s: no problem found without -oss-ep", tt.name)
+		}
+		if got := strings.Contains(err.Error(), "-resume needs -atomic and -job-id"); got == tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
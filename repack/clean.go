@@ -0,0 +1,184 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Upload is a multipart upload that was neither completed nor aborted
+type Upload struct {
+	Key       string    `json:"key"`
+	UploadID  string    `json:"upload_id"`
+	Initiated time.Time `json:"initiated"`
+}
+
+// CleanUploads aborts the multipart uploads under location, like my-bucket/apks/,
+// initiated more than olderThan ago, or only lists them with dryRun
+func CleanUploads(ctx context.Context, opts Options, location string, olderThan time.Duration, dryRun bool) ([]Upload, error) {
+	if location == "" {
+		return nil, errorOf(KindConfig, fmt.Errorf("bucket/prefix is required"))
+	}
+	if !strings.Contains(location, "/") {
+		location += "/"
+	}
+	p := &packer{Options: opts, ctx: ctx}
+	r, err := NewReader(p.ossConfig(), location)
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+
+	var uploads []Upload
+	before := time.Now().Add(-olderThan)
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return uploads, errorOf(KindCanceled, err)
+		}
+		list, err := r.Client.ListMultipartUploads(oss.Prefix(r.Object),
+			oss.KeyMarker(keyMarker), oss.UploadIDMarker(uploadIDMarker))
+		if err != nil {
+			return uploads, fmt.Errorf("list multipart uploads: %v", err)
+		}
+		for _, u := range list.Uploads {
+			if u.Initiated.After(before) {
+				continue
+			}
+			upload := Upload{Key: u.Key, UploadID: u.UploadID, Initiated: u.Initiated}
+			if !dryRun {
+				imur := oss.InitiateMultipartUploadResult{Bucket: r.Bucket, Key: u.Key, UploadID: u.UploadID}
+				if err := r.Client.AbortMultipartUpload(imur); err != nil {
+					return uploads, fmt.Errorf("abort multipart upload %s of %s: %v", u.UploadID, u.Key, err)
+				}
+				// the resumeManifest of an upload left to resume, if any
+				if err := r.Client.DeleteObject(manifestKey(imur)); err != nil {
+					p.log().Warn("remove resume manifest", "key", u.Key, "upload_id", u.UploadID, "error", err)
+				}
+			}
+			p.log().Info("multipart upload", "key", u.Key, "upload_id", u.UploadID, "initiated", u.Initiated, "aborted", !dryRun)
+			uploads = append(uploads, upload)
+		}
+		if !list.IsTruncated {
+			return uploads, nil
+		}
+		keyMarker, uploadIDMarker = list.NextKeyMarker, list.NextUploadIDMarker
+	}
+}
+
+// TempObject is a temp object of Atomic or a stage of SharedPrefix left
+// behind by a failed or killed job
+type TempObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// CleanTempObjects deletes the temp objects and stages under location last
+// modified more than olderThan ago, and returns them, or only lists them with dryRun
+func CleanTempObjects(ctx context.Context, opts Options, location string, olderThan time.Duration, dryRun bool) ([]TempObject, error) {
+	if location == "" {
+		return nil, errorOf(KindConfig, fmt.Errorf("bucket/prefix is required"))
+	}
+	if !strings.Contains(location, "/") {
+		location += "/"
+	}
+	p := &packer{Options: opts}
+	r, err := NewReader(p.ossConfig(), location)
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+
+	var objects []TempObject
+	before := time.Now().Add(-olderThan)
+	marker := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return objects, errorOf(KindCanceled, err)
+		}
+		list, err := r.Client.ListObjects(oss.Prefix(r.Object), oss.Marker(marker))
+		if err != nil {
+			return objects, fmt.Errorf("list objects: %v", err)
+		}
+		for _, o := range list.Objects {
+			if !leftoverPattern.MatchString(o.Key) || o.LastModified.After(before) {
+				continue
+			}
+			if !dryRun {
+				if err := r.Client.DeleteObject(o.Key); err != nil {
+					return objects, fmt.Errorf("delete %s: %v", o.Key, err)
+				}
+			}
+			p.log().Info("temp object", "key", o.Key, "bytes", o.Size, "last_modified", o.LastModified, "deleted", !dryRun)
+			objects = append(objects, TempObject{Key: o.Key, Size: o.Size, LastModified: o.LastModified})
+		}
+		if !list.IsTruncated {
+			return objects, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+// ExpiredObject is a dest of DeleteAfter past its time
+type ExpiredObject struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	DeleteAfter time.Time `json:"delete_after"`
+}
+
+// CleanExpired deletes the objects under location tagged by DeleteAfter with
+// a time past, and returns them, or only lists them with dryRun
+func CleanExpired(ctx context.Context, opts Options, location string, dryRun bool) ([]ExpiredObject, error) {
+	if location == "" {
+		return nil, errorOf(KindConfig, fmt.Errorf("bucket/prefix is required"))
+	}
+	if !strings.Contains(location, "/") {
+		location += "/"
+	}
+	p := &packer{Options: opts}
+	r, err := NewReader(p.ossConfig(), location)
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+
+	var objects []ExpiredObject
+	now := time.Now()
+	marker := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return objects, errorOf(KindCanceled, err)
+		}
+		list, err := r.Client.ListObjects(oss.Prefix(r.Object), oss.Marker(marker))
+		if err != nil {
+			return objects, fmt.Errorf("list objects: %v", err)
+		}
+		for _, o := range list.Objects {
+			tags, err := r.Client.GetObjectTagging(o.Key)
+			if err != nil {
+				return objects, fmt.Errorf("tags of %s: %v", o.Key, err)
+			}
+			var deleteAfter time.Time
+			for _, tag := range tags {
+				if tag.Key == DeleteAfterTag {
+					deleteAfter, _ = time.Parse(time.RFC3339, tag.Value)
+				}
+			}
+			if deleteAfter.IsZero() || deleteAfter.After(now) {
+				continue
+			}
+			if !dryRun {
+				if err := r.Client.DeleteObject(o.Key); err != nil {
+					return objects, fmt.Errorf("delete %s: %v", o.Key, err)
+				}
+			}
+			p.log().Info("expired object", "key", o.Key, "bytes", o.Size, "delete_after", deleteAfter, "deleted", !dryRun)
+			objects = append(objects, ExpiredObject{Key: o.Key, Size: o.Size, DeleteAfter: deleteAfter})
+		}
+		if !list.IsTruncated {
+			return objects, nil
+		}
+		marker = list.NextMarker
+	}
+}
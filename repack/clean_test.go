@@ -0,0 +1,141 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCleanUploads(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	var aborted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if got := r.URL.Query().Get("prefix"); got != "apks/" {
+				t.Errorf("prefix %q", got)
+			}
+			fmt.Fprintf(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>
+<Upload><Key>apks/old.apk</Key><UploadId>1</UploadId><Initiated>%s</Initiated></Upload>
+<Upload><Key>apks/new.apk</Key><UploadId>2</UploadId><Initiated>%s</Initiated></Upload>
+</ListMultipartUploadsResult>`, old, recent)
+		case http.MethodDelete:
+			aborted = append(aborted, r.URL.Path+"?"+r.URL.Query().Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	opts := Options{OSSEndpoint: server.URL, OSSAccessKeyID: "id", OSSAccessKeySecret: "secret"}
+	uploads, err := CleanUploads(context.Background(), opts, "bucket/apks/", 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].Key != "apks/old.apk" || len(aborted) != 0 {
+		t.Fatalf("dry run: uploads %+v, aborted %v", uploads, aborted)
+	}
+
+	if _, err := CleanUploads(context.Background(), opts, "bucket/apks/", 24*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	// with the resume manifest of the upload
+	if len(aborted) != 2 || aborted[0] != "/bucket/apks/old.apk?1" || aborted[1] != "/bucket/apks/old.apk.resume-1?" {
+		t.Errorf("aborted %v", aborted)
+	}
+
+	if _, err := CleanUploads(context.Background(), opts, "", time.Hour, true); KindOf(err) != KindConfig {
+		t.Errorf("no location: %v", err)
+	}
+}
+
+func TestCleanTempObjects(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// two pages
+			if r.URL.Query().Get("marker") == "" {
+				fmt.Fprintf(w, `<ListBucketResult><IsTruncated>true</IsTruncated><NextMarker>apks/b</NextMarker>
+<Contents><Key>apks/a.apk</Key><Size>1</Size><LastModified>%s</LastModified></Contents>
+<Contents><Key>apks/a.apk.tmp-0123456789abcdef</Key><Size>2</Size><LastModified>%s</LastModified></Contents>
+</ListBucketResult>`, old, old)
+				return
+			}
+			fmt.Fprintf(w, `<ListBucketResult><IsTruncated>false</IsTruncated>
+<Contents><Key>apks/b.apk.stage-0123456789abcdef</Key><Size>3</Size><LastModified>%s</LastModified></Contents>
+<Contents><Key>apks/c.apk.tmp-0123456789abcdef</Key><Size>4</Size><LastModified>%s</LastModified></Contents>
+</ListBucketResult>`, old, recent)
+		case http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	opts := Options{OSSEndpoint: server.URL, OSSAccessKeyID: "id", OSSAccessKeySecret: "secret"}
+	objects, err := CleanTempObjects(context.Background(), opts, "bucket/apks/", 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Size != 2 || objects[1].Key != "apks/b.apk.stage-0123456789abcdef" || len(deleted) != 0 {
+		t.Fatalf("dry run: objects %+v, deleted %v", objects, deleted)
+	}
+
+	if _, err := CleanTempObjects(context.Background(), opts, "bucket/apks/", 24*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != "/bucket/apks/a.apk.tmp-0123456789abcdef" || deleted[1] != "/bucket/apks/b.apk.stage-0123456789abcdef" {
+		t.Errorf("deleted %v", deleted)
+	}
+}
+
+func TestCleanExpired(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tags := map[string]string{"/bucket/apks/a.apk": past, "/bucket/apks/b.apk": future}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Has("tagging"):
+			fmt.Fprint(w, `<Tagging><TagSet><Tag><Key>env</Key><Value>test</Value></Tag>`)
+			if v, ok := tags[r.URL.Path]; ok {
+				fmt.Fprintf(w, `<Tag><Key>%s</Key><Value>%s</Value></Tag>`, DeleteAfterTag, v)
+			}
+			fmt.Fprint(w, `</TagSet></Tagging>`)
+		default:
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>
+<Contents><Key>apks/a.apk</Key><Size>1</Size></Contents>
+<Contents><Key>apks/b.apk</Key><Size>2</Size></Contents>
+<Contents><Key>apks/c.apk</Key><Size>3</Size></Contents>
+</ListBucketResult>`)
+		}
+	}))
+	defer server.Close()
+
+	opts := Options{OSSEndpoint: server.URL, OSSAccessKeyID: "id", OSSAccessKeySecret: "secret"}
+	objects, err := CleanExpired(context.Background(), opts, "bucket/apks/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "apks/a.apk" || len(deleted) != 0 {
+		t.Fatalf("dry run: objects %+v, deleted %v", objects, deleted)
+	}
+	if _, err := CleanExpired(context.Background(), opts, "bucket/apks/", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/bucket/apks/a.apk" {
+		t.Errorf("deleted %v", deleted)
+	}
+	if _, err := CleanExpired(context.Background(), opts, "", false); KindOf(err) != KindConfig {
+		t.Errorf("no location: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// ContainerExts are the extensions of archives of split apks
+var ContainerExts = []string{".apks", ".xapk"}
+
+// isContainer reports whether location is an .apks or XAPK archive
+func isContainer(location string) bool {
+	ext := strings.ToLower(path.Ext(location))
+	for _, e := range ContainerExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// isSplit reports whether the container entry is an apk
+func isSplit(f *zip.File) bool {
+	return strings.HasSuffix(strings.ToLower(f.Name), ".apk")
+}
+
+// splitEntries returns the apks of the container, which are all superseded
+// by repackSplits
+func splitEntries(r *zip.Reader) map[string]bool {
+	names := make(map[string]bool)
+	for _, f := range r.File {
+		if isSplit(f) {
+			names[f.Name] = true
+		}
+	}
+	return names
+}
+
+// repackSplits repacks every apk in the container and appends it to w
+// in place of the original entry, leaving the other entries untouched
+func (p *packer) repackSplits(w *Appender, r *zip.Reader) error {
+	for _, f := range r.File {
+		if !isSplit(f) {
+			continue
+		}
+
+		// the split and the repacked one are both in memory
+		size := 2 * int64(f.UncompressedSize64)
+		if err := p.memory.reserve(size, "split "+f.Name); err != nil {
+			return err
+		}
+		apk, err := readEntry(f)
+		if err != nil {
+			p.memory.release(size)
+			return fmt.Errorf("read split %s: %v", f.Name, err)
+		}
+		p.log().Info("repack split", "phase", PhaseBuild, "name", f.Name, "bytes", len(apk))
+		apk, err = p.repackBytes(apk)
+		if err != nil {
+			p.memory.release(size)
+			return fmt.Errorf("repack split %s: %v", f.Name, err)
+		}
+
+		header := f.FileHeader
+		header.Method = p.replaceMethod(f.Name, f)
+		err = w.WriteEntry(&header, apk)
+		p.memory.release(size)
+		if err != nil {
+			return fmt.Errorf("write split %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// repackBytes repacks the apk in memory and returns the new apk
+func (p *packer) repackBytes(apk []byte) ([]byte, error) {
+	r := bytes.NewReader(apk)
+	size := int64(len(apk))
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ReadDirectory(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	sign := p.needSign()
+	var drop map[string]bool
+	if sign {
+		// each split has its own signature file
+		p.SigFileName = ""
+		manifest, err := p.readManifest(r, zipReader)
+		if err != nil {
+			return nil, err
+		}
+		drop, err = p.dropEntries(zipReader)
+		if err != nil {
+			return nil, err
+		}
+		base, err := p.newManifestBase(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", ManifestPath, err)
+		}
+		if p.appended, err = p.newEntries(zipReader); err != nil {
+			return nil, fmt.Errorf("appended entries: %v", err)
+		}
+		if err := p.changeManifest(base, drop); err != nil {
+			return nil, fmt.Errorf("change manifest: %v", err)
+		}
+	}
+	if p.CPIDComment {
+		dir.Comment = p.CPIDContent
+	}
+
+	stale := drop
+	if p.DropStale && sign {
+		stale = p.staleEntries()
+		for name := range drop {
+			stale[name] = true
+		}
+	}
+	segments := []Segment{{Offset: 0, Size: dir.Offset}}
+	if len(stale) > 0 {
+		segments, err = dir.Remove(r, stale, p.log())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var block []byte
+	if p.V2Channel {
+		segments, block, err = p.changeSigningBlock(r, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	for _, s := range segments {
+		out.Write(apk[s.Offset : s.Offset+s.Size])
+	}
+	out.Write(block)
+	writer := dir.Append(&out)
+	writer.PageAlign = p.PageAlign
+	writer.Level = p.CompressionLevel
+	if sign {
+		if err := p.appendFiles(writer); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// writeKeyPair writes a new private key and self signed cert pem to dir
+func writeKeyPair(t *testing.T, dir string) (keyPEM, certPEM string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "repack test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		// signPKCS7 expects the extensions of a keytool cert
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, certPEM = filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem")
+	ioutil.WriteFile(keyPEM, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600)
+	ioutil.WriteFile(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	return keyPEM, certPEM
+}
+
+// zipOf returns a zip of the name and content pairs
+func zipOf(files ...string) []byte {
+	var buf bytes.Buffer
+	w := stdzip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		fw, _ := w.Create(files[i])
+		fw.Write([]byte(files[i+1]))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestRepackSplits(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+	p.PrivateKeyPEM, p.CertPEM = writeKeyPair(t, dir)
+	p.WorkDir, p.CPIDContent, p.CPIDFile, p.DropStale = dir, "c1", true, true
+	p.SigFileName, p.ExtraFiles, p.schemes = "", nil, schemes{v1: true}
+
+	manifest := "Manifest-Version: 1.0\r\n\r\n"
+	base := zipOf(ManifestPath, manifest, "META-INF/BASE.SF", "sf", "META-INF/BASE.RSA", "rsa", "classes.dex", "dex", CPIDPath, "old")
+	split := zipOf(ManifestPath, manifest, "lib/arm64-v8a/libx.so", "elf")
+	src := zipOf("toc.pb", "toc", "base.apk", string(base), "split_config.arm64_v8a.apk", string(split))
+
+	r, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadDirectory(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := d.Remove(bytes.NewReader(src), splitEntries(r), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	for _, s := range segments {
+		out.Write(src[s.Offset : s.Offset+s.Size])
+	}
+	w := d.Append(&out)
+	if err := p.repackSplits(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(container.File) != 3 {
+		t.Fatalf("%d entries in the container", len(container.File))
+	}
+	if toc, err := readEntry(findFile(container, "toc.pb")); err != nil || string(toc) != "toc" {
+		t.Errorf("toc.pb: %q, %v", toc, err)
+	}
+	for name, sig := range map[string]string{"base.apk": "BASE", "split_config.arm64_v8a.apk": SigFileName} {
+		f := findFile(container, name)
+		if f == nil {
+			t.Fatalf("%s not found", name)
+		}
+		apk, err := readEntry(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		ar, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		cpid, err := readEntry(findFile(ar, CPIDPath))
+		if err != nil || string(cpid) != "c1" {
+			t.Errorf("%s: cpid %q, %v", name, cpid, err)
+		}
+		mf, err := readEntry(findFile(ar, ManifestPath))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if m, err := parseManifest(mf); err != nil || m.entry(CPIDPath) == nil || !m.entry(CPIDPath).hasDigests([]byte("c1")) {
+			t.Errorf("%s: manifest %q, %v", name, mf, err)
+		}
+		for _, path := range []string{SFPath, RSAPath} {
+			if findFile(ar, fmt.Sprintf(path, sig)) == nil {
+				t.Errorf("%s: %s not found", name, fmt.Sprintf(path, sig))
+			}
+		}
+	}
+}
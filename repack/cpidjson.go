@@ -0,0 +1,160 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema that -cpid-json is validated against
+type Schema struct {
+	Required             []string                  `json:"required"`
+	Properties           map[string]SchemaProperty `json:"properties"`
+	AdditionalProperties *bool                     `json:"additionalProperties"`
+}
+
+// SchemaProperty is the schema of a key of the cpid json
+type SchemaProperty struct {
+	Type      string        `json:"type"` // string, number, integer or boolean
+	Pattern   string        `json:"pattern"`
+	MaxLength int           `json:"maxLength"`
+	Enum      []interface{} `json:"enum"`
+}
+
+// DefaultSchema requires a string channel
+var DefaultSchema = Schema{
+	Required: []string{"channel"},
+	Properties: map[string]SchemaProperty{
+		"channel": {Type: "string"},
+	},
+}
+
+// loadSchema reads the schema of -cpid-schema from local disk or OSS
+func (p *packer) loadSchema() (*Schema, error) {
+	if p.CPIDSchema == "" {
+		schema := DefaultSchema
+		return &schema, nil
+	}
+
+	var buf []byte
+	var err error
+	if strings.HasPrefix(p.CPIDSchema, OSSScheme) {
+		buf, err = ReadObject(p.ossConfig(), strings.TrimPrefix(p.CPIDSchema, OSSScheme))
+	} else {
+		buf, err = ioutil.ReadFile(p.CPIDSchema)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{}
+	if err := json.Unmarshal(buf, schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", p.CPIDSchema, err)
+	}
+	for key, prop := range schema.Properties {
+		if _, err := regexp.Compile(prop.Pattern); err != nil {
+			return nil, fmt.Errorf("%s: pattern of %s: %v", p.CPIDSchema, key, err)
+		}
+	}
+	return schema, nil
+}
+
+// canonicalJSON validates doc against schema, and returns it compacted
+// with the keys sorted
+func canonicalJSON(doc string, schema *Schema) (string, error) {
+	d := json.NewDecoder(strings.NewReader(doc))
+	d.UseNumber()
+	var v map[string]interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", fmt.Errorf("invalid cpid json: %v", err)
+	}
+	if d.More() {
+		return "", fmt.Errorf("invalid cpid json: trailing data")
+	}
+	if err := schema.validate(v); err != nil {
+		return "", fmt.Errorf("invalid cpid json: %v", err)
+	}
+
+	// maps are marshaled with the keys sorted
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// validate checks the keys of v
+func (s *Schema) validate(v map[string]interface{}) error {
+	for _, key := range s.Required {
+		if _, ok := v[key]; !ok {
+			return fmt.Errorf("missing key: %s", key)
+		}
+	}
+
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p, ok := s.Properties[key]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("unknown key: %s", key)
+			}
+			continue
+		}
+		if err := p.validate(v[key]); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the value of a key
+func (p SchemaProperty) validate(value interface{}) error {
+	switch p.Type {
+	case "":
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expect string, got: %v", value)
+		}
+		if p.MaxLength > 0 && len([]rune(s)) > p.MaxLength {
+			return fmt.Errorf("longer than %d", p.MaxLength)
+		}
+		if p.Pattern != "" && !regexp.MustCompile(p.Pattern).MatchString(s) {
+			return fmt.Errorf("%q doesn't match %s", s, p.Pattern)
+		}
+	case "number", "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("expect %s, got: %v", p.Type, value)
+		}
+		if _, err := n.Int64(); p.Type == "integer" && err != nil {
+			return fmt.Errorf("expect integer, got: %s", n)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expect boolean, got: %v", value)
+		}
+	default:
+		return fmt.Errorf("unsupported type in schema: %s", p.Type)
+	}
+
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not one of %v", value, p.Enum)
+	}
+	return nil
+}
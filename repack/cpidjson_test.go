@@ -0,0 +1,67 @@
+package repack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	closed := false
+	schema := &Schema{
+		Required: []string{"channel", "sub"},
+		Properties: map[string]SchemaProperty{
+			"channel":  {Type: "string", Pattern: "^[a-z]+$", MaxLength: 8},
+			"sub":      {Type: "integer"},
+			"ratio":    {Type: "number"},
+			"beta":     {Type: "boolean"},
+			"campaign": {Type: "string", Enum: []interface{}{"spring", "summer"}},
+		},
+		AdditionalProperties: &closed,
+	}
+	tests := []struct {
+		doc  string
+		want string
+		ok   bool
+	}{
+		{`{"sub": 3, "channel": "huawei"}`, `{"channel":"huawei","sub":3}`, true},
+		{` {"sub":3,"channel":"huawei","ratio":0.5,"beta":true,"campaign":"spring"} `, `{"beta":true,"campaign":"spring","channel":"huawei","ratio":0.5,"sub":3}`, true},
+		{`{"channel":"huawei","sub":12345678901234567890123}`, "", false},
+		{`{"channel":"huawei"}`, "", false},
+		{`{"channel":"Huawei","sub":3}`, "", false},
+		{`{"channel":"huaweihonor","sub":3}`, "", false},
+		{`{"channel":"huawei","sub":3.5}`, "", false},
+		{`{"channel":"huawei","sub":3,"beta":"yes"}`, "", false},
+		{`{"channel":"huawei","sub":3,"campaign":"winter"}`, "", false},
+		{`{"channel":"huawei","sub":3,"extra":1}`, "", false},
+		{`{"channel":"huawei","sub":3} {}`, "", false},
+		{`["huawei"]`, "", false},
+	}
+	for _, tt := range tests {
+		got, err := canonicalJSON(tt.doc, schema)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%s: %s, %v, want %s", tt.doc, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadSchema(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+
+	p.CPIDSchema = ""
+	if schema, err := p.loadSchema(); err != nil || len(schema.Required) != 1 {
+		t.Errorf("default schema: %v, %v", schema, err)
+	}
+	for name, content := range map[string]string{
+		"ok.json":      `{"required":["channel"],"properties":{"channel":{"type":"string","pattern":"^c"}}}`,
+		"pattern.json": `{"properties":{"channel":{"pattern":"("}}}`,
+		"bad.json":     `{"required":"channel"}`,
+	} {
+		p.CPIDSchema = filepath.Join(dir, name)
+		ioutil.WriteFile(p.CPIDSchema, []byte(content), 0644)
+		if _, err := p.loadSchema(); (err == nil) != (name == "ok.json") {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
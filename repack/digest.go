@@ -0,0 +1,210 @@
+package repack
+
+import (
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// consts of the digests of entries
+const (
+	DefaultDigestJobs   = 8
+	DigestChunkSize     = 4 << 20 // of the ranges read ahead
+	DefaultVerifySample = 16      // entries VerifyRemote checks at random
+)
+
+// digestJobs returns the number of ranges read at the same time to compute
+// the digests of entries
+func (p *packer) digestJobs() int {
+	if p.DigestJobs > 0 {
+		return p.DigestJobs
+	}
+	return DefaultDigestJobs
+}
+
+// parallel calls fn with 0 to n-1, up to DigestJobs at the same time, and
+// returns the first error, making no more calls after it or once the job is done
+func (p *packer) parallel(n int, fn func(i int) error) error {
+	sem := make(chan struct{}, p.digestJobs())
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var first error
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return first
+	}
+	for i := 0; i < n && failed() == nil; i++ {
+		if err := p.jobContext().Err(); err != nil {
+			wg.Wait()
+			return err
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(i); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
+
+// fetcher reads ahead the data of the entries to hash in ranges of
+// DigestChunkSize, up to DigestJobs ranges held at the same time for all
+type fetcher struct {
+	ra     io.ReaderAt
+	tokens chan struct{}
+}
+
+func (p *packer) newFetcher(ra io.ReaderAt) *fetcher {
+	return &fetcher{ra: ra, tokens: make(chan struct{}, p.digestJobs())}
+}
+
+// fetchChunk is a range being read
+type fetchChunk struct {
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+// reader returns the n bytes at off, read ahead in the background. It must
+// be closed to release the ranges not read yet.
+func (f *fetcher) reader(off, n int64) io.ReadCloser {
+	r := &chunkReader{
+		f:      f,
+		chunks: make(chan *fetchChunk, cap(f.tokens)),
+		stop:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.chunks)
+		// in order, so the range hashed next never waits for those after
+		for pos := off; pos < off+n; pos += DigestChunkSize {
+			size := off + n - pos
+			if size > DigestChunkSize {
+				size = DigestChunkSize
+			}
+			select {
+			case f.tokens <- struct{}{}:
+			case <-r.stop:
+				return
+			}
+			c := &fetchChunk{buf: make([]byte, size), done: make(chan struct{})}
+			go func(pos int64) {
+				_, c.err = f.ra.ReadAt(c.buf, pos)
+				close(c.done)
+			}(pos)
+			select {
+			case r.chunks <- c:
+			case <-r.stop:
+				<-c.done
+				<-f.tokens
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// chunkReader reads the ranges of fetcher.reader in order
+type chunkReader struct {
+	f      *fetcher
+	chunks chan *fetchChunk
+	stop   chan struct{}
+	cur    *fetchChunk
+	pos    int
+}
+
+func (r *chunkReader) Read(buf []byte) (int, error) {
+	if r.cur == nil {
+		c, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		<-c.done
+		r.cur, r.pos = c, 0
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+	n := copy(buf, r.cur.buf[r.pos:])
+	r.pos += n
+	if r.pos == len(r.cur.buf) {
+		r.release()
+	}
+	return n, nil
+}
+
+// release returns the token of the current range
+func (r *chunkReader) release() {
+	if r.cur != nil {
+		r.cur = nil
+		<-r.f.tokens
+	}
+}
+
+// Close stops reading ahead and releases the ranges not read
+func (r *chunkReader) Close() error {
+	close(r.stop)
+	r.release()
+	for c := range r.chunks {
+		<-c.done
+		<-r.f.tokens
+	}
+	return nil
+}
+
+// entryDigest returns the SHA1 digest of the content of f
+func entryDigest(fetch *fetcher, f *zip.File) (string, error) {
+	h := sha1.New()
+	if err := hashEntry(fetch, f, h); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashEntry writes the content of f to w checking its CRC32, reading with
+// fetch as zip.File.Open reads 4KB at a time, each a request to OSS
+func hashEntry(fetch *fetcher, f *zip.File, w io.Writer) error {
+	offset, err := f.DataOffset()
+	if err != nil {
+		return err
+	}
+	cr := fetch.reader(offset, int64(f.CompressedSize64))
+	defer cr.Close()
+	var rd io.Reader = cr
+	switch f.Method {
+	case zip.Store:
+	case zip.Deflate:
+		fr := flate.NewReader(rd)
+		defer fr.Close()
+		rd = fr
+	default:
+		return fmt.Errorf("unsupported compression method: %d", f.Method)
+	}
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, crc), rd)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != f.UncompressedSize64 || crc.Sum32() != f.CRC32 {
+		return fmt.Errorf("checksum error")
+	}
+	return nil
+}
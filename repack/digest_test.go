@@ -0,0 +1,92 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowReaderAt counts the reads of r at the same time
+type slowReaderAt struct {
+	r       *bytes.Reader
+	mu      sync.Mutex
+	cur     int
+	maxSeen int
+}
+
+func (s *slowReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	s.mu.Lock()
+	s.cur++
+	if s.cur > s.maxSeen {
+		s.maxSeen = s.cur
+	}
+	s.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	defer func() {
+		s.mu.Lock()
+		s.cur--
+		s.mu.Unlock()
+	}()
+	return s.r.ReadAt(buf, off)
+}
+
+func TestFetcher(t *testing.T) {
+	data := make([]byte, 5*DigestChunkSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	ra := &slowReaderAt{r: bytes.NewReader(data)}
+	p := &packer{Options: Options{DigestJobs: 2}}
+	f := p.newFetcher(ra)
+
+	r := f.reader(10, int64(len(data))-20)
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data[10:len(data)-10]) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	if ra.maxSeen > 2 {
+		t.Errorf("%d ranges read at the same time", ra.maxSeen)
+	}
+
+	// closed before reading it all, releasing the ranges read ahead
+	r = f.reader(0, int64(len(data)))
+	if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if n := len(f.tokens); n != 0 {
+		t.Errorf("%d ranges held after close", n)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	p := &packer{Options: Options{DigestJobs: 3}, ctx: context.Background()}
+	var mu sync.Mutex
+	calls := 0
+	err := p.parallel(100, func(i int) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if i == 5 {
+			return fmt.Errorf("entry %d", i)
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	if err == nil || err.Error() != "entry 5" || calls == 100 {
+		t.Errorf("%v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.ctx = ctx
+	if err := p.parallel(10, func(i int) error { return nil }); err != context.Canceled {
+		t.Errorf("canceled: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package repack
+
+import (
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DownloadChunkSize is the bytes of each ranged read of DownloadSource
+const DownloadChunkSize = 8 * 1024 * 1024
+
+// downloadSource downloads the source of r to a file of the work dir to serve
+// its reads from disk, checked with crc, the crc-64 computed by OSS, if known
+func (p *packer) downloadSource(r *Reader, size int64, crc string) (_ *os.File, err error) {
+	start := time.Now()
+	f, err := ioutil.TempFile(p.WorkDir, "source-")
+	if err != nil {
+		return nil, fmt.Errorf("download source: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	h := crc64.New(crc64.MakeTable(crc64.ECMA))
+	buf := make([]byte, DownloadChunkSize)
+	n, err := io.CopyBuffer(io.MultiWriter(f, h), io.NewSectionReader(r, 0, size), buf)
+	if err != nil {
+		return nil, fmt.Errorf("download source: %v", err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("download source: %d of %d bytes", n, size)
+	}
+	if sum := strconv.FormatUint(h.Sum64(), 10); crc != "" && sum != crc {
+		return nil, fmt.Errorf("download source: crc-64 %s, expect %s", sum, crc)
+	}
+	p.log().Info("source downloaded", "phase", PhaseOpen, "file", f.Name(), "bytes", size, "duration", time.Since(start))
+	return f, nil
+}
@@ -0,0 +1,51 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"hash/crc64"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDownloadSource(t *testing.T) {
+	source := zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")
+	objects := map[string][]byte{"bucket/a.apk": source}
+	server := newOSSServer(objects)
+	defer server.Close()
+	p := &packer{Options: DefaultOptions(), ctx: context.Background()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.WorkDir = t.TempDir()
+	p.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	r, err := NewReader(p.ossConfig(), "bucket/a.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crc := strconv.FormatUint(crc64.Checksum(source, crc64.MakeTable(crc64.ECMA)), 10)
+	f, err := p.downloadSource(r, int64(len(source)), crc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if buf, _ := ioutil.ReadFile(f.Name()); !bytes.Equal(buf, source) {
+		t.Errorf("downloaded %d bytes", len(buf))
+	}
+	if _, err := p.downloadSource(r, int64(len(source)), "1"); err == nil || !strings.Contains(err.Error(), "crc-64") {
+		t.Errorf("other crc: %v", err)
+	}
+
+	// the dests are then built from the copy
+	opts := p.Options
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent, opts.DownloadSource = "bucket/a.apk", "bucket/b.apk", "c1", true
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyAPK(t, objects["bucket/b.apk"]); err != nil {
+		t.Error(err)
+	}
+}
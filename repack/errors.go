@@ -0,0 +1,186 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Kind tells what failed, so callers can decide between retrying and
+// paging a human
+type Kind int
+
+// kinds of errors
+const (
+	KindUnknown   Kind = iota
+	KindConfig         // invalid options, templates or input files
+	KindSource         // source apk missing or not a valid apk
+	KindSign           // manifest or signature of the dest apk
+	KindThrottled      // OSS kept returning 503 after retries
+	KindVerify         // dest apk failed validation after upload
+	KindCanceled       // context canceled or timed out, e.g. on SIGTERM
+	KindHook           // a pre-sign or post-upload hook, or the upload callback failed
+)
+
+var kindNames = map[Kind]string{
+	KindUnknown:   "unknown",
+	KindConfig:    "config",
+	KindSource:    "source",
+	KindSign:      "sign",
+	KindThrottled: "throttled",
+	KindVerify:    "verify",
+	KindCanceled:  "canceled",
+	KindHook:      "hook",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Error is an error of a Kind
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorOf returns err as an error of kind, unless it already has a kind or
+// is OSS throttling
+func errorOf(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	if k := kindOfMessage(err); k != KindUnknown {
+		kind = k
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// kindOfMessage returns the kind of errors that lost their type, as they
+// are wrapped with %v
+func kindOfMessage(err error) Kind {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		strings.Contains(msg, context.Canceled.Error()), strings.Contains(msg, context.DeadlineExceeded.Error()):
+		return KindCanceled
+	case strings.Contains(msg, errMemory): // before 503, which may be in its sizes
+		return KindConfig
+	case strings.Contains(msg, errCallback): // before 503, which may be in its message
+		return KindHook
+	case strings.Contains(msg, errSourceChanged):
+		return KindSource
+	case strings.Contains(msg, "503"): // same check as StoreWithRetry
+		return KindThrottled
+	}
+	return KindUnknown
+}
+
+// KindOf returns the kind of err
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	if err != nil {
+		return kindOfMessage(err)
+	}
+	return KindUnknown
+}
+
+// kindOfAll returns the kind shared by errs, or KindUnknown
+func kindOfAll(errs []error) Kind {
+	if len(errs) == 0 {
+		return KindUnknown
+	}
+	kind := KindOf(errs[0])
+	for _, err := range errs[1:] {
+		if KindOf(err) != kind {
+			return KindUnknown
+		}
+	}
+	return kind
+}
+
+// RequestError is an OSS request that failed with an error response, with
+// the ids that Aliyun support asks for
+type RequestError struct {
+	Op        string // e.g. UploadPartCopy
+	RequestID string
+	HostID    string // of the OSS cluster
+	Err       error
+}
+
+// Error adds the host id to the message of the SDK, which ends with the
+// request id
+func (e *RequestError) Error() string {
+	if e.HostID == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ", HostId=" + e.HostID
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// requestError returns err of op as a RequestError if it is an error
+// response of OSS, without ids for a response without body like that of HEAD
+func requestError(op string, err error) error {
+	var se oss.ServiceError
+	if !errors.As(err, &se) {
+		return err
+	}
+	return &RequestError{Op: op, RequestID: se.RequestID, HostID: se.HostID, Err: err}
+}
+
+// requestIDPattern matches the ids of a RequestError in the message of an
+// error, as they are wrapped with %v
+var requestIDPattern = regexp.MustCompile(`RequestId=([^\s,;]+)(?:, HostId=([^\s,;]+))?`)
+
+// RequestIDOf returns the request id and host id of the failed OSS request
+// of err, empty if none
+func RequestIDOf(err error) (requestID, hostID string) {
+	var re *RequestError
+	if errors.As(err, &re) {
+		return re.RequestID, re.HostID
+	}
+	var se oss.ServiceError
+	if errors.As(err, &se) {
+		return se.RequestID, se.HostID
+	}
+	if err != nil {
+		if m := requestIDPattern.FindStringSubmatch(err.Error()); m != nil {
+			return m[1], m[2]
+		}
+	}
+	return "", ""
+}
+
+// RequestAttrs returns the oss_request_id and oss_host_id attrs of a log
+// of err, none if it has no failed OSS request
+func RequestAttrs(err error) []interface{} {
+	requestID, hostID := RequestIDOf(err)
+	var attrs []interface{}
+	if requestID != "" {
+		attrs = append(attrs, "oss_request_id", requestID)
+	}
+	if hostID != "" {
+		attrs = append(attrs, "oss_host_id", hostID)
+	}
+	return attrs
+}
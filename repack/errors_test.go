@@ -0,0 +1,69 @@
+package repack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func TestKindOf(t *testing.T) {
+	signErr := errorOf(KindSign, errors.New("sign"))
+	tests := []struct {
+		err  error
+		kind Kind
+	}{
+		{nil, KindUnknown},
+		{errors.New("eof"), KindUnknown},
+		{errorOf(KindConfig, errors.New("bad template")), KindConfig},
+		{fmt.Errorf("channel huawei: %w", signErr), KindSign},
+		{errorOf(KindConfig, signErr), KindSign},
+		{errorOf(KindSource, errors.New("oss: service returned error: StatusCode=503")), KindThrottled},
+		{errors.New("StatusCode=503"), KindThrottled},
+		{fmt.Errorf("upload: %w", context.Canceled), KindCanceled},
+		{errors.New("Get \"https://oss\": context deadline exceeded"), KindCanceled},
+	}
+	for _, tt := range tests {
+		if kind := KindOf(tt.err); kind != tt.kind {
+			t.Errorf("%v: kind %v, want %v", tt.err, kind, tt.kind)
+		}
+	}
+
+	if kind := kindOfAll([]error{signErr, errorOf(KindSign, errors.New("digest"))}); kind != KindSign {
+		t.Errorf("same kinds: %v", kind)
+	}
+	if kind := kindOfAll([]error{signErr, errorOf(KindVerify, errors.New("crc"))}); kind != KindUnknown {
+		t.Errorf("mixed kinds: %v", kind)
+	}
+}
+
+func TestRequestIDOf(t *testing.T) {
+	se := oss.ServiceError{StatusCode: 403, Code: "AccessDenied", RequestID: "5C3D", HostID: "bucket.oss"}
+	err := requestError("GetObject", se)
+	if !strings.HasSuffix(err.Error(), "RequestId=5C3D, HostId=bucket.oss") {
+		t.Errorf("message %q", err)
+	}
+	tests := []struct {
+		err               error
+		requestID, hostID string
+	}{
+		{nil, "", ""},
+		{errors.New("eof"), "", ""},
+		{requestError("GetObject", errors.New("eof")), "", ""},
+		{fmt.Errorf("part 2: %w", err), "5C3D", "bucket.oss"},
+		{se, "5C3D", "bucket.oss"},
+		{fmt.Errorf("flush oss: %v", err), "5C3D", "bucket.oss"},
+		{fmt.Errorf("object size: %v", oss.ServiceError{StatusCode: 404, RequestID: "5C3E"}), "5C3E", ""},
+	}
+	for _, tt := range tests {
+		if requestID, hostID := RequestIDOf(tt.err); requestID != tt.requestID || hostID != tt.hostID {
+			t.Errorf("%v: ids %q %q, want %q %q", tt.err, requestID, hostID, tt.requestID, tt.hostID)
+		}
+	}
+	if attrs := RequestAttrs(err); len(attrs) != 4 || attrs[1] != "5C3D" || attrs[3] != "bucket.oss" {
+		t.Errorf("attrs %v", attrs)
+	}
+}
@@ -0,0 +1,162 @@
+package repack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Event is the JSON event of a Function Compute invocation. Fields not set
+// are taken from the options of the function.
+type Event struct {
+	Source         string `json:"source"`           // my-bucket/origin.apk
+	Dest           string `json:"dest"`             // my-bucket/dest.apk
+	CPID           string `json:"cpid"`             // cpid content, a template of Job
+	Channel        string `json:"channel"`          // channel of the cpid template
+	CertPEM        string `json:"cert_pem"`         // /path/to/cert.pem or oss://my-bucket/cert.pem
+	PrivateKeyPEM  string `json:"priv_pem"`         // /path/to/private_key.pem or oss://my-bucket/private_key.pem
+	PrivateKeyBlob string `json:"priv_blob"`        // the private key encrypted by KMS
+	KeySecretName  string `json:"key_secret_name"`  // secret of Secrets Manager of the private key
+	CertSecretName string `json:"cert_secret_name"` // secret of Secrets Manager of the cert
+	OSSEndpoint    string `json:"oss_endpoint"`
+	SourceEndpoint string `json:"source_oss_endpoint"` // of the source bucket if in another region
+	Force          bool   `json:"force"`
+	Tags           string `json:"tags"`         // env=test,team=games: tags of the dest, to match lifecycle rules
+	DeleteAfter    string `json:"delete_after"` // 72h: clean deletes the dest after it
+}
+
+// Credentials are the STS credentials of Function Compute, or those of the
+// request of a job of the service
+type Credentials struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+}
+
+// ossEvents is the event of an OSS trigger, or of an OSS event
+// notification to MNS
+type ossEvents struct {
+	Events []struct {
+		EventName string `json:"eventName"` // ObjectCreated:PutObject
+		OSS       struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"` // url encoded
+			} `json:"object"`
+		} `json:"oss"`
+	} `json:"events"`
+}
+
+// ParseEvent parses the JSON event of an invocation, or an OSS trigger event
+// with the created object as the source and no dest
+func ParseEvent(buf []byte) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return e, errorOf(KindConfig, fmt.Errorf("invalid event: %v", err))
+	}
+	var oe ossEvents
+	if json.Unmarshal(buf, &oe); len(oe.Events) > 0 {
+		return parseOSSEvents(oe)
+	}
+	if e.Source == "" || e.Dest == "" {
+		return e, errorOf(KindConfig, fmt.Errorf("invalid event: source and dest are required"))
+	}
+	if err := e.check(); err != nil {
+		return e, errorOf(KindConfig, fmt.Errorf("invalid event: %v", err))
+	}
+	return e, nil
+}
+
+// check checks the fields of e parsed when applied to the options
+func (e Event) check() error {
+	if e.DeleteAfter != "" {
+		if d, err := time.ParseDuration(e.DeleteAfter); err != nil || d < 0 {
+			return fmt.Errorf("delete_after: expect a duration like 72h: %s", e.DeleteAfter)
+		}
+	}
+	if _, err := parseTags(e.Tags); err != nil {
+		return fmt.Errorf("tags: %v", err)
+	}
+	return nil
+}
+
+// parseOSSEvents returns the event of the first object of oe
+func parseOSSEvents(oe ossEvents) (Event, error) {
+	var e Event
+	oss := oe.Events[0].OSS
+	if name := oe.Events[0].EventName; !strings.HasPrefix(name, "ObjectCreated:") {
+		return e, errorOf(KindConfig, fmt.Errorf("invalid event: %s is not an ObjectCreated event", name))
+	}
+	key, err := url.PathUnescape(oss.Object.Key)
+	if err != nil {
+		key = oss.Object.Key
+	}
+	if oss.Bucket.Name == "" || key == "" {
+		return e, errorOf(KindConfig, fmt.Errorf("invalid event: bucket and object key are required"))
+	}
+	e.Source = oss.Bucket.Name + "/" + key
+	return e, nil
+}
+
+// Options returns base with the fields of the event and creds. The OSS
+// endpoint defaults to the internal endpoint of the region of the function.
+func (e Event) Options(base Options, creds Credentials) Options {
+	opts := base
+	opts.SourceAPK = e.Source
+	if e.Dest != "" {
+		opts.DestAPK = e.Dest
+	}
+	if e.CPID != "" {
+		opts.CPIDContent = e.CPID
+	}
+	if e.Channel != "" {
+		opts.Channel = e.Channel
+	}
+	if e.CertPEM != "" {
+		opts.CertPEM = e.CertPEM
+		opts.CertSecretName = ""
+	}
+	if e.CertSecretName != "" {
+		opts.CertSecretName = e.CertSecretName
+	}
+	if e.PrivateKeyPEM != "" {
+		opts.PrivateKeyPEM = e.PrivateKeyPEM
+		opts.PrivateKeyBlob, opts.KeySecretName = "", ""
+	}
+	if e.PrivateKeyBlob != "" {
+		opts.PrivateKeyBlob, opts.KeySecretName = e.PrivateKeyBlob, ""
+	}
+	if e.KeySecretName != "" {
+		opts.KeySecretName = e.KeySecretName
+	}
+	opts.Force = opts.Force || e.Force
+	if e.Tags != "" {
+		opts.Tags = e.Tags
+	}
+	if e.DeleteAfter != "" {
+		opts.DeleteAfter, _ = time.ParseDuration(e.DeleteAfter) // see check
+	}
+
+	if e.OSSEndpoint != "" {
+		opts.OSSEndpoint = e.OSSEndpoint
+	}
+	if e.SourceEndpoint != "" {
+		opts.SourceEndpoint = e.SourceEndpoint
+	}
+	if opts.OSSEndpoint == "" {
+		if region := os.Getenv("FC_REGION"); region != "" {
+			opts.OSSEndpoint = fmt.Sprintf("oss-%s-internal.aliyuncs.com", region)
+		}
+	}
+	if creds.AccessKeyID != "" {
+		opts.OSSAccessKeyID = creds.AccessKeyID
+		opts.OSSAccessKeySecret = creds.AccessKeySecret
+		opts.OSSSecurityToken = creds.SecurityToken
+	}
+	return opts
+}
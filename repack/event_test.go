@@ -0,0 +1,61 @@
+package repack
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		event string
+		ok    bool
+	}{
+		{`{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1"}`, true},
+		{`{"source":"bucket/a.apk"}`, false},
+		{`{"source":`, false},
+		{`{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1","tags":"env=test","delete_after":"72h"}`, true},
+		{`{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1","delete_after":"3 days"}`, false},
+		{`{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1","tags":"env"}`, false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseEvent([]byte(tt.event)); (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %v", tt.event, err, tt.ok)
+		}
+	}
+
+	trigger := `{"events":[{"eventName":"%s","oss":{"bucket":{"name":"bucket"},"object":{"key":"apks/qq%%20v2.apk"}}}]}`
+	e, err := ParseEvent([]byte(fmt.Sprintf(trigger, "ObjectCreated:PutObject")))
+	if err != nil || e.Source != "bucket/apks/qq v2.apk" || e.Dest != "" {
+		t.Errorf("trigger event %+v: %v", e, err)
+	}
+	if _, err := ParseEvent([]byte(fmt.Sprintf(trigger, "ObjectRemoved:DeleteObject"))); KindOf(err) != KindConfig {
+		t.Errorf("removed object: %v", err)
+	}
+}
+
+func TestEventOptions(t *testing.T) {
+	t.Setenv("FC_REGION", "cn-hangzhou")
+	base := DefaultOptions()
+	base.CPIDContent, base.CertPEM = "{{.Channel}}", "/etc/repack/cert.pem"
+	e := Event{Source: "bucket/a.apk", Dest: "bucket/b.apk", Channel: "huawei", PrivateKeyPEM: "oss://keys/priv.pem"}
+
+	opts := e.Options(base, Credentials{AccessKeyID: "sts-id", AccessKeySecret: "sts-secret", SecurityToken: "token"})
+	if opts.SourceAPK != "bucket/a.apk" || opts.DestAPK != "bucket/b.apk" || opts.Channel != "huawei" {
+		t.Errorf("source %s, dest %s, channel %s", opts.SourceAPK, opts.DestAPK, opts.Channel)
+	}
+	if opts.CPIDContent != "{{.Channel}}" || opts.CertPEM != "/etc/repack/cert.pem" || opts.PrivateKeyPEM != "oss://keys/priv.pem" {
+		t.Errorf("cpid %s, cert %s, key %s", opts.CPIDContent, opts.CertPEM, opts.PrivateKeyPEM)
+	}
+	if opts.OSSEndpoint != "oss-cn-hangzhou-internal.aliyuncs.com" || opts.OSSAccessKeyID != "sts-id" || opts.OSSSecurityToken != "token" {
+		t.Errorf("endpoint %s, credentials %s %s", opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSSecurityToken)
+	}
+	base.OSSEndpoint, base.OSSAccessKeyID, base.DestAPK = "oss-cn-shanghai.aliyuncs.com", "id", "bucket/{{.Dir}}{{.Name}}-{{.Channel}}.apk"
+	e.Dest = ""
+	opts = e.Options(base, Credentials{})
+	if opts.DestAPK != base.DestAPK {
+		t.Errorf("dest %s, want the template of the options", opts.DestAPK)
+	}
+	if opts.OSSEndpoint != "oss-cn-shanghai.aliyuncs.com" || opts.OSSAccessKeyID != "id" {
+		t.Errorf("endpoint %s, access key %s", opts.OSSEndpoint, opts.OSSAccessKeyID)
+	}
+}
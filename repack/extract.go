@@ -0,0 +1,103 @@
+package repack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// Extracted is the cpid of an apk found by ExtractCPID, with what was read
+// to find it
+type Extracted struct {
+	Source    string `json:"source"`
+	Path      string `json:"path,omitempty"`      // of the first cpid entry found
+	CPID      string `json:"cpid,omitempty"`      // content of the cpid entry
+	Comment   string `json:"comment,omitempty"`   // zip comment, with CPIDComment
+	MetaData  string `json:"meta_data,omitempty"` // value of the meta-data MetaDataName of AndroidManifest.xml
+	Channel   string `json:"channel,omitempty"`   // walle channel of the signing block, with V2Channel
+	BytesRead int64  `json:"bytes_read"`          // of the apk, with its central directory
+}
+
+// Found reports whether a cpid was found in any of the places looked at
+func (e Extracted) Found() bool {
+	return e.Path != "" || e.Comment != "" || e.MetaData != "" || e.Channel != ""
+}
+
+// ExtractCPID reads the cpid entry, meta-data and walle channel of
+// opts.SourceAPK with ranged reads, failing with KindSource if none is found
+func ExtractCPID(ctx context.Context, opts Options) (Extracted, error) {
+	p := &packer{Options: opts}
+	e := Extracted{Source: p.SourceAPK}
+	read := ReadStats().BytesRead
+	r, err := p.openCached(p.SourceAPK)
+	if err != nil {
+		return e, errorOf(KindSource, err)
+	}
+	size := r.Size()
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return e, errorOf(KindSource, fmt.Errorf("zip reader: %v", err))
+	}
+
+	for _, path := range splitPaths(p.CPIDPaths) {
+		f := findFile(zipReader, path)
+		if f == nil {
+			continue
+		}
+		content, err := readEntry(f)
+		if err != nil {
+			return e, errorOf(KindSource, fmt.Errorf("%s: %v", path, err))
+		}
+		e.Path, e.CPID = path, string(content)
+		break
+	}
+	if p.CPIDComment {
+		e.Comment = zipReader.Comment
+	}
+	if p.MetaDataName != "" {
+		buf, err := readAndroidManifest(zipReader)
+		if err != nil {
+			return e, errorOf(KindSource, err)
+		}
+		d, err := parseAXML(buf)
+		if err != nil {
+			return e, errorOf(KindSource, fmt.Errorf("%s: %v", AndroidManifestPath, err))
+		}
+		e.MetaData, _ = d.metaData(p.MetaDataName)
+	}
+	if p.V2Channel {
+		dir, err := ReadDirectory(r, size)
+		if err != nil {
+			return e, errorOf(KindSource, fmt.Errorf("central directory: %v", err))
+		}
+		block, err := ReadSigningBlock(r, dir.Offset)
+		if err != nil && err != errNoSigningBlock {
+			return e, errorOf(KindSource, fmt.Errorf("apk signing block: %v", err))
+		}
+		if block != nil {
+			if channel := block.Get(WalleChannelID); channel != nil {
+				e.Channel = walleChannelName(channel)
+			}
+		}
+	}
+	e.BytesRead = ReadStats().BytesRead - read
+	p.log().Info("extracted cpid", "source", p.SourceAPK, "path", e.Path, "size", size, "bytes_read", e.BytesRead)
+	if !e.Found() {
+		return e, errorOf(KindSource, fmt.Errorf("no cpid in %s", p.SourceAPK))
+	}
+	return e, nil
+}
+
+// walleChannelName returns the channel of the channel info of Walle, or
+// the info as is if it isn't of its format
+func walleChannelName(info []byte) string {
+	var v struct {
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(info, &v); err != nil || v.Channel == "" {
+		return string(info)
+	}
+	return v.Channel
+}
@@ -0,0 +1,47 @@
+package repack
+
+import (
+	"context"
+	"testing"
+)
+
+func TestExtractCPID(t *testing.T) {
+	plain := zipOf("classes.dex", "dex", "assets/channel", "c1")
+	objects := map[string][]byte{
+		"bucket/cpid.apk":  plain,
+		"bucket/walle.apk": withSigningBlock(t, zipOf("classes.dex", "dex"), true, SigningPair{WalleChannelID, []byte(`{"channel":"huawei"}`)}),
+		"bucket/none.apk":  zipOf("classes.dex", "dex"),
+	}
+	server := newOSSServer(objects)
+	defer server.Close()
+
+	tests := []struct {
+		apk       string
+		v2Channel bool
+		want      Extracted // without Source and BytesRead
+		found     bool
+	}{
+		{"cpid.apk", false, Extracted{Path: "assets/channel", CPID: "c1"}, true},
+		{"walle.apk", true, Extracted{Channel: "huawei"}, true},
+		{"none.apk", false, Extracted{}, false},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+		opts.SourceAPK, opts.CPIDPaths, opts.V2Channel = "bucket/"+tt.apk, "cpid,assets/channel", tt.v2Channel
+		e, err := ExtractCPID(context.Background(), opts)
+		if (err == nil) != tt.found || err != nil && KindOf(err) != KindSource {
+			t.Errorf("%s: %v", tt.apk, err)
+		}
+		if e.BytesRead <= 0 || e.BytesRead > int64(len(objects[opts.SourceAPK])) {
+			t.Errorf("%s: %d bytes read", tt.apk, e.BytesRead)
+		}
+		e.Source, e.BytesRead = "", 0
+		if e != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.apk, e, tt.want)
+		}
+	}
+	if name := walleChannelName([]byte("raw")); name != "raw" {
+		t.Errorf("raw channel %q", name)
+	}
+}
@@ -0,0 +1,161 @@
+package repack
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// actions of -entry-rule
+const (
+	RuleRemove = "remove" // drop the entries matched from the dest apk
+	RuleKeep   = "keep"   // keep the entries matched, removed by an earlier rule
+)
+
+// RegexpPrefix marks the pattern of an EntryRule as a regular expression
+const RegexpPrefix = "re:"
+
+// EntryRule removes or keeps the entries of the source matching Pattern, a
+// glob where ** matches across dirs, or a regular expression after RegexpPrefix
+type EntryRule struct {
+	Action  string // remove or keep
+	Pattern string // META-INF/*.kotlin_module, assets/** or re:^lib/x86/
+}
+
+// ParseEntryRule parses "<action> <pattern>", like "remove assets/**"
+func ParseEntryRule(s string) (EntryRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return EntryRule{}, fmt.Errorf("expect remove or keep and a pattern, got: %s", s)
+	}
+	rule := EntryRule{Action: fields[0], Pattern: fields[1]}
+	if _, err := rule.regexp(); err != nil {
+		return EntryRule{}, err
+	}
+	return rule, nil
+}
+
+// regexp returns the regular expression of the pattern of r, and checks
+// its action
+func (r EntryRule) regexp() (*regexp.Regexp, error) {
+	if r.Action != RuleRemove && r.Action != RuleKeep {
+		return nil, fmt.Errorf("unknown action %q, expect remove or keep", r.Action)
+	}
+	if strings.HasPrefix(r.Pattern, RegexpPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(r.Pattern, RegexpPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Pattern, err)
+		}
+		return re, nil
+	}
+	if r.Pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	return globRegexp(r.Pattern), nil
+}
+
+// globRegexp returns the regular expression matching the whole names glob
+// matches
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			// **/ also matches no dir at all
+			if i+2 < len(glob) && glob[i+2] == '/' {
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else {
+				b.WriteString(".*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// EntryRules implements flag.Value for repeatable -entry-rule flags
+type EntryRules []EntryRule
+
+func (a *EntryRules) String() string {
+	if a == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *a {
+		s = append(s, r.Action+" "+r.Pattern)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses "<action> <pattern>", see ParseEntryRule
+func (a *EntryRules) Set(value string) error {
+	rule, err := ParseEntryRule(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, rule)
+	return nil
+}
+
+// removedEntries returns the entries of r EntryRules remove, decided by the last
+// rule matching each, never AndroidManifest.xml or MANIFEST.MF
+func (p *packer) removedEntries(r *zip.Reader) ([]string, error) {
+	if len(p.EntryRules) == 0 {
+		return nil, nil
+	}
+	res := make([]*regexp.Regexp, len(p.EntryRules))
+	for i, rule := range p.EntryRules {
+		re, err := rule.regexp()
+		if err != nil {
+			return nil, fmt.Errorf("-entry-rule %s %s: %v", rule.Action, rule.Pattern, err)
+		}
+		res[i] = re
+	}
+	var names []string
+	for _, f := range r.File {
+		if f.Name == AndroidManifestPath || f.Name == ManifestPath {
+			continue
+		}
+		remove := false
+		for i, rule := range p.EntryRules {
+			if res[i].MatchString(f.Name) {
+				remove = rule.Action == RuleRemove
+			}
+		}
+		if remove {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// dropEntries returns the entries of r to drop from the dest apk: those of
+// checkArtifacts and those EntryRules remove
+func (p *packer) dropEntries(r *zip.Reader) (map[string]bool, error) {
+	drop, err := p.checkArtifacts(r)
+	if err != nil {
+		return nil, err
+	}
+	names, err := p.removedEntries(r)
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+	if len(names) > 0 {
+		p.log().Info("remove entries", "phase", PhaseBuild, "count", len(names), "entries", names)
+	}
+	for _, name := range names {
+		drop[name] = true
+	}
+	return drop, nil
+}
@@ -0,0 +1,97 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"META-INF/*.kotlin_module", "META-INF/core.kotlin_module", true},
+		{"META-INF/*.kotlin_module", "META-INF/a/core.kotlin_module", false},
+		{"assets/**", "assets/a/b.json", true},
+		{"assets/**", "res/assets/a.json", false},
+		{"**/*.png", "icon.png", true},
+		{"**/*.png", "res/drawable/icon.png", true},
+		{"lib/?86/*.so", "lib/x86/libc.so", true},
+		{"a.json", "a-json", false},
+	}
+	for _, tt := range tests {
+		if match := globRegexp(tt.glob).MatchString(tt.name); match != tt.match {
+			t.Errorf("%s %s: %v", tt.glob, tt.name, match)
+		}
+	}
+}
+
+func TestEntryRulesSet(t *testing.T) {
+	var rules EntryRules
+	for _, v := range []string{"remove assets/**", "keep re:^assets/common/"} {
+		if err := rules.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	if s := rules.String(); s != "remove assets/**,keep re:^assets/common/" {
+		t.Errorf("rules %s", s)
+	}
+	for _, v := range []string{"remove", "drop assets/**", "remove re:(", "remove a b"} {
+		if err := rules.Set(v); err == nil {
+			t.Errorf("Set(%q) accepted", v)
+		}
+	}
+}
+
+func TestRemovedEntries(t *testing.T) {
+	src := zipOf(AndroidManifestPath, "axml", ManifestPath, "mf", "assets/a.json", "a", "assets/common/b.json", "b",
+		"META-INF/core.kotlin_module", "k", "classes.dex", "dex")
+	r, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packer{}
+	for _, v := range []string{"remove assets/**", "keep assets/common/**", "remove META-INF/*.kotlin_module", "remove re:Manifest"} {
+		p.EntryRules.Set(v)
+	}
+	names, err := p.removedEntries(r)
+	if got := strings.Join(names, ","); err != nil || got != "assets/a.json,META-INF/core.kotlin_module" {
+		t.Errorf("removed %s, %v", got, err)
+	}
+}
+
+func TestRepackEntryRules(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex", "assets/a.json", "a")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	opts.EntryRules.Set("remove assets/**")
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	apk := objects["bucket/b.apk"]
+	if err := verifyAPK(t, apk); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findFile(r, "assets/a.json") != nil || findFile(r, "classes.dex") == nil {
+		t.Error("assets/a.json not removed")
+	}
+	if result, err := Repack(context.Background(), opts); err != nil || !result.Skipped {
+		t.Errorf("repacked again: %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,59 @@
+package repack
+
+import (
+	"fmt"
+)
+
+// FlushStrategy writes the object of a Writer from the ranges of the source it
+// keeps and the data written after them, see Writer.Flush
+type FlushStrategy interface {
+	Flush(w *Writer) error
+}
+
+// MultipartCopy copies the ranges of the source in parallel parts of PartSize,
+// CopyPartSizeInBytes if 0, an object too small for a part with LocalPut
+type MultipartCopy struct {
+	PartSize int64
+}
+
+// Flush implements FlushStrategy
+func (s MultipartCopy) Flush(w *Writer) error {
+	if w.offset < MinPartSizeInBytes && w.Callback == nil {
+		return LocalPut{}.Flush(w)
+	}
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = CopyPartSizeInBytes
+	}
+	return w.multipart(partSize, false)
+}
+
+// StreamedUpload is a MultipartCopy reading the ranges of the source, from OSS
+// or its copy on disk, and uploading them from this process
+type StreamedUpload struct {
+	PartSize int64
+}
+
+// Flush implements FlushStrategy
+func (s StreamedUpload) Flush(w *Writer) error {
+	if w.offset < MinPartSizeInBytes && w.Callback == nil {
+		return LocalPut{}.Flush(w)
+	}
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = CopyPartSizeInBytes
+	}
+	return w.multipart(partSize, true)
+}
+
+// LocalPut reads the ranges of the source and puts them with the data
+// written in a single PutObject, which can't have a callback
+type LocalPut struct{}
+
+// Flush implements FlushStrategy
+func (LocalPut) Flush(w *Writer) error {
+	if w.Callback != nil {
+		return fmt.Errorf("put with a callback, use a multipart upload")
+	}
+	return w.put()
+}
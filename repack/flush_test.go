@@ -0,0 +1,48 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// flushFunc is a func as a FlushStrategy
+type flushFunc func(w *Writer) error
+
+func (f flushFunc) Flush(w *Writer) error {
+	return f(w)
+}
+
+func TestFlushStrategy(t *testing.T) {
+	var flushed *Writer
+	w := &Writer{Strategy: flushFunc(func(w *Writer) error { flushed = w; return nil })}
+	if err := w.Flush(); err != nil || flushed != w {
+		t.Errorf("flushed %v: %v", flushed, err)
+	}
+	if err := (LocalPut{}).Flush(&Writer{Callback: &Callback{}}); err == nil {
+		t.Error("put with a callback")
+	}
+}
+
+func TestCopyPartStreamed(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 1000)
+	server := newOSSServer(map[string][]byte{"bucket/src.apk": object})
+	defer server.Close()
+	src, err := NewReader(OSSConfig{Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret"}, "bucket/src.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &copyStore{}
+	w := &Writer{Client: store, srcClient: src.Client, SrcBucket: "bucket", SrcObject: "src.apk",
+		Log: slog.New(slog.NewTextHandler(ioutil.Discard, nil)), Context: context.Background()}
+	if _, err := w.copyPart(oss.InitiateMultipartUploadResult{}, []Segment{{100, 3000}}, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if store.copies != 0 || len(store.parts) != 1 || !bytes.Equal(store.parts[0], object[100:3100]) {
+		t.Errorf("%d copies, parts %d", store.copies, len(store.parts))
+	}
+}
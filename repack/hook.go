@@ -0,0 +1,114 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hooks of a job
+const (
+	HookPreSign    = "pre-sign"    // before the dest apk is built and signed
+	HookPostUpload = "post-upload" // after the dest apk is uploaded
+)
+
+// hookTimeout is the time a hook may take
+const hookTimeout = 5 * time.Minute
+
+// HookPayload is the JSON body posted to a hook URL, or written to the
+// stdin of a hook command
+type HookPayload struct {
+	Hook    string `json:"hook"` // pre-sign or post-upload
+	Source  string `json:"source"`
+	Channel string `json:"channel,omitempty"`
+	Result  Result `json:"result"` // without the etag and size before upload
+}
+
+// runHook runs the hook command or URL of name, if any. A failed hook fails
+// the job, so a pre-sign hook can reject an apk.
+func (p *packer) runHook(name, channel string, result Result) error {
+	hook := p.PreSignHook
+	if name == HookPostUpload {
+		hook = p.PostUploadHook
+	}
+	if hook == "" {
+		return nil
+	}
+	payload := HookPayload{Hook: name, Source: p.SourceAPK, Channel: channel, Result: result}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(p.jobContext(), hookTimeout)
+	defer cancel()
+	end := p.trace("hook." + name)
+	start := time.Now()
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		err = postHook(ctx, hook, body)
+	} else {
+		err = execHook(ctx, hook, body, payload)
+	}
+	end(err)
+	if err != nil {
+		return errorOf(KindHook, fmt.Errorf("%s hook: %v", name, err))
+	}
+	p.log().Info("hook done", "hook", name, "dest", result.Dest, "duration", time.Since(start))
+	return nil
+}
+
+// postHook posts body to url, any status but 2xx is an error
+func postHook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// execHook runs command with sh, with the payload as env and body as stdin,
+// a non-zero exit is an error
+func execHook(ctx context.Context, command string, body []byte, payload HookPayload) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(body)
+	r := payload.Result
+	cmd.Env = append(os.Environ(),
+		"REPACK_HOOK="+payload.Hook,
+		"REPACK_SOURCE="+payload.Source,
+		"REPACK_CHANNEL="+payload.Channel,
+		"REPACK_DEST="+r.Dest,
+		"REPACK_CPID="+r.CPID,
+		"REPACK_ETAG="+r.ETag,
+		"REPACK_SIZE="+strconv.FormatInt(r.Size, 10),
+	)
+	if r.Info != nil {
+		cmd.Env = append(cmd.Env,
+			"REPACK_PACKAGE_NAME="+r.Info.PackageName,
+			"REPACK_VERSION_CODE="+strconv.FormatInt(r.Info.VersionCode, 10),
+			"REPACK_VERSION_NAME="+r.Info.VersionName,
+		)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
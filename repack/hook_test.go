@@ -0,0 +1,55 @@
+package repack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunHook(t *testing.T) {
+	var posted HookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+		if posted.Result.Dest == "bucket/rejected.apk" {
+			http.Error(w, "malware", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	result := Result{Dest: "bucket/b.apk", CPID: "huawei", ETag: "etag", Size: 42}
+	p := &packer{Options: Options{SourceAPK: "bucket/a.apk", PreSignHook: server.URL, PostUploadHook: server.URL}}
+	if err := p.runHook(HookPostUpload, "huawei", result); err != nil {
+		t.Fatal(err)
+	}
+	if posted.Hook != HookPostUpload || posted.Source != "bucket/a.apk" || posted.Channel != "huawei" || posted.Result.ETag != "etag" {
+		t.Errorf("posted %+v", posted)
+	}
+	result.Dest = "bucket/rejected.apk"
+	if err := p.runHook(HookPreSign, "huawei", result); KindOf(err) != KindHook || !strings.Contains(err.Error(), "malware") {
+		t.Errorf("rejected: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	p.PostUploadHook = `echo "$REPACK_HOOK $REPACK_DEST $REPACK_SIZE" > ` + out + ` && cat >> ` + out
+	result.Dest = "bucket/b.apk"
+	if err := p.runHook(HookPostUpload, "huawei", result); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadFile(out)
+	if lines := strings.SplitN(string(buf), "\n", 2); lines[0] != "post-upload bucket/b.apk 42" || !strings.Contains(lines[1], `"etag":"etag"`) {
+		t.Errorf("command output %q", buf)
+	}
+	p.PostUploadHook = "echo failed >&2; exit 1"
+	if err := p.runHook(HookPostUpload, "huawei", result); KindOf(err) != KindHook || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("failed command: %v", err)
+	}
+
+	p.PreSignHook = ""
+	if err := p.runHook(HookPreSign, "huawei", result); err != nil {
+		t.Errorf("no hook: %v", err)
+	}
+}
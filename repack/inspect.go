@@ -0,0 +1,139 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// known ids of the APK Signing Block
+var sigBlockIDs = map[uint32]string{
+	V2SignatureID:  "v2 signature",
+	V3SignatureID:  "v3 signature",
+	0x1b93ad61:     "v3.1 signature",
+	WalleChannelID: "walle channel",
+	0x881155ff:     "vasdolly channel",
+	PlayFrostingID: "google play frosting",
+}
+
+// inspect prints the entries, signatures and channel of the apk at
+// p.SourceAPK, with ranged reads only
+func (p *packer) inspect(out io.Writer) error {
+	r, err := p.openCached(p.SourceAPK)
+	if err != nil {
+		return err
+	}
+	return p.inspectAPK(out, r, r.Size())
+}
+
+// inspectAPK prints the apk in r to out
+func (p *packer) inspectAPK(out io.Writer, ossReader io.ReaderAt, objectSize int64) error {
+	zipReader, err := zip.NewReader(ossReader, objectSize)
+	if err != nil {
+		return err
+	}
+	dir, err := ReadDirectory(ossReader, objectSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "apk: %s, %d bytes, %d entries\n", p.SourceAPK, objectSize, len(zipReader.File))
+	if info, err := readApkInfo(zipReader); err == nil {
+		fmt.Fprintf(out, "package: %s\n", info)
+	}
+
+	offsets := make(map[string]int64)
+	for _, rec := range dir.Records {
+		offsets[rec.Name] = rec.Offset
+	}
+
+	fmt.Fprintln(out, "entries:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "method\tsize\tcompressed\toffset\talign\t  name")
+	for _, f := range zipReader.File {
+		method, align := "deflate", "-"
+		if f.Method == zip.Store {
+			method = "store"
+			offset, err := f.DataOffset()
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.Name, err)
+			}
+			align = fmt.Sprintf("%d", dataAlignment(offset))
+		} else if f.Method != zip.Deflate {
+			method = fmt.Sprintf("%d", f.Method)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t  %s\n", method,
+			f.UncompressedSize64, f.CompressedSize64, offsets[f.Name], align, f.Name)
+	}
+	w.Flush()
+
+	var sigFiles []string
+	for _, f := range zipReader.File {
+		if strings.HasPrefix(f.Name, MetaInfoPath) && isSignatureFile(f.Name) {
+			sigFiles = append(sigFiles, f.Name)
+		}
+	}
+	fmt.Fprintf(out, "signature files: %s\n", strings.Join(sigFiles, ", "))
+
+	if block, err := ReadSigningBlock(ossReader, dir.Offset); err != nil {
+		fmt.Fprintf(out, "signing block: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "signing block: %d bytes at %d\n", block.Size, block.Offset)
+		for _, pair := range block.Pairs {
+			fmt.Fprintf(out, "  0x%08x %s, %d bytes\n", pair.ID, sigBlockIDs[pair.ID], len(pair.Value))
+		}
+		if channel := block.Get(WalleChannelID); channel != nil {
+			fmt.Fprintf(out, "walle channel: %s\n", channel)
+		}
+	}
+
+	fmt.Fprintf(out, "comment: %q\n", dir.Comment)
+	for _, path := range p.cpidPaths() {
+		if f := findFile(zipReader, path); f == nil {
+			fmt.Fprintf(out, "%s: not found\n", path)
+		} else if content, err := readEntry(f); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", path, err)
+		} else {
+			fmt.Fprintf(out, "%s: %q\n", path, content)
+		}
+	}
+	if p.MetaDataName != "" {
+		buf, err := readAndroidManifest(zipReader)
+		if err != nil {
+			return err
+		}
+		d, err := parseAXML(buf)
+		if err != nil {
+			return err
+		}
+		if value, ok := d.metaData(p.MetaDataName); ok {
+			fmt.Fprintf(out, "meta-data %s: %q\n", p.MetaDataName, value)
+		} else {
+			fmt.Fprintf(out, "meta-data %s: not found\n", p.MetaDataName)
+		}
+	}
+	return nil
+}
+
+// isSignatureFile reports whether name is a v1 signature file
+func isSignatureFile(name string) bool {
+	for _, ext := range []string{".SF", ".RSA", ".DSA", ".EC"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// dataAlignment returns the largest power of two up to 64KB that offset is
+// a multiple of
+func dataAlignment(offset int64) int64 {
+	align := int64(1)
+	for align < 65536 && offset%(align*2) == 0 {
+		align *= 2
+	}
+	return align
+}
@@ -0,0 +1,67 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInspectAPK(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDFile, p.CPIDPaths, p.V2Channel, p.MetaDataName = true, "cpid,assets/channel", false, ""
+
+	var buf bytes.Buffer
+	w := stdzip.NewWriter(&buf)
+	for _, f := range []struct {
+		name, content string
+		method        uint16
+	}{
+		{"classes.dex", "dex", stdzip.Deflate},
+		{"META-INF/CERT.SF", "sf", stdzip.Deflate},
+		{"META-INF/CERT.RSA", "rsa", stdzip.Deflate},
+		{"cpid", "c1", stdzip.Store},
+	} {
+		fw, _ := w.CreateHeader(&stdzip.FileHeader{Name: f.name, Method: f.method})
+		fw.Write([]byte(f.content))
+	}
+	w.SetComment("c0")
+	w.Close()
+	apk := withSigningBlock(t, buf.Bytes(), false, SigningPair{0x7109871a, []byte("v2")}, SigningPair{WalleChannelID, []byte(`{"channel":"c2"}`)})
+
+	var out bytes.Buffer
+	if err := p.inspectAPK(&out, bytes.NewReader(apk), int64(len(apk))); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"4 entries",
+		"signature files: META-INF/CERT.SF, META-INF/CERT.RSA\n",
+		"0x7109871a v2 signature, 2 bytes\n",
+		`walle channel: {"channel":"c2"}` + "\n",
+		`comment: "c0"` + "\n",
+		`cpid: "c1"` + "\n",
+		"assets/channel: not found\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q not in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDataAlignment(t *testing.T) {
+	tests := []struct {
+		offset, want int64
+	}{
+		{1, 1},
+		{6, 2},
+		{4096, 4096},
+		{3 * 16384, 16384},
+		{0, 65536},
+		{1 << 20, 65536},
+	}
+	for _, tt := range tests {
+		if got := dataAlignment(tt.offset); got != tt.want {
+			t.Errorf("offset %d: %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// consts ...
+const (
+	MetaInfoPath = "META-INF/"
+	ManifestPath = "META-INF/MANIFEST.MF"
+	SFPath       = "META-INF/%s.SF"
+	RSAPath      = "META-INF/%s.RSA"
+	SigFileName  = "CERT"
+	CPIDPath     = "cpid"
+	LineWidth    = 72 // bytes of a manifest line, without CRLF
+	OSSScheme    = "oss://"
+)
+
+// DefaultModTime is the time of appended entries in -deterministic mode
+var DefaultModTime = time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// manifestBase is a parsed manifest with the signature file lines of its
+// entries, parsed once per source and shared by the channels of a fan-out
+type manifestBase struct {
+	manifest *manifest
+	sf       map[*section]string // of the sections of manifest, see sfSection
+}
+
+// newManifestBase parses the manifest buf of the source, see StrictManifest
+// and LenientManifest, and computes the digests of its entries
+func (p *packer) newManifestBase(buf []byte) (*manifestBase, error) {
+	mode := parseDefault
+	switch {
+	case p.StrictManifest:
+		mode = parseStrict
+	case p.LenientManifest:
+		mode = parseLenient
+	}
+	m, err := parseManifestMode(buf, mode, func(err error) {
+		p.log().Warn("repaired manifest", "phase", PhaseOpen, "error", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := &manifestBase{manifest: m, sf: make(map[*section]string, len(m.sections))}
+	for _, s := range m.entries() {
+		b.sf[s] = sfSection(s)
+	}
+	return b, nil
+}
+
+// sfSection returns the lines of the entry s in the signature file, with
+// the digest of s as it is in the manifest
+func sfSection(s *section) string {
+	return wrapLine("Name: "+s.get("Name"), "\r\n") + "SHA1-Digest: " + sha1Sum(s.bytes()) + "\r\n\r\n"
+}
+
+// changeManifest writes the MANIFEST.MF changed by the manifest mutators, its
+// signature file and signature, computing only the digests changed from base
+func (p *packer) changeManifest(base *manifestBase, drop map[string]bool) error {
+	manifest := base.manifest.clone()
+	manifest.minimal = p.MinimalManifest
+	edit := &ManifestEdit{p: p, m: manifest}
+	for _, m := range p.manifestMutators(drop) {
+		if err := m.MutateManifest(edit); err != nil {
+			return err
+		}
+	}
+	for i, m := range p.ManifestMutators {
+		if err := m.MutateManifest(edit); err != nil {
+			return fmt.Errorf("manifest mutator %d: %v", i, err)
+		}
+	}
+
+	// write MANIFEST.MF
+	mf := manifest.bytes()
+	if err := p.writeWorkFile("MANIFEST.MF", mf); err != nil {
+		return err
+	}
+
+	// write CERT.SF
+	sf := &bytes.Buffer{}
+	sf.WriteString("Signature-Version: 1.0\r\n")
+	if signed := p.schemes.apkSigned(); signed != "" {
+		sf.WriteString(fmt.Sprintf("X-Android-APK-Signed: %s\r\n", signed))
+	}
+	mfDigest := sha1Sum(mf)
+	sf.WriteString(fmt.Sprintf("SHA1-Digest-Manifest: %s\r\n", mfDigest))
+	sf.WriteString("\r\n")
+
+	// the digest of each section, as it is in MANIFEST.MF
+	for _, s := range manifest.entries() {
+		line, ok := base.sf[s]
+		if !ok {
+			line = sfSection(s)
+		}
+		sf.WriteString(line)
+	}
+	if err := p.writeWorkFile(p.SigFileName+".SF", sf.Bytes()); err != nil {
+		return err
+	}
+	// parsed again before signing, so that a section written differently
+	// than its digest fails here rather than on install
+	if err := checkSignatureFile(sf.Bytes(), mf); err != nil {
+		return fmt.Errorf("check %s.SF: %v", p.SigFileName, err)
+	}
+
+	// write CERT.RSA
+	end := p.trace("sign")
+	rsa, err := p.signSF()
+	end(err)
+	if err != nil {
+		return err
+	}
+
+	return p.writeWorkFile(p.SigFileName+".RSA", rsa)
+}
+
+// writeWorkFile writes the file name to the work dir, or keeps it in
+// memory with InMemory
+func (p *packer) writeWorkFile(name string, buf []byte) error {
+	if p.InMemory {
+		if p.workFiles == nil {
+			p.workFiles = make(map[string][]byte)
+		}
+		p.workFiles[name] = buf
+		return nil
+	}
+	path := filepath.Join(p.WorkDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// readWorkFile reads the file name written by writeWorkFile
+func (p *packer) readWorkFile(name string) ([]byte, error) {
+	if p.InMemory {
+		buf, ok := p.workFiles[name]
+		if !ok {
+			return nil, fmt.Errorf("%s not found in memory", name)
+		}
+		return buf, nil
+	}
+	return ioutil.ReadFile(filepath.Join(p.WorkDir, name))
+}
+
+// setDigest adds or updates the entry of the file name in manifest
+func (p *packer) setDigest(m *manifest, name string, content []byte) {
+	s := m.edit(name)
+	if s != nil {
+		p.log().Debug("update digest", "phase", PhaseBuild, "name", name)
+	} else {
+		p.log().Debug("add digest", "phase", PhaseBuild, "name", name)
+		s = m.addEntry(name)
+	}
+	if removed := s.setDigests(content); len(removed) > 0 {
+		p.log().Warn("removed digests of unknown hashes", "phase", PhaseBuild, "name", name, "attributes", removed)
+	}
+}
+
+// wrapLine splits line into continuation lines of up to LineWidth bytes ending
+// with eol, each before a byte that can't continue a UTF-8 character
+func wrapLine(line, eol string) string {
+	var b strings.Builder
+	width := LineWidth
+	for len(line) > width {
+		i := width
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		if i == 0 {
+			// only bytes continuing a character, not UTF-8
+			i = width
+		}
+		b.WriteString(line[:i])
+		b.WriteString(eol + " ")
+		line = line[i:]
+		width = LineWidth - 1
+	}
+	b.WriteString(line)
+	b.WriteString(eol)
+	return b.String()
+}
+
+// readManifest reads the manifest of the apk in r, or builds it from the
+// entries read from ra if the apk is not signed
+func (p *packer) readManifest(ra io.ReaderAt, r *zip.Reader) ([]byte, error) {
+	var manifest []byte
+
+	for _, f := range r.File {
+		if f.Name == ManifestPath {
+			p.log().Debug("found manifest", "phase", PhaseOpen, "name", f.Name)
+
+			fr, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer fr.Close()
+			buf, err := ioutil.ReadAll(fr)
+			if err != nil {
+				return nil, err
+			}
+			manifest = buf
+		}
+
+		if strings.HasSuffix(f.Name, ".SF") &&
+			strings.HasPrefix(f.Name, MetaInfoPath) {
+			p.log().Debug("found signature file", "phase", PhaseOpen, "name", f.Name)
+
+			sigName := strings.TrimSuffix(f.Name, ".SF")
+			sigName = strings.TrimPrefix(sigName, MetaInfoPath)
+			p.SigFileName = sigName
+		}
+
+		if manifest != nil && p.SigFileName != "" {
+			return manifest, nil
+		}
+	}
+
+	if p.SigFileName == "" {
+		p.log().Info("using default signature file name", "phase", PhaseOpen, "name", SigFileName)
+		p.SigFileName = SigFileName
+	}
+	if manifest == nil {
+		p.log().Info("manifest not found, building it", "phase", PhaseOpen)
+		end := p.trace("manifest.build")
+		buf, err := p.buildManifest(ra, r)
+		end(err)
+		if err != nil {
+			return nil, fmt.Errorf("build manifest: %v", err)
+		}
+		manifest = buf
+	}
+	if err := p.memory.reserve(int64(len(manifest)), "manifest"); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readEntry reads the uncompressed content of f
+func readEntry(f *zip.File) ([]byte, error) {
+	fr, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	return ioutil.ReadAll(fr)
+}
+
+// isRepacked reports whether the dest apk is signed and already has the same
+// cpid and extra files, so that retries of a finished job can be skipped
+func (p *packer) isRepacked() (bool, error) {
+	if !p.needSign() && !p.CPIDComment && !p.V2Channel {
+		return false, nil
+	}
+
+	ossReader, err := p.openCached(p.DestAPK)
+	if err != nil {
+		return false, err
+	}
+	objectSize := ossReader.Size()
+	r, err := zip.NewReader(ossReader, objectSize)
+	if err != nil {
+		return false, err
+	}
+
+	if p.CPIDComment && r.Comment != p.CPIDContent {
+		p.log().Info("dest has different comment", "phase", PhaseCheck, "comment", r.Comment)
+		return false, nil
+	}
+	dir, err := ReadDirectory(ossReader, objectSize)
+	if err != nil {
+		return false, err
+	}
+	block, err := ReadSigningBlock(ossReader, dir.Offset)
+	if err != nil && p.V2Channel {
+		return false, err
+	}
+	if err != nil {
+		block = nil
+	}
+	if p.V2Channel {
+		if channel := block.Get(WalleChannelID); !bytes.Equal(channel, p.walleChannel()) {
+			p.log().Info("dest has different channel", "phase", PhaseCheck, "channel", channel)
+			return false, nil
+		}
+	}
+
+	// signed, with the schemes of the job if known
+	v1 := false
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, MetaInfoPath) && strings.HasSuffix(f.Name, ".SF") {
+			sigName := strings.TrimSuffix(f.Name, ".SF")
+			v1 = findFile(r, sigName+".RSA") != nil
+			break
+		}
+	}
+	mf := findFile(r, ManifestPath)
+	v1 = v1 && mf != nil
+	v2 := block != nil && block.Get(V2SignatureID) != nil
+	v3 := block != nil && block.Get(V3SignatureID) != nil
+	signed := v1 || v2 || v3
+	if s := p.schemes; s != (schemes{}) {
+		signed = (v1 || !s.v1) && (v2 || !s.v2) && (v3 || !s.v3)
+	}
+	if !signed {
+		p.log().Info("dest is not signed", "phase", PhaseCheck, "schemes", p.schemes.String())
+		return false, nil
+	}
+	var manifest *manifest
+	if v1 {
+		buf, err := readEntry(mf)
+		if err != nil {
+			return false, err
+		}
+		manifest, err = parseManifest(buf)
+		if err != nil {
+			p.log().Info("dest has malformed manifest", "phase", PhaseCheck, "error", err)
+			return false, nil
+		}
+	}
+	signedWith := func(name string, content []byte) bool {
+		if manifest != nil {
+			s := manifest.entry(name)
+			return s != nil && s.hasDigests(content)
+		}
+		// v2 and v3 sign the whole apk
+		f := findFile(r, name)
+		if f == nil {
+			return false
+		}
+		buf, err := readEntry(f)
+		return err == nil && bytes.Equal(buf, content)
+	}
+
+	// same main attributes
+	for _, a := range p.ManifestAttrs {
+		if manifest != nil && manifest.sections[0].get(a.Name) != a.Value {
+			p.log().Info("dest has different manifest attribute", "phase", PhaseCheck, "name", a.Name)
+			return false, nil
+		}
+	}
+	// none of the entries removed
+	removed, err := p.removedEntries(r)
+	if err != nil {
+		return false, err
+	}
+	if len(removed) > 0 {
+		p.log().Info("dest has entries to remove", "phase", PhaseCheck, "entries", removed)
+		return false, nil
+	}
+
+	if len(p.EntryTransformers) > 0 {
+		return p.sameEntries(r, signedWith)
+	}
+
+	// same cpid
+	for _, path := range p.cpidPaths() {
+		f := findFile(r, path)
+		if f == nil {
+			return false, nil
+		}
+		cpid, err := readEntry(f)
+		if err != nil {
+			return false, err
+		}
+		if string(cpid) != p.CPIDContent {
+			p.log().Info("dest has different cpid", "phase", PhaseCheck, "name", path, "cpid", cpid)
+			return false, nil
+		}
+		if !strings.HasPrefix(path, MetaInfoPath) && !signedWith(path, cpid) {
+			p.log().Info("dest has unsigned cpid", "phase", PhaseCheck, "name", path)
+			return false, nil
+		}
+	}
+	if p.MetaDataName != "" {
+		// setting the same meta-data again must not change anything
+		axml, err := readAndroidManifest(r)
+		if err != nil {
+			return false, err
+		}
+		changed, err := p.changeAndroidManifest(r)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(axml, changed) || !signedWith(AndroidManifestPath, axml) {
+			p.log().Info("dest has different meta-data", "phase", PhaseCheck, "name", p.MetaDataName)
+			return false, nil
+		}
+	}
+
+	// same extra files
+	for _, f := range p.ExtraFiles {
+		if !signedWith(f.Path, f.Content) {
+			p.log().Info("dest has different file", "phase", PhaseCheck, "name", f.Path)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sameEntries reports whether the dest apk in r has the entries newEntries
+// appends, as EntryTransformers change them, and signed
+func (p *packer) sameEntries(r *zip.Reader, signedWith func(name string, content []byte) bool) (bool, error) {
+	entries, err := p.newEntries(r)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		f := findFile(r, e.Header.Name)
+		if f == nil {
+			return false, nil
+		}
+		content, err := readEntry(f)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(content, e.Content) || !e.unlisted && !signedWith(e.Header.Name, content) {
+			p.log().Info("dest has different entry", "phase", PhaseCheck, "name", e.Header.Name)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// entryMethod returns zip.Store for entries listed in -store, or zip.Deflate
+func (p *packer) entryMethod(name string) uint16 {
+	for _, stored := range strings.Split(p.StoreEntries, ",") {
+		if strings.TrimSpace(stored) == name {
+			return zip.Store
+		}
+	}
+	return zip.Deflate
+}
+
+// modTime returns the time to stamp appended entries with. In -deterministic
+// mode it is SOURCE_DATE_EPOCH if set, or DefaultModTime.
+func (p *packer) modTime() time.Time {
+	if !p.Deterministic {
+		return time.Now()
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if sec, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC()
+		}
+		p.log().Warn("invalid SOURCE_DATE_EPOCH", "value", epoch)
+	}
+	return DefaultModTime
+}
+
+// copyFile ...
+func (p *packer) copyFile(w *Appender, to, name string) error {
+	content, err := p.readWorkFile(name)
+	if err != nil {
+		return err
+	}
+
+	header := &zip.FileHeader{
+		Name:   to,
+		Method: p.entryMethod(to),
+	}
+	header.SetModTime(p.modTime())
+
+	return w.WriteEntry(header, content)
+}
+
+// cpidPaths returns the paths of -cpid-path to write the cpid content to,
+// or none if -cpid-file is off or the cpid goes to the signing block
+func (p *packer) cpidPaths() []string {
+	if !p.CPIDFile || p.V2Channel {
+		return nil
+	}
+	return splitPaths(p.CPIDPaths)
+}
+
+// splitPaths returns the comma separated paths of list
+func splitPaths(list string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// loadExtraFiles reads the content of -add files from local disk or OSS
+func (p *packer) loadExtraFiles() error {
+	for i := range p.ExtraFiles {
+		f := &p.ExtraFiles[i]
+
+		var err error
+		if strings.HasPrefix(f.Source, OSSScheme) {
+			f.Content, err = ReadObject(p.ossConfig(), strings.TrimPrefix(f.Source, OSSScheme))
+		} else {
+			f.Content, err = ioutil.ReadFile(f.Source)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Source, err)
+		}
+		if err := p.memory.reserve(int64(len(f.Content)), "extra file "+f.Path); err != nil {
+			return err
+		}
+		p.log().Info("loaded extra file", "name", f.Path, "bytes", len(f.Content))
+	}
+	return nil
+}
+
+// findFile returns the entry of the name in r, or nil if not found
+func findFile(r *zip.Reader, name string) *zip.File {
+	for _, f := range r.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// inheritHeader copies the flags, such as the utf-8 name flag, attributes,
+// extra fields and time of the old entry to header of its replacement
+func inheritHeader(header *zip.FileHeader, old *zip.File) {
+	header.CreatorVersion = old.CreatorVersion
+	header.Flags = old.Flags
+	header.ExternalAttrs = old.ExternalAttrs
+	header.Extra = old.Extra
+	header.Comment = old.Comment
+	header.ModifiedTime = old.ModifiedTime
+	header.ModifiedDate = old.ModifiedDate
+}
+
+// replaceMethod returns Store if old is stored or name is in -store, or
+// Deflate for the other methods the appender can't write
+func (p *packer) replaceMethod(name string, old *zip.File) uint16 {
+	if old.Method == zip.Store {
+		return zip.Store
+	}
+	return p.entryMethod(name)
+}
+
+// needSign reports whether any entry is added or changed, so that the apk
+// must be signed again
+func (p *packer) needSign() bool {
+	return p.Sign || len(p.cpidPaths()) > 0 || p.MetaDataName != "" || len(p.ExtraFiles) > 0 || len(p.ManifestAttrs) > 0 || len(p.EntryRules) > 0
+}
+
+// staleEntries returns the entries superseded by appendFiles
+func (p *packer) staleEntries() map[string]bool {
+	names := map[string]bool{}
+	if p.schemes.v1 {
+		names[ManifestPath] = true
+		names[fmt.Sprintf(SFPath, p.SigFileName)] = true
+		names[fmt.Sprintf(RSAPath, p.SigFileName)] = true
+	}
+	for _, path := range p.cpidPaths() {
+		names[path] = true
+	}
+	return names
+}
+
+// appendFiles appends the entries of p.appended and the new signature to w
+func (p *packer) appendFiles(w *Appender) error {
+	for _, e := range p.appended {
+		if err := w.WriteEntry(e.Header, e.Content); err != nil {
+			return fmt.Errorf("copy %s: %v", e.Header.Name, err)
+		}
+	}
+	// copy meta files: MANIFEST.MF/CERT.SF/CERT.RSA
+	if !p.schemes.v1 {
+		return nil
+	}
+	if err := p.copyMeta(w); err != nil {
+		return fmt.Errorf("copy meta: %v", err)
+	}
+	return nil
+}
+
+// copyMeta ...
+func (p *packer) copyMeta(w *Appender) error {
+	// MANIFEST.MF
+	source := "MANIFEST.MF"
+	dest := ManifestPath
+	if err := p.copyFile(w, dest, source); err != nil {
+		return err
+	}
+	// CERT.SF
+	source = p.SigFileName + ".SF"
+	dest = fmt.Sprintf(SFPath, p.SigFileName)
+	if err := p.copyFile(w, dest, source); err != nil {
+		return err
+	}
+
+	// CERT.RSA
+	source = p.SigFileName + ".RSA"
+	dest = fmt.Sprintf(RSAPath, p.SigFileName)
+	if err := p.copyFile(w, dest, source); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,441 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestSetDigest(t *testing.T) {
+	const manifest = "Manifest-Version: 1.0\r\n\r\n" +
+		"Name: classes.dex\r\nSHA1-Digest: dex\r\n\r\n" +
+		"Name: cpid\r\nSHA1-Digest: old\r\n\r\n"
+	long := "assets/" + strings.Repeat("x", 80) + ".json"
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"update", "cpid", strings.Replace(manifest, "SHA1-Digest: old", "SHA1-Digest: "+sha1Sum([]byte("new")), 1)},
+		{"add", "assets/channel.json", manifest + "Name: assets/channel.json\r\nSHA1-Digest: " + sha1Sum([]byte("new")) + "\r\n\r\n"},
+		{"add wrapped", long, manifest + wrapLine("Name: "+long, "\r\n") + "SHA1-Digest: " + sha1Sum([]byte("new")) + "\r\n\r\n"},
+	}
+	p := &packer{Options: DefaultOptions()}
+	for _, tt := range tests {
+		m, err := parseManifest([]byte(manifest))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p.setDigest(m, tt.path, []byte("new"))
+		if got := string(m.bytes()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManifestBase(t *testing.T) {
+	const manifest = "Manifest-Version: 1.0\r\n\r\n" +
+		"Name: classes.dex\r\nSHA1-Digest: dex\r\n\r\n" +
+		"Name: cpid\r\nSHA1-Digest: old\r\n\r\n"
+	p := &packer{Options: DefaultOptions()}
+	base, err := p.newManifestBase([]byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the channels change their clones only
+	for _, channel := range []string{"huawei", "xiaomi"} {
+		m := base.manifest.clone()
+		p.setDigest(m, "cpid", []byte(channel))
+		want := strings.Replace(manifest, "SHA1-Digest: old", "SHA1-Digest: "+sha1Sum([]byte(channel)), 1)
+		if got := string(m.bytes()); got != want {
+			t.Errorf("%s: %q", channel, got)
+		}
+		entries := m.entries()
+		if line, ok := base.sf[entries[0]]; !ok || line != sfSection(entries[0]) {
+			t.Errorf("%s: sf of classes.dex not shared: %q", channel, line)
+		}
+		if _, ok := base.sf[entries[1]]; ok {
+			t.Errorf("%s: sf of the changed cpid taken from the base", channel)
+		}
+	}
+	if got := string(base.manifest.bytes()); got != manifest {
+		t.Errorf("base changed: %q", got)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	for _, n := range []int{1, LineWidth, LineWidth + 1, 3*LineWidth + 5} {
+		line := strings.Repeat("a", n)
+		lines := strings.Split(strings.TrimSuffix(wrapLine(line, "\r\n"), "\r\n"), "\r\n")
+		var joined string
+		for i, l := range lines {
+			if len(l) > LineWidth {
+				t.Errorf("%d: line %d of %d bytes", n, i, len(l))
+			}
+			if i > 0 {
+				l = strings.TrimPrefix(l, " ")
+			}
+			joined += l
+		}
+		if joined != line {
+			t.Errorf("%d: wrapped %q", n, wrapLine(line, "\r\n"))
+		}
+	}
+
+	// the 3 bytes of each character stay on one line
+	line := "Name: assets/" + strings.Repeat("渠道", 30) + ".json"
+	for i, l := range strings.Split(strings.TrimSuffix(wrapLine(line, "\r\n"), "\r\n"), "\r\n") {
+		if len(l) > LineWidth || !utf8.ValidString(l) {
+			t.Errorf("line %d: %q", i, l)
+		}
+	}
+}
+
+func TestNewEntriesReplace(t *testing.T) {
+	var src bytes.Buffer
+	w := stdzip.NewWriter(&src)
+	for _, e := range []struct {
+		name   string
+		method uint16
+	}{{"assets/stored.json", stdzip.Store}, {"assets/deflated.json", stdzip.Deflate}, {"assets/bzip2.json", 12}} {
+		f, _ := w.CreateRaw(&stdzip.FileHeader{Name: e.name, Method: e.method})
+		f.Write([]byte("old"))
+	}
+	w.Close()
+	r, err := zip.NewReader(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDFile = false
+	for _, name := range []string{"assets/stored.json", "assets/deflated.json", "assets/bzip2.json"} {
+		p.ExtraFiles = append(p.ExtraFiles, ExtraFile{Path: name, Replace: true, Content: []byte("new " + name)})
+	}
+	entries, err := p.newEntries(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint16{"assets/stored.json": zip.Store, "assets/deflated.json": zip.Deflate, "assets/bzip2.json": zip.Deflate}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries", len(entries))
+	}
+	for _, e := range entries {
+		if e.Header.Method != want[e.Header.Name] || string(e.Content) != "new "+e.Header.Name {
+			t.Errorf("%s: method %d, %q", e.Header.Name, e.Header.Method, e.Content)
+		}
+	}
+}
+
+func TestEntryMethod(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	p.StoreEntries = "cpid, assets/channel.json"
+	tests := []struct {
+		name   string
+		method uint16
+	}{
+		{"cpid", zip.Store},
+		{"assets/channel.json", zip.Store},
+		{"assets/channel", zip.Deflate},
+		{"META-INF/MANIFEST.MF", zip.Deflate},
+	}
+	for _, tt := range tests {
+		if method := p.entryMethod(tt.name); method != tt.method {
+			t.Errorf("%s: method %d, want %d", tt.name, method, tt.method)
+		}
+	}
+}
+
+func TestIsRepacked(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	buildAPK := func(cpid string, signed bool) []byte {
+		m, _ := parseManifest([]byte("Manifest-Version: 1.0\r\n\r\n"))
+		p.setDigest(m, CPIDPath, []byte(cpid))
+		p.setDigest(m, "assets/channel.json", []byte("{}"))
+		files := [][2]string{{ManifestPath, string(m.bytes())}, {"META-INF/CERT.SF", "sf"}, {"assets/channel.json", "{}"}, {CPIDPath, cpid}}
+		if signed {
+			files = append(files, [2]string{"META-INF/CERT.RSA", "rsa"})
+		}
+		var buf bytes.Buffer
+		w := stdzip.NewWriter(&buf)
+		for _, f := range files {
+			fw, _ := w.Create(f[0])
+			fw.Write([]byte(f[1]))
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	server := newOSSServer(map[string][]byte{
+		"bucket/same.apk":     buildAPK("c1", true),
+		"bucket/other.apk":    buildAPK("c2", true),
+		"bucket/unsigned.apk": buildAPK("c1", false),
+	})
+	defer server.Close()
+
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.CPIDContent, p.CPIDFile = "c1", true
+	tests := []struct {
+		name  string
+		dest  string
+		extra string
+		want  bool
+	}{
+		{"same cpid", "same.apk", "{}", true},
+		{"different cpid", "other.apk", "{}", false},
+		{"unsigned", "unsigned.apk", "{}", false},
+		{"different extra file", "same.apk", "{\"a\":1}", false},
+	}
+	for _, tt := range tests {
+		p.DestAPK = "bucket/" + tt.dest
+		p.ExtraFiles = ExtraFiles{{Path: "assets/channel.json", Content: []byte(tt.extra)}}
+		got, err := p.isRepacked()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	p.DestAPK = "bucket/missing.apk"
+	if _, err := p.isRepacked(); err == nil {
+		t.Error("no error of a missing dest")
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+	p.PrivateKeyPEM, p.CertPEM = writeKeyPair(t, dir)
+	p.WorkDir, p.CPIDContent, p.CPIDFile, p.ExtraFiles = dir, "c1", true, nil
+	p.Deterministic = true
+
+	tests := []struct {
+		epoch string
+		want  time.Time
+	}{
+		{"", DefaultModTime},
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"yesterday", DefaultModTime},
+	}
+	for _, tt := range tests {
+		t.Setenv("SOURCE_DATE_EPOCH", tt.epoch)
+		if got := p.modTime(); !got.Equal(tt.want) {
+			t.Errorf("SOURCE_DATE_EPOCH=%s: %v, want %v", tt.epoch, got, tt.want)
+		}
+	}
+
+	apk := zipOf(ManifestPath, "Manifest-Version: 1.0\r\n\r\n", "classes.dex", "dex")
+	first, err := p.repackBytes(apk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.repackBytes(apk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("repacked twice to different bytes")
+	}
+	r, err := stdzip.NewReader(bytes.NewReader(first), int64(len(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File[2:] {
+		if !f.Modified.Equal(DefaultModTime) {
+			t.Errorf("%s: modified at %v", f.Name, f.Modified)
+		}
+	}
+}
+
+func TestCPIDPaths(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+	p.PrivateKeyPEM, p.CertPEM = writeKeyPair(t, dir)
+	p.WorkDir, p.CPIDContent, p.CPIDFile, p.ExtraFiles = dir, "c1", true, nil
+	p.CPIDPaths = "cpid, META-INF/channel.txt,,assets/channel"
+	p.schemes = schemes{v1: true}
+
+	apk, err := p.repackBytes(zipOf(ManifestPath, "Manifest-Version: 1.0\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mf []byte
+	for _, f := range r.File {
+		if f.Name == ManifestPath {
+			mf, _ = readEntry(f) // the appended one
+		}
+	}
+	m, err := parseManifest(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, signed := range map[string]bool{"cpid": true, "META-INF/channel.txt": false, "assets/channel": true} {
+		f := findFile(r, path)
+		if f == nil {
+			t.Fatalf("%s not found", path)
+		}
+		if cpid, err := readEntry(f); err != nil || string(cpid) != "c1" {
+			t.Errorf("%s: %q, %v", path, cpid, err)
+		}
+		if s := m.entry(path); (s != nil) != signed {
+			t.Errorf("%s: in the manifest %v, want %v", path, s != nil, signed)
+		}
+	}
+
+	p.CPIDFile = false
+	if paths := p.cpidPaths(); len(paths) != 0 {
+		t.Errorf("paths %v with -cpid-file=false", paths)
+	}
+}
+
+func TestCPIDComment(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDContent, p.CPIDComment, p.CPIDFile, p.MetaDataName, p.ExtraFiles = "c1", true, false, "", nil
+
+	src := zipOf(ManifestPath, "Manifest-Version: 1.0\r\n\r\n", "META-INF/CERT.SF", "sf", "META-INF/CERT.RSA", "rsa")
+	apk, err := p.repackBytes(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != "c1" || len(r.File) != 3 {
+		t.Errorf("comment %q, %d entries", r.Comment, len(r.File))
+	}
+
+	// the comment is all that changes, so the signature still holds
+	server := newOSSServer(map[string][]byte{"bucket/dest.apk": apk})
+	defer server.Close()
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.DestAPK = "bucket/dest.apk"
+	for cpid, want := range map[string]bool{"c1": true, "c2": false} {
+		p.CPIDContent = cpid
+		if got, err := p.isRepacked(); err != nil || got != want {
+			t.Errorf("cpid %s: %v, %v, want %v", cpid, got, err, want)
+		}
+	}
+
+	p.CPIDContent = strings.Repeat("x", maxCommentLen+1)
+	if _, err := p.repackBytes(src); err == nil {
+		t.Error("no error of a comment over 64KB")
+	}
+}
+
+func TestInheritHeader(t *testing.T) {
+	modified := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	custom := []byte{0xfe, 0xca, 2, 0, 'h', 'i'}
+	zip64 := []byte{0x01, 0x00, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	var src bytes.Buffer
+	w := stdzip.NewWriter(&src)
+	for _, h := range []*stdzip.FileHeader{
+		{Name: "assets/渠道.json", Method: stdzip.Deflate, Extra: append(append([]byte(nil), custom...), zip64...)},
+		{Name: AndroidManifestPath, Method: 12},
+	} {
+		h.SetModTime(modified)
+		f, _ := w.CreateRaw(h)
+		f.Write([]byte("old"))
+	}
+	w.Close()
+	r, err := zip.NewReader(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDFile, p.Deterministic = false, false
+	p.ExtraFiles = ExtraFiles{
+		{Path: "assets/渠道.json", Replace: true, Content: []byte("new")},
+		{Path: AndroidManifestPath, Replace: true, Content: []byte("axml")},
+	}
+	if p.appended, err = p.newEntries(r); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadDirectory(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	out.Write(src.Bytes()[:d.Offset])
+	a := d.Append(&out)
+	if err := p.appendFiles(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := stdzip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replacements take the places of the old entries in the directory
+	for _, f := range dest.File {
+		if !f.Modified.Equal(modified) {
+			t.Errorf("%s: modified at %v, want %v", f.Name, f.Modified, modified)
+		}
+		if f.Method != stdzip.Deflate {
+			t.Errorf("%s: method %d", f.Name, f.Method)
+		}
+	}
+	f := dest.File[0]
+	if f.Flags&0x800 == 0 {
+		t.Errorf("%s: flags %#x without the utf-8 name flag", f.Name, f.Flags)
+	}
+	if !bytes.Equal(f.Extra, custom) {
+		t.Errorf("%s: extra %x, want %x without zip64", f.Name, f.Extra, custom)
+	}
+}
+
+func TestRemoveExtra(t *testing.T) {
+	extra := []byte{
+		0x01, 0x00, 4, 0, 1, 2, 3, 4, // zip64
+		0xfe, 0xca, 1, 0, 'x',
+		0x35, 0xd9, 2, 0, 0, 0, // alignment
+	}
+	tests := []struct {
+		name  string
+		extra []byte
+		ids   []uint16
+		want  []byte
+	}{
+		{"none", extra, nil, extra},
+		{"zip64 and alignment", extra, []uint16{zip64ExtraID, alignExtraID}, extra[8:13]},
+		{"all", extra, []uint16{zip64ExtraID, alignExtraID, 0xcafe}, nil},
+		{"truncated", extra[:len(extra)-1], []uint16{zip64ExtraID}, extra[8:13]},
+	}
+	for _, tt := range tests {
+		if got := removeExtra(tt.extra, tt.ids...); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWorkFiles(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		dir := t.TempDir()
+		p := &packer{Options: Options{WorkDir: dir, InMemory: inMemory}}
+		if err := p.writeWorkFile(AndroidManifestPath, []byte("axml")); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := p.readWorkFile(AndroidManifestPath); err != nil || string(buf) != "axml" {
+			t.Errorf("in memory %v: %q, %v", inMemory, buf, err)
+		}
+		files, _ := ioutil.ReadDir(dir)
+		if inMemory != (len(files) == 0) {
+			t.Errorf("in memory %v: %d files in the work dir", inMemory, len(files))
+		}
+		if _, err := p.readWorkFile("CERT.SF"); err == nil {
+			t.Errorf("in memory %v: read a file never written", inMemory)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package repack
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// KeyRule signs the apks of Package and Channel with its key and cert, both
+// patterns like com.example.* and empty for any
+type KeyRule struct {
+	Package        string `json:"package"`
+	Channel        string `json:"channel"`
+	CertPEM        string `json:"cert_pem"`
+	PrivateKeyPEM  string `json:"priv_pem"`
+	PrivateKeyBlob string `json:"priv_blob"`
+	KeySecretName  string `json:"key_secret_name"`
+	CertSecretName string `json:"cert_secret_name"`
+
+	// next key of a rotation, see Options.NextPrivateKeyPEM
+	NextCertPEM       string `json:"next_cert_pem"`
+	NextPrivateKeyPEM string `json:"next_priv_pem"`
+}
+
+// matches reports whether the rule is of the package and channel
+func (r KeyRule) matches(pkg, channel string) bool {
+	match := func(pattern, s string) bool {
+		ok, _ := path.Match(pattern, s)
+		return pattern == "" || ok
+	}
+	return match(r.Package, pkg) && match(r.Channel, channel)
+}
+
+// applyTo sets the keys and certs of opts to those of the rule
+func (r KeyRule) applyTo(opts *Options) {
+	opts.CertPEM, opts.CertSecretName = r.CertPEM, r.CertSecretName
+	opts.PrivateKeyPEM, opts.PrivateKeyBlob, opts.KeySecretName = r.PrivateKeyPEM, r.PrivateKeyBlob, r.KeySecretName
+	opts.NextCertPEM, opts.NextPrivateKeyPEM = r.NextCertPEM, r.NextPrivateKeyPEM
+}
+
+// loadKeyMap reads the rules of KeyMap, a json array of KeyRule, and
+// checks the patterns and keys of each
+func (p *packer) loadKeyMap(add func(format string, args ...interface{})) {
+	buf, err := p.readPEM(p.KeyMap)
+	if err != nil {
+		add("-key-map: %v", err)
+		return
+	}
+	var rules []KeyRule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		add("-key-map: %v", err)
+		return
+	}
+	for i, r := range rules {
+		if _, err := path.Match(r.Package, ""); err != nil {
+			add("-key-map rule %d: package %q: %v", i+1, r.Package, err)
+		}
+		if _, err := path.Match(r.Channel, ""); err != nil {
+			add("-key-map rule %d: channel %q: %v", i+1, r.Channel, err)
+		}
+		if !p.needSign() {
+			continue
+		}
+		q := &packer{Options: p.Options}
+		r.applyTo(&q.Options)
+		ruleAdd := func(format string, args ...interface{}) {
+			add("-key-map rule %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+		q.checkKeys(ruleAdd)
+		q.checkNextKey(ruleAdd)
+	}
+	p.keyRules = rules
+}
+
+// hasKey reports whether the options give a key and cert of their own, to
+// sign the apks no rule of the key map matches
+func (p *packer) hasKey() bool {
+	return (p.PrivateKeyPEM != "" || p.PrivateKeyBlob != "" || p.KeySecretName != "") &&
+		(p.CertPEM != "" || p.CertSecretName != "")
+}
+
+// selectKey sets the key and cert of the job to those of the first rule of
+// the key map matching its package and channel
+func (p *packer) selectKey(job Job) error {
+	for i, r := range p.keyRules {
+		if r.matches(job.PackageName, job.Channel) {
+			r.applyTo(&p.Options)
+			p.keyPEM, p.certPEM = nil, nil
+			p.log().Info("selected key", "rule", i+1, "package", job.PackageName)
+			return nil
+		}
+	}
+	if len(p.keyRules) > 0 && p.needSign() && !p.hasKey() {
+		return fmt.Errorf("no rule of -key-map for package %s and channel %q", job.PackageName, job.Channel)
+	}
+	return nil
+}
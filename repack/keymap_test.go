@@ -0,0 +1,84 @@
+package repack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule         KeyRule
+		pkg, channel string
+		want         bool
+	}{
+		{KeyRule{}, "com.a", "huawei", true},
+		{KeyRule{Package: "com.a"}, "com.a", "", true},
+		{KeyRule{Package: "com.a"}, "com.b", "", false},
+		{KeyRule{Package: "com.*"}, "com.b", "", true},
+		{KeyRule{Package: "com.*", Channel: "hua*"}, "com.b", "huawei", true},
+		{KeyRule{Package: "com.*", Channel: "hua*"}, "com.b", "xiaomi", false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.pkg, tt.channel); got != tt.want {
+			t.Errorf("%+v of %s %s: %v", tt.rule, tt.pkg, tt.channel, got)
+		}
+	}
+}
+
+func TestKeyMap(t *testing.T) {
+	dir := t.TempDir()
+	keyA, certA := writeKeyPair(t, dir)
+	keyB, certB := writeKeyPair(t, t.TempDir())
+	writeRules := func(rules ...KeyRule) string {
+		buf, _ := json.Marshal(rules)
+		name := filepath.Join(dir, "keys.json")
+		ioutil.WriteFile(name, buf, 0644)
+		return name
+	}
+
+	opts := DefaultOptions()
+	opts.KeyMap = writeRules(
+		KeyRule{Package: "com.a", Channel: "huawei", PrivateKeyPEM: keyA, CertPEM: certA},
+		KeyRule{Package: "com.*", PrivateKeyPEM: keyB, CertPEM: certB},
+	)
+	p := &packer{Options: opts, ctx: context.Background()}
+	var problems []string
+	add := func(format string, args ...interface{}) { problems = append(problems, format) }
+	p.loadKeyMap(add)
+	if len(problems) != 0 || len(p.keyRules) != 2 {
+		t.Fatalf("problems %v", problems)
+	}
+	for _, tt := range []struct{ pkg, channel, key string }{
+		{"com.a", "huawei", keyA},
+		{"com.a", "xiaomi", keyB},
+		{"com.b", "", keyB},
+	} {
+		q := &packer{Options: opts, keyRules: p.keyRules}
+		if err := q.selectKey(Job{PackageName: tt.pkg, Channel: tt.channel}); err != nil || q.PrivateKeyPEM != tt.key {
+			t.Errorf("%s %s: key %s: %v", tt.pkg, tt.channel, q.PrivateKeyPEM, err)
+		}
+	}
+	// no rule and no key of the options
+	q := &packer{Options: opts, keyRules: p.keyRules}
+	if err := q.selectKey(Job{PackageName: "org.c"}); err == nil || !strings.Contains(err.Error(), "no rule of -key-map") {
+		t.Errorf("no rule: %v", err)
+	}
+	q.PrivateKeyPEM, q.CertPEM = keyA, certA
+	if err := q.selectKey(Job{PackageName: "org.c"}); err != nil || q.PrivateKeyPEM != keyA {
+		t.Errorf("key of the options: %v", err)
+	}
+
+	// bad patterns and keys of the rules
+	p = &packer{Options: opts, ctx: context.Background()}
+	p.KeyMap = writeRules(KeyRule{Package: "com.[", PrivateKeyPEM: keyA, CertPEM: certB})
+	problems = nil
+	p.loadKeyMap(func(format string, args ...interface{}) { problems = append(problems, fmt.Sprintf(format, args...)) })
+	if len(problems) != 2 || !strings.Contains(problems[0], `package "com.["`) || !strings.Contains(problems[1], "is not the key of") {
+		t.Errorf("problems %v", problems)
+	}
+}
@@ -0,0 +1,285 @@
+package repack
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kmsVersion is the version of the KMS RPC API
+const kmsVersion = "2016-01-20"
+
+// KMSClient is a client of the KMS RPC API, as there is no vendored KMS
+// SDK. The requests are signed with the OSS credentials.
+type KMSClient struct {
+	Endpoint        string // kms.<region>.aliyuncs.com or kms-vpc.<region>.aliyuncs.com
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+	Client          *http.Client
+}
+
+// KMSError is the error body of the KMS API
+type KMSError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"Code"`
+	Message   string `json:"Message"`
+	RequestID string `json:"RequestId"`
+	HostID    string `json:"HostId"`
+}
+
+func (e *KMSError) Error() string {
+	return fmt.Sprintf("kms: %d %s: %s, request id: %s", e.Status, e.Code, e.Message, e.RequestID)
+}
+
+// KeyEnvelope is a private key pem encrypted with aes-gcm by a data key of
+// KMS, which only KMS can decrypt. It is stored as json in place of the pem.
+type KeyEnvelope struct {
+	CiphertextBlob string `json:"ciphertext_blob"` // of the data key, from GenerateDataKey
+	Nonce          string `json:"nonce"`           // base64 of the aes-gcm nonce
+	Ciphertext     string `json:"ciphertext"`      // base64 of the pem sealed with the data key
+}
+
+// Decrypt returns the plaintext of a ciphertext blob of KMS
+func (c *KMSClient) Decrypt(ctx context.Context, blob string) (string, error) {
+	var resp struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	err := c.do(ctx, "Decrypt", url.Values{"CiphertextBlob": {blob}}, &resp)
+	return resp.Plaintext, err
+}
+
+// GenerateDataKey returns a new aes-256 data key of the KMS key keyID, and
+// the ciphertext blob of it
+func (c *KMSClient) GenerateDataKey(ctx context.Context, keyID string) ([]byte, string, error) {
+	var resp struct {
+		Plaintext      string `json:"Plaintext"`
+		CiphertextBlob string `json:"CiphertextBlob"`
+	}
+	if err := c.do(ctx, "GenerateDataKey", url.Values{"KeyId": {keyID}, "KeySpec": {"AES_256"}}, &resp); err != nil {
+		return nil, "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, "", fmt.Errorf("kms: invalid data key: %v", err)
+	}
+	return key, resp.CiphertextBlob, nil
+}
+
+// SealKey encrypts the pem plain with a new data key of the KMS key keyID
+func (c *KMSClient) SealKey(ctx context.Context, keyID string, plain []byte) (*KeyEnvelope, error) {
+	key, blob, err := c.GenerateDataKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &KeyEnvelope{
+		CiphertextBlob: blob,
+		Nonce:          base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext:     base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plain, nil)),
+	}, nil
+}
+
+// OpenKey returns the pem of buf, a KeyEnvelope as json, or else the
+// ciphertext blob of the pem encrypted by KMS Encrypt
+func (c *KMSClient) OpenKey(ctx context.Context, buf []byte) ([]byte, error) {
+	buf = []byte(strings.TrimSpace(string(buf)))
+	var env KeyEnvelope
+	if err := json.Unmarshal(buf, &env); err != nil || env.CiphertextBlob == "" {
+		plain, err := c.Decrypt(ctx, string(buf))
+		return []byte(plain), err
+	}
+
+	plain, err := c.Decrypt(ctx, env.CiphertextBlob)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(plain)
+	if err != nil {
+		return nil, fmt.Errorf("kms: invalid data key: %v", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %v", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(nonce))
+	}
+	opened, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt the key envelope: %v", err)
+	}
+	return opened, nil
+}
+
+// newGCM returns the aes-gcm of key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// do sends a signed request of action, and decodes the response into v
+func (c *KMSClient) do(ctx context.Context, action string, params url.Values, v interface{}) error {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	params.Set("Action", action)
+	params.Set("Format", "JSON")
+	params.Set("Version", kmsVersion)
+	params.Set("AccessKeyId", c.AccessKeyID)
+	params.Set("SignatureMethod", "HMAC-SHA1")
+	params.Set("SignatureVersion", "1.0")
+	params.Set("SignatureNonce", hex.EncodeToString(nonce))
+	params.Set("Timestamp", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	if c.SecurityToken != "" {
+		params.Set("SecurityToken", c.SecurityToken)
+	}
+	params.Set("Signature", rpcSignature("POST", params, c.AccessKeySecret))
+
+	endpoint := c.Endpoint
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(endpoint, "/")+"/", strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms: %v", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("kms: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		e := &KMSError{Status: resp.StatusCode}
+		json.Unmarshal(buf, e)
+		return e
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("kms: invalid response: %v", err)
+	}
+	return nil
+}
+
+// rpcSignature returns the signature of the params of an RPC API request
+func rpcSignature(method string, params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = rpcEscape(k) + "=" + rpcEscape(params.Get(k))
+	}
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write([]byte(method + "&" + rpcEscape("/") + "&" + rpcEscape(strings.Join(pairs, "&"))))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// rpcEscape percent encodes s as the RPC API signs it
+func rpcEscape(s string) string {
+	s = url.QueryEscape(s)
+	return strings.NewReplacer("+", "%20", "*", "%2A", "%7E", "~").Replace(s)
+}
+
+// SealPrivateKey encrypts the private key pem of opts with a new data key
+// of the KMS key keyID
+func SealPrivateKey(ctx context.Context, opts Options, keyID string) (*KeyEnvelope, error) {
+	p := &packer{Options: opts}
+	switch {
+	case p.PrivateKeyPEM == "":
+		return nil, errorOf(KindConfig, fmt.Errorf("-priv-pem is required"))
+	case p.KMSEndpoint == "":
+		return nil, errorOf(KindConfig, fmt.Errorf("-kms-ep is required"))
+	case keyID == "":
+		return nil, errorOf(KindConfig, fmt.Errorf("-kms-key-id is required"))
+	}
+	buf, err := p.readPEM(p.PrivateKeyPEM)
+	if err != nil {
+		return nil, errorOf(KindConfig, err)
+	}
+	if block, _ := pem.Decode(buf); block == nil {
+		return nil, errorOf(KindConfig, fmt.Errorf("no pem block in %s", p.PrivateKeyPEM))
+	}
+	env, err := p.kmsClient().SealKey(ctx, keyID, buf)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt the private key with kms: %v", err)
+	}
+	return env, nil
+}
+
+// openedKeys are the pems decrypted by KMS, by the sha-256 of their
+// ciphertext and of the credentialsKey that decrypted them
+var openedKeys sync.Map
+
+// openKey decrypts buf, an envelope or a ciphertext blob of KMS, see
+// KMSClient.OpenKey, keeping it unless PrivateSecrets
+func (p *packer) openKey(buf []byte) ([]byte, error) {
+	sum := sha256.Sum256(append([]byte(p.credentialsKey()+"\n"), buf...))
+	if opened, ok := openedKeys.Load(sum); ok && !p.PrivateSecrets {
+		return opened.([]byte), nil
+	}
+	end := p.trace("kms.decrypt")
+	opened, err := p.kmsClient().OpenKey(p.jobContext(), buf)
+	end(err)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt the private key with kms: %v", err)
+	}
+	if !p.PrivateSecrets {
+		openedKeys.Store(sum, opened)
+	}
+	return opened, nil
+}
+
+// kmsClient returns the client of KMSEndpoint
+func (p *packer) kmsClient() *KMSClient {
+	return &KMSClient{
+		Endpoint:        p.KMSEndpoint,
+		AccessKeyID:     p.OSSAccessKeyID,
+		AccessKeySecret: p.OSSAccessKeySecret,
+		SecurityToken:   p.OSSSecurityToken,
+	}
+}
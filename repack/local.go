@@ -0,0 +1,286 @@
+package repack
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// SignLocal signs the local apk opts.SourceAPK again to the local file
+// opts.DestAPK like Sign, without OSS but for the keys and extra files
+func SignLocal(ctx context.Context, opts Options) (result Result, err error) {
+	p := &packer{Options: signOptions(opts), memory: newMemoryBudget(opts.MaxMemory)}
+	p.ExtraFiles = append(ExtraFiles(nil), opts.ExtraFiles...)
+	if err := p.checkLocalConfig(); err != nil {
+		return Result{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, errorOf(KindCanceled, err)
+	}
+	cleanup, err := p.makeWorkDir()
+	if err != nil {
+		return Result{}, errorOf(KindConfig, err)
+	}
+	defer cleanup()
+	end := p.startJob(ctx, slog.String("source", p.SourceAPK))
+	defer func() { end(err) }()
+
+	start := time.Now()
+	p.progress(PhaseOpen, p.DestAPK)
+	f, err := os.Open(p.SourceAPK)
+	if err != nil {
+		return Result{}, errorOf(KindSource, err)
+	}
+	defer f.Close()
+	src, err := p.openLocalSource(f)
+	if err != nil {
+		return Result{}, errorOf(KindSource, err)
+	}
+	if err := p.selectKey(p.newJob(src, "")); err != nil {
+		return Result{}, errorOf(KindConfig, err)
+	}
+
+	result = Result{Dest: p.DestAPK, Info: src.Info, SourceSize: src.Size}
+	p.progress(PhaseBuild, p.DestAPK)
+	result.Appended, err = p.writeLocal(src)
+	if err != nil {
+		return result, err
+	}
+	if p.VerifySignature {
+		p.progress(PhaseValidate, p.DestAPK)
+		if err := p.verifyLocal(p.DestAPK); err != nil {
+			return result, errorOf(KindVerify, fmt.Errorf("verify %s: %v", p.DestAPK, err))
+		}
+	}
+	if err := p.describeLocal(&result); err != nil {
+		return result, fmt.Errorf("describe dest: %v", err)
+	}
+	if err := p.audit("", result); err != nil {
+		return result, err
+	}
+	p.progress(PhaseDone, p.DestAPK)
+	p.log().Info("signed", "phase", PhaseDone, "dest", p.DestAPK, "duration", time.Since(start))
+	return result, nil
+}
+
+// checkLocalConfig checks the options of SignLocal, see checkConfig
+func (p *packer) checkLocalConfig() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case p.SourceAPK == "":
+		add("-source is required")
+	case strings.HasPrefix(p.SourceAPK, OSSScheme):
+		add("-source must be a local file: %s", p.SourceAPK)
+	case isContainer(p.SourceAPK):
+		add("-source is an apk container, only apks can be signed: %s", p.SourceAPK)
+	}
+	switch {
+	case p.DestAPK == "":
+		add("-dest is required")
+	case strings.HasPrefix(p.DestAPK, OSSScheme):
+		add("-dest must be a local file: %s", p.DestAPK)
+	case sameFile(p.SourceAPK, p.DestAPK):
+		add("-dest is the source: %s", p.DestAPK)
+	}
+
+	if err := p.loadExtraFiles(); err != nil {
+		add("load extra files: %v", err)
+	}
+	if _, _, err := parseSchemes(p.Schemes); err != nil {
+		add("-schemes: %v", err)
+	}
+	if p.StrictManifest && p.LenientManifest {
+		add("-strict and -lenient can't be used together")
+	}
+	for _, a := range p.ManifestAttrs {
+		if err := checkMainAttr(a.Name, a.Value); err != nil {
+			add("-manifest-attr: %v", err)
+		}
+	}
+	for _, rule := range p.EntryRules {
+		if _, err := rule.regexp(); err != nil {
+			add("-entry-rule: %v", err)
+		}
+	}
+	if p.KeyMap != "" {
+		p.loadKeyMap(add)
+	}
+	if p.KeyMap == "" || p.hasKey() {
+		p.checkKeys(add)
+	}
+	if _, err := flate.NewWriter(ioutil.Discard, p.CompressionLevel); err != nil {
+		add("-level: %v", err)
+	}
+	for _, name := range p.checksums() {
+		if checksumHashes[name] == nil {
+			add("-checksum: unknown %q, expect sha256 or md5", name)
+		}
+	}
+	if err := checkPageAlign(p.PageAlign); err != nil {
+		add("-page-align: %v", err)
+	}
+	if !p.InMemory {
+		if err := checkWritable(p.WorkDir); err != nil {
+			add("-work-dir: %v", err)
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return &Error{Kind: KindConfig, Err: fmt.Errorf("%s", problems[0])}
+	}
+	return &Error{Kind: KindConfig, Err: fmt.Errorf("%d config problems: %s", len(problems), strings.Join(problems, "; "))}
+}
+
+// sameFile reports whether the local files a and b are the same, by path
+// or, if both exist, by inode
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// openLocalSource reads the central directory and manifest of the local
+// apk f, see openSource
+func (p *packer) openLocalSource(f *os.File) (*Source, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < directoryEndLen {
+		return nil, fmt.Errorf("not a zip file: %d bytes", info.Size())
+	}
+	zipReader, err := zip.NewReader(f, info.Size())
+	if err == zip.ErrFormat {
+		return nil, fmt.Errorf("not a zip file: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+	src := &Source{
+		Cache: f,
+		Size:  info.Size(),
+		Zip:   zipReader,
+	}
+	if err := p.readSource(src); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// writeLocal builds the apk of p.DestAPK from src, replaced once written and
+// synced, and returns the names of the appended entries
+func (p *packer) writeLocal(src *Source) ([]string, error) {
+	dest, err := ioutil.TempFile(filepath.Dir(p.DestAPK), "."+filepath.Base(p.DestAPK)+".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("write dest: %v", err)
+	}
+	temp := dest.Name()
+	defer func() {
+		if dest != nil {
+			dest.Close()
+			os.Remove(temp)
+		}
+	}()
+
+	appended, err := p.build(src, func(segments []Segment) (io.Writer, error) {
+		for _, s := range segments {
+			if _, err := io.Copy(dest, io.NewSectionReader(src.Cache, s.Offset, s.Size)); err != nil {
+				return nil, fmt.Errorf("copy %s: %v", p.SourceAPK, err)
+			}
+		}
+		return dest, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := dest.Chmod(0644); err != nil {
+		return nil, fmt.Errorf("write dest: %v", err)
+	}
+	if err := dest.Sync(); err != nil {
+		return nil, fmt.Errorf("write dest: %v", err)
+	}
+	if err := dest.Close(); err != nil {
+		return nil, fmt.Errorf("write dest: %v", err)
+	}
+	dest = nil
+	if err := os.Rename(temp, p.DestAPK); err != nil {
+		os.Remove(temp)
+		return nil, fmt.Errorf("write dest: %v", err)
+	}
+	return appended, nil
+}
+
+// verifyLocal checks the signatures of the local apk name, reading all of it
+func (p *packer) verifyLocal(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zipReader, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("zip reader: %v", err)
+	}
+	dir, err := ReadDirectory(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("central directory: %v", err)
+	}
+	return p.verifySignatures(f, info.Size(), dir, zipReader, nil)
+}
+
+// describeLocal fills result with the size of the local dest apk, its
+// checksums, the signing cert and the time spent in each phase, see describe
+func (p *packer) describeLocal(result *Result) error {
+	info, err := os.Stat(result.Dest)
+	if err != nil {
+		return err
+	}
+	result.Size = info.Size()
+	if names := p.checksums(); len(names) > 0 {
+		f, err := os.Open(result.Dest)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sums, err := sumReader(f, names)
+		if err != nil {
+			return err
+		}
+		result.SHA256, result.MD5 = sums["sha256"], sums["md5"]
+	}
+	result.CertSHA256 = p.certSHA256
+	if p.certSHA256 != "" {
+		result.Schemes = p.schemes.String()
+	}
+	result.PhasesMS = make(map[string]int64)
+	for phase, d := range p.phases {
+		result.PhasesMS[phase] = d.Milliseconds()
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestKey writes a private key and its self-signed cert of name in
+// dir, and returns their paths with the key
+func writeTestKey(t *testing.T, dir, name string) (keyPath, certPath string, key *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		SubjectKeyId: []byte(name), // signPKCS7 expects extensions, as in the certs of keytool
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, certPath = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".x509.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, certPath, key
+}
+
+// testAndroidManifest returns the binary AndroidManifest.xml of package
+func testAndroidManifest(t *testing.T, pkg string) string {
+	d := &axmlDoc{utf8: true, strings: []string{"manifest", "package", pkg}}
+	d.nodes = []*axmlNode{
+		{Type: resXMLStartElement, NS: noIndex, Name: 0, Attrs: []*axmlAttr{{NS: noIndex, Name: 1, Raw: 2, Type: resValueTypeString, Data: 2}}},
+		{Type: resXMLEndElement, NS: noIndex, Name: 0},
+	}
+	buf, err := d.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// TestSignLocalConcurrent signs an apk with several keys at the same time, to
+// be run with -race for the state shared by the jobs, like the certs signed again
+func TestSignLocalConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.apk")
+	if err := ioutil.WriteFile(source, zipOf(AndroidManifestPath, testAndroidManifest(t, "com.example.game"), "classes.dex", "dex", "res/a.png", "png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	type signer struct {
+		keyPath, certPath string
+		key               *rsa.PrivateKey
+	}
+	var signers []signer
+	for i := 0; i < 3; i++ {
+		keyPath, certPath, key := writeTestKey(t, dir, fmt.Sprintf("tenant-%d", i))
+		signers = append(signers, signer{keyPath, certPath, key})
+	}
+
+	const jobs = 12
+	var wg sync.WaitGroup
+	errs := make([]error, jobs)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := signers[i%len(signers)]
+			opts := DefaultOptions()
+			opts.SourceAPK = source
+			opts.DestAPK = filepath.Join(dir, fmt.Sprintf("dest-%d.apk", i))
+			opts.PrivateKeyPEM, opts.CertPEM = s.keyPath, s.certPath
+			opts.WorkDir = dir
+			opts.VerifySignature = true
+			opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+			_, errs[i] = SignLocal(context.Background(), opts)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		// the cert of each dest is that of its own key
+		r, err := stdzip.OpenReader(filepath.Join(dir, fmt.Sprintf("dest-%d.apk", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cert []byte
+		for _, f := range r.File {
+			if strings.HasPrefix(f.Name, MetaInfoPath) && strings.HasSuffix(f.Name, ".RSA") {
+				rc, _ := f.Open()
+				cert, _ = ioutil.ReadAll(rc)
+				rc.Close()
+			}
+		}
+		r.Close()
+		for j, s := range signers {
+			found := bytes.Contains(cert, x509.MarshalPKCS1PublicKey(&s.key.PublicKey))
+			if want := j == i%len(signers); found != want {
+				t.Errorf("job %d: public key of tenant-%d in the cert %v, want %v", i, j, found, want)
+			}
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("work dir %s left", e.Name())
+		}
+	}
+}
+
+func TestSignLocalConfig(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.apk")
+	ioutil.WriteFile(source, zipOf("classes.dex", "dex"), 0644)
+	keyPath, certPath, _ := writeTestKey(t, dir, "key")
+	tests := []struct {
+		name         string
+		source, dest string
+		pageAlign    int64
+		err          string
+	}{
+		{"oss source", "oss://bucket/a.apk", filepath.Join(dir, "b.apk"), 0, "-source must be a local file"},
+		{"oss dest", source, "oss://bucket/b.apk", 0, "-dest must be a local file"},
+		{"same file", source, filepath.Join(dir, ".", "source.apk"), 0, "-dest is the source"},
+		{"page align", source, filepath.Join(dir, "b.apk"), 3, "-page-align"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.SourceAPK, opts.DestAPK, opts.PageAlign = tt.source, tt.dest, tt.pageAlign
+		opts.PrivateKeyPEM, opts.CertPEM, opts.WorkDir = keyPath, certPath, dir
+		_, err := SignLocal(context.Background(), opts)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// digestHashes are the hashes of the digest attributes of an entry, by the
+// upper case attribute name
+var digestHashes = map[string]func() hash.Hash{
+	"SHA1-DIGEST":    sha1.New,
+	"SHA-1-DIGEST":   sha1.New,
+	"SHA-224-DIGEST": sha256.New224,
+	"SHA-256-DIGEST": sha256.New,
+	"SHA-384-DIGEST": sha512.New384,
+	"SHA-512-DIGEST": sha512.New,
+	"MD5-DIGEST":     md5.New,
+}
+
+// manifest is a parsed MANIFEST.MF, see the JAR File Specification, with
+// lines ending with CRLF, LF or CR and continuation lines
+type manifest struct {
+	sections []*section // the main section, then one of each entry
+	eol      string     // of the first line, for the sections written again
+	minimal  bool       // patch the changed sections, see section.patch
+}
+
+// section is a section of a manifest. It keeps the bytes it was parsed from
+// until it is changed, as the signature file has their digest.
+type section struct {
+	attrs   []attr
+	raw     []byte
+	eol     string
+	parsed  []byte // the bytes raw was, kept once changed
+	minimal bool   // patch parsed when changed rather than write it again
+}
+
+// attr is an attribute of a section, in the order of the manifest
+type attr struct {
+	name, value string
+}
+
+// manifest parsing modes, see parseManifestMode
+const (
+	parseDefault = iota // reject what can't be parsed, like Android
+	parseStrict         // also reject what the JAR File Specification doesn't allow
+	parseLenient        // drop the lines and sections that can't be parsed
+)
+
+// manifestError is an error of a manifest at a line and a column, in
+// bytes, from 1
+type manifestError struct {
+	line, column int
+	msg          string
+}
+
+func (e *manifestError) Error() string {
+	return fmt.Sprintf("malformed manifest: line %d, column %d: %s", e.line, e.column, e.msg)
+}
+
+// parseManifest parses buf into its sections
+func parseManifest(buf []byte) (*manifest, error) {
+	return parseManifestMode(buf, parseDefault, nil)
+}
+
+// parseManifestMode parses buf into its sections in mode, passing the errors
+// to repaired with parseLenient and writing again the sections it drops from
+func parseManifestMode(buf []byte, mode int, repaired func(error)) (*manifest, error) {
+	m := &manifest{eol: "\r\n"}
+	if i := bytes.IndexAny(buf, "\r\n"); i >= 0 {
+		_, next := readLine(buf, i)
+		m.eol = string(buf[i:next])
+	}
+	s := &section{eol: m.eol}
+	start, sectionLine := 0, 1 // of s in buf
+	dirty := false             // s has lines dropped
+	names := map[string]int{}  // line of the section of each entry, with parseStrict
+	lineNo, attrLine := 0, 0   // of the last attribute
+	errorAt := func(column int, format string, args ...interface{}) *manifestError {
+		return &manifestError{line: lineNo, column: column, msg: fmt.Sprintf(format, args...)}
+	}
+	// repair passes err to repaired if lenient, or returns it
+	repair := func(err *manifestError) error {
+		if mode != parseLenient {
+			return err
+		}
+		repaired(err)
+		dirty = true
+		return nil
+	}
+	// checkUTF8 checks the last attribute with parseStrict, once joined, as
+	// a character may be split over two lines
+	checkUTF8 := func() error {
+		if mode != parseStrict || len(s.attrs) == 0 {
+			return nil
+		}
+		a := s.attrs[len(s.attrs)-1]
+		if i := invalidUTF8([]byte(a.name + ": " + a.value)); i >= 0 {
+			return &manifestError{line: attrLine, column: i + 1, msg: fmt.Sprintf("attribute %s not UTF-8", a.name)}
+		}
+		return nil
+	}
+	// addSection adds s, parsed from raw
+	addSection := func(raw []byte) error {
+		if err := checkUTF8(); err != nil {
+			return err
+		}
+		if len(m.sections) > 0 {
+			name := s.get("Name")
+			if name == "" {
+				err := &manifestError{line: sectionLine, column: 1, msg: "section without Name"}
+				if mode != parseLenient {
+					return err
+				}
+				repaired(err)
+				return nil
+			}
+			if first, ok := names[name]; ok && mode == parseStrict {
+				return &manifestError{line: sectionLine, column: 1, msg: fmt.Sprintf("section of %s again, first at line %d", name, first)}
+			}
+			names[name] = sectionLine
+		} else if mode == parseStrict && (len(s.attrs) == 0 || !strings.EqualFold(s.attrs[0].name, "Manifest-Version")) {
+			return &manifestError{line: sectionLine, column: 1, msg: "the main section doesn't start with Manifest-Version"}
+		}
+		s.raw, s.parsed = raw, raw
+		if dirty {
+			s.raw, s.parsed = nil, nil
+		}
+		m.sections = append(m.sections, s)
+		return nil
+	}
+
+	for pos := 0; pos < len(buf); {
+		line, next := readLine(buf, pos)
+		lineNo++
+		if mode == parseStrict {
+			if err := strictLine(line, next == pos+len(line)); err != nil {
+				err.line = lineNo
+				return nil, err
+			}
+		}
+		switch {
+		case len(line) == 0:
+			if len(s.attrs) > 0 || len(m.sections) == 0 {
+				if err := addSection(buf[start:next]); err != nil {
+					return nil, err
+				}
+				s = &section{eol: m.eol}
+			}
+			// the empty lines between sections are in none of them
+			start, sectionLine, dirty = next, lineNo+1, false
+		case line[0] == ' ':
+			if len(s.attrs) == 0 {
+				if err := repair(errorAt(1, "continuation line without attribute")); err != nil {
+					return nil, err
+				}
+				break
+			}
+			s.attrs[len(s.attrs)-1].value += string(line[1:])
+		default:
+			if err := checkUTF8(); err != nil {
+				return nil, err
+			}
+			a, err := parseAttr(line)
+			if err != nil {
+				err.line = lineNo
+				if err := repair(err); err != nil {
+					return nil, err
+				}
+				if a.name == "" {
+					break
+				}
+			}
+			if mode == parseStrict {
+				for _, b := range s.attrs {
+					if strings.EqualFold(a.name, b.name) {
+						return nil, errorAt(1, "attribute %s again in the section", a.name)
+					}
+				}
+			}
+			s.attrs = append(s.attrs, a)
+			attrLine = lineNo
+		}
+		pos = next
+	}
+	if len(s.attrs) > 0 || len(m.sections) == 0 {
+		// the last section without the empty line, add it so more can follow
+		raw := append([]byte(nil), buf[start:]...)
+		if len(raw) > 0 && raw[len(raw)-1] != '\n' && raw[len(raw)-1] != '\r' {
+			raw = append(raw, m.eol...)
+		}
+		if err := addSection(append(raw, m.eol...)); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// parseAttr parses the attribute of line. On error, the attribute is that
+// of a missing space after the colon, or none.
+func parseAttr(line []byte) (attr, *manifestError) {
+	i := bytes.IndexByte(line, ':')
+	switch {
+	case i < 0:
+		return attr{}, &manifestError{column: len(line) + 1, msg: fmt.Sprintf("no colon in attribute %q", line)}
+	case i == 0:
+		return attr{}, &manifestError{column: 1, msg: fmt.Sprintf("no name in attribute %q", line)}
+	case i+1 == len(line) || line[i+1] != ' ':
+		a := attr{name: string(line[:i]), value: strings.TrimLeft(string(line[i+1:]), " ")}
+		return a, &manifestError{column: i + 2, msg: fmt.Sprintf("no space after the colon in attribute %q", line)}
+	}
+	return attr{name: string(line[:i]), value: string(line[i+2:])}, nil
+}
+
+// strictLine checks the length and attribute name of line against the JAR
+// File Specification, last if the end of the manifest without a line ending
+func strictLine(line []byte, last bool) *manifestError {
+	switch {
+	case len(line) > LineWidth:
+		return &manifestError{column: LineWidth + 1, msg: fmt.Sprintf("line longer than %d bytes", LineWidth)}
+	case last && len(line) > 0:
+		return &manifestError{column: len(line) + 1, msg: "no line ending at the end of the manifest"}
+	case len(line) > 0 && line[0] != ' ':
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			return invalidAttrName(line[:i])
+		}
+	}
+	return nil
+}
+
+// invalidAttrName checks name against the JAR File Specification: up to
+// 70 letters, digits, - and _
+func invalidAttrName(name []byte) *manifestError {
+	if len(name) > 70 {
+		return &manifestError{column: 71, msg: "attribute name longer than 70 bytes"}
+	}
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return &manifestError{column: i + 1, msg: fmt.Sprintf("invalid character %q in attribute name", c)}
+		}
+	}
+	return nil
+}
+
+// invalidUTF8 returns the offset of the first byte of buf that is not
+// UTF-8, or -1
+func invalidUTF8(buf []byte) int {
+	for i := 0; i < len(buf); {
+		r, size := utf8.DecodeRune(buf[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+// readLine returns the line at pos without its CRLF, LF or CR, and the
+// position of the next line
+func readLine(buf []byte, pos int) ([]byte, int) {
+	i := bytes.IndexAny(buf[pos:], "\r\n")
+	if i < 0 {
+		return buf[pos:], len(buf)
+	}
+	end := pos + i
+	next := end + 1
+	if buf[end] == '\r' && next < len(buf) && buf[next] == '\n' {
+		next++
+	}
+	return buf[pos:end], next
+}
+
+// bytes returns the manifest with the changed sections written again
+func (m *manifest) bytes() []byte {
+	var b bytes.Buffer
+	for _, s := range m.sections {
+		b.Write(s.bytes())
+	}
+	return b.Bytes()
+}
+
+// clone returns a copy of m sharing its sections, which are copied by edit
+// before they are changed
+func (m *manifest) clone() *manifest {
+	return &manifest{sections: append([]*section(nil), m.sections...), eol: m.eol, minimal: m.minimal}
+}
+
+// edit returns the section of the entry name to change, a copy in place of
+// the section that may be shared with other clones, or nil if none
+func (m *manifest) edit(name string) *section {
+	for i, s := range m.sections[1:] {
+		if s.get("Name") == name {
+			c := *s
+			c.attrs = append([]attr(nil), s.attrs...)
+			c.minimal = m.minimal
+			m.sections[i+1] = &c
+			return &c
+		}
+	}
+	return nil
+}
+
+// editMain returns the main section to change, a copy in place of the
+// section that may be shared with other clones
+func (m *manifest) editMain() *section {
+	c := *m.sections[0]
+	c.attrs = append([]attr(nil), c.attrs...)
+	c.minimal = m.minimal
+	m.sections[0] = &c
+	return &c
+}
+
+// entries returns the sections of the entries
+func (m *manifest) entries() []*section {
+	return m.sections[1:]
+}
+
+// entry returns the section of the entry name, or nil
+func (m *manifest) entry(name string) *section {
+	for _, s := range m.entries() {
+		if s.get("Name") == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// addEntry adds the section of the entry name, with the digest attributes
+// the other entries have
+func (m *manifest) addEntry(name string) *section {
+	s := &section{attrs: []attr{{name: "Name", value: name}}, eol: m.eol}
+	if entries := m.entries(); len(entries) > 0 {
+		for _, a := range entries[0].attrs {
+			if digestHashes[strings.ToUpper(a.name)] != nil {
+				s.attrs = append(s.attrs, attr{name: a.name})
+			}
+		}
+	}
+	m.sections = append(m.sections, s)
+	return s
+}
+
+// removeEntry removes the section of the entry name, if any
+func (m *manifest) removeEntry(name string) {
+	for i, s := range m.sections[1:] {
+		if s.get("Name") == name {
+			m.sections = append(m.sections[:i+1:i+1], m.sections[i+2:]...)
+			return
+		}
+	}
+}
+
+// get returns the value of the attribute name, whose case is ignored
+func (s *section) get(name string) string {
+	for _, a := range s.attrs {
+		if strings.EqualFold(a.name, name) {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// set sets the attribute name, whose case is ignored, or adds it at the
+// end of s
+func (s *section) set(name, value string) {
+	for i, a := range s.attrs {
+		if strings.EqualFold(a.name, name) {
+			if a.value != value {
+				s.attrs[i].value = value
+				s.raw = nil
+			}
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attr{name: name, value: value})
+	s.raw = nil
+}
+
+// checkMainAttr checks that name is a main attribute the JAR File
+// Specification allows and signing doesn't set, and value a single line
+func checkMainAttr(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("no attribute name")
+	}
+	if err := invalidAttrName([]byte(name)); err != nil {
+		return fmt.Errorf("invalid attribute name %q: %s", name, err.msg)
+	}
+	upper := strings.ToUpper(name)
+	if upper == "NAME" || upper == "MANIFEST-VERSION" || strings.Contains(upper, "-DIGEST") {
+		return fmt.Errorf("attribute %s can't be set", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("invalid value of %s: %q", name, value)
+	}
+	return nil
+}
+
+// setDigests sets every digest attribute of s to that of content, or adds
+// SHA1-Digest if none, keeping the other attributes like Magic, and returns
+// those of unknown hashes it removed
+func (s *section) setDigests(content []byte) (removed []string) {
+	attrs := s.attrs[:0]
+	found := false
+	for _, a := range s.attrs {
+		if strings.HasSuffix(strings.ToUpper(a.name), "-DIGEST") {
+			newHash := digestHashes[strings.ToUpper(a.name)]
+			if newHash == nil {
+				removed = append(removed, a.name)
+				continue
+			}
+			h := newHash()
+			h.Write(content)
+			a.value = base64.StdEncoding.EncodeToString(h.Sum(nil))
+			found = true
+		}
+		attrs = append(attrs, a)
+	}
+	if !found {
+		attrs = append(attrs, attr{name: "SHA1-Digest", value: sha1Sum(content)})
+	}
+	s.attrs = attrs
+	s.raw = nil
+	return removed
+}
+
+// hasDigests reports whether s has digests, all of them of content
+func (s *section) hasDigests(content []byte) bool {
+	found := false
+	for _, a := range s.attrs {
+		newHash := digestHashes[strings.ToUpper(a.name)]
+		if newHash == nil {
+			continue
+		}
+		h := newHash()
+		h.Write(content)
+		if a.value != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// bytes returns the bytes s was parsed from, or writes it again if changed
+func (s *section) bytes() []byte {
+	if s.raw != nil {
+		return s.raw
+	}
+	if s.minimal && s.parsed != nil {
+		return s.patch()
+	}
+	var b bytes.Buffer
+	for _, a := range s.attrs {
+		b.WriteString(wrapLine(a.name+": "+a.value, s.eol))
+	}
+	b.WriteString(s.eol)
+	return b.Bytes()
+}
+
+// buildManifest builds the manifest of an unsigned apk with the SHA1-Digest of
+// every entry but dirs and META-INF, reading up to DigestJobs ranges at a time
+func (p *packer) buildManifest(ra io.ReaderAt, r *zip.Reader) ([]byte, error) {
+	start := time.Now()
+	var files []*zip.File
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") || strings.HasPrefix(f.Name, MetaInfoPath) {
+			continue
+		}
+		files = append(files, f)
+	}
+
+	fetch := p.newFetcher(ra)
+	digests := make([]string, len(files))
+	err := p.parallel(len(files), func(i int) error {
+		digest, err := entryDigest(fetch, files[i])
+		if err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+		digests[i] = digest
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("Manifest-Version: 1.0\r\n")
+	b.WriteString("Created-By: repack-apk\r\n")
+	b.WriteString("\r\n")
+	for i, f := range files {
+		b.WriteString(wrapLine("Name: "+f.Name, "\r\n"))
+		b.WriteString(fmt.Sprintf("SHA1-Digest: %s\r\n", digests[i]))
+		b.WriteString("\r\n")
+	}
+	p.log().Info("built manifest", "phase", PhaseOpen, "entries", len(files), "duration", time.Since(start))
+	return b.Bytes(), nil
+}
+
+// patch returns the bytes s was parsed from with only the changed attributes
+// written again, the removed ones left out and the added ones at the end
+func (s *section) patch() []byte {
+	var b bytes.Buffer
+	used := make([]bool, len(s.attrs))
+	eol := s.eol
+	pos := 0
+	for pos < len(s.parsed) {
+		line, next := readLine(s.parsed, pos)
+		if len(line) == 0 {
+			break
+		}
+		// the attribute with its continuation lines
+		name, value := string(line), ""
+		if i := bytes.Index(line, []byte(": ")); i > 0 {
+			name, value = string(line[:i]), string(line[i+2:])
+		}
+		eol = string(s.parsed[pos+len(line) : next])
+		end := next
+		for end < len(s.parsed) && s.parsed[end] == ' ' {
+			line, next := readLine(s.parsed, end)
+			value += string(line[1:])
+			eol = string(s.parsed[end+len(line) : next])
+			end = next
+		}
+		for i, a := range s.attrs {
+			if used[i] || a.name != name {
+				continue
+			}
+			used[i] = true
+			if a.value == value {
+				b.Write(s.parsed[pos:end])
+			} else {
+				b.WriteString(wrapLine(a.name+": "+a.value, eol))
+			}
+			break
+		}
+		pos = end
+	}
+	for i, a := range s.attrs {
+		if !used[i] {
+			b.WriteString(wrapLine(a.name+": "+a.value, eol))
+		}
+	}
+	b.Write(s.parsed[pos:])
+	return b.Bytes()
+}
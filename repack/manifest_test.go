@@ -0,0 +1,222 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestParseManifest(t *testing.T) {
+	// LF line endings, a wrapped name, SHA-256 digests and an unknown one
+	const src = "Manifest-Version: 1.0\n" +
+		"Created-By: other\n" +
+		"\n" +
+		"Name: res/a\n" +
+		" b.png\n" +
+		"SHA-256-Digest: old\n" +
+		"SHA1-Digest: old\n" +
+		"\n" +
+		"Name: c.txt\n" +
+		"SHA-256-Digest: kept\n" +
+		"\n"
+	m, err := parseManifest([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.entries()) != 2 || m.sections[0].get("created-by") != "other" {
+		t.Fatalf("sections %+v", m.sections)
+	}
+	if got := string(m.bytes()); got != src {
+		t.Errorf("unchanged manifest written as %q", got)
+	}
+
+	s := m.entry("res/ab.png")
+	if s == nil {
+		t.Fatal("wrapped name not found")
+	}
+	s.setDigests([]byte("new"))
+	sum := sha256.Sum256([]byte("new"))
+	// written again with the LF of the source
+	want := "Name: res/ab.png\nSHA-256-Digest: " + base64.StdEncoding.EncodeToString(sum[:]) + "\nSHA1-Digest: " + sha1Sum([]byte("new")) + "\n\n"
+	if got := string(s.bytes()); got != want {
+		t.Errorf("changed section %q, want %q", got, want)
+	}
+	if !s.hasDigests([]byte("new")) || s.hasDigests([]byte("old")) || m.entry("c.txt").hasDigests([]byte("kept")) {
+		t.Errorf("hasDigests of the changed section and the kept one")
+	}
+	// the other sections are kept as they were
+	if got := string(m.bytes()); !strings.HasSuffix(got, "Name: c.txt\nSHA-256-Digest: kept\n\n") {
+		t.Errorf("manifest %q", got)
+	}
+
+	added := m.addEntry("cpid")
+	added.setDigests([]byte("c1"))
+	if len(added.attrs) != 3 || added.get("SHA-256-Digest") == "" || added.get("SHA1-Digest") == "" {
+		t.Errorf("added entry %+v, want the digests of the first entry", added.attrs)
+	}
+
+	unknown, _ := parseManifest([]byte("Manifest-Version: 1.0\r\n\r\nName: a\r\nSHA3-Digest: x\r\nMagic: y\r\n\r\n"))
+	removed := unknown.entry("a").setDigests([]byte("a"))
+	if attrs := unknown.entry("a").attrs; len(attrs) != 3 || attrs[1].name != "Magic" || attrs[2].name != "SHA1-Digest" {
+		t.Errorf("unknown digest: %+v", attrs)
+	}
+	if len(removed) != 1 || removed[0] != "SHA3-Digest" {
+		t.Errorf("removed %v", removed)
+	}
+
+	for _, bad := range []string{" continued\r\n", "Manifest-Version: 1.0\r\n\r\nSHA1-Digest: x\r\n\r\n", "no colon\r\n"} {
+		if _, err := parseManifest([]byte(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	var buf bytes.Buffer
+	w := stdzip.NewWriter(&buf)
+	for _, f := range []struct {
+		name   string
+		method uint16
+	}{{"classes.dex", stdzip.Deflate}, {"res/", stdzip.Store}, {"res/a.png", stdzip.Store}, {"META-INF/services/x", stdzip.Deflate}} {
+		fw, _ := w.CreateHeader(&stdzip.FileHeader{Name: f.name, Method: f.method})
+		if !strings.HasSuffix(f.name, "/") {
+			fw.Write([]byte(f.name))
+		}
+	}
+	w.Close()
+	apk := buf.Bytes()
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &packer{Options: Options{Jobs: 2}}
+	mf, err := p.readManifest(bytes.NewReader(apk), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseManifest(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.entries()) != 2 {
+		t.Errorf("manifest %q, want the entries but the dir and META-INF", mf)
+	}
+	for _, name := range []string{"classes.dex", "res/a.png"} {
+		if s := m.entry(name); s == nil || !s.hasDigests([]byte(name)) {
+			t.Errorf("%s: digest not in %q", name, mf)
+		}
+	}
+
+	// a corrupt entry fails the checksum
+	offset, _ := findFile(r, "res/a.png").DataOffset()
+	corrupt := append([]byte(nil), apk...)
+	corrupt[offset] ^= 0xff
+	if _, err := p.readManifest(bytes.NewReader(corrupt), r); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("corrupt entry: %v", err)
+	}
+}
+
+func TestRemoveEntry(t *testing.T) {
+	m, err := parseManifest([]byte("Manifest-Version: 1.0\r\n\r\nName: a\r\nSHA-256-Digest: x\r\n\r\nName: b\r\nSHA-256-Digest: y\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.removeEntry("a")
+	m.removeEntry("unknown")
+	if m.entry("a") != nil || m.entry("b") == nil || len(m.entries()) != 1 {
+		t.Errorf("manifest %q", m.bytes())
+	}
+}
+
+func TestManifestPatch(t *testing.T) {
+	// LF line endings, a name wrapped before the line width and an
+	// attribute after the digest, as written by other tools
+	const src = "Manifest-Version: 1.0\n" +
+		"Created-By: other\n" +
+		"\n" +
+		"Name: res/a\n" +
+		" b.png\n" +
+		"SHA1-Digest: old\n" +
+		"Magic: x\n" +
+		"\n" +
+		"Name: c.txt\n" +
+		"SHA1-Digest: kept\n" +
+		"\n"
+	digest := sha1Sum([]byte("new"))
+	long := strings.Repeat("v", LineWidth)
+	tests := []struct {
+		name    string
+		minimal bool
+		change  func(m *manifest)
+		want    string
+	}{
+		{"unchanged", true, func(m *manifest) {}, src},
+		{"same digest", true, func(m *manifest) { m.edit("c.txt").set("SHA1-Digest", "kept") }, src},
+		{"digest patched", true, func(m *manifest) { m.edit("res/ab.png").setDigests([]byte("new")) },
+			strings.Replace(src, "SHA1-Digest: old\n", "SHA1-Digest: "+digest+"\n", 1)},
+		{"attribute added", true, func(m *manifest) { m.edit("c.txt").set("X-Build", "7") },
+			strings.Replace(src, "SHA1-Digest: kept\n", "SHA1-Digest: kept\nX-Build: 7\n", 1)},
+		{"long value wrapped", true, func(m *manifest) { m.editMain().set("Created-By", long) },
+			strings.Replace(src, "Created-By: other\n", wrapLine("Created-By: "+long, "\n"), 1)},
+		{"section written again", false, func(m *manifest) { m.edit("res/ab.png").setDigests([]byte("new")) },
+			strings.Replace(src, "Name: res/a\n b.png\nSHA1-Digest: old\n", "Name: res/ab.png\nSHA1-Digest: "+digest+"\n", 1)},
+	}
+	for _, tt := range tests {
+		m, err := parseManifest([]byte(src))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		m.minimal = tt.minimal
+		c := m.clone()
+		tt.change(c)
+		if got := string(c.bytes()); got != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+		if got := string(m.bytes()); got != src {
+			t.Errorf("%s: the clone changed the source manifest to %q", tt.name, got)
+		}
+	}
+}
+
+func TestParseManifestMode(t *testing.T) {
+	const valid = "Manifest-Version: 1.0\r\n\r\nName: a\r\nSHA1-Digest: x\r\n\r\n"
+	tests := []struct {
+		name     string
+		src      string
+		mode     int
+		err      string // empty if parsed
+		repaired int
+	}{
+		{"valid", valid, parseStrict, "", 0},
+		{"no colon", "Manifest-Version: 1.0\r\n\r\nName: a\r\nbad\r\n\r\n", parseDefault, "line 4, column 4: no colon", 0},
+		{"no colon repaired", "Manifest-Version: 1.0\r\n\r\nName: a\r\nbad\r\n\r\n", parseLenient, "", 1},
+		{"no space", "Manifest-Version: 1.0\r\n\r\nName: a\r\nSHA1-Digest:x\r\n\r\n", parseDefault, "line 4, column 13: no space", 0},
+		{"continuation without attribute", " x\r\nManifest-Version: 1.0\r\n\r\n", parseLenient, "", 1},
+		{"section without name", "Manifest-Version: 1.0\r\n\r\nSHA1-Digest: x\r\n\r\n", parseDefault, "line 3, column 1: section without Name", 0},
+		{"section without name dropped", "Manifest-Version: 1.0\r\n\r\nSHA1-Digest: x\r\n\r\n", parseLenient, "", 1},
+		{"lenient name", valid + "Name: a\r\nSHA1-Digest: y\r\n\r\n", parseDefault, "", 0},
+		{"name again", valid + "Name: a\r\nSHA1-Digest: y\r\n\r\n", parseStrict, "line 6, column 1: section of a again, first at line 3", 0},
+		{"attribute again", "Manifest-Version: 1.0\r\nA: 1\r\nA: 2\r\n\r\n", parseStrict, "line 3, column 1: attribute A again", 0},
+		{"no manifest version", "Created-By: x\r\n\r\n", parseStrict, "line 1, column 1: the main section", 0},
+		{"long line", "Manifest-Version: 1.0\r\nX: " + strings.Repeat("v", LineWidth) + "\r\n\r\n", parseStrict, "line 2, column 73: line longer", 0},
+		{"invalid name", "Manifest-Version: 1.0\r\nX.Y: 1\r\n\r\n", parseStrict, "line 2, column 2: invalid character", 0},
+		{"no line ending", "Manifest-Version: 1.0", parseStrict, "line 1, column 22: no line ending", 0},
+		{"not utf-8", "Manifest-Version: 1.0\r\nX: a\xff\r\n\r\n", parseStrict, "line 2, column 5: attribute X not UTF-8", 0},
+	}
+	for _, tt := range tests {
+		repaired := 0
+		_, err := parseManifestMode([]byte(tt.src), tt.mode, func(error) { repaired++ })
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+		if repaired != tt.repaired {
+			t.Errorf("%s: %d repaired, want %d", tt.name, repaired, tt.repaired)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package repack
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errMemory is in the message of the errors of reserve, see kindOfMessage
+const errMemory = "over the memory budget"
+
+// memoryBudget accounts the bytes a job holds in memory, such as the dest apks
+// until upload and the source ranges merged into parts
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64 // no limit if 0
+	used  int64
+}
+
+func newMemoryBudget(limitMB int64) *memoryBudget {
+	return &memoryBudget{limit: limitMB << 20}
+}
+
+// reserve accounts n more bytes of what, or fails if that is over the limit
+func (b *memoryBudget) reserve(n int64, what string) error {
+	if b == nil || b.limit <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return errorOf(KindConfig, fmt.Errorf("%s: %d bytes is %s of %d bytes, %d in use", what, n, errMemory, b.limit, b.used))
+	}
+	b.used += n
+	return nil
+}
+
+// release returns n bytes reserved before
+func (b *memoryBudget) release(n int64) {
+	if b == nil || b.limit <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// joinedReaderAt reads head, then the rest from r, e.g. the leftover of the
+// source before the spilled data of a Writer
+type joinedReaderAt struct {
+	head []byte
+	r    io.ReaderAt
+}
+
+func (j joinedReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	n := 0
+	if off < int64(len(j.head)) {
+		n = copy(buf, j.head[off:])
+		if n == len(buf) {
+			return n, nil
+		}
+	}
+	m, err := j.r.ReadAt(buf[n:], off+int64(n)-int64(len(j.head)))
+	return n + m, err
+}
@@ -0,0 +1,54 @@
+package repack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(1)
+	if err := b.reserve(1<<19, "a"); err != nil {
+		t.Fatal(err)
+	}
+	err := b.reserve(1<<19+1, "b")
+	if KindOf(err) != KindConfig {
+		t.Errorf("over the budget: %v, kind %v", err, KindOf(err))
+	}
+	b.release(1 << 19)
+	if err := b.reserve(1<<20, "c"); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	var none *memoryBudget
+	if err := none.reserve(1<<40, "d"); err != nil {
+		t.Errorf("no budget: %v", err)
+	}
+}
+
+func TestWriterSpill(t *testing.T) {
+	head, data := []byte("head"), bytes.Repeat([]byte("x"), 3<<19)
+	dir := t.TempDir()
+	w := &Writer{Log: slog.Default(), SpillDir: dir, memory: newMemoryBudget(1)}
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(data[i<<19 : (i+1)<<19]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.spill == nil || len(w.buffer) != 0 || w.memory.used != 0 {
+		t.Fatalf("not spilled: %d bytes in memory, %d reserved", len(w.buffer), w.memory.used)
+	}
+	body, size := w.body(head)
+	got, err := ioutil.ReadAll(body)
+	if err != nil || size != int64(len(head)+len(data)) || !bytes.Equal(got, append(head, data...)) {
+		t.Errorf("body of %d bytes, read %d: %v", size, len(got), err)
+	}
+	w.spill.Close()
+	os.Remove(w.spill.Name())
+
+	w = &Writer{Log: slog.Default(), memory: newMemoryBudget(1)}
+	if _, err := w.Write(data); KindOf(err) != KindConfig {
+		t.Errorf("without a spill dir: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package repack
+
+import (
+	"fmt"
+)
+
+// ManifestMutator changes the MANIFEST.MF of a dest apk signed again with v1;
+// those of Options.ManifestMutators run in order after the built-in ones
+type ManifestMutator interface {
+	MutateManifest(m *ManifestEdit) error
+}
+
+// ManifestMutatorFunc is a func as a ManifestMutator
+type ManifestMutatorFunc func(m *ManifestEdit) error
+
+// MutateManifest calls f(m)
+func (f ManifestMutatorFunc) MutateManifest(m *ManifestEdit) error {
+	return f(m)
+}
+
+// ManifestEdit is the MANIFEST.MF of a dest apk changed by the mutators, whose
+// entries added or changed must be in the dest apk too, such as ExtraFiles
+type ManifestEdit struct {
+	p *packer
+	m *manifest
+}
+
+// Entries returns the names of the entries of the manifest, in order
+func (e *ManifestEdit) Entries() []string {
+	var names []string
+	for _, s := range e.m.entries() {
+		names = append(names, s.get("Name"))
+	}
+	return names
+}
+
+// HasEntry reports whether the manifest has the entry name
+func (e *ManifestEdit) HasEntry(name string) bool {
+	return e.m.entry(name) != nil
+}
+
+// AddEntry sets the digests of the entry name to those of content, adding
+// its section if it has none
+func (e *ManifestEdit) AddEntry(name string, content []byte) {
+	e.p.setDigest(e.m, name, content)
+}
+
+// UpdateDigest sets the digests of the entry name to those of content, and
+// fails if the manifest has no such entry
+func (e *ManifestEdit) UpdateDigest(name string, content []byte) error {
+	if e.m.entry(name) == nil {
+		return fmt.Errorf("no entry %s in %s", name, ManifestPath)
+	}
+	e.p.setDigest(e.m, name, content)
+	return nil
+}
+
+// RemoveEntry removes the section of the entry name, if any
+func (e *ManifestEdit) RemoveEntry(name string) {
+	e.m.removeEntry(name)
+}
+
+// SetMainAttr sets the attribute name of the main section, one that
+// -manifest-attr may set, see checkMainAttr
+func (e *ManifestEdit) SetMainAttr(name, value string) error {
+	if err := checkMainAttr(name, value); err != nil {
+		return err
+	}
+	e.m.editMain().set(name, value)
+	return nil
+}
+
+// manifestMutators returns the built-in mutators of the manifest of the
+// dest apk without the entries of drop, with the entries of p.appended
+func (p *packer) manifestMutators(drop map[string]bool) []ManifestMutator {
+	return []ManifestMutator{
+		ManifestMutatorFunc(func(m *ManifestEdit) error {
+			for name := range drop {
+				m.RemoveEntry(name)
+			}
+			return nil
+		}),
+		ManifestMutatorFunc(func(m *ManifestEdit) error {
+			for _, e := range p.appended {
+				if !e.unlisted {
+					m.AddEntry(e.Header.Name, e.Content)
+				}
+			}
+			return nil
+		}),
+		ManifestMutatorFunc(func(m *ManifestEdit) error {
+			for _, a := range p.ManifestAttrs {
+				if err := m.SetMainAttr(a.Name, a.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+}
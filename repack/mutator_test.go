@@ -0,0 +1,63 @@
+package repack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestManifestMutators(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+	p.PrivateKeyPEM, p.CertPEM = writeKeyPair(t, dir)
+	p.WorkDir, p.CPIDContent, p.CPIDFile, p.ExtraFiles, p.schemes = dir, "c1", true, nil, schemes{v1: true}
+	var entries []string
+	p.ManifestMutators = []ManifestMutator{ManifestMutatorFunc(func(m *ManifestEdit) error {
+		entries = m.Entries()
+		m.RemoveEntry("res/a.png")
+		if err := m.UpdateDigest("classes.dex", []byte("new")); err != nil {
+			return err
+		}
+		return m.SetMainAttr("X-Build", "7")
+	})}
+	manifest := "Manifest-Version: 1.0\r\n\r\nName: classes.dex\r\nSHA1-Digest: old\r\n\r\nName: res/a.png\r\nSHA1-Digest: png\r\n\r\n"
+	apk, err := p.repackBytes(zipOf(ManifestPath, manifest, "classes.dex", "dex", "res/a.png", "png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the built-in mutators ran first
+	if strings.Join(entries, ",") != "classes.dex,res/a.png,"+CPIDPath {
+		t.Errorf("entries %v", entries)
+	}
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mf []byte
+	for _, f := range r.File {
+		if f.Name == ManifestPath {
+			mf, _ = readEntry(f) // the appended one
+		}
+	}
+	m, err := parseManifest(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.sections[0].get("X-Build") != "7" || m.entry("res/a.png") != nil || !m.entry("classes.dex").hasDigests([]byte("new")) {
+		t.Errorf("manifest %q", mf)
+	}
+
+	for _, mutator := range []ManifestMutatorFunc{
+		func(m *ManifestEdit) error { return m.UpdateDigest("missing", nil) },
+		func(m *ManifestEdit) error { return m.SetMainAttr("Manifest-Version", "2") },
+		func(m *ManifestEdit) error { return fmt.Errorf("mutator failed") },
+	} {
+		p.ManifestMutators = []ManifestMutator{mutator}
+		if _, err := p.repackBytes(zipOf(ManifestPath, manifest, "classes.dex", "dex")); err == nil {
+			t.Error("repacked despite the error of a mutator")
+		}
+	}
+}
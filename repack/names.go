@@ -0,0 +1,73 @@
+package repack
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"unicode/utf8"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// unicodePathID is the id of the Info-ZIP Unicode Path extra field, the UTF-8
+// name of an entry whose name is in another encoding, like GBK
+const unicodePathID = 0x7075
+
+// utf8Flag is the flag of an entry whose name is UTF-8
+const utf8Flag = 0x800
+
+// unicodePath returns the name of the Unicode Path extra field of f, "" if
+// none or if written for another name, by the CRC32 of the name
+func unicodePath(f *zip.File) string {
+	extra := f.Extra
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			return ""
+		}
+		field := extra[:size]
+		extra = extra[size:]
+		if id != unicodePathID || len(field) < 5 || field[0] != 1 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(field[1:]) != crc32.ChecksumIEEE([]byte(f.Name)) || !utf8.Valid(field[5:]) {
+			return ""
+		}
+		return string(field[5:])
+	}
+	return ""
+}
+
+// checkNames warns about the names of r not in UTF-8, signed as their bytes
+// as Android reads them, and maps the extra files named by their Unicode Path
+func (p *packer) checkNames(r *zip.Reader) {
+	var names []string
+	byPath := map[string]string{}
+	for _, f := range r.File {
+		if utf8.ValidString(f.Name) {
+			continue
+		}
+		names = append(names, f.Name)
+		if path := unicodePath(f); path != "" {
+			byPath[path] = f.Name
+		}
+		if f.Flags&utf8Flag != 0 {
+			p.log().Warn("entry name flagged as UTF-8 is not", "phase", PhaseOpen, "name", f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	p.log().Warn("entry names not in UTF-8, signed as is", "phase", PhaseOpen, "entries", len(names), "first", names[0])
+
+	for i, f := range p.ExtraFiles {
+		if findFile(r, f.Path) != nil {
+			continue
+		}
+		if name, ok := byPath[f.Path]; ok {
+			p.log().Info("entry found by its unicode path", "phase", PhaseOpen, "path", f.Path, "name", name)
+			p.ExtraFiles[i].Path = name
+		}
+	}
+}
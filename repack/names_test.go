@@ -0,0 +1,55 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// unicodePathExtra returns the Unicode Path extra field of path for an entry
+// named name
+func unicodePathExtra(name, path string) []byte {
+	field := binary.LittleEndian.AppendUint32([]byte{1}, crc32.ChecksumIEEE([]byte(name)))
+	field = append(field, path...)
+	extra := binary.LittleEndian.AppendUint16(nil, unicodePathID)
+	extra = binary.LittleEndian.AppendUint16(extra, uint16(len(field)))
+	return append(extra, field...)
+}
+
+func TestCheckNames(t *testing.T) {
+	gbk := "assets/\xc7\xfe\xb5\xc0.txt" // 渠道 in GBK
+	var buf bytes.Buffer
+	w := stdzip.NewWriter(&buf)
+	for _, h := range []*stdzip.FileHeader{
+		{Name: gbk, Extra: unicodePathExtra(gbk, "assets/渠道.txt")},
+		{Name: "assets/\xb0\xa1", Extra: unicodePathExtra("other", "assets/stale")},
+		{Name: "classes.dex"},
+	} {
+		fw, _ := w.CreateHeader(h)
+		fw.Write([]byte(h.Name))
+	}
+	w.Close()
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := unicodePath(r.File[0]); path != "assets/渠道.txt" {
+		t.Errorf("unicode path %q", path)
+	}
+	if path := unicodePath(r.File[1]); path != "" {
+		t.Errorf("unicode path %q of another name", path)
+	}
+
+	p := &packer{Options: Options{Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}}
+	p.ExtraFiles = ExtraFiles{{Path: "assets/渠道.txt"}, {Path: "assets/stale"}, {Path: "classes.dex"}}
+	p.checkNames(r)
+	if p.ExtraFiles[0].Path != gbk || p.ExtraFiles[1].Path != "assets/stale" || p.ExtraFiles[2].Path != "classes.dex" {
+		t.Errorf("extra files %+v", p.ExtraFiles)
+	}
+}
@@ -0,0 +1,73 @@
+package repack
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// errSourceChanged is in the errors of a source overwritten during a job
+const errSourceChanged = "source overwritten since opened"
+
+// checkAppendOffset checks that the central directory of an apk of size bytes,
+// where the dests append, agrees with its end record and its local headers
+func checkAppendOffset(d *Directory, size int64) error {
+	if d.Offset < 0 || d.Offset+d.Size > size {
+		return fmt.Errorf("central directory at %d of %d bytes past the end of the %d bytes", d.Offset, d.Size, size)
+	}
+	if d.Offset+d.Size != d.End {
+		return fmt.Errorf("central directory at %d of %d bytes ends at %d, not at its end record at %d", d.Offset, d.Size, d.Offset+d.Size, d.End)
+	}
+	for _, rec := range d.Records {
+		if rec.Offset < 0 || rec.Offset >= d.Offset {
+			return fmt.Errorf("local header of %s at %d, not before the central directory at %d", rec.Name, rec.Offset, d.Offset)
+		}
+	}
+	return nil
+}
+
+// checkSourceUnchanged fails if the source object was overwritten since src was
+// opened, as its ranges would no longer match the directory built from src
+func (p *packer) checkSourceUnchanged(src *Source) error {
+	if src.Reader == nil || src.ETag == "" {
+		return nil
+	}
+	meta, err := src.Reader.Client.GetObjectDetailedMeta(src.Reader.Object)
+	if err != nil {
+		return fmt.Errorf("source meta: %v", err)
+	}
+	size, err := contentLength(meta)
+	if err != nil {
+		return fmt.Errorf("source meta: %v", err)
+	}
+	if etag := strings.Trim(meta.Get("ETag"), `"`); etag != src.ETag || size != src.Size {
+		return errorOf(KindSource, fmt.Errorf("%s: etag %s of %d bytes, expect %s of %d bytes", errSourceChanged, etag, size, src.ETag, src.Size))
+	}
+	return nil
+}
+
+// ifMatch returns options with If-Match etag, unless it is empty
+func ifMatch(etag string, options ...oss.Option) []oss.Option {
+	if etag == "" {
+		return options
+	}
+	return append(options, oss.IfMatch(quoteETag(etag)))
+}
+
+// quoteETag returns etag quoted, as in the ETag header
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
+
+// sourceChanged returns err of a read or copy of the source as a KindSource
+// error if OSS rejected its If-Match, the source being overwritten
+func sourceChanged(err error) error {
+	var se oss.ServiceError
+	if errors.As(err, &se) && se.StatusCode == http.StatusPreconditionFailed {
+		return errorOf(KindSource, fmt.Errorf("%s: %v", errSourceChanged, err))
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckAppendOffset(t *testing.T) {
+	apk := zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")
+	d, err := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAppendOffset(d, int64(len(apk))); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(d *Directory)
+	}{
+		{"past the end", func(d *Directory) { d.Size += 100 }},
+		{"before the end record", func(d *Directory) { d.End += 10 }},
+		{"local header after", func(d *Directory) { d.Records[1].Offset = d.Offset }},
+	}
+	for _, tt := range tests {
+		d, _ := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+		tt.change(d)
+		if err := checkAppendOffset(d, int64(len(apk))); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCheckSourceUnchanged(t *testing.T) {
+	apk := zipOf(AndroidManifestPath, "axml")
+	s := newMemStore()
+	s.objects["a.apk"] = apk
+	src := &Source{Reader: &Reader{Object: "a.apk", Client: s}, Size: int64(len(apk)), ETag: fmt.Sprintf("%X", md5.Sum(apk))}
+	p := &packer{}
+	if err := p.checkSourceUnchanged(src); err != nil {
+		t.Fatal(err)
+	}
+	s.objects["a.apk"] = zipOf(AndroidManifestPath, "other")
+	if err := p.checkSourceUnchanged(src); KindOf(err) != KindSource {
+		t.Errorf("overwritten: %v", err)
+	}
+	// no etag to compare
+	src.ETag = ""
+	if err := p.checkSourceUnchanged(src); err != nil {
+		t.Errorf("no etag: %v", err)
+	}
+}
+
+func TestReadSourceChanged(t *testing.T) {
+	var ifMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+	}))
+	defer server.Close()
+	r, err := NewReader(OSSConfig{Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret"}, "bucket/a.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ETag = "E1"
+	_, err = r.ReadAt(make([]byte, 10), 0)
+	if KindOf(err) != KindSource || !strings.Contains(err.Error(), errSourceChanged) {
+		t.Errorf("read: %v", err)
+	}
+	if len(ifMatch) != 1 || ifMatch[0] != `"E1"` {
+		t.Errorf("If-Match %q", ifMatch)
+	}
+	if err := sourceChanged(errors.New("connection reset")); KindOf(err) == KindSource {
+		t.Errorf("other error: %v", err)
+	}
+}
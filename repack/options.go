@@ -0,0 +1,622 @@
+package repack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options of a repack, one field for each flag of the command
+type Options struct {
+	SigFileName        string // auto detect from *.SF
+	PrivateKeyPEM      string // /path/to/private_key.pem or oss://my-bucket/private_key.pem
+	PrivateKeyBlob     string // the private key encrypted by KMS, in place of PrivateKeyPEM
+	KeySecretName      string // secret of Secrets Manager of the private key, in place of PrivateKeyPEM
+	CertSecretName     string // secret of Secrets Manager of the cert, in place of CertPEM
+	KeyMap             string // /path/to/keys.json or oss://my-bucket/keys.json, see KeyRule
+	NextPrivateKeyPEM  string // next key of a rotation, each dest is signed with it again
+	NextCertPEM        string // cert of the next key
+	NextSuffix         string // of the dests signed with the next key, before the extension
+	KMSEndpoint        string // of KMS to decrypt the private key with, and of Secrets Manager
+	PrivateSecrets     bool   // don't share the secrets and keys read with KMS with the other jobs of the process
+	CertPEM            string // /path/to/cert.pem or oss://my-bucket/cert.pem
+	SourceAPK          string // my-bucket/origin.apk
+	DestAPK            string // my-bucket/dest.apk
+	CPIDContent        string // cpid content, a template of Job
+	Channel            string // channel of the cpid template
+	CPIDJSON           string // cpid content as json, a template of Job
+	CPIDSchema         string // /path/to/schema.json or oss://my-bucket/schema.json
+	CPIDSeal           string // aes-gcm or hmac
+	CPIDKey            string // /path/to/cpid.key or oss://my-bucket/cpid.key, hex encoded
+	CPIDFile           bool   // add cpid content as the cpid file
+	CPIDPaths          string // cpid,assets/channel: paths of the cpid files
+	CPIDComment        bool   // set cpid content as the archive comment
+	V2Channel          bool   // set cpid content as the channel in the signing block
+	MetaDataName       string // set cpid content to the meta-data in AndroidManifest.xml
+	OSSEndpoint        string
+	SourceEndpoint     string // of the source bucket if in another region, OSSEndpoint if empty
+	AccelerateEndpoint string // of transfer acceleration, DefaultAccelerateEndpoint if empty
+	SourceAccelerate   bool   // read the source through AccelerateEndpoint
+	DestAccelerate     bool   // write the dest through AccelerateEndpoint
+	OSSAccessKeyID     string
+	OSSAccessKeySecret string
+	OSSSecurityToken   string
+	WorkDir            string // parent of the temp dirs of the jobs, the system temp dir if empty
+	InMemory           bool   // keep the signature files in memory, without a work dir
+	CacheDir           string // keep the blocks of the apks read on disk, see CachedReader
+	DownloadSource     bool   // download the source to the work dir once and read it from there
+	PageAlign          int64  // align stored entries to this boundary, 0 to disable
+	MaxMemory          int64  // MB of memory a job may hold, no limit if 0
+	DropStale          bool   // drop the data of superseded entries
+	SignatureArtifacts string // warn, keep, drop or fail, see ArtifactsWarn
+	MinimalManifest    bool   // change only the lines of the changed attributes of MANIFEST.MF
+	ManifestAttrs      ManifestAttrs
+	StrictManifest     bool   // reject the source manifests the JAR File Specification doesn't allow
+	LenientManifest    bool   // drop the lines and sections of the source manifest that can't be parsed
+	Schemes            string // v1,v2,v3: signature schemes of the dests signed again, auto if empty, see SchemesAuto
+	StoreEntries       string // cpid,assets/channel.json: entries to store uncompressed
+	CompressionLevel   int    // flate level of deflated entries
+	ExtraFiles         ExtraFiles
+	EntryRules         EntryRules
+	Sign               bool   // sign again even without cpid or extra files
+	Force              bool   // repack even if dest already has the same cpid
+	Deterministic      bool   // fixed timestamps for reproducible output
+	Validate           bool   // check the dest apk after upload
+	VerifySignature    bool   // check the v1 and v2 signatures with Validate, reading every entry
+	DigestJobs         int    // ranges read at the same time for the digests of entries, DefaultDigestJobs if 0
+	VerifySample       int    // entries VerifyRemote checks at random, besides those it always reads
+	Atomic             bool   // upload to a temp object, copied to the dest once validated
+	Resume             bool   // with Atomic and JobID, continue the uploads of a failed attempt of the job
+	PreSignHook        string // command or http(s) url to run before building a dest apk
+	PostUploadHook     string // command or http(s) url to run after uploading a dest apk
+	Channels           string // /path/to/channels.txt or oss://my-bucket/channels.txt
+	Jobs               int    // number of dest apks to upload at the same time
+	SharedPrefix       bool   // with Channels, copy the kept ranges of the source to a stage once
+	CopyStrategy       string // auto, parts, single or local, see CopyAuto
+	Batch              string // /path/to/jobs.jsonl, jobs.csv or oss://my-bucket/jobs.jsonl
+	Retries            int    // number of retries of a failed row of the batch
+	SHA256             bool   // read the dest apk back to compute its sha-256
+	Checksums          string // sha256,md5: checksums of the dest apk, read back once
+	ChecksumSidecar    bool   // write the checksums to <dest>.sha256 and <dest>.md5
+	ChecksumMeta       bool   // set the checksums as x-oss-meta-sha256 and x-oss-meta-md5 of the dest
+	Tagging            bool   // tag the dest with its channel, source version, cert and JobID
+	JobID              string // in the tags of the dest, such as the request id of FC
+	Caller             string // who asked for the job, in the audit records
+	Callback           string // url OSS posts to once the dest is committed, see Callback
+	CallbackBody       string // body of the callback, DefaultCallbackBody if empty
+
+	// tags of the dest to match lifecycle rules, like env=test,team=games,
+	// and the time after which clean deletes it, see DeleteAfterTag
+	Tags        string
+	DeleteAfter time.Duration
+
+	// Progress is called as each phase begins, may be nil
+	Progress func(Progress) `json:"-"`
+	// LockDest locks each dest once rendered, failing it on an error, and
+	// returns the func unlocking it once the dest is done, may be nil
+	LockDest func(dest string) (unlock func(), err error) `json:"-"`
+	// Logger with the ids of the job such as request-id, slog.Default() if nil
+	Logger *slog.Logger `json:"-"`
+	// Tracer of the phases, OSS requests and signing, may be nil
+	Tracer Tracer `json:"-"`
+	// Retry of the OSS requests and failed parts, DefaultRetryPolicy if nil
+	Retry *RetryPolicy `json:"-"`
+	// Throttle is called before each OSS request and its retries, and may
+	// block to rate limit them, may be nil
+	Throttle func(op string) `json:"-"`
+	// Audit is called with the record of each dest written, and fails the
+	// dest if it returns an error, may be nil
+	Audit func(AuditRecord) error `json:"-"`
+	// ManifestMutators change the MANIFEST.MF of each dest signed again
+	// with v1, after the built-in ones, may be nil
+	ManifestMutators []ManifestMutator `json:"-"`
+	// EntryTransformers change the entries appended to each dest signed
+	// again, before they are signed, may be nil
+	EntryTransformers []EntryTransformer `json:"-"`
+}
+
+// DefaultOptions returns the options with the defaults of the command
+func DefaultOptions() Options {
+	return Options{
+		CPIDFile:         true,
+		CPIDPaths:        CPIDPath,
+		CompressionLevel: defaultLevel,
+		Validate:         true,
+		VerifySignature:  true,
+		Jobs:             4,
+		Retries:          2,
+		NextSuffix:       DefaultNextSuffix,
+	}
+}
+
+// redactedOptions marshals as json, in both text and json logs
+type redactedOptions Options
+
+func (o redactedOptions) MarshalJSON() ([]byte, error) {
+	type plain redactedOptions
+	return json.Marshal(plain(o))
+}
+
+func (o redactedOptions) MarshalText() ([]byte, error) {
+	return o.MarshalJSON()
+}
+
+// Redacted returns o without the OSS secrets and the private key blob
+func (o Options) Redacted() Options {
+	if o.PrivateKeyBlob != "" {
+		o.PrivateKeyBlob = "***"
+	}
+	if o.OSSAccessKeySecret != "" {
+		o.OSSAccessKeySecret = "***"
+	}
+	if o.OSSSecurityToken != "" {
+		o.OSSSecurityToken = "***"
+	}
+	return o
+}
+
+func (o Options) String() string {
+	buf, _ := json.MarshalIndent(redactedOptions(o.Redacted()), "", "  ")
+	return string(buf)
+}
+
+// LogValue implements slog.LogValuer, to keep the secrets out of logs
+func (o Options) LogValue() slog.Value {
+	return slog.AnyValue(redactedOptions(o.Redacted()))
+}
+
+// ExtraFile is a file to add to the apk besides cpid
+type ExtraFile struct {
+	Path    string // assets/channel.json
+	Source  string // /path/to/file or oss://my-bucket/file
+	Replace bool   // must replace an existing entry
+	Content []byte `json:"-"`
+}
+
+// ExtraFiles implements flag.Value for repeatable -add flags
+type ExtraFiles []ExtraFile
+
+func (f *ExtraFiles) String() string {
+	if f == nil {
+		return ""
+	}
+	var s []string
+	for _, e := range *f {
+		s = append(s, e.Path+"="+e.Source)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses path=source
+func (f *ExtraFiles) Set(value string) error {
+	return f.Add(value, false)
+}
+
+// Add parses path=source, the entry must exist in the apk if replace
+func (f *ExtraFiles) Add(value string, replace bool) error {
+	pathAndSource := strings.SplitN(value, "=", 2)
+	if len(pathAndSource) != 2 || pathAndSource[0] == "" || pathAndSource[1] == "" {
+		return fmt.Errorf("expect path=source, got: %s", value)
+	}
+	*f = append(*f, ExtraFile{
+		Path:    pathAndSource[0],
+		Source:  pathAndSource[1],
+		Replace: replace,
+	})
+	return nil
+}
+
+// ManifestAttr is a main attribute of MANIFEST.MF to add or override,
+// like Built-By
+type ManifestAttr struct {
+	Name  string
+	Value string
+}
+
+// ManifestAttrs implements flag.Value for repeatable -manifest-attr flags
+type ManifestAttrs []ManifestAttr
+
+func (a *ManifestAttrs) String() string {
+	if a == nil {
+		return ""
+	}
+	var s []string
+	for _, attr := range *a {
+		s = append(s, attr.Name+"="+attr.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses name=value
+func (a *ManifestAttrs) Set(value string) error {
+	nameAndValue := strings.SplitN(value, "=", 2)
+	if len(nameAndValue) != 2 {
+		return fmt.Errorf("expect name=value, got: %s", value)
+	}
+	if err := checkMainAttr(nameAndValue[0], nameAndValue[1]); err != nil {
+		return err
+	}
+	*a = append(*a, ManifestAttr{Name: nameAndValue[0], Value: nameAndValue[1]})
+	return nil
+}
+
+// phases of a dest apk
+const (
+	PhaseOpen     = "open"     // read the central directory of the source
+	PhaseCheck    = "check"    // check the cpid of an existing dest
+	PhaseBuild    = "build"    // build and sign the new entries
+	PhaseUpload   = "upload"   // copy the source and upload the new entries
+	PhaseValidate = "validate" // re-open the dest
+	PhasePublish  = "publish"  // copy the temp object to the dest with Atomic
+	PhaseStage    = "stage"    // copy the kept ranges of the source once with SharedPrefix
+	PhaseDone     = "done"
+)
+
+// Progress of a dest apk
+type Progress struct {
+	Phase string
+	Dest  string
+}
+
+// progress reports the phase of dest. With channels, it is called from the
+// upload workers too.
+func (p *packer) progress(phase, dest string) {
+	p.log().Debug("phase", "phase", phase, "dest", dest)
+	now := time.Now()
+	if p.phase != "" {
+		if p.phases == nil {
+			p.phases = make(map[string]time.Duration)
+		}
+		p.phases[p.phase] += now.Sub(p.phaseStart)
+	}
+	p.phase, p.phaseStart = phase, now
+	p.retryMu.Lock()
+	p.usage.phase = phase
+	p.retryMu.Unlock()
+	p.startPhase(phase, dest)
+	if p.Progress != nil {
+		p.Progress(Progress{Phase: phase, Dest: dest})
+	}
+}
+
+// Result of a dest apk
+type Result struct {
+	Dest     string   `json:"dest"`     // my-bucket/dest.apk
+	CPID     string   `json:"cpid"`     // rendered cpid content
+	Skipped  bool     `json:"skipped"`  // dest already repacked with the same cpid
+	Appended []string `json:"appended"` // entries appended to the source apk
+	Info     *ApkInfo `json:"info"`     // nil if not available
+
+	ETag          string           `json:"etag,omitempty"`
+	VersionID     string           `json:"version_id,omitempty"` // if the bucket is versioned
+	Size          int64            `json:"size,omitempty"`
+	SourceSize    int64            `json:"source_size"`
+	SourceVersion string           `json:"source_version,omitempty"` // version id of the source, its etag if not versioned
+	SourceCRC64   string           `json:"source_crc64,omitempty"`   // crc-64 of the source computed by OSS
+	CRC64         string           `json:"crc64,omitempty"`          // crc-64 of the dest computed by OSS
+	SHA256        string           `json:"sha256,omitempty"`         // with Options.SHA256 or Checksums
+	MD5           string           `json:"md5,omitempty"`            // with Options.Checksums
+	CertSHA256    string           `json:"cert_sha256,omitempty"`    // of the signing cert, if signed again
+	Schemes       string           `json:"schemes,omitempty"`        // signature schemes of the dest, if signed again
+	PhasesMS      map[string]int64 `json:"phases_ms,omitempty"`      // milliseconds of each phase
+	Retries       map[string]int64 `json:"retries,omitempty"`        // of the OSS requests by operation, "part" for the parts of an upload
+	RetryMS       int64            `json:"retry_ms,omitempty"`       // milliseconds slept before the retries
+	Requests      map[string]int64 `json:"requests,omitempty"`       // OSS requests of the dest by operation, retries included
+	PhaseRequests map[string]int64 `json:"phase_requests,omitempty"` // OSS requests of the dest by phase
+	BytesRead     int64            `json:"bytes_read,omitempty"`     // of the source, by the ranged reads of the dest
+	BytesCopied   int64            `json:"bytes_copied,omitempty"`   // copied on the OSS side by UploadPartCopy
+	BytesUploaded int64            `json:"bytes_uploaded,omitempty"` // uploaded by UploadPart and PutObject
+	Expires       string           `json:"expires,omitempty"`        // expiry date of a lifecycle rule of the dest
+	Next          *Result          `json:"next,omitempty"`           // of the dest signed with the next key
+}
+
+// packer runs a repack with its own copy of the options, which are updated
+// for each job
+type packer struct {
+	Options
+
+	phase      string // current phase, since phaseStart
+	phaseStart time.Time
+	phases     map[string]time.Duration
+	certSHA256 string  // of the cert in the signature
+	schemes    schemes // of the dest, see selectSchemes
+	keyPEM     []byte  // read once per job, see readPrivateKey
+	certPEM    []byte
+	keyRules   []KeyRule // of KeyMap
+	job        Job       // template data of the dest, for the callback
+	appended   []*Entry  // of the dest, see newEntries
+	outputs    int       // dests of the source, see chooseCopyStrategy
+
+	workFiles map[string][]byte // the work dir with InMemory
+
+	retryMu sync.Mutex       // of the counters of the OSS requests of the job
+	retries map[string]int64 // see addRetry
+	retryMS int64
+	usage   usage         // see addRequest and addBytes
+	memory  *memoryBudget // shared by the channels of a fan-out
+
+	ctx      context.Context // of the span of the job, stops the OSS retries once done
+	phaseCtx context.Context // of the span of the current phase
+	phaseEnd func(error)
+}
+
+func (p *packer) log() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
+
+// DefaultAccelerateEndpoint is the global endpoint of OSS transfer
+// acceleration, for the buckets with it enabled
+const DefaultAccelerateEndpoint = "oss-accelerate.aliyuncs.com"
+
+// accelerateEndpoint returns the endpoint of transfer acceleration
+func (p *packer) accelerateEndpoint() string {
+	if p.AccelerateEndpoint != "" {
+		return p.AccelerateEndpoint
+	}
+	return DefaultAccelerateEndpoint
+}
+
+// sourceEndpoint returns the endpoint the source is read from
+func (p *packer) sourceEndpoint() string {
+	switch {
+	case p.SourceAccelerate:
+		return p.accelerateEndpoint()
+	case p.SourceEndpoint != "":
+		return p.SourceEndpoint
+	}
+	return p.OSSEndpoint
+}
+
+// destEndpoint returns the endpoint the dest is written to, and the other
+// objects such as the keys are read from
+func (p *packer) destEndpoint() string {
+	if p.DestAccelerate {
+		return p.accelerateEndpoint()
+	}
+	return p.OSSEndpoint
+}
+
+func (p *packer) ossConfig() OSSConfig {
+	return OSSConfig{
+		Endpoint:        p.destEndpoint(),
+		AccessKeyID:     p.OSSAccessKeyID,
+		AccessKeySecret: p.OSSAccessKeySecret,
+		SecurityToken:   p.OSSSecurityToken,
+		Log:             p.log(),
+		Context:         p.ctx,
+		Trace:           p.trace,
+		Retry:           p.Retry,
+		OnRetry:         p.addRetry,
+		Throttle:        p.Throttle,
+		OnRequest:       p.addRequest,
+		OnBytes:         p.addBytes,
+	}
+}
+
+// sourceConfig returns the config of the source bucket
+func (p *packer) sourceConfig() OSSConfig {
+	config := p.ossConfig()
+	config.Endpoint = p.sourceEndpoint()
+	return config
+}
+
+// copyConfig returns the config of a Writer from the source
+func (p *packer) copyConfig() OSSConfig {
+	config := p.ossConfig()
+	if endpoint := p.sourceEndpoint(); endpoint != config.Endpoint {
+		config.SourceEndpoint = endpoint
+	}
+	return config
+}
+
+// addRetry counts a retry of op after delay in the result of the job
+func (p *packer) addRetry(op string, delay time.Duration) {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	if p.retries == nil {
+		p.retries = make(map[string]int64)
+	}
+	p.retries[op]++
+	p.retryMS += delay.Milliseconds()
+}
+
+// newPacker checks opts and loads the extra files, see checkConfig
+func newPacker(ctx context.Context, opts Options) (*packer, error) {
+	p := &packer{Options: opts, ctx: ctx, memory: newMemoryBudget(opts.MaxMemory)}
+	p.ExtraFiles = append(ExtraFiles(nil), opts.ExtraFiles...)
+	if err := p.checkConfig(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Repack repacks opts.SourceAPK with the cpid of opts.Channel to opts.DestAPK,
+// skipping a dest with the same cpid unless opts.Force, safe for concurrent use
+func Repack(ctx context.Context, opts Options) (result Result, err error) {
+	p, err := newPacker(ctx, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, errorOf(KindCanceled, err)
+	}
+	// of no kind, as the disk may be full for now
+	cleanup, err := p.makeWorkDir()
+	if err != nil {
+		return Result{}, err
+	}
+	defer cleanup()
+	end := p.startJob(ctx, slog.String("source", p.SourceAPK))
+	defer func() { end(err) }()
+	p.progress(PhaseOpen, p.DestAPK)
+	src, err := p.openSource()
+	if err != nil {
+		return Result{}, errorOf(KindSource, err)
+	}
+	defer src.close()
+	t, err := p.newTemplates()
+	if err != nil {
+		return Result{}, errorOf(KindConfig, err)
+	}
+	job := p.newJob(src, p.Channel)
+	p.job = job
+	if err := t.apply(p, job); err != nil {
+		return Result{}, errorOf(KindConfig, err)
+	}
+	if err := p.selectKey(job); err != nil {
+		return Result{}, errorOf(KindConfig, err)
+	}
+	if p.usesCPID() && p.CPIDContent == "" {
+		return Result{}, errorOf(KindConfig, fmt.Errorf("the cpid is empty"))
+	}
+	// a dest template of an OSS trigger may point back to the source
+	if p.DestAPK == p.SourceAPK {
+		return Result{}, errorOf(KindConfig, fmt.Errorf("dest is the source: %s", p.DestAPK))
+	}
+	result, err = p.run(ctx, src)
+	if err != nil || !p.hasNextKey() {
+		return result, err
+	}
+
+	// sign the dest again with the next key, to a dest of its own
+	q := &packer{Options: p.Options, memory: p.memory, ctx: p.ctx, job: p.job}
+	q.Logger = p.log().With("key", "next")
+	q.useNextKey()
+	next, err := q.run(ctx, src)
+	result.Next = &next
+	return result, err
+}
+
+// RepackChannels repacks opts.SourceAPK for every channel of opts.Channels,
+// returning the results of the dest apks done even if some channels failed
+func RepackChannels(ctx context.Context, opts Options) (results []Result, err error) {
+	p, err := newPacker(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	cleanup, err := p.makeWorkDir()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	end := p.startJob(ctx, slog.String("source", p.SourceAPK), slog.String("channels", p.Channels))
+	defer func() { end(err) }()
+	return p.fanOut(ctx)
+}
+
+// makeWorkDir creates a temp dir of the job under WorkDir, as the signature
+// files of concurrent jobs have the same names, and returns its cleanup
+func (p *packer) makeWorkDir() (func(), error) {
+	if p.InMemory {
+		return func() {}, nil
+	}
+	if p.WorkDir != "" {
+		if err := os.MkdirAll(p.WorkDir, 0755); err != nil {
+			return nil, fmt.Errorf("work dir: %v", err)
+		}
+	}
+	dir, err := ioutil.TempDir(p.WorkDir, "repack-")
+	if err != nil {
+		return nil, fmt.Errorf("work dir: %v", err)
+	}
+	p.WorkDir = dir
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// Sign signs the apk of opts.SourceAPK again to opts.DestAPK, with the
+// extra files but no cpid, e.g. to change the signing key
+func Sign(ctx context.Context, opts Options) (Result, error) {
+	return Repack(ctx, signOptions(opts))
+}
+
+// signOptions returns opts to sign an apk again, with no cpid
+func signOptions(opts Options) Options {
+	opts.Sign, opts.Force = true, true
+	opts.CPIDFile, opts.CPIDComment, opts.V2Channel = false, false, false
+	opts.CPIDJSON, opts.CPIDSeal, opts.MetaDataName = "", "", ""
+	return opts
+}
+
+// Inspect prints the entries, signatures and channel of opts.SourceAPK to w
+func Inspect(ctx context.Context, opts Options, w io.Writer) error {
+	p := &packer{Options: opts, ctx: ctx}
+	if err := p.inspect(w); err != nil {
+		return errorOf(KindSource, fmt.Errorf("inspect: %v", err))
+	}
+	return nil
+}
+
+// lockDest locks the dest of the current job with LockDest
+func (p *packer) lockDest() (unlock func(), err error) {
+	if p.LockDest == nil {
+		return func() {}, nil
+	}
+	return p.LockDest(p.DestAPK)
+}
+
+// run repacks and uploads the dest apk of the current job
+func (p *packer) run(ctx context.Context, src *Source) (Result, error) {
+	start := time.Now()
+	result := Result{Dest: p.DestAPK, CPID: p.CPIDContent, Info: src.Info, SourceSize: src.Size, SourceVersion: src.Version, SourceCRC64: src.CRC64}
+	p.schemes = src.Schemes
+	unlock, err := p.lockDest()
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+	if !p.Force && !src.Container {
+		p.progress(PhaseCheck, p.DestAPK)
+		repacked, err := p.isRepacked()
+		if err != nil {
+			p.log().Warn("check dest", "phase", PhaseCheck, "error", err)
+		} else if repacked {
+			p.log().Info("dest already repacked with the same cpid, skip", "phase", PhaseCheck)
+			result.Skipped = true
+			return result, nil
+		}
+	}
+
+	if err := p.runHook(HookPreSign, p.Channel, result); err != nil {
+		return result, err
+	}
+	p.progress(PhaseBuild, p.DestAPK)
+	w, appended, err := p.repack(src)
+	if err != nil {
+		return result, err
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err := p.checkSourceUnchanged(src); err != nil {
+		return result, err
+	}
+	if err := p.upload(w, appended); err != nil {
+		return result, err
+	}
+	p.progress(PhaseDone, p.DestAPK)
+	p.log().Info("repacked", "phase", PhaseDone, "dest", p.DestAPK, "duration", time.Since(start))
+	result.Appended = appended
+	if err := p.tagDest(p.Channel, result); err != nil {
+		return result, err
+	}
+	if err := p.describe(&result); err != nil {
+		return result, fmt.Errorf("describe dest: %v", err)
+	}
+	if err := p.audit(p.Channel, result); err != nil {
+		return result, err
+	}
+	if err := p.runHook(HookPostUpload, p.Channel, result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,226 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestExtraFilesSet(t *testing.T) {
+	var files ExtraFiles
+	for _, v := range []string{"assets/channel.json=/tmp/channel.json", "a=oss://bucket/a=b"} {
+		if err := files.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	if len(files) != 2 || files[1].Path != "a" || files[1].Source != "oss://bucket/a=b" {
+		t.Errorf("files %+v", files)
+	}
+	for _, v := range []string{"nosource", "=src", "path="} {
+		if err := files.Set(v); err == nil {
+			t.Errorf("Set(%q) accepted", v)
+		}
+	}
+}
+
+func TestManifestAttrsSet(t *testing.T) {
+	var attrs ManifestAttrs
+	for _, v := range []string{"Built-By=ci", "X-Channel_Tool=1.2=beta"} {
+		if err := attrs.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	if s := attrs.String(); s != "Built-By=ci,X-Channel_Tool=1.2=beta" {
+		t.Errorf("attrs %s", s)
+	}
+	for _, v := range []string{"novalue", "=v", "Name=a", "manifest-version=2", "SHA-256-Digest=x", "Bad Name=v", "X-A=a\nb"} {
+		if err := attrs.Set(v); err == nil {
+			t.Errorf("Set(%q) accepted", v)
+		}
+	}
+}
+
+func TestNewPacker(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *Options)
+		ok     bool
+	}{
+		{"default", func(o *Options) {}, true},
+		{"page align", func(o *Options) { o.PageAlign = 16384 }, true},
+		{"page align not a power of two", func(o *Options) { o.PageAlign = 12288 }, false},
+		{"v2 channel", func(o *Options) { o.V2Channel = true }, true},
+		{"v2 channel with meta-data", func(o *Options) { o.V2Channel, o.MetaDataName = true, "UMENG_CHANNEL" }, false},
+		{"missing extra file", func(o *Options) { o.ExtraFiles.Set("assets/a.json=/nonexistent/a.json") }, false},
+	}
+	server := newOSSServer(map[string][]byte{})
+	defer server.Close()
+	keyPEM, certPEM := writeKeyPair(t, t.TempDir())
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+		opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+		opts.PrivateKeyPEM, opts.CertPEM = keyPEM, certPEM
+		tt.change(&opts)
+		if _, err := newPacker(context.Background(), opts); (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	opts := DefaultOptions()
+	opts.OSSAccessKeyID, opts.OSSAccessKeySecret, opts.OSSSecurityToken = "id", "secret", "token"
+	var logs bytes.Buffer
+	slog.New(slog.NewJSONHandler(&logs, nil)).Info("config", "options", opts)
+	for _, s := range []string{logs.String(), opts.String()} {
+		if strings.Contains(s, "secret") || strings.Contains(s, "token") || !strings.Contains(s, `"id"`) {
+			t.Errorf("not redacted: %s", s)
+		}
+	}
+	if opts.OSSAccessKeySecret != "secret" {
+		t.Error("options changed")
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	p := &packer{Options: Options{OSSEndpoint: "oss-cn-hangzhou.aliyuncs.com"}}
+	if p.sourceConfig().Endpoint != p.OSSEndpoint || p.copyConfig().SourceEndpoint != "" {
+		t.Errorf("source %s, copy %s", p.sourceConfig().Endpoint, p.copyConfig().SourceEndpoint)
+	}
+	p.SourceEndpoint, p.SourceAccelerate = "oss-us-west-1.aliyuncs.com", true
+	if p.sourceConfig().Endpoint != DefaultAccelerateEndpoint || p.copyConfig().SourceEndpoint != DefaultAccelerateEndpoint ||
+		p.ossConfig().Endpoint != p.OSSEndpoint {
+		t.Errorf("source accelerate: source %s, copy %s, dest %s", p.sourceConfig().Endpoint, p.copyConfig().SourceEndpoint, p.ossConfig().Endpoint)
+	}
+	// the copies are within the endpoint of the dest
+	p.AccelerateEndpoint, p.DestAccelerate = "oss-accelerate-overseas.aliyuncs.com", true
+	if p.ossConfig().Endpoint != p.AccelerateEndpoint || p.copyConfig().SourceEndpoint != "" {
+		t.Errorf("accelerate: dest %s, copy %s", p.ossConfig().Endpoint, p.copyConfig().SourceEndpoint)
+	}
+}
+
+func TestMakeWorkDir(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "scratch")
+	p := &packer{Options: Options{WorkDir: parent}}
+	cleanup, err := p.makeWorkDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(p.WorkDir) != parent {
+		t.Errorf("work dir %s, not under %s", p.WorkDir, parent)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.WorkDir, "CERT.SF"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if _, err := os.Stat(p.WorkDir); !os.IsNotExist(err) {
+		t.Errorf("work dir not removed: %v", err)
+	}
+}
+
+// TestRepackConcurrent runs the jobs of a server with different keys at the
+// same time, with -race for the state they share
+func TestRepackConcurrent(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+
+	// the options of the server, copied by each job
+	base := DefaultOptions()
+	base.OSSEndpoint, base.OSSAccessKeyID, base.OSSAccessKeySecret = server.URL, "id", "secret"
+	base.SourceAPK = "bucket/a.apk"
+	base.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	extra := filepath.Join(t.TempDir(), "channel.json")
+	ioutil.WriteFile(extra, []byte("{}"), 0644)
+	base.ExtraFiles.Set("assets/channel.json=" + extra)
+
+	const keys, jobs = 2, 8
+	var keyPEMs, certPEMs [keys]string
+	for i := range keyPEMs {
+		keyPEMs[i], certPEMs[i] = writeKeyPair(t, t.TempDir())
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, jobs)
+	for i := 0; i < jobs; i++ {
+		opts := base
+		opts.DestAPK, opts.CPIDContent = fmt.Sprintf("bucket/b-%d.apk", i), fmt.Sprintf("c%d", i)
+		opts.PrivateKeyPEM, opts.CertPEM = keyPEMs[i%keys], certPEMs[i%keys]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = Repack(context.Background(), opts)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		apk := objects[fmt.Sprintf("bucket/b-%d.apk", i)]
+		r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		if cpid, err := readEntry(findFile(r, CPIDPath)); err != nil || string(cpid) != fmt.Sprintf("c%d", i) {
+			t.Errorf("job %d: cpid %q, %v", i, cpid, err)
+		}
+		if findFile(r, "assets/channel.json") == nil {
+			t.Errorf("job %d: extra file not added", i)
+		}
+		// signed with the cert of its own key
+		certPEM, _ := ioutil.ReadFile(certPEMs[i%keys])
+		block, _ := pem.Decode(certPEM)
+		rsa, err := readEntry(findFile(r, fmt.Sprintf(RSAPath, SigFileName)))
+		if err != nil || !bytes.Contains(rsa, block.Bytes) {
+			t.Errorf("job %d: not signed with the cert of key %d: %v", i, i%keys, err)
+		}
+	}
+}
+
+func TestRepackAtomic(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	opts.Atomic, opts.Validate = true, true
+	var phases []string
+	opts.Progress = func(p Progress) { phases = append(phases, p.Phase) }
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(phases, ","); !strings.HasSuffix(got, PhaseUpload+","+PhaseValidate+","+PhasePublish+","+PhaseDone) {
+		t.Errorf("phases %s", got)
+	}
+	apk := objects["bucket/b.apk"]
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpid, err := readEntry(findFile(r, CPIDPath)); err != nil || string(cpid) != "c1" {
+		t.Errorf("cpid %q, %v", cpid, err)
+	}
+	// the temp object is removed once published
+	for key := range objects {
+		if strings.Contains(key, ".tmp-") {
+			t.Errorf("temp object %s left", key)
+		}
+	}
+}
@@ -0,0 +1,887 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// consts ...
+const (
+	CopyPartWorkerCount   = 8
+	CopyPartSizeInBytes   = 50 * 1024 * 1024
+	MaxWriteBufferInBytes = 100 * 1024 * 1024
+	MinPartSizeInBytes    = 100 * 1024
+	MaxPartSizeInBytes    = 5 * 1024 * 1024 * 1024
+	MaxPartCount          = 10000
+)
+
+// Reader implements io.ReaderAt and reads from OSS object
+type Reader struct {
+	Bucket string
+	Object string
+	Client Store
+	ETag   string // of the object, sent as If-Match of every read if not empty
+
+	retry   *RetryPolicy    // of the short reads
+	log     *slog.Logger    // of the short reads, slog.Default() if nil
+	ctx     context.Context // stops the retries once done, may be nil
+	onRetry func(op string, delay time.Duration)
+	onBytes func(op string, n int64)
+}
+
+// OSSConfig ...
+type OSSConfig struct {
+	Endpoint        string
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+	Log             *slog.Logger    // of the retries, slog.Default() if nil
+	Context         context.Context // stops the retries once done, may be nil
+
+	// Trace starts a span of a request, may be nil
+	Trace func(name string, attrs ...slog.Attr) func(error)
+	// Retry of the requests, DefaultRetryPolicy if nil
+	Retry *RetryPolicy
+	// OnRetry is called before each retry of an operation, may be nil
+	OnRetry func(op string, delay time.Duration)
+	// Throttle is called before each request, may be nil
+	Throttle func(op string)
+	// OnRequest is called before each request of an operation, its retries
+	// included, may be nil
+	OnRequest func(op string)
+	// OnBytes is called with the bytes read by GetObject, copied by
+	// UploadPartCopy or uploaded by UploadPart and PutObject, may be nil
+	OnBytes func(op string, n int64)
+	// SourceEndpoint of the source of a Writer, Endpoint if empty
+	SourceEndpoint string
+}
+
+func (c OSSConfig) log() *slog.Logger {
+	if c.Log != nil {
+		return c.Log
+	}
+	return slog.Default()
+}
+
+// NewReader ...
+func NewReader(config OSSConfig, location string) (*Reader, error) {
+	client, err := oss.New(
+		config.Endpoint, config.AccessKeyID, config.AccessKeySecret,
+		oss.SecurityToken(config.SecurityToken))
+
+	if err != nil {
+		return nil, err
+	}
+
+	bucketAndObject := strings.SplitN(location, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", location)
+	}
+
+	bucket, object := bucketAndObject[0], bucketAndObject[1]
+	bucketClient, _ := client.Bucket(bucket)
+
+	return &Reader{
+		Bucket:  bucket,
+		Object:  object,
+		Client:  newStore(bucketClient, config),
+		retry:   config.Retry,
+		log:     config.Log,
+		ctx:     config.Context,
+		onRetry: config.OnRetry,
+		onBytes: config.OnBytes,
+	}, nil
+}
+
+// ReadAt reads len(buf) bytes from OSS object at offset, requesting a body
+// cut short again from where it stopped, with the backoff of the retry policy
+func (r *Reader) ReadAt(buf []byte, off int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	b := newBackoff(r.retry)
+	n := 0
+	for {
+		resp, err := r.Client.GetObject(r.Object,
+			ifMatch(r.ETag, oss.Range(off+int64(n), off+int64(len(buf))-1))...)
+		if err != nil {
+			return n, sourceChanged(err)
+		}
+		m, err := io.ReadFull(resp, buf[n:])
+		resp.Close()
+		n += m
+		transferred(r.onBytes, "GetObject", &stats.read, int64(m))
+		if err == nil {
+			return n, nil
+		}
+
+		if m > 0 {
+			// the retries are of reads that make no progress
+			b = newBackoff(r.retry)
+		}
+		delay := b.next()
+		if delay == 0 {
+			return n, fmt.Errorf("expect %d bytes, got: %d: %v", len(buf), n, err)
+		}
+		r.logger().Warn("short read, resume", "object", r.Object, "offset", off+int64(n), "missing", len(buf)-n, "error", err)
+		retried(r.onRetry, "GetObject", delay)
+		if err := sleep(r.ctx, delay); err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *Reader) logger() *slog.Logger {
+	if r.log != nil {
+		return r.log
+	}
+	return slog.Default()
+}
+
+// Size returns the object size
+func (r *Reader) Size() (int64, error) {
+	resp, err := r.Client.GetObjectDetailedMeta(r.Object)
+	if err != nil {
+		return 0, err
+	}
+	return contentLength(resp)
+}
+
+// contentLength returns the object size in the meta of an object
+func contentLength(resp http.Header) (int64, error) {
+	length := resp.Get("Content-Length")
+	if len(length) == 0 {
+		return 0, fmt.Errorf("empty content length")
+	}
+
+	return strconv.ParseInt(length, 10, 64)
+}
+
+// ReadObject reads the whole object at location
+func ReadObject(config OSSConfig, location string) ([]byte, error) {
+	r, err := NewReader(config, location)
+	if err != nil {
+		return nil, err
+	}
+	size, err := r.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	if size == 0 {
+		return buf, nil
+	}
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteObject puts buf to the object at location
+func WriteObject(config OSSConfig, location string, buf []byte) error {
+	r, err := NewReader(config, location)
+	if err != nil {
+		return err
+	}
+	return r.Client.PutObject(r.Object, bytes.NewReader(buf))
+}
+
+// Writer implements io.Writer and writes to OSS object
+type Writer struct {
+	Bucket     string
+	Object     string
+	SrcBucket  string
+	SrcObject  string
+	SrcETag    string // of the source, sent as If-Match of its reads and copies if not empty
+	Client     Store
+	Log        *slog.Logger
+	Context    context.Context // aborts the upload when done, may be nil
+	SpillDir   string          // dir to write to once over the memory budget, "" to fail
+	Callback   *Callback       // upload callback of the object, nil if none
+	Strategy   FlushStrategy   // how the object is written, MultipartCopy if nil, see chooseCopyStrategy
+	ResumeID   string          // job whose upload of Object a failed attempt leaves to resume, see resumeManifest
+	SrcVersion string          // version id or etag of the source, recorded in the resumeManifest
+
+	srcClient Store
+	buffer    []byte
+	segments  []Segment // byte ranges of the source to put before buffer
+	offset    int64     // total size of segments
+
+	retry     *RetryPolicy // of the failed parts
+	onRetry   func(op string, delay time.Duration)
+	onBytes   func(op string, n int64)
+	srcLocal  io.ReaderAt // copy of the source on disk the segments are read from, nil to read OSS
+	noCopy    int32       // set once UploadPartCopy is rejected, see copyPart
+	memory    *memoryBudget
+	spill     *os.File // the data written after buffer was over the budget
+	spillSize int64
+}
+
+// NewWriter ...
+func NewWriter(config OSSConfig, location, srcLocation string, segments []Segment) (*Writer, error) {
+	client, err := oss.New(
+		config.Endpoint, config.AccessKeyID, config.AccessKeySecret,
+		oss.SecurityToken(config.SecurityToken))
+
+	if err != nil {
+		return nil, err
+	}
+
+	bucketAndObject := strings.SplitN(location, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", location)
+	}
+
+	bucket, object := bucketAndObject[0], bucketAndObject[1]
+	bucketClient, _ := client.Bucket(bucket)
+
+	bucketAndObject = strings.SplitN(srcLocation, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", srcLocation)
+	}
+	srcBucket, srcObject := bucketAndObject[0], bucketAndObject[1]
+	srcClient := client
+	if config.SourceEndpoint != "" {
+		srcClient, err = oss.New(
+			config.SourceEndpoint, config.AccessKeyID, config.AccessKeySecret,
+			oss.SecurityToken(config.SecurityToken))
+		if err != nil {
+			return nil, err
+		}
+	}
+	srcBucketClient, _ := srcClient.Bucket(srcBucket)
+
+	offset := int64(0)
+	for _, s := range segments {
+		offset += s.Size
+	}
+
+	return &Writer{
+		Log:       config.log(),
+		Context:   config.Context,
+		Bucket:    bucket,
+		Object:    object,
+		SrcBucket: srcBucket,
+		SrcObject: srcObject,
+		Client:    newStore(bucketClient, config),
+		srcClient: newStore(srcBucketClient, config),
+		segments:  segments,
+		offset:    offset,
+		retry:     config.Retry,
+		onRetry:   config.OnRetry,
+		onBytes:   config.OnBytes,
+	}, nil
+}
+
+// Writer keeps buf in memory until Flush, or in a file of SpillDir once
+// over the memory budget
+func (w *Writer) Write(buf []byte) (int, error) {
+	if w.spill == nil {
+		err := w.memory.reserve(int64(len(buf)), "writer buffer")
+		if err == nil {
+			w.buffer = append(w.buffer, buf...)
+			if len(w.buffer) > MaxWriteBufferInBytes {
+				w.Log.Warn("max writer buffer exceeded", "bytes", len(w.buffer))
+			}
+			return len(buf), nil
+		}
+		if w.SpillDir == "" {
+			return 0, err
+		}
+		if err := w.spillBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.spill.Write(buf)
+	w.spillSize += int64(n)
+	return n, err
+}
+
+// spillBuffer moves the buffer to a file of SpillDir
+func (w *Writer) spillBuffer() error {
+	f, err := ioutil.TempFile(w.SpillDir, "buffer-")
+	if err != nil {
+		return fmt.Errorf("spill writer buffer: %v", err)
+	}
+	if _, err := f.Write(w.buffer); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("spill writer buffer: %v", err)
+	}
+	w.Log.Info("writer buffer spilled to disk", "phase", PhaseBuild, "bytes", len(w.buffer), "file", f.Name())
+	w.spill, w.spillSize = f, int64(len(w.buffer))
+	w.memory.release(int64(len(w.buffer)))
+	w.buffer = nil
+	return nil
+}
+
+// size returns the size of the dest object
+func (w *Writer) size() int64 {
+	return w.offset + int64(len(w.buffer)) + w.spillSize
+}
+
+// body returns head followed by the data written, and its size
+func (w *Writer) body(head []byte) (io.ReadSeeker, int64) {
+	if w.spill == nil {
+		buf := append(head, w.buffer...)
+		return bytes.NewReader(buf), int64(len(buf))
+	}
+	size := int64(len(head)) + w.spillSize
+	return io.NewSectionReader(joinedReaderAt{head: head, r: w.spill}, 0, size), size
+}
+
+// copyFrom makes w copy its segments from the object at location instead
+// of the source, an object made of them one after another, see prefixStage
+func (w *Writer) copyFrom(config OSSConfig, location string) error {
+	r, err := NewReader(config, location)
+	if err != nil {
+		return err
+	}
+	w.SrcBucket, w.SrcObject, w.SrcETag, w.srcClient = r.Bucket, r.Object, "", r.Client
+	w.srcLocal = nil
+	w.segments = []Segment{{Offset: 0, Size: w.offset}}
+	return nil
+}
+
+// readSegments reads the given byte ranges of the source object, or of its
+// copy on disk, reserving them in the memory budget
+func (w *Writer) readSegments(segments []Segment) ([]byte, error) {
+	size := int64(0)
+	for _, s := range segments {
+		size += s.Size
+	}
+	if err := w.memory.reserve(size, "source ranges"); err != nil {
+		return nil, err
+	}
+	var src io.ReaderAt = &Reader{Bucket: w.SrcBucket, Object: w.SrcObject, Client: w.srcClient, ETag: w.SrcETag, retry: w.retry, log: w.Log, ctx: w.Context, onRetry: w.onRetry, onBytes: w.onBytes}
+	if w.srcLocal != nil {
+		src = w.srcLocal
+	}
+	buf := make([]byte, 0, size)
+	for _, s := range segments {
+		part := buf[len(buf) : len(buf)+int(s.Size)]
+		if _, err := src.ReadAt(part, s.Offset); err != nil {
+			w.memory.release(size)
+			return nil, err
+		}
+		buf = buf[:len(buf)+int(s.Size)]
+	}
+	return buf, nil
+}
+
+// planParts splits w.segments into the ranges of each part of up to partSize
+// bytes, and returns the leftover too small for a part
+func (w *Writer) planParts(partSize int64) ([][]Segment, []Segment) {
+	// grow the part size of huge objects to stay within MaxPartCount,
+	// keeping one part for the buffer and one for each segment boundary
+	if limit := int64(MaxPartCount - 1 - len(w.segments)); w.offset/partSize >= limit {
+		partSize = w.offset/limit + 1
+	}
+
+	var parts [][]Segment
+	var pending []Segment
+	pendingSize := int64(0)
+	for _, s := range w.segments {
+		for s.Size > 0 {
+			var n int64
+			if pendingSize == 0 && s.Size >= MinPartSizeInBytes {
+				n = partSize
+				// avoid the last part < 100KB
+				if s.Size-n < MinPartSizeInBytes {
+					n = s.Size
+				}
+				parts = append(parts, []Segment{{Offset: s.Offset, Size: n}})
+			} else {
+				n = MinPartSizeInBytes - pendingSize
+				if n > s.Size {
+					n = s.Size
+				}
+				pending = append(pending, Segment{Offset: s.Offset, Size: n})
+				pendingSize += n
+				if pendingSize >= MinPartSizeInBytes {
+					parts = append(parts, pending)
+					pending, pendingSize = nil, 0
+				}
+			}
+			s.Offset += n
+			s.Size -= n
+		}
+	}
+	return parts, pending
+}
+
+// Flush writes the target object with w.Strategy, a MultipartCopy of
+// CopyPartSizeInBytes if nil
+func (w *Writer) Flush() error {
+	defer w.memory.release(int64(len(w.buffer)))
+	if w.spill != nil {
+		defer func() {
+			w.spill.Close()
+			os.Remove(w.spill.Name())
+		}()
+	}
+	strategy := w.Strategy
+	if strategy == nil {
+		strategy = MultipartCopy{}
+	}
+	return strategy.Flush(w)
+}
+
+// put reads the source segments and puts them with the data written in a
+// single request
+func (w *Writer) put() error {
+	w.Log.Info("put small object", "phase", PhaseUpload, "bytes", w.offset)
+
+	buf, err := w.readSegments(w.segments)
+	if err != nil {
+		return err
+	}
+	defer w.memory.release(int64(len(buf)))
+	body, _ := w.body(buf)
+	return w.Client.PutObject(w.Object, body)
+}
+
+// multipart writes the target object in parts of partSize, copied unless stream:
+// 1. initiate a multipart upload
+// 2. copy the source segments to the target
+// 3. upload the newly written w.buffer
+// 4. complete the multipart upload
+func (w *Writer) multipart(partSize int64, stream bool) (err error) {
+	w.Log.Info("begin multipart copy", "phase", PhaseUpload, "bytes", w.offset, "part_size", partSize, "stream", stream)
+
+	// prepare all parts
+	type partDesc struct {
+		index    int64
+		segments []Segment
+	}
+	planned, leftover := w.planParts(partSize)
+	numParts := int64(len(planned))
+	if numParts+1 > MaxPartCount {
+		return fmt.Errorf("too many parts: %d", numParts+1)
+	}
+	for _, p := range planned {
+		if len(p) == 1 && p[0].Size > MaxPartSizeInBytes {
+			return fmt.Errorf("part too large: %d", p[0].Size)
+		}
+	}
+
+	up, uploaded, err := w.initiate(planned)
+	if err != nil {
+		return err
+	}
+	// don't leave the parts of a failed or canceled upload behind, unless
+	// the next attempt resumes it
+	defer func() {
+		var ce *CallbackError
+		completed := err == nil || errors.As(err, &ce)
+		switch {
+		case completed && w.ResumeID != "":
+			w.removeManifest(up)
+		case completed:
+		case w.ResumeID != "":
+			w.Log.Info("multipart upload left to resume", "phase", PhaseUpload, "upload_id", up.UploadID)
+		default:
+			w.abort(up)
+		}
+	}()
+	// the parts already uploaded, of the same source ranges as the
+	// manifest of the upload tells, are not copied again
+	var resumed []oss.UploadPart
+	partsChan := make(chan partDesc, numParts)
+	for i, segments := range planned {
+		if part, ok := uploaded[i+1]; ok && int64(part.Size) == segmentsSize(segments) {
+			resumed = append(resumed, oss.UploadPart{PartNumber: part.PartNumber, ETag: part.ETag})
+			continue
+		}
+		partsChan <- partDesc{
+			index:    int64(i) + 1,
+			segments: segments,
+		}
+	}
+	close(partsChan)
+
+	// parallelly copy part and gather all results
+	type resultDesc struct {
+		desc partDesc
+		part oss.UploadPart
+		err  error
+	}
+	resChan := make(chan resultDesc, numParts)
+	if len(uploaded) > 0 {
+		w.Log.Info("resume multipart upload", "phase", PhaseUpload, "upload_id", up.UploadID, "parts", numParts, "uploaded", len(resumed))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(CopyPartWorkerCount)
+	for i := 0; i < CopyPartWorkerCount; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range partsChan {
+				var part oss.UploadPart
+				var err error
+				if err = w.canceled(); err == nil {
+					part, err = w.copyPart(up, p.segments, p.index, stream)
+				}
+				resChan <- resultDesc{
+					desc: p,
+					part: part,
+					err:  err,
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(resChan)
+
+	// retry the failed parts one at a time, fail if any of them still fails
+	parts := append([]oss.UploadPart{}, resumed...)
+	var failed []resultDesc
+	for r := range resChan {
+		if r.err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		parts = append(parts, r.part)
+	}
+	var errs []error
+	for _, r := range failed {
+		// a source overwritten fails every retry too
+		if KindOf(r.err) == KindSource {
+			errs = append(errs, fmt.Errorf("part %d: %w", r.desc.index, r.err))
+			continue
+		}
+		w.Log.Warn("retry part", append([]interface{}{"phase", PhaseUpload, "part", r.desc.index, "error", r.err}, RequestAttrs(r.err)...)...)
+		part, err := w.retryPart(up, r.desc.segments, r.desc.index, stream, r.err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("part %d: %w", r.desc.index, err))
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d parts failed, first: %w", len(errs), numParts, errs[0])
+	}
+
+	buf, err := w.readSegments(leftover)
+	if err != nil {
+		return err
+	}
+	defer w.memory.release(int64(len(buf)))
+
+	if err := w.canceled(); err != nil {
+		return err
+	}
+	// nothing is left to upload when copying a whole object, see publish
+	if body, size := w.body(buf); size > 0 {
+		finalPart, err := w.Client.UploadPart(up, body, size, int(numParts+1))
+		if err != nil {
+			return err
+		}
+		parts = append(parts, finalPart)
+	}
+
+	if w.Callback == nil {
+		_, err = w.Client.CompleteMultipartUpload(up, parts)
+		return err
+	}
+	resp, err := w.Client.CompleteMultipartUploadWithCallback(up, parts, w.Callback)
+	if err != nil {
+		return err
+	}
+	w.Log.Info("upload callback", "phase", PhaseUpload, "url", w.Callback.URL, "response", string(resp))
+	return nil
+}
+
+// resumeManifest is written next to an upload that may be resumed, as
+// <key>.resume-<upload id>, resumed only for the same job, source and parts
+type resumeManifest struct {
+	Owner   string      `json:"owner"`   // ResumeID of the writer
+	Source  string      `json:"source"`  // bucket/object
+	Version string      `json:"version"` // of the source, never resumed if empty
+	Parts   [][]Segment `json:"parts"`   // source ranges of each part but the last, by number
+}
+
+// manifestKey returns the object of the resumeManifest of up
+func manifestKey(up oss.InitiateMultipartUploadResult) string {
+	return up.Key + ".resume-" + up.UploadID
+}
+
+// initiate initiates a multipart upload of w.Object or, with ResumeID, returns
+// the one a failed attempt left for the same planned parts, with its parts
+func (w *Writer) initiate(planned [][]Segment) (oss.InitiateMultipartUploadResult, map[int]oss.UploadedPart, error) {
+	manifest := resumeManifest{Owner: w.ResumeID, Source: w.SrcBucket + "/" + w.SrcObject, Version: w.SrcVersion, Parts: planned}
+	if w.ResumeID != "" {
+		up, err := w.lastUpload(manifest)
+		if err != nil {
+			return oss.InitiateMultipartUploadResult{}, nil, fmt.Errorf("find upload to resume: %v", err)
+		}
+		if up != nil {
+			list, err := w.Client.ListUploadedParts(*up)
+			if err != nil {
+				return oss.InitiateMultipartUploadResult{}, nil, fmt.Errorf("list parts of upload %s: %v", up.UploadID, err)
+			}
+			uploaded := make(map[int]oss.UploadedPart)
+			for _, part := range list.UploadedParts {
+				uploaded[part.PartNumber] = part
+			}
+			return *up, uploaded, nil
+		}
+	}
+	up, err := w.Client.InitiateMultipartUpload(w.Object)
+	if err != nil || w.ResumeID == "" {
+		return up, nil, err
+	}
+	buf, _ := json.Marshal(manifest)
+	if err := w.Client.PutObject(manifestKey(up), bytes.NewReader(buf)); err != nil {
+		w.abort(up)
+		return up, nil, fmt.Errorf("write resume manifest: %v", err)
+	}
+	return up, nil, nil
+}
+
+// lastUpload returns the latest uncompleted upload of w.Object with want as its
+// manifest, nil if none, aborting the others of the job
+func (w *Writer) lastUpload(want resumeManifest) (*oss.InitiateMultipartUploadResult, error) {
+	var uploads []oss.UncompletedUpload
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		list, err := w.Client.ListMultipartUploads(oss.Prefix(w.Object),
+			oss.KeyMarker(keyMarker), oss.UploadIDMarker(uploadIDMarker))
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range list.Uploads {
+			if u.Key == w.Object {
+				uploads = append(uploads, u)
+			}
+		}
+		if !list.IsTruncated {
+			break
+		}
+		keyMarker, uploadIDMarker = list.NextKeyMarker, list.NextUploadIDMarker
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Initiated.After(uploads[j].Initiated) })
+	for _, u := range uploads {
+		up := oss.InitiateMultipartUploadResult{Bucket: w.Bucket, Key: u.Key, UploadID: u.UploadID}
+		manifest, err := w.readManifest(up)
+		if err != nil {
+			return nil, err
+		}
+		if manifest == nil || manifest.Owner != want.Owner {
+			continue
+		}
+		if want.Version != "" && manifest.Source == want.Source && manifest.Version == want.Version && reflect.DeepEqual(manifest.Parts, want.Parts) {
+			return &up, nil
+		}
+		w.Log.Info("multipart upload of other parts, not resumed", "phase", PhaseUpload, "upload_id", up.UploadID)
+		w.abort(up)
+	}
+	return nil, nil
+}
+
+// readManifest returns the resumeManifest of up, nil if none
+func (w *Writer) readManifest(up oss.InitiateMultipartUploadResult) (*resumeManifest, error) {
+	body, err := w.Client.GetObject(manifestKey(up))
+	var se oss.ServiceError
+	if errors.As(err, &se) && se.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var manifest resumeManifest
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("resume manifest of upload %s: %v", up.UploadID, err)
+	}
+	return &manifest, nil
+}
+
+// abort aborts up and removes its manifest, logging a failure
+func (w *Writer) abort(up oss.InitiateMultipartUploadResult) {
+	if err := w.Client.AbortMultipartUpload(up); err != nil {
+		w.Log.Error("abort multipart upload", "phase", PhaseUpload, "upload_id", up.UploadID, "error", err)
+		return
+	}
+	w.Log.Info("multipart upload aborted", "phase", PhaseUpload, "upload_id", up.UploadID)
+	if w.ResumeID != "" {
+		w.removeManifest(up)
+	}
+}
+
+// removeManifest deletes the resumeManifest of up once it is completed or
+// aborted
+func (w *Writer) removeManifest(up oss.InitiateMultipartUploadResult) {
+	if err := w.Client.DeleteObject(manifestKey(up)); err != nil {
+		w.Log.Warn("remove resume manifest", "phase", PhaseUpload, "upload_id", up.UploadID, "error", err)
+	}
+}
+
+// copyPart copies segments to the part index of up, on the server side if it
+// is a single range of the source unless stream, streamed once OSS rejects it
+func (w *Writer) copyPart(up oss.InitiateMultipartUploadResult, segments []Segment, index int64, stream bool) (oss.UploadPart, error) {
+	if len(segments) == 1 && !stream && atomic.LoadInt32(&w.noCopy) == 0 {
+		var options []oss.Option
+		if w.SrcETag != "" {
+			options = append(options, oss.CopySourceIfMatch(quoteETag(w.SrcETag)))
+		}
+		part, err := w.Client.UploadPartCopy(
+			up, w.SrcBucket, w.SrcObject,
+			segments[0].Offset, segments[0].Size, int(index), options...)
+		if err == nil || !copyRejected(err) {
+			return part, sourceChanged(err)
+		}
+		if atomic.CompareAndSwapInt32(&w.noCopy, 0, 1) {
+			w.Log.Warn("server side copy rejected, stream the source", "phase", PhaseUpload, "source", w.SrcBucket+"/"+w.SrcObject, "error", err)
+		}
+	}
+	if len(segments) == 1 {
+		return w.streamPart(up, segments[0], index)
+	}
+	buf, err := w.readSegments(segments)
+	if err != nil {
+		return oss.UploadPart{}, err
+	}
+	defer w.memory.release(int64(len(buf)))
+	return w.Client.UploadPart(up, bytes.NewReader(buf), int64(len(buf)), int(index))
+}
+
+// copyRejected reports whether UploadPartCopy failed as OSS can't copy from
+// the source, e.g. a bucket of another region or account
+func copyRejected(err error) bool {
+	var se oss.ServiceError
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Code {
+	case "NoSuchBucket", "AccessDenied", "InvalidArgument", "NotImplemented":
+		return true
+	}
+	return false
+}
+
+// streamPart uploads the range s of the source to the part index of up,
+// streamed from a single GET without buffering it, or from the copy on disk
+func (w *Writer) streamPart(up oss.InitiateMultipartUploadResult, s Segment, index int64) (oss.UploadPart, error) {
+	if w.srcLocal != nil {
+		return w.Client.UploadPart(up, io.NewSectionReader(w.srcLocal, s.Offset, s.Size), s.Size, int(index))
+	}
+	body := &rangeReader{client: w.srcClient, object: w.SrcObject, etag: w.SrcETag, off: s.Offset, size: s.Size}
+	defer body.Close()
+	return w.Client.UploadPart(up, body, s.Size, int(index))
+}
+
+// rangeReader reads a range of an object with one GET request. Seeking
+// starts a new request from there, as a retry of the upload seeks to 0.
+type rangeReader struct {
+	client Store
+	object string
+	etag   string // If-Match of the request if not empty
+	off    int64
+	size   int64
+
+	pos  int64
+	body io.ReadCloser
+}
+
+func (r *rangeReader) Read(buf []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.client.GetObject(r.object, ifMatch(r.etag, oss.Range(r.off+r.pos, r.off+r.size-1))...)
+		if err != nil {
+			return 0, sourceChanged(err)
+		}
+		r.body = body
+	}
+	if rest := r.size - r.pos; int64(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	n, err := r.body.Read(buf)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 || offset > r.size {
+		return 0, fmt.Errorf("seek out of range: %d", offset)
+	}
+	if offset != r.pos {
+		r.Close()
+		r.pos = offset
+	}
+	return offset, nil
+}
+
+// Close ends the request in progress
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// retryPart copies a part failed with err again with the backoff of w.retry,
+// until it succeeds, the retries run out or w.Context is done
+func (w *Writer) retryPart(up oss.InitiateMultipartUploadResult, segments []Segment, index int64, stream bool, err error) (oss.UploadPart, error) {
+	b := newBackoff(w.retry)
+	for {
+		if cerr := w.canceled(); cerr != nil {
+			return oss.UploadPart{}, cerr
+		}
+		delay := b.next()
+		if delay == 0 {
+			return oss.UploadPart{}, err
+		}
+		retried(w.onRetry, "part", delay)
+		if err := sleep(w.Context, delay); err != nil {
+			return oss.UploadPart{}, err
+		}
+		var part oss.UploadPart
+		part, err = w.copyPart(up, segments, index, stream)
+		if err == nil {
+			return part, nil
+		}
+	}
+}
+
+// canceled returns the error of w.Context once it is done
+func (w *Writer) canceled() error {
+	if w.Context == nil {
+		return nil
+	}
+	return w.Context.Err()
+}
@@ -0,0 +1,552 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// newOSSServer serves the objects of bucket/object keys, with ranged reads,
+// and stores or deletes the objects put or deleted
+func newOSSServer(objects map[string][]byte) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		switch r.Method {
+		case http.MethodPut:
+			buf, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			objects[key] = buf
+			mu.Unlock()
+			return
+		case http.MethodDelete:
+			mu.Lock()
+			delete(objects, key)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		mu.Lock()
+		buf, ok := objects[key]
+		mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	}))
+}
+
+func TestPlanPartsLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []Segment
+	}{
+		{"small", []Segment{{0, 3 * CopyPartSizeInBytes}}},
+		{"1TB", []Segment{{0, 1 << 40}}},
+		{"4.5TB in ranges", []Segment{{0, 1 << 40}, {1<<40 + 100, 7 << 39}}},
+	}
+	for _, tt := range tests {
+		w := &Writer{segments: tt.segments}
+		for _, s := range tt.segments {
+			w.offset += s.Size
+		}
+		parts, leftover := w.planParts(CopyPartSizeInBytes)
+		if len(parts)+1 > MaxPartCount {
+			t.Errorf("%s: %d parts", tt.name, len(parts))
+		}
+		var size int64
+		for _, p := range parts {
+			for _, s := range p {
+				size += s.Size
+			}
+			if len(p) == 1 && p[0].Size > MaxPartSizeInBytes {
+				t.Errorf("%s: part of %d bytes", tt.name, p[0].Size)
+			}
+		}
+		for _, s := range leftover {
+			size += s.Size
+		}
+		if size != w.offset {
+			t.Errorf("%s: parts of %d bytes, want %d", tt.name, size, w.offset)
+		}
+	}
+}
+
+// partStore records the calls of a multipart upload, failing the copies of
+// the parts in fail as many times
+type partStore struct {
+	Store
+	mu        sync.Mutex
+	fail      map[int]int
+	copied    int
+	completed int // parts
+	aborted   bool
+}
+
+func (s *partStore) InitiateMultipartUpload(objectKey string, options ...oss.Option) (oss.InitiateMultipartUploadResult, error) {
+	return oss.InitiateMultipartUploadResult{Key: objectKey, UploadID: "1"}, nil
+}
+
+func (s *partStore) UploadPartCopy(imur oss.InitiateMultipartUploadResult, srcBucketName, srcObjectKey string,
+	startPosition, partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail[partNumber] > 0 {
+		s.fail[partNumber]--
+		return oss.UploadPart{}, errors.New("connection reset")
+	}
+	s.copied++
+	return oss.UploadPart{PartNumber: partNumber}, nil
+}
+
+func (s *partStore) UploadPart(imur oss.InitiateMultipartUploadResult, reader io.Reader,
+	partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	return oss.UploadPart{PartNumber: partNumber}, nil
+}
+
+func (s *partStore) CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart) (oss.CompleteMultipartUploadResult, error) {
+	s.completed = len(parts)
+	return oss.CompleteMultipartUploadResult{}, nil
+}
+
+func (s *partStore) AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) error {
+	s.aborted = true
+	return nil
+}
+
+// newPartWriter returns a Writer of 3 parts copied from the source to store
+func newPartWriter(ctx context.Context, store Store) *Writer {
+	return &Writer{
+		Object:   "dest.apk",
+		Client:   store,
+		Log:      slog.Default(),
+		Context:  ctx,
+		segments: []Segment{{0, 3 * CopyPartSizeInBytes}},
+		offset:   3 * CopyPartSizeInBytes,
+	}
+}
+
+func TestFlushCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store := &partStore{}
+	if err := newPartWriter(ctx, store).Flush(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("flush: %v", err)
+	}
+	if store.copied != 0 || !store.aborted {
+		t.Errorf("%d parts copied, aborted %v", store.copied, store.aborted)
+	}
+}
+
+func TestFlushRetryPart(t *testing.T) {
+	store := &partStore{fail: map[int]int{2: 1}}
+	if err := newPartWriter(context.Background(), store).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.copied != 3 || store.completed != 3 || store.aborted {
+		t.Errorf("%d parts copied, %d completed, aborted %v", store.copied, store.completed, store.aborted)
+	}
+
+	// the part keeps failing until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	store = &partStore{fail: map[int]int{1: 100}}
+	err := newPartWriter(ctx, store).Flush()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 parts failed") || !store.aborted {
+		t.Errorf("flush: %v, aborted %v", err, store.aborted)
+	}
+
+	// or the retries of the policy run out
+	store = &partStore{fail: map[int]int{1: 100}}
+	w := newPartWriter(context.Background(), store)
+	w.retry = &RetryPolicy{Delay: time.Millisecond, Retries: 2}
+	if err := w.Flush(); err == nil || store.fail[1] != 97 || !store.aborted {
+		t.Errorf("flush: %v, %d failures left, aborted %v", err, store.fail[1], store.aborted)
+	}
+}
+
+func TestReadAtResume(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 1000)
+	var mu sync.Mutex
+	var ranges []string
+	cuts := 2
+	// cuts the connection of the first responses after half of their body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(object))
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		cut := cuts > 0
+		cuts--
+		mu.Unlock()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		body := rec.Body.Bytes()
+		if !cut {
+			w.Write(body)
+			return
+		}
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	r, err := NewReader(OSSConfig{
+		Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret",
+		Log:   slog.New(slog.NewTextHandler(&logs, nil)),
+		Retry: &RetryPolicy{Delay: time.Millisecond, Retries: 1},
+	}, "bucket/src.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4000)
+	if n, err := r.ReadAt(buf, 1000); err != nil || n != len(buf) {
+		t.Fatalf("read %d: %v", n, err)
+	}
+	if !bytes.Equal(buf, object[1000:5000]) {
+		t.Error("resumed read differs")
+	}
+	if want := "bytes=1000-4999,bytes=3000-4999,bytes=4000-4999"; strings.Join(ranges, ",") != want {
+		t.Errorf("ranges %v, want %s", ranges, want)
+	}
+	if n := strings.Count(logs.String(), "short read, resume"); n != 2 {
+		t.Errorf("%d resumes logged to the logger of the config: %s", n, logs.String())
+	}
+
+	// a read making no progress fails once the retries run out
+	mu.Lock()
+	cuts, ranges = 100, nil
+	mu.Unlock()
+	if _, err := r.ReadAt(buf[:1], 0); err == nil {
+		t.Error("read of a connection always cut")
+	}
+}
+
+// copyStore rejects the server side copies, keeping the parts uploaded
+type copyStore struct {
+	partStore
+	copies int
+	parts  [][]byte
+}
+
+func (s *copyStore) UploadPartCopy(imur oss.InitiateMultipartUploadResult, srcBucketName, srcObjectKey string,
+	startPosition, partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	s.copies++
+	return oss.UploadPart{}, oss.ServiceError{StatusCode: 404, Code: "NoSuchBucket"}
+}
+
+func (s *copyStore) UploadPart(imur oss.InitiateMultipartUploadResult, reader io.Reader,
+	partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	// read twice, as a retry of the SDK seeks back to the start
+	ioutil.ReadAll(io.LimitReader(reader, 10))
+	reader.(io.Seeker).Seek(0, io.SeekStart)
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return oss.UploadPart{}, err
+	}
+	s.parts = append(s.parts, buf)
+	return oss.UploadPart{PartNumber: partNumber}, nil
+}
+
+func TestCopyPartRejected(t *testing.T) {
+	object := bytes.Repeat([]byte("0123456789"), 1000)
+	server := newOSSServer(map[string][]byte{"bucket/src.apk": object})
+	defer server.Close()
+	src, err := NewReader(OSSConfig{Endpoint: server.URL, AccessKeyID: "id", AccessKeySecret: "secret"}, "bucket/src.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	store := &copyStore{}
+	w := &Writer{Client: store, srcClient: src.Client, SrcBucket: "bucket", SrcObject: "src.apk",
+		Log: slog.New(slog.NewTextHandler(&logs, nil)), Context: context.Background()}
+	for i, s := range []Segment{{100, 3000}, {5000, 2000}} {
+		if _, err := w.copyPart(oss.InitiateMultipartUploadResult{}, []Segment{s}, int64(i+1), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.copies != 1 || len(store.parts) != 2 || !bytes.Equal(store.parts[0], object[100:3100]) || !bytes.Equal(store.parts[1], object[5000:7000]) {
+		t.Errorf("%d copies, parts %d", store.copies, len(store.parts))
+	}
+	if n := strings.Count(logs.String(), "server side copy rejected"); n != 1 {
+		t.Errorf("%d warnings: %s", n, logs.String())
+	}
+
+	if copyRejected(errors.New("connection reset")) || copyRejected(oss.ServiceError{StatusCode: 503, Code: "ServiceUnavailable"}) ||
+		!copyRejected(requestError("UploadPartCopy", oss.ServiceError{StatusCode: 403, Code: "AccessDenied"})) {
+		t.Error("copyRejected")
+	}
+}
+
+// memStore is a Store of one bucket in memory, with the multipart uploads
+// of the Writer
+type memStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]*memUpload // by id
+	copies   int                   // parts copied by UploadPartCopy
+	failNext bool                  // fail the next CompleteMultipartUpload
+	next     int
+}
+
+type memUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte), uploads: make(map[string]*memUpload)}
+}
+
+var errMemStore = errors.New("memStore: not implemented")
+
+func notFound() error {
+	return oss.ServiceError{Code: "NoSuchKey", StatusCode: http.StatusNotFound}
+}
+
+func (s *memStore) GetObject(key string, options ...oss.Option) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.objects[key]
+	if !ok {
+		return nil, notFound()
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (s *memStore) GetObjectDetailedMeta(key string, options ...oss.Option) (http.Header, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.objects[key]
+	if !ok {
+		return nil, notFound()
+	}
+	meta := http.Header{}
+	meta.Set("Content-Length", fmt.Sprint(len(buf)))
+	meta.Set("ETag", fmt.Sprintf(`"%X"`, md5.Sum(buf)))
+	return meta, nil
+}
+
+func (s *memStore) PutObject(key string, r io.Reader, options ...oss.Option) error {
+	buf, err := ioutil.ReadAll(r)
+	s.mu.Lock()
+	s.objects[key] = buf
+	s.mu.Unlock()
+	return err
+}
+
+func (s *memStore) InitiateMultipartUpload(key string, options ...oss.Option) (oss.InitiateMultipartUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	id := fmt.Sprintf("%032X", s.next)
+	s.uploads[id] = &memUpload{key: key, initiated: time.Now().Add(time.Duration(s.next) * time.Second), parts: make(map[int][]byte)}
+	return oss.InitiateMultipartUploadResult{Bucket: "bucket", Key: key, UploadID: id}, nil
+}
+
+func (s *memStore) part(imur oss.InitiateMultipartUploadResult, n int, buf []byte) (oss.UploadPart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[imur.UploadID]
+	if !ok {
+		return oss.UploadPart{}, oss.ServiceError{Code: "NoSuchUpload", StatusCode: http.StatusNotFound}
+	}
+	u.parts[n] = buf
+	return oss.UploadPart{PartNumber: n, ETag: fmt.Sprintf(`"%X"`, md5.Sum(buf))}, nil
+}
+
+func (s *memStore) UploadPartCopy(imur oss.InitiateMultipartUploadResult, srcBucket, srcKey string,
+	start, size int64, n int, options ...oss.Option) (oss.UploadPart, error) {
+	s.mu.Lock()
+	src, ok := s.objects[srcKey]
+	s.copies++
+	s.mu.Unlock()
+	if !ok {
+		return oss.UploadPart{}, notFound()
+	}
+	return s.part(imur, n, append([]byte(nil), src[start:start+size]...))
+}
+
+func (s *memStore) UploadPart(imur oss.InitiateMultipartUploadResult, r io.Reader,
+	size int64, n int, options ...oss.Option) (oss.UploadPart, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return oss.UploadPart{}, err
+	}
+	return s.part(imur, n, buf)
+}
+
+func (s *memStore) CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart) (oss.CompleteMultipartUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failNext {
+		s.failNext = false
+		return oss.CompleteMultipartUploadResult{}, oss.ServiceError{Code: "InternalError", StatusCode: 500}
+	}
+	u := s.uploads[imur.UploadID]
+	var buf []byte
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return oss.CompleteMultipartUploadResult{}, fmt.Errorf("part %d out of order", part.PartNumber)
+		}
+		buf = append(buf, u.parts[part.PartNumber]...)
+	}
+	s.objects[u.key] = buf
+	delete(s.uploads, imur.UploadID)
+	return oss.CompleteMultipartUploadResult{}, nil
+}
+
+func (s *memStore) AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) error {
+	s.mu.Lock()
+	delete(s.uploads, imur.UploadID)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) ListMultipartUploads(options ...oss.Option) (oss.ListMultipartUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result oss.ListMultipartUploadResult
+	for id, u := range s.uploads {
+		result.Uploads = append(result.Uploads, oss.UncompletedUpload{Key: u.key, UploadID: id, Initiated: u.initiated})
+	}
+	return result, nil
+}
+
+func (s *memStore) ListUploadedParts(imur oss.InitiateMultipartUploadResult) (oss.ListUploadedPartsResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result oss.ListUploadedPartsResult
+	for n, buf := range s.uploads[imur.UploadID].parts {
+		result.UploadedParts = append(result.UploadedParts, oss.UploadedPart{PartNumber: n, Size: len(buf), ETag: fmt.Sprintf(`"%X"`, md5.Sum(buf))})
+	}
+	sort.Slice(result.UploadedParts, func(i, j int) bool { return result.UploadedParts[i].PartNumber < result.UploadedParts[j].PartNumber })
+	return result, nil
+}
+
+func (s *memStore) ListObjects(options ...oss.Option) (oss.ListObjectsResult, error) {
+	return oss.ListObjectsResult{}, errMemStore
+}
+
+func (s *memStore) DeleteObject(key string) error {
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) CopyObject(src, dest string, options ...oss.Option) (oss.CopyObjectResult, error) {
+	return oss.CopyObjectResult{}, errMemStore
+}
+
+func (s *memStore) PutObjectTagging(key string, tags []Tag) error { return errMemStore }
+
+func (s *memStore) GetObjectTagging(key string) ([]Tag, error) { return nil, errMemStore }
+
+func (s *memStore) CompleteMultipartUploadWithCallback(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart, callback *Callback) ([]byte, error) {
+	return nil, errMemStore
+}
+
+// testSource returns n bytes where each 4 bytes differ from the others
+func testSource(n int, seed byte) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i/251) ^ byte(i) ^ seed
+	}
+	return buf
+}
+
+func TestWriterResume(t *testing.T) {
+	const size = 1 << 20
+	const partSize = 200 << 10
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	newWriter := func(s *memStore, resumeID, version string, segments []Segment) *Writer {
+		w := &Writer{Bucket: "bucket", Object: "dest.apk.tmp-0123456789abcdef", SrcBucket: "bucket", SrcObject: "src.apk", SrcVersion: version,
+			Client: s, srcClient: s, Log: logger, ResumeID: resumeID, segments: segments, retry: &RetryPolicy{}}
+		w.offset = segmentsSize(segments)
+		w.Write([]byte("appended entries"))
+		return w
+	}
+	want := func(s *memStore, segments []Segment) []byte {
+		var buf []byte
+		for _, seg := range segments {
+			buf = append(buf, s.objects["src.apk"][seg.Offset:seg.Offset+seg.Size]...)
+		}
+		return append(buf, "appended entries"...)
+	}
+	all := []Segment{{Offset: 0, Size: size}}
+	tests := []struct {
+		name     string
+		first    string    // resume id of the failed attempt
+		version  string    // of the source of the second attempt, e1 in the first
+		changed  bool      // the source is overwritten in between
+		segments []Segment // kept by the second attempt
+		copies   int       // by the second attempt
+		uploads  int       // left once done
+	}{
+		{"same job", "job", "e1", false, all, 0, 0},
+		{"other job", "other", "e1", false, all, 5, 1},
+		{"source changed", "job", "e2", true, all, 5, 0},
+		{"other ranges", "job", "e1", false, []Segment{{Offset: 1000, Size: size - 1000}}, 5, 0},
+		{"no version", "job", "", false, all, 5, 0},
+	}
+	for _, tt := range tests {
+		s := newMemStore()
+		s.objects["src.apk"] = testSource(size, 0)
+		first := newWriter(s, tt.first, "e1", all)
+		s.failNext = true
+		if err := first.multipart(partSize, false); err == nil {
+			t.Fatalf("%s: first attempt did not fail", tt.name)
+		}
+		if len(s.uploads) != 1 {
+			t.Fatalf("%s: %d uploads left by the first attempt, want 1", tt.name, len(s.uploads))
+		}
+		if tt.changed {
+			s.objects["src.apk"] = testSource(size, 1)
+		}
+
+		s.copies = 0
+		second := newWriter(s, "job", tt.version, tt.segments)
+		if err := second.multipart(partSize, false); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := s.objects[second.Object]; !bytes.Equal(got, want(s, tt.segments)) {
+			t.Errorf("%s: dest of %d bytes differs from the source", tt.name, len(got))
+		}
+		if s.copies != tt.copies {
+			t.Errorf("%s: %d parts copied, want %d", tt.name, s.copies, tt.copies)
+		}
+		if len(s.uploads) != tt.uploads {
+			t.Errorf("%s: %d uploads left, want %d", tt.name, len(s.uploads), tt.uploads)
+		}
+		for key := range s.objects {
+			if strings.Contains(key, ".resume-") && tt.uploads == 0 {
+				t.Errorf("%s: manifest %s left", tt.name, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// Source is the apk to repack, read once and shared by all dest apks
+type Source struct {
+	Reader     *Reader     // nil if local, see SignLocal
+	Cache      io.ReaderAt // of Reader, for the small reads of the entries, or the local file
+	Downloaded *os.File    // copy of the source in the work dir with DownloadSource, nil if none
+	Size       int64
+	Version    string // version id of the source object, its etag if the bucket is not versioned
+	ETag       string // of the source object when opened, see checkSourceUnchanged
+	CRC64      string // crc-64 of the source object computed by OSS, empty if unknown
+	Zip        *zip.Reader
+	Dir        *Directory
+	Info       *ApkInfo      // nil if not available
+	Manifest   *manifestBase // parsed MANIFEST.MF, nil if the apk is not signed again with v1
+	Container  bool
+	Block      *SigningBlock // nil if none
+	Schemes    schemes       // of the dests signed again, see selectSchemes
+
+	chunkMu   sync.Mutex
+	chunkSums map[string][][]byte // of the kept ranges, see keptChunkSums
+}
+
+// openSource reads the central directory and manifest of p.SourceAPK
+func (p *packer) openSource() (*Source, error) {
+	ossReader, err := NewReader(p.sourceConfig(), p.SourceAPK)
+	if err != nil {
+		return nil, fmt.Errorf("oss reader: %v", err)
+	}
+	meta, err := ossReader.Client.GetObjectDetailedMeta(ossReader.Object)
+	if err != nil {
+		return nil, fmt.Errorf("object size: %v", err)
+	}
+	objectSize, err := contentLength(meta)
+	if err != nil {
+		return nil, fmt.Errorf("object size: %v", err)
+	}
+	if err := checkSourceObject(ossReader.Object, meta, objectSize); err != nil {
+		return nil, err
+	}
+	// every later read of the source is of this version of it
+	ossReader.ETag = strings.Trim(meta.Get("ETag"), `"`)
+
+	var cache io.ReaderAt
+	var downloaded *os.File
+	if p.DownloadSource {
+		downloaded, err = p.downloadSource(ossReader, objectSize, meta.Get("X-Oss-Hash-Crc64ecma"))
+		cache = downloaded
+	} else {
+		cache, err = newCachedReader(ossReader, meta, p.CacheDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cache: %v", err)
+	}
+
+	zipReader, err := zip.NewReader(cache, objectSize)
+	if err != nil && downloaded != nil {
+		downloaded.Close()
+	}
+	if err == zip.ErrFormat {
+		return nil, fmt.Errorf("not a zip file: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+
+	src := &Source{
+		Reader:     ossReader,
+		Cache:      cache,
+		Downloaded: downloaded,
+		Size:       objectSize,
+		Version:    meta.Get("X-Oss-Version-Id"),
+		CRC64:      meta.Get("X-Oss-Hash-Crc64ecma"),
+		ETag:       ossReader.ETag,
+		Zip:        zipReader,
+		Container:  isContainer(p.SourceAPK),
+	}
+	if src.Version == "" {
+		src.Version = src.ETag
+	}
+	if err := p.readSource(src); err != nil {
+		src.close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// close closes the copy of the source downloaded, if any
+func (src *Source) close() {
+	if src.Downloaded != nil {
+		src.Downloaded.Close()
+	}
+}
+
+// readSource reads the apk info, central directory, signing block and
+// manifest of src from src.Cache and src.Zip
+func (p *packer) readSource(src *Source) error {
+	zipReader := src.Zip
+	if err := checkSourceEntries(zipReader, src.Container); err != nil {
+		return err
+	}
+	var err error
+	if !src.Container {
+		p.checkNames(zipReader)
+		src.Info, err = readApkInfo(zipReader)
+		if err != nil {
+			p.log().Warn("apk info not available", "phase", PhaseOpen, "error", err)
+		} else {
+			p.log().Info("apk info", "phase", PhaseOpen, "package", src.Info.PackageName, "version_code", src.Info.VersionCode, "version_name", src.Info.VersionName)
+		}
+	}
+
+	src.Dir, err = ReadDirectory(src.Cache, src.Size)
+	if err != nil {
+		return fmt.Errorf("central directory: %v", err)
+	}
+	if err := checkAppendOffset(src.Dir, src.Size); err != nil {
+		return errorOf(KindSource, fmt.Errorf("append offset: %v", err))
+	}
+	src.Schemes = schemes{v1: true}
+	if !src.Container {
+		src.Block, err = p.checkSigningBlock(src.Cache, src.Dir)
+		if err != nil {
+			return err
+		}
+		if p.needSign() {
+			src.Schemes, err = p.selectSchemes(src.Info, src.Block)
+			if err != nil {
+				return errorOf(KindConfig, err)
+			}
+			p.log().Info("signature schemes", "phase", PhaseOpen, "schemes", src.Schemes.String())
+			if !src.Schemes.v1 && len(p.ManifestAttrs) > 0 {
+				p.log().Warn("no v1 signature, so no MANIFEST.MF for the manifest attributes", "phase", PhaseOpen)
+			}
+		}
+	}
+
+	if !src.Container && p.needSign() && src.Schemes.v1 {
+		buf, err := p.readManifest(src.Cache, zipReader)
+		if err != nil {
+			return fmt.Errorf("read manifest: %v", err)
+		}
+		// parsed once for all the channels
+		src.Manifest, err = p.newManifestBase(buf)
+		if err != nil {
+			return errorOf(KindSource, fmt.Errorf("%s: %v", ManifestPath, err))
+		}
+	}
+	return nil
+}
+
+// expiryPattern is the date in the x-oss-expiration header of an object
+// with a lifecycle rule
+var expiryPattern = regexp.MustCompile(`expiry-date="([^"]+)"`)
+
+// leftoverPattern is the suffix of the temp objects of Atomic, see upload,
+// of the resumeManifest of their uploads, and of the stages of SharedPrefix
+var leftoverPattern = regexp.MustCompile(`\.(tmp|stage)-[0-9a-f]{16}(\.resume-[0-9A-Za-z]+)?$`)
+
+// checkSourceObject rejects a source object too small for a zip, expired by
+// a lifecycle rule, or the temp object of an unfinished job
+func checkSourceObject(object string, meta http.Header, size int64) error {
+	if size < directoryEndLen {
+		return fmt.Errorf("not a zip file: %d bytes", size)
+	}
+	if m := expiryPattern.FindStringSubmatch(meta.Get("X-Oss-Expiration")); m != nil {
+		if t, err := http.ParseTime(m[1]); err == nil && time.Now().After(t) {
+			return fmt.Errorf("source expired at %s by a lifecycle rule", m[1])
+		}
+	}
+	if leftoverPattern.MatchString(object) {
+		return fmt.Errorf("source is the temp object of an unfinished upload: %s", object)
+	}
+	return nil
+}
+
+// checkSourceEntries rejects a source that is a zip but not an apk, or a
+// container without apks
+func checkSourceEntries(r *zip.Reader, container bool) error {
+	if container {
+		for _, f := range r.File {
+			if isSplit(f) {
+				return nil
+			}
+		}
+		return fmt.Errorf("not an apk container: no apk in it")
+	}
+	for _, name := range []string{AndroidManifestPath, "classes.dex"} {
+		if findFile(r, name) == nil {
+			return fmt.Errorf("not an apk: %s not found", name)
+		}
+	}
+	return nil
+}
+
+// repack builds the apk of p.DestAPK from src. The new entries are kept in
+// the returned writer until upload, with the names of the appended entries.
+func (p *packer) repack(src *Source) (*Writer, []string, error) {
+	var ossWriter *Writer
+	appended, err := p.build(src, func(segments []Segment) (io.Writer, error) {
+		w, err := NewWriter(p.copyConfig(), p.DestAPK, p.SourceAPK, segments)
+		if err != nil {
+			return nil, fmt.Errorf("oss writer: %v", err)
+		}
+		w.Log = p.log()
+		w.Context = p.jobContext()
+		w.memory = p.memory
+		if !p.InMemory {
+			w.SpillDir = p.WorkDir
+		}
+		if src.Downloaded != nil {
+			w.srcLocal = src.Downloaded
+		}
+		w.SrcVersion = src.Version
+		w.SrcETag = src.ETag
+		ossWriter = w
+		return w, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ossWriter, appended, nil
+}
+
+// build writes the apk of p.DestAPK from src to the writer open returns for
+// the ranges of src kept, and returns the names of the appended entries
+func (p *packer) build(src *Source, open func(segments []Segment) (io.Writer, error)) ([]string, error) {
+	dir := src.Dir.Clone()
+	sign := !src.Container && p.needSign()
+	p.schemes = src.Schemes
+	var drop map[string]bool
+	if sign {
+		var err error
+		drop, err = p.dropEntries(src.Zip)
+		if err != nil {
+			return nil, err
+		}
+		if p.appended, err = p.newEntries(src.Zip); err != nil {
+			return nil, fmt.Errorf("appended entries: %v", err)
+		}
+		end := p.trace("manifest")
+		if src.Manifest != nil {
+			err = p.changeManifest(src.Manifest, drop)
+		}
+		end(err)
+		if err != nil {
+			return nil, errorOf(KindSign, fmt.Errorf("change manifest: %v", err))
+		}
+	}
+	if p.CPIDComment && !src.Container {
+		dir.Comment = p.CPIDContent
+	}
+
+	stale := drop
+	if p.DropStale && src.Container {
+		stale = splitEntries(src.Zip)
+	} else if p.DropStale && sign {
+		stale = p.staleEntries()
+		for name := range drop {
+			stale[name] = true
+		}
+	}
+	segments := []Segment{{Offset: 0, Size: dir.Offset}}
+	var err error
+	if len(stale) > 0 {
+		segments, err = dir.Remove(src.Cache, stale, p.log())
+		if err != nil {
+			return nil, fmt.Errorf("drop stale entries: %v", err)
+		}
+	}
+
+	// the signing block of the source is replaced by the new one
+	v2 := sign && (p.schemes.v2 || p.schemes.v3)
+	if v2 && src.Block != nil {
+		segments = trimSegments(segments, src.Block.Size)
+		dir.Offset -= src.Block.Size
+	}
+
+	var block []byte
+	if p.V2Channel && !src.Container {
+		segments, block, err = p.changeSigningBlock(src.Cache, dir)
+		if err != nil {
+			return nil, fmt.Errorf("apk signing block: %v", err)
+		}
+	}
+
+	w, err := open(segments)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(block); err != nil {
+		return nil, err
+	}
+	// with v2, the entries and central directory are signed before upload
+	var tail bytes.Buffer
+	writer := dir.Append(w)
+	if v2 {
+		writer = dir.Append(&tail)
+	}
+	writer.PageAlign = p.PageAlign
+	writer.Level = p.CompressionLevel
+
+	if src.Container {
+		err = p.repackSplits(writer, src.Zip)
+	} else if sign {
+		err = p.appendFiles(writer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("close zip: %v", err)
+	}
+	if v2 {
+		end := p.trace("sign.v2")
+		signed, err := p.signTail(src, segments, tail.Bytes(), dir.Comment, p.schemes)
+		end(err)
+		if err != nil {
+			return nil, errorOf(KindSign, fmt.Errorf("sign %s: %v", p.schemes, err))
+		}
+		if _, err := w.Write(signed); err != nil {
+			return nil, err
+		}
+	}
+	return writer.Appended(), nil
+}
+
+// trimSegments returns segments without their last size bytes
+func trimSegments(segments []Segment, size int64) []Segment {
+	trimmed := append([]Segment(nil), segments...)
+	for size > 0 && len(trimmed) > 0 {
+		last := &trimmed[len(trimmed)-1]
+		if last.Size > size {
+			last.Size -= size
+			break
+		}
+		size -= last.Size
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	return trimmed
+}
+
+// upload flushes w to OSS and validates the dest apk. With Atomic, w is
+// flushed to a temp object, copied to the dest only once validated.
+func (p *packer) upload(w *Writer, appended []string) error {
+	dest := w.Bucket + "/" + w.Object
+	location := dest
+	if p.Atomic {
+		w.Object += ".tmp-" + p.tempID(w.SrcVersion)
+		if p.Resume {
+			w.ResumeID = p.JobID
+		}
+		location = w.Bucket + "/" + w.Object
+		defer p.removeTemp(location)
+	}
+	p.progress(PhaseUpload, dest)
+	if !p.Atomic {
+		w.Callback = p.callback()
+	}
+	p.chooseCopyStrategy(w)
+	start, size := time.Now(), w.size()
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush oss: %v", err)
+	}
+	p.log().Info("uploaded", "phase", PhaseUpload, "dest", location, "bytes", size, "duration", time.Since(start))
+	if p.Validate {
+		p.progress(PhaseValidate, dest)
+		if err := p.validateDest(location, appended); err != nil {
+			return errorOf(KindVerify, fmt.Errorf("validate dest: %v", err))
+		}
+	}
+	if p.Atomic {
+		p.progress(PhasePublish, dest)
+		if err := p.publish(location, dest, size); err != nil {
+			return fmt.Errorf("publish dest: %v", err)
+		}
+	}
+	return nil
+}
+
+// publish copies the temp object of size bytes to dest on the OSS side
+func (p *packer) publish(temp, dest string, size int64) error {
+	start := time.Now()
+	w, err := NewWriter(p.ossConfig(), dest, temp, []Segment{{Offset: 0, Size: size}})
+	if err != nil {
+		return err
+	}
+	w.Log = p.log()
+	w.Context = p.jobContext()
+	w.memory = p.memory
+	w.Callback = p.callback()
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	p.log().Info("published", "phase", PhasePublish, "temp", temp, "dest", dest, "duration", time.Since(start))
+	return nil
+}
+
+// removeTemp deletes the temp object of Atomic, whether it was published or not
+func (p *packer) removeTemp(location string) {
+	r, err := NewReader(p.ossConfig(), location)
+	if err == nil {
+		err = r.Client.DeleteObject(r.Object)
+	}
+	if err != nil {
+		p.log().Warn("remove temp object", "temp", location, "error", err)
+	}
+}
+
+// tempID returns the suffix of the temp object of Atomic, the same for every
+// attempt of JobID with Resume on the same version of the source
+func (p *packer) tempID(version string) string {
+	if p.Resume {
+		sum := sha256.Sum256([]byte(p.JobID + "\n" + version))
+		return hex.EncodeToString(sum[:8])
+	}
+	return newTempID()
+}
+
+// newTempID returns a random suffix of the temp objects
+func newTempID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+package repack
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSource(t *testing.T) {
+	expired := http.Header{"X-Oss-Expiration": {`expiry-date="Mon, 02 Jan 2006 00:00:00 GMT", rule-id="old"`}}
+	later := http.Header{"X-Oss-Expiration": {`expiry-date="` + time.Now().Add(time.Hour).UTC().Format(http.TimeFormat) + `", rule-id="old"`}}
+	objectTests := []struct {
+		object string
+		meta   http.Header
+		size   int64
+		ok     bool
+	}{
+		{"a.apk", http.Header{}, 1000, true},
+		{"a.apk", later, 1000, true},
+		{"a.apk", http.Header{}, directoryEndLen - 1, false},
+		{"a.apk", expired, 1000, false},
+		{"a.apk.tmp-0123456789abcdef", http.Header{}, 1000, false},
+	}
+	for _, tt := range objectTests {
+		if err := checkSourceObject(tt.object, tt.meta, tt.size); (err == nil) != tt.ok {
+			t.Errorf("%s %v: %v, want ok %v", tt.object, tt.meta, err, tt.ok)
+		}
+	}
+
+	objects := map[string][]byte{
+		"bucket/a.apk":   zipOf(AndroidManifestPath, "axml", "classes.dex", "dex"),
+		"bucket/res.apk": zipOf(AndroidManifestPath, "axml", "res/a.png", "png"),
+		"bucket/a.xapk":  zipOf("manifest.json", "{}"),
+		"bucket/a.txt":   []byte(strings.Repeat("not a zip", 10)),
+	}
+	server := newOSSServer(objects)
+	defer server.Close()
+	p := &packer{Options: DefaultOptions(), ctx: context.Background()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	for source, want := range map[string]string{
+		"bucket/a.apk":   "",
+		"bucket/res.apk": "classes.dex not found",
+		"bucket/a.xapk":  "no apk in it",
+		"bucket/a.txt":   "not a zip file",
+	} {
+		p.SourceAPK = source
+		_, err := p.openSource()
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: %v, want %q", source, err, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package repack
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// checksumHashes are the hashes of -checksum
+var checksumHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// checksums returns the names of the checksums of the dest apk, sorted
+func (p *packer) checksums() []string {
+	names := map[string]bool{}
+	if p.SHA256 {
+		names["sha256"] = true
+	}
+	for _, name := range strings.Split(p.Checksums, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// describe fills result with the etag, version, size and checksums of the
+// dest apk, the time of each phase and the retries of the OSS requests
+func (p *packer) describe(result *Result) error {
+	r, err := NewReader(p.ossConfig(), result.Dest)
+	if err != nil {
+		return err
+	}
+	meta, err := r.Client.GetObjectDetailedMeta(r.Object)
+	if err != nil {
+		return err
+	}
+
+	if names := p.checksums(); len(names) > 0 {
+		sums, err := p.sumObject(r, names)
+		if err != nil {
+			return err
+		}
+		result.SHA256, result.MD5 = sums["sha256"], sums["md5"]
+		if p.ChecksumSidecar {
+			for _, name := range names {
+				sidecar := result.Dest + "." + name
+				line := sums[name] + "  " + path.Base(r.Object) + "\n"
+				if err := WriteObject(p.ossConfig(), sidecar, []byte(line)); err != nil {
+					return fmt.Errorf("write %s: %v", sidecar, err)
+				}
+			}
+		}
+		if p.ChecksumMeta {
+			// the meta of an object is only changed by copying it to itself
+			options := []oss.Option{oss.MetadataDirective(oss.MetaReplace)}
+			if contentType := meta.Get("Content-Type"); contentType != "" {
+				options = append(options, oss.ContentType(contentType))
+			}
+			for key := range meta {
+				if strings.HasPrefix(strings.ToLower(key), "x-oss-meta-") {
+					options = append(options, oss.Meta(key[len("x-oss-meta-"):], meta.Get(key)))
+				}
+			}
+			for _, name := range names {
+				options = append(options, oss.Meta(name, sums[name]))
+			}
+			if _, err := r.Client.CopyObject(r.Object, r.Object, options...); err != nil {
+				return fmt.Errorf("set checksum meta: %v", err)
+			}
+			if meta, err = r.Client.GetObjectDetailedMeta(r.Object); err != nil {
+				return err
+			}
+		}
+	}
+	result.ETag = strings.Trim(meta.Get("ETag"), `"`)
+	result.VersionID = meta.Get("X-Oss-Version-Id")
+	result.CRC64 = meta.Get("X-Oss-Hash-Crc64ecma")
+	if m := expiryPattern.FindStringSubmatch(meta.Get("X-Oss-Expiration")); m != nil {
+		result.Expires = m[1]
+	}
+	result.Size, _ = strconv.ParseInt(meta.Get("Content-Length"), 10, 64)
+
+	result.CertSHA256 = p.certSHA256
+	if p.certSHA256 != "" {
+		result.Schemes = p.schemes.String()
+	}
+	result.PhasesMS = make(map[string]int64)
+	for phase, d := range p.phases {
+		result.PhasesMS[phase] = d.Milliseconds()
+	}
+
+	p.addUsage(result)
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	if len(p.retries) > 0 {
+		result.Retries = make(map[string]int64)
+		for op, n := range p.retries {
+			result.Retries[op] = n
+		}
+		result.RetryMS = p.retryMS
+		p.log().Warn("slowed down by retries", "dest", result.Dest, "retries", p.retries, "retry_ms", p.retryMS)
+	}
+	return nil
+}
+
+// sumObject reads the object of r once to compute the checksums of names
+func (p *packer) sumObject(r *Reader, names []string) (map[string]string, error) {
+	body, err := r.Client.GetObject(r.Object)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return sumReader(body, names)
+}
+
+// sumReader reads r to its end to compute the checksums of names
+func sumReader(r io.Reader, names []string) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, name := range names {
+		hashes[name] = checksumHashes[name]()
+		writers = append(writers, hashes[name])
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for name, h := range hashes {
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
@@ -0,0 +1,139 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDescribe(t *testing.T) {
+	apk := []byte("dest apk")
+	server := newOSSServer(map[string][]byte{"bucket/dest.apk": apk})
+	defer server.Close()
+
+	p := &packer{Options: DefaultOptions()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.SHA256, p.certSHA256 = true, "cert"
+	p.progress(PhaseBuild, "bucket/dest.apk")
+	p.progress(PhaseUpload, "bucket/dest.apk")
+	p.progress(PhaseDone, "bucket/dest.apk")
+
+	result := Result{Dest: "bucket/dest.apk"}
+	if err := p.describe(&result); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(apk)
+	if result.Size != int64(len(apk)) || result.SHA256 != hex.EncodeToString(sum[:]) || result.CertSHA256 != "cert" {
+		t.Errorf("result %+v", result)
+	}
+	if _, ok := result.PhasesMS[PhaseUpload]; !ok || len(result.PhasesMS) != 2 {
+		t.Errorf("phases %v, want build and upload", result.PhasesMS)
+	}
+}
+
+func TestDescribeChecksums(t *testing.T) {
+	apk := []byte("dest apk")
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	meta := http.Header{"X-Oss-Meta-Channel": {"huawei"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPut && r.Header.Get("X-Oss-Copy-Source") != "":
+			meta = http.Header{}
+			for k, v := range r.Header {
+				if strings.HasPrefix(k, "X-Oss-Meta-") {
+					meta[k] = v
+				}
+			}
+			fmt.Fprint(w, "<CopyObjectResult><ETag>\"copied\"</ETag></CopyObjectResult>")
+		case r.Method == http.MethodPut:
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		default:
+			for k, v := range meta {
+				w.Header()[k] = v
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(apk))
+		}
+	}))
+	defer server.Close()
+
+	p := &packer{Options: DefaultOptions()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.Checksums, p.ChecksumSidecar, p.ChecksumMeta = "md5, sha256", true, true
+	result := Result{Dest: "bucket/apks/dest.apk"}
+	if err := p.describe(&result); err != nil {
+		t.Fatal(err)
+	}
+	sha, md := sha256.Sum256(apk), md5.Sum(apk)
+	if result.SHA256 != hex.EncodeToString(sha[:]) || result.MD5 != hex.EncodeToString(md[:]) {
+		t.Errorf("result %+v", result)
+	}
+	if got := string(objects["/bucket/apks/dest.apk.sha256"]); got != result.SHA256+"  dest.apk\n" {
+		t.Errorf("sha256 sidecar %q", got)
+	}
+	if got := string(objects["/bucket/apks/dest.apk.md5"]); got != result.MD5+"  dest.apk\n" {
+		t.Errorf("md5 sidecar %q", got)
+	}
+	// the meta of the dest kept, with the checksums
+	if meta.Get("X-Oss-Meta-Sha256") != result.SHA256 || meta.Get("X-Oss-Meta-Md5") != result.MD5 || meta.Get("X-Oss-Meta-Channel") != "huawei" {
+		t.Errorf("meta %v", meta)
+	}
+
+	// checked with the options
+	p.Checksums, p.SHA256 = "sha1", false
+	if err := p.checkConfig(); err == nil || !strings.Contains(err.Error(), `-checksum: unknown "sha1"`) {
+		t.Errorf("unknown checksum: %v", err)
+	}
+	p.Checksums = ""
+	if err := p.checkConfig(); err == nil || !strings.Contains(err.Error(), "need -checksum") {
+		t.Errorf("sidecar without checksum: %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	result, err := Repack(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests, phaseRequests int64
+	for _, n := range result.Requests {
+		requests += n
+	}
+	for _, n := range result.PhaseRequests {
+		phaseRequests += n
+	}
+	if result.Requests["GetObject"] == 0 || result.PhaseRequests[PhaseOpen] == 0 || requests != phaseRequests {
+		t.Errorf("requests %v, by phase %v", result.Requests, result.PhaseRequests)
+	}
+	if result.BytesRead == 0 || result.BytesUploaded == 0 {
+		t.Errorf("read %d, uploaded %d", result.BytesRead, result.BytesUploaded)
+	}
+
+	var total Result
+	total.addUsage(result)
+	total.addUsage(result)
+	if total.Requests["GetObject"] != 2*result.Requests["GetObject"] || total.BytesUploaded != 2*result.BytesUploaded {
+		t.Errorf("total %+v", total)
+	}
+}
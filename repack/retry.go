@@ -0,0 +1,466 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Store ...
+type Store interface {
+	GetObject(objectKey string, options ...oss.Option) (io.ReadCloser, error)
+	GetObjectDetailedMeta(objectKey string, options ...oss.Option) (http.Header, error)
+	PutObject(objectKey string, reader io.Reader, options ...oss.Option) error
+	InitiateMultipartUpload(objectKey string, options ...oss.Option) (oss.InitiateMultipartUploadResult, error)
+	UploadPartCopy(imur oss.InitiateMultipartUploadResult, srcBucketName, srcObjectKey string,
+		startPosition, partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error)
+	UploadPart(imur oss.InitiateMultipartUploadResult, reader io.Reader,
+		partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error)
+	CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
+		parts []oss.UploadPart) (oss.CompleteMultipartUploadResult, error)
+	AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) error
+	ListMultipartUploads(options ...oss.Option) (oss.ListMultipartUploadResult, error)
+	ListUploadedParts(imur oss.InitiateMultipartUploadResult) (oss.ListUploadedPartsResult, error)
+	ListObjects(options ...oss.Option) (oss.ListObjectsResult, error)
+	DeleteObject(objectKey string) error
+	CopyObject(srcObjectKey, destObjectKey string, options ...oss.Option) (oss.CopyObjectResult, error)
+	PutObjectTagging(objectKey string, tags []Tag) error
+	GetObjectTagging(objectKey string) ([]Tag, error)
+	CompleteMultipartUploadWithCallback(imur oss.InitiateMultipartUploadResult,
+		parts []oss.UploadPart, callback *Callback) ([]byte, error)
+}
+
+// RetryPolicy is the backoff of the retries of OSS requests, and of the
+// failed parts of an upload
+type RetryPolicy struct {
+	Delay      time.Duration // before the first retry
+	Multiplier float64       // of the delay for each next retry, 2 if 0
+	Retries    int           // no retry if 0
+	MaxElapsed time.Duration // since the first attempt, no retry that would end later, no limit if 0
+
+	// Retryable reports whether a failed request is retried, OSS throttling
+	// (503) if nil. The parts of an upload are retried on any error.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy retries OSS throttling 8 times, from 100ms to 12.8s
+var DefaultRetryPolicy = RetryPolicy{Delay: 100 * time.Millisecond, Multiplier: 2, Retries: 8}
+
+// retryable reports whether the failed request is retried
+func (r *RetryPolicy) retryable(err error) bool {
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+	if se, ok := err.(oss.ServiceError); ok && se.StatusCode == 503 {
+		return true
+	}
+	return strings.Contains(err.Error(), "503")
+}
+
+// StoreWithRetry ...
+type StoreWithRetry struct {
+	ossBucket *oss.Bucket
+	log       *slog.Logger
+	ctx       context.Context // may be nil
+	trace     func(name string, attrs ...slog.Attr) func(error)
+	policy    *RetryPolicy // DefaultRetryPolicy if nil
+	onRetry   func(op string, delay time.Duration)
+	throttle  func(op string) // may be nil
+	onRequest func(op string)
+	onBytes   func(op string, n int64)
+}
+
+// NewStoreWithRetry ...
+func NewStoreWithRetry(ossBucket *oss.Bucket) Store {
+	return NewStoreWithRetryPolicy(ossBucket, nil)
+}
+
+// NewStoreWithRetryPolicy returns a Store retrying with policy,
+// DefaultRetryPolicy if nil
+func NewStoreWithRetryPolicy(ossBucket *oss.Bucket, policy *RetryPolicy) Store {
+	return newStore(ossBucket, OSSConfig{Retry: policy})
+}
+
+// newStore returns the Store of bucket with the logger, context, tracer,
+// retries and callbacks of config
+func newStore(ossBucket *oss.Bucket, config OSSConfig) *StoreWithRetry {
+	return &StoreWithRetry{
+		ossBucket: ossBucket,
+		log:       config.log(),
+		ctx:       config.Context,
+		trace:     config.Trace,
+		policy:    config.Retry,
+		onRetry:   config.OnRetry,
+		throttle:  config.Throttle,
+		onRequest: config.OnRequest,
+		onBytes:   config.OnBytes,
+	}
+}
+
+type backoff struct {
+	delay      time.Duration
+	multiplier float64
+	i          int
+	max        int
+	deadline   time.Time // zero if no MaxElapsed
+}
+
+// newBackoff returns the backoff of policy, DefaultRetryPolicy if nil
+func newBackoff(policy *RetryPolicy) *backoff {
+	if policy == nil {
+		policy = &DefaultRetryPolicy
+	}
+	b := &backoff{
+		delay:      policy.Delay,
+		multiplier: policy.Multiplier,
+		i:          0,
+		max:        policy.Retries,
+	}
+	if b.multiplier == 0 {
+		b.multiplier = 2
+	}
+	if policy.MaxElapsed > 0 {
+		b.deadline = time.Now().Add(policy.MaxElapsed)
+	}
+	return b
+}
+
+// next returns the delay before the next retry, 0 if there is none
+func (b *backoff) next() time.Duration {
+	if b.i >= b.max {
+		return 0
+	}
+	delay := b.delay
+	if !b.deadline.IsZero() && time.Now().Add(delay).After(b.deadline) {
+		return 0
+	}
+
+	b.i++
+	b.delay = time.Duration(float64(b.delay) * b.multiplier)
+	return delay
+}
+
+// retried counts a retry of op after delay in the stats of the process,
+// and calls onRetry of the job if not nil
+func retried(onRetry func(op string, delay time.Duration), op string, delay time.Duration) {
+	countRetry(op, delay)
+	if onRetry != nil {
+		onRetry(op, delay)
+	}
+}
+
+// transferred counts the n bytes of a request of op in counter of the
+// stats of the process, and calls onBytes of the job if not nil
+func transferred(onBytes func(op string, n int64), op string, counter *int64, n int64) {
+	countBytes(counter, n)
+	if onBytes != nil {
+		onBytes(op, n)
+	}
+}
+
+// traced runs a request of op in a span
+func (s *StoreWithRetry) traced(op string, f func() error) error {
+	if s.trace == nil {
+		return f()
+	}
+	end := s.trace("oss."+op, slog.String("bucket", s.ossBucket.BucketName))
+	err := f()
+	end(err)
+	return err
+}
+
+func (s *StoreWithRetry) retry(op string, f func() error) error {
+	policy := s.policy
+	if policy == nil {
+		policy = &DefaultRetryPolicy
+	}
+	b := newBackoff(policy)
+	for {
+		if s.throttle != nil {
+			s.throttle(op)
+		}
+		countRequest(op)
+		if s.onRequest != nil {
+			s.onRequest(op)
+		}
+		err := s.traced(op, f)
+		if err == nil {
+			return nil
+		}
+
+		countError(op)
+		if !policy.retryable(err) {
+			return requestError(op, err)
+		}
+		delay := b.next()
+		if delay == time.Duration(0) {
+			return requestError(op, err)
+		}
+		args := []interface{}{"op", op, "attempt", b.i, "delay", delay, "error", err}
+		s.log.Warn("retry", append(args, RequestAttrs(err)...)...)
+		retried(s.onRetry, op, delay)
+		if err := sleep(s.ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for delay, or fails once ctx is done, ctx may be nil
+func sleep(ctx context.Context, delay time.Duration) error {
+	if ctx == nil {
+		time.Sleep(delay)
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetObject ...
+func (s *StoreWithRetry) GetObject(objectKey string, options ...oss.Option) (resp io.ReadCloser, err error) {
+	err = s.retry("GetObject", func() error {
+		resp, err = s.ossBucket.GetObject(objectKey, options...)
+		return err
+	})
+
+	return
+}
+
+// GetObjectDetailedMeta ...
+func (s *StoreWithRetry) GetObjectDetailedMeta(
+	objectKey string, options ...oss.Option) (resp http.Header, err error) {
+	err = s.retry("GetObjectDetailedMeta", func() error {
+		resp, err = s.ossBucket.GetObjectDetailedMeta(objectKey, options...)
+		return err
+	})
+
+	return
+}
+
+// PutObject ...
+func (s *StoreWithRetry) PutObject(objectKey string, reader io.Reader, options ...oss.Option) (err error) {
+	err = s.retry("PutObject", func() error {
+		if sk, ok := reader.(io.Seeker); ok {
+			sk.Seek(0, io.SeekStart)
+		}
+		err = s.ossBucket.PutObject(objectKey, reader, options...)
+		return err
+	})
+	if r, ok := reader.(*bytes.Reader); ok && err == nil {
+		transferred(s.onBytes, "PutObject", &stats.uploaded, r.Size())
+	}
+
+	return
+}
+
+// InitiateMultipartUpload ...
+func (s *StoreWithRetry) InitiateMultipartUpload(
+	objectKey string, options ...oss.Option) (resp oss.InitiateMultipartUploadResult, err error) {
+	err = s.retry("InitiateMultipartUpload", func() error {
+		resp, err = s.ossBucket.InitiateMultipartUpload(objectKey, options...)
+		return err
+	})
+
+	return
+}
+
+// UploadPartCopy ...
+func (s *StoreWithRetry) UploadPartCopy(
+	imur oss.InitiateMultipartUploadResult, srcBucketName, srcObjectKey string,
+	startPosition, partSize int64, partNumber int, options ...oss.Option) (resp oss.UploadPart, err error) {
+	err = s.retry("UploadPartCopy", func() error {
+		resp, err = s.ossBucket.UploadPartCopy(
+			imur, srcBucketName, srcObjectKey, startPosition, partSize, partNumber, options...)
+		return err
+	})
+	if err == nil {
+		transferred(s.onBytes, "UploadPartCopy", &stats.copied, partSize)
+	}
+
+	return
+}
+
+// UploadPart ...
+func (s *StoreWithRetry) UploadPart(imur oss.InitiateMultipartUploadResult, reader io.Reader,
+	partSize int64, partNumber int, options ...oss.Option) (resp oss.UploadPart, err error) {
+	err = s.retry("UploadPart", func() error {
+		if sk, ok := reader.(io.Seeker); ok {
+			sk.Seek(0, io.SeekStart)
+		}
+
+		resp, err = s.ossBucket.UploadPart(
+			imur, reader, partSize, partNumber, options...)
+		return err
+	})
+	if err == nil {
+		transferred(s.onBytes, "UploadPart", &stats.uploaded, partSize)
+	}
+
+	return
+}
+
+// CompleteMultipartUpload ...
+func (s *StoreWithRetry) CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart) (resp oss.CompleteMultipartUploadResult, err error) {
+	err = s.retry("CompleteMultipartUpload", func() error {
+		resp, err = s.ossBucket.CompleteMultipartUpload(imur, parts)
+		return err
+	})
+
+	return
+}
+
+// AbortMultipartUpload ...
+func (s *StoreWithRetry) AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) (err error) {
+	err = s.retry("AbortMultipartUpload", func() error {
+		err = s.ossBucket.AbortMultipartUpload(imur)
+		return err
+	})
+
+	return
+}
+
+// ListMultipartUploads ...
+func (s *StoreWithRetry) ListMultipartUploads(options ...oss.Option) (resp oss.ListMultipartUploadResult, err error) {
+	err = s.retry("ListMultipartUploads", func() error {
+		resp, err = s.ossBucket.ListMultipartUploads(options...)
+		return err
+	})
+
+	return
+}
+
+// ListUploadedParts ...
+func (s *StoreWithRetry) ListUploadedParts(imur oss.InitiateMultipartUploadResult) (resp oss.ListUploadedPartsResult, err error) {
+	err = s.retry("ListUploadedParts", func() error {
+		resp, err = s.ossBucket.ListUploadedParts(imur)
+		return err
+	})
+
+	return
+}
+
+// ListObjects ...
+func (s *StoreWithRetry) ListObjects(options ...oss.Option) (resp oss.ListObjectsResult, err error) {
+	err = s.retry("ListObjects", func() error {
+		resp, err = s.ossBucket.ListObjects(options...)
+		return err
+	})
+
+	return
+}
+
+// DeleteObject ...
+func (s *StoreWithRetry) DeleteObject(objectKey string) (err error) {
+	err = s.retry("DeleteObject", func() error {
+		err = s.ossBucket.DeleteObject(objectKey)
+		return err
+	})
+
+	return
+}
+
+// CopyObject ...
+func (s *StoreWithRetry) CopyObject(
+	srcObjectKey, destObjectKey string, options ...oss.Option) (resp oss.CopyObjectResult, err error) {
+	err = s.retry("CopyObject", func() error {
+		resp, err = s.ossBucket.CopyObject(srcObjectKey, destObjectKey, options...)
+		return err
+	})
+
+	return
+}
+
+// PutObjectTagging replaces the tags of the object. The SDK has no tagging
+// API, so the request is sent with its connection.
+func (s *StoreWithRetry) PutObjectTagging(objectKey string, tags []Tag) (err error) {
+	body, err := taggingXML(tags)
+	if err != nil {
+		return err
+	}
+	err = s.retry("PutObjectTagging", func() error {
+		headers := map[string]string{oss.HTTPHeaderContentType: "application/xml"}
+		resp, err := s.ossBucket.Client.Conn.Do("PUT", s.ossBucket.BucketName, objectKey,
+			"tagging", "tagging", headers, bytes.NewReader(body), 0, nil)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("oss: unexpected status %d", resp.StatusCode)
+		}
+		return err
+	})
+
+	return
+}
+
+// GetObjectTagging returns the tags of the object
+func (s *StoreWithRetry) GetObjectTagging(objectKey string) (tags []Tag, err error) {
+	err = s.retry("GetObjectTagging", func() error {
+		resp, err := s.ossBucket.Client.Conn.Do("GET", s.ossBucket.BucketName, objectKey,
+			"tagging", "tagging", nil, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var t tagging
+		if err := xml.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return fmt.Errorf("oss: invalid tagging: %v", err)
+		}
+		tags = t.Tags
+		return nil
+	})
+
+	return
+}
+
+// CompleteMultipartUploadWithCallback completes the upload with callback and
+// returns the response of the app server, sent with the connection of the SDK
+func (s *StoreWithRetry) CompleteMultipartUploadWithCallback(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart, callback *Callback) (body []byte, err error) {
+	complete, err := completeXML(parts)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := callback.headers()
+	if err != nil {
+		return nil, err
+	}
+	err = s.retry("CompleteMultipartUpload", func() error {
+		params := "uploadId=" + imur.UploadID
+		resp, err := s.ossBucket.Client.Conn.Do("POST", s.ossBucket.BucketName, imur.Key,
+			params, params, headers, bytes.NewReader(complete), 0, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return err
+		}
+		// 203 if the object is committed but the callback failed
+		if resp.StatusCode == http.StatusNonAuthoritativeInfo {
+			var se oss.ServiceError
+			if xml.Unmarshal(body, &se) != nil || se.Message == "" {
+				se.Message = string(body)
+			}
+			return &CallbackError{Message: se.Message, RequestID: resp.Headers.Get(oss.HTTPHeaderOssRequestID)}
+		}
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,102 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func TestRetryContext(t *testing.T) {
+	var logs bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newStore(nil, OSSConfig{Log: slog.New(slog.NewTextHandler(&logs, nil)), Context: ctx})
+
+	before := ReadStats()
+	calls := 0
+	start := time.Now()
+	err := s.retry("GetObject", func() error {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return oss.ServiceError{StatusCode: 503}
+	})
+	if err != context.Canceled || calls != 2 {
+		t.Errorf("err %v after %d calls, want canceled after 2", err, calls)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled after %v", elapsed)
+	}
+	if n := strings.Count(logs.String(), "msg=retry"); n != 2 {
+		t.Errorf("%d retries logged to the logger of the config: %s", n, logs.String())
+	}
+	after := ReadStats()
+	if after.Requests["GetObject"]-before.Requests["GetObject"] != 2 || after.Errors["GetObject"]-before.Errors["GetObject"] != 2 ||
+		after.Retries["GetObject"]-before.Retries["GetObject"] != 2 {
+		t.Errorf("stats %+v, before %+v", after, before)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{Delay: time.Millisecond, Retries: 2, Retryable: func(err error) bool {
+		return err != io.EOF
+	}}
+	s := newStore(nil, OSSConfig{Retry: policy})
+	for _, c := range []struct {
+		err   error
+		calls int
+	}{
+		{oss.ServiceError{StatusCode: 500}, 3},
+		{io.EOF, 1},
+	} {
+		calls := 0
+		err := s.retry("GetObject", func() error {
+			calls++
+			return c.err
+		})
+		if !errors.Is(err, c.err) || calls != c.calls {
+			t.Errorf("%v: err %v after %d calls, want %d", c.err, err, calls, c.calls)
+		}
+	}
+
+	// 503 only by default
+	if (&RetryPolicy{}).retryable(oss.ServiceError{StatusCode: 500}) || !DefaultRetryPolicy.retryable(oss.ServiceError{StatusCode: 503}) {
+		t.Error("default retryable")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(&RetryPolicy{Delay: 100 * time.Millisecond, Multiplier: 1.5, Retries: 3})
+	var delays []time.Duration
+	for d := b.next(); d != 0; d = b.next() {
+		delays = append(delays, d)
+	}
+	if len(delays) != 3 || delays[0] != 100*time.Millisecond || delays[1] != 150*time.Millisecond || delays[2] != 225*time.Millisecond {
+		t.Errorf("delays %v", delays)
+	}
+
+	// no retry that would end after MaxElapsed
+	b = newBackoff(&RetryPolicy{Delay: 100 * time.Millisecond, Retries: 10, MaxElapsed: 350 * time.Millisecond})
+	if d1, d2, d3 := b.next(), b.next(), b.next(); d1 != 100*time.Millisecond || d2 != 200*time.Millisecond || d3 != 0 {
+		t.Errorf("delays %v %v %v", d1, d2, d3)
+	}
+}
+
+func TestOnRetry(t *testing.T) {
+	p := &packer{}
+	config := p.ossConfig()
+	config.Retry, config.Trace = &RetryPolicy{Delay: 2 * time.Millisecond, Retries: 2}, nil
+	s := newStore(nil, config)
+	s.retry("GetObject", func() error { return oss.ServiceError{StatusCode: 503} })
+	if p.retries["GetObject"] != 2 || p.retryMS != 6 {
+		t.Errorf("retries %v, %dms", p.retries, p.retryMS)
+	}
+}
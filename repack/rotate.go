@@ -0,0 +1,58 @@
+package repack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DefaultNextSuffix is the suffix of the dest apks signed with the next key
+const DefaultNextSuffix = "-next"
+
+// hasNextKey reports whether a next key is given, so each dest apk is
+// signed with the key and again with the next key during a rotation
+func (p *packer) hasNextKey() bool {
+	return p.NextPrivateKeyPEM != "" || p.NextCertPEM != ""
+}
+
+// nextDest returns dest with the suffix of the next key before its
+// extension, e.g. my-bucket/qq-next.apk
+func (p *packer) nextDest(dest string) string {
+	suffix := p.NextSuffix
+	if suffix == "" {
+		suffix = DefaultNextSuffix
+	}
+	ext := path.Ext(dest)
+	if strings.Contains(ext, "/") {
+		ext = ""
+	}
+	return strings.TrimSuffix(dest, ext) + suffix + ext
+}
+
+// useNextKey sets the key, cert and dest of the job to those of the next key
+func (p *packer) useNextKey() {
+	p.PrivateKeyPEM, p.CertPEM = p.NextPrivateKeyPEM, p.NextCertPEM
+	p.PrivateKeyBlob, p.KeySecretName, p.CertSecretName = "", "", ""
+	p.keyPEM, p.certPEM = nil, nil
+	p.DestAPK = p.nextDest(p.DestAPK)
+}
+
+// checkNextKey checks that the next key and cert are given together, and
+// are a pair
+func (p *packer) checkNextKey(add func(format string, args ...interface{})) {
+	switch {
+	case !p.hasNextKey():
+		return
+	case p.NextPrivateKeyPEM == "" || p.NextCertPEM == "":
+		add("-next-priv-pem and -next-cert-pem are required together")
+		return
+	case !p.needSign():
+		add("-next-priv-pem can't be used without signing again")
+		return
+	}
+	q := &packer{Options: p.Options}
+	q.useNextKey()
+	q.checkKeys(func(format string, args ...interface{}) {
+		add("next key: %s", fmt.Sprintf(format, args...))
+	})
+}
@@ -0,0 +1,94 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestNextDest(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	for dest, want := range map[string]string{
+		"bucket/qq-huawei.apk": "bucket/qq-huawei-next.apk",
+		"bucket/qq":            "bucket/qq-next",
+		"bucket/v1.2/qq":       "bucket/v1.2/qq-next",
+	} {
+		if got := p.nextDest(dest); got != want {
+			t.Errorf("%s: %s, want %s", dest, got, want)
+		}
+	}
+	p.NextSuffix = ".v2"
+	if got := p.nextDest("bucket/qq.apk"); got != "bucket/qq.v2.apk" {
+		t.Errorf("suffix .v2: %s", got)
+	}
+}
+
+// certOf returns the signature block of the apk
+func certOf(t *testing.T, apk []byte) []byte {
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, "META-INF/") && strings.HasSuffix(f.Name, ".RSA") {
+			buf, _ := readEntry(f)
+			return buf
+		}
+	}
+	t.Fatal("no signature block")
+	return nil
+}
+
+func TestRepackNextKey(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, dir)
+	opts.NextPrivateKeyPEM, opts.NextCertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	result, err := Repack(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Next == nil || result.Next.Dest != "bucket/b-next.apk" || result.Next.CPID != "c1" {
+		t.Fatalf("next %+v", result.Next)
+	}
+	if bytes.Equal(certOf(t, objects["bucket/b.apk"]), certOf(t, objects["bucket/b-next.apk"])) {
+		t.Error("next dest signed with the same key")
+	}
+
+	// one more result of each channel
+	channels := filepath.Join(dir, "channels.txt")
+	ioutil.WriteFile(channels, []byte("huawei\nxiaomi\n"), 0644)
+	opts.Channels, opts.CPIDContent, opts.DestAPK = channels, "{{.Channel}}", "bucket/{{.Channel}}.apk"
+	results, err := RepackChannels(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dests []string
+	for _, r := range results {
+		dests = append(dests, r.Dest)
+	}
+	sort.Strings(dests)
+	if got := strings.Join(dests, ","); got != "bucket/huawei-next.apk,bucket/huawei.apk,bucket/xiaomi-next.apk,bucket/xiaomi.apk" {
+		t.Errorf("dests %s", got)
+	}
+
+	// the next key and cert go together
+	opts.NextCertPEM = ""
+	if _, err := Repack(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "-next-priv-pem and -next-cert-pem are required together") {
+		t.Errorf("next key without cert: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// signature schemes of -schemes
+const (
+	SchemesAuto = "auto" // chosen from the sdk versions of the apk, see selectSchemes
+	SchemeV1    = "v1"   // JAR signing, verified by all versions of Android
+	SchemeV2    = "v2"   // APK Signature Scheme v2, verified since Android 7.0
+	SchemeV3    = "v3"   // APK Signature Scheme v3, verified since Android 9
+)
+
+// sdk versions of the signature schemes
+const (
+	sdkV2         = 24 // verifies v2 signatures, and skips v1 if there is one
+	sdkV3         = 28 // verifies v3 signatures
+	sdkV2Required = 30 // requires a v2 signature of the apps targeting it
+	sdkMax        = 0x7fffffff
+)
+
+// strippingProtectionID is the id of the attribute of the v2 signed data
+// telling that the apk has a v3 signature too, so that it can't be removed
+const strippingProtectionID = 0xbeeff00d
+
+// schemes are the signature schemes of a dest apk
+type schemes struct {
+	v1, v2, v3 bool
+}
+
+func (s schemes) String() string {
+	var names []string
+	for _, scheme := range []struct {
+		on   bool
+		name string
+	}{{s.v1, SchemeV1}, {s.v2, SchemeV2}, {s.v3, SchemeV3}} {
+		if scheme.on {
+			names = append(names, scheme.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// apkSigned is the X-Android-APK-Signed attribute of the v1 signature file,
+// so that Android rejects the apk if the other schemes are stripped
+func (s schemes) apkSigned() string {
+	switch {
+	case s.v2 && s.v3:
+		return "2, 3"
+	case s.v2:
+		return "2"
+	case s.v3:
+		return "3"
+	}
+	return ""
+}
+
+// parseSchemes parses v1,v2,v3, ok false if auto or empty
+func parseSchemes(value string) (s schemes, ok bool, err error) {
+	if value == "" || value == SchemesAuto {
+		return s, false, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case SchemeV1:
+			s.v1 = true
+		case SchemeV2:
+			s.v2 = true
+		case SchemeV3:
+			s.v3 = true
+		default:
+			return s, false, fmt.Errorf("unknown scheme %q, expect auto or v1, v2 and v3", name)
+		}
+	}
+	return s, true, nil
+}
+
+// selectSchemes returns the schemes of the dests like apksigner: v2 and v3 from
+// Android 7.0, v1 and v2 if targeting Android 11 or v2 signed, else v1
+func (p *packer) selectSchemes(info *ApkInfo, block *SigningBlock) (schemes, error) {
+	s, ok, err := parseSchemes(p.Schemes)
+	if err != nil {
+		return s, err
+	}
+	if ok {
+		if !s.v1 && info != nil && info.MinSdk < sdkV2 {
+			p.log().Warn("no v1 signature, the dest won't install below Android 7.0", "phase", PhaseOpen, "min_sdk", info.MinSdk)
+		}
+		return s, nil
+	}
+	hadV2 := block != nil && block.Get(V2SignatureID) != nil
+	switch {
+	case info == nil:
+		s = schemes{v1: true, v2: hadV2}
+	case info.MinSdk >= sdkV2:
+		s = schemes{v2: true, v3: true}
+	case info.TargetSdk >= sdkV2Required || hadV2:
+		s = schemes{v1: true, v2: true}
+	default:
+		s = schemes{v1: true}
+	}
+	return s, nil
+}
+
+// v2Algorithm returns the v2 signature algorithm of priv, that of apksigner:
+// RSASSA-PKCS1-v1_5 with SHA-256 up to 3072 bits, with SHA-512 above
+func v2Algorithm(priv *rsa.PrivateKey) uint32 {
+	if priv.N.BitLen() <= 3072 {
+		return 0x0103
+	}
+	return 0x0104
+}
+
+// signTail returns tail, the rest of the dest after the kept ranges of src,
+// with an APK Signing Block of the v2 and v3 signatures in front of its directory
+func (p *packer) signTail(src *Source, segments []Segment, tail []byte, comment string, s schemes) ([]byte, error) {
+	endOffset := len(tail) - directoryEndLen - len(comment)
+	if endOffset < 0 || binary.LittleEndian.Uint32(tail[endOffset:]) != directoryEndSignature {
+		return nil, fmt.Errorf("end of central directory not found")
+	}
+	end := tail[endOffset:]
+	cdOffset := int64(binary.LittleEndian.Uint32(end[16:]))
+	if cdOffset == uint32max {
+		return nil, fmt.Errorf("zip64 apks can't be v2 signed")
+	}
+	kept := int64(0)
+	for _, s := range segments {
+		kept += s.Size
+	}
+	cdStart := cdOffset - kept
+	if cdStart < 0 || cdStart > int64(endOffset) {
+		return nil, fmt.Errorf("invalid central directory offset: %d", cdOffset)
+	}
+
+	priv, err := p.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := p.signingCert(rand.Reader, priv)
+	if err != nil {
+		return nil, err
+	}
+	algo := v2Algorithm(priv)
+	newHash := v2Algorithms[algo].digest
+
+	// the whole chunks of the kept ranges, then the rest of them with the
+	// appended entries
+	whole := kept / v2ChunkSize * v2ChunkSize
+	sums, err := src.keptChunkSums(p, segments, whole, algo)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]byte, kept-whole, kept-whole+cdStart)
+	if _, err := (&segmentReader{r: src.Cache, segments: segments}).ReadAt(entries, whole); err != nil {
+		return nil, err
+	}
+	entries = append(entries, tail[:cdStart]...)
+	var chunks []digestChunk
+	chunks = append(chunks, splitChunks(bytes.NewReader(entries), 0, int64(len(entries)))...)
+	chunks = append(chunks, splitChunks(bytes.NewReader(tail), cdStart, int64(endOffset)-cdStart)...)
+	chunks = append(chunks, splitChunks(bytes.NewReader(end), 0, int64(len(end)))...)
+	rest, err := p.chunkSums(chunks, []func() hash.Hash{newHash})
+	if err != nil {
+		return nil, err
+	}
+	digest := joinChunkSums([][][]byte{append(sums[:len(sums):len(sums)], rest[0]...)}, []func() hash.Hash{newHash})[0]
+
+	b := &SigningBlock{padded: true}
+	if s.v2 {
+		var attrs []byte
+		if s.v3 {
+			attrs = append(uint32Bytes(strippingProtectionID), uint32Bytes(3)...)
+		}
+		signer, err := schemeSigner(priv, cert, algo, digest, nil, attrs)
+		if err != nil {
+			return nil, err
+		}
+		b.Set(V2SignatureID, signer)
+	}
+	if s.v3 {
+		sdks := append(uint32Bytes(sdkV3), uint32Bytes(sdkMax)...)
+		signer, err := schemeSigner(priv, cert, algo, digest, sdks, nil)
+		if err != nil {
+			return nil, err
+		}
+		b.Set(V3SignatureID, signer)
+	}
+	block := b.Bytes()
+
+	sum := sha256.Sum256(cert)
+	p.certSHA256 = hex.EncodeToString(sum[:])
+	p.log().Info("signed", "phase", PhaseBuild, "schemes", s.String(), "block", len(block))
+
+	out := make([]byte, 0, len(tail)+len(block))
+	out = append(out, tail[:cdStart]...)
+	out = append(out, block...)
+	out = append(out, tail[cdStart:]...)
+	binary.LittleEndian.PutUint32(out[len(block)+endOffset+16:], uint32(cdOffset+int64(len(block))))
+	return out, nil
+}
+
+// schemeSigner returns the v2 signers, or the v3 signers of sdks, of the only
+// signer with priv, with the additional attribute attrs if not nil
+func schemeSigner(priv *rsa.PrivateKey, cert []byte, algo uint32, digest, sdks, attrs []byte) ([]byte, error) {
+	var signedData []byte
+	signedData = append(signedData, lengthPrefixed(lengthPrefixed(uint32Bytes(algo), lengthPrefixed(digest)))...)
+	signedData = append(signedData, lengthPrefixed(lengthPrefixed(cert))...)
+	signedData = append(signedData, sdks...)
+	if attrs != nil {
+		signedData = append(signedData, lengthPrefixed(lengthPrefixed(attrs))...)
+	} else {
+		signedData = append(signedData, lengthPrefixed()...)
+	}
+
+	h := v2Algorithms[algo].hash
+	hashed := h.New()
+	hashed.Write(signedData)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, h, hashed.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := lengthPrefixed(signedData)
+	signer = append(signer, sdks...)
+	signer = append(signer, lengthPrefixed(lengthPrefixed(uint32Bytes(algo), lengthPrefixed(sig)))...)
+	signer = append(signer, lengthPrefixed(publicKey)...)
+	return lengthPrefixed(lengthPrefixed(signer)), nil
+}
+
+// lengthPrefixed returns values one after another, prefixed with their
+// uint32 length
+func lengthPrefixed(values ...[]byte) []byte {
+	n := 0
+	for _, v := range values {
+		n += len(v)
+	}
+	buf := uint32Bytes(uint32(n))
+	for _, v := range values {
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+// uint32Bytes returns v little endian
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return buf
+}
+
+// keptChunkSums returns the digests of algo of the whole chunks of the first
+// size bytes of the kept segments, computed once for all the channels
+func (src *Source) keptChunkSums(p *packer, segments []Segment, size int64, algo uint32) ([][]byte, error) {
+	key := fmt.Sprintf("%#x %v", algo, segments)
+	src.chunkMu.Lock()
+	defer src.chunkMu.Unlock()
+	if sums, ok := src.chunkSums[key]; ok {
+		return sums, nil
+	}
+	chunks := splitChunks(&segmentReader{r: src.Cache, segments: segments}, 0, size)
+	sums, err := p.chunkSums(chunks, []func() hash.Hash{v2Algorithms[algo].digest})
+	if err != nil {
+		return nil, err
+	}
+	if src.chunkSums == nil {
+		src.chunkSums = make(map[string][][]byte)
+	}
+	src.chunkSums[key] = sums[0]
+	return sums[0], nil
+}
+
+// segmentReader reads the segments of r one after another
+type segmentReader struct {
+	r        io.ReaderAt
+	segments []Segment
+}
+
+func (s *segmentReader) ReadAt(buf []byte, off int64) (int, error) {
+	n := 0
+	start := int64(0) // of the segment in the joined ranges
+	for _, seg := range s.segments {
+		if n == len(buf) {
+			break
+		}
+		if off+int64(n) < start+seg.Size {
+			skip := off + int64(n) - start
+			size := seg.Size - skip
+			if size > int64(len(buf)-n) {
+				size = int64(len(buf) - n)
+			}
+			m, err := s.r.ReadAt(buf[n:n+int(size)], seg.Offset+skip)
+			n += m
+			if err != nil && !(err == io.EOF && m == int(size)) {
+				return n, err
+			}
+		}
+		start += seg.Size
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
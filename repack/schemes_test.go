@@ -0,0 +1,91 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+)
+
+func TestParseSchemes(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      schemes
+		ok        bool
+		apkSigned string
+	}{
+		{"", schemes{}, false, ""},
+		{SchemesAuto, schemes{}, false, ""},
+		{"v1", schemes{v1: true}, true, ""},
+		{"v1, v2", schemes{v1: true, v2: true}, true, "2"},
+		{"v1,v2,v3", schemes{v1: true, v2: true, v3: true}, true, "2, 3"},
+		{"v3", schemes{v3: true}, true, "3"},
+	}
+	for _, tt := range tests {
+		s, ok, err := parseSchemes(tt.value)
+		if err != nil || s != tt.want || ok != tt.ok || s.apkSigned() != tt.apkSigned {
+			t.Errorf("%q: %s, %v, %v, apk signed %q", tt.value, s, ok, err, s.apkSigned())
+		}
+	}
+	if _, _, err := parseSchemes("v1,v4"); err == nil {
+		t.Error("v4: no error")
+	}
+	if s := (schemes{v1: true, v3: true}).String(); s != "v1,v3" {
+		t.Errorf("string %s", s)
+	}
+}
+
+func TestSelectSchemes(t *testing.T) {
+	v2Signed := &SigningBlock{}
+	v2Signed.Set(V2SignatureID, []byte("signers"))
+	tests := []struct {
+		name  string
+		value string
+		info  *ApkInfo
+		block *SigningBlock
+		want  schemes
+	}{
+		{"unknown sdks", "", nil, nil, schemes{v1: true}},
+		{"unknown sdks, v2 signed", "", nil, v2Signed, schemes{v1: true, v2: true}},
+		{"android 7.0", "", &ApkInfo{MinSdk: 24, TargetSdk: 30}, nil, schemes{v2: true, v3: true}},
+		{"targets android 11", "", &ApkInfo{MinSdk: 21, TargetSdk: 30}, nil, schemes{v1: true, v2: true}},
+		{"v2 signed", "", &ApkInfo{MinSdk: 21, TargetSdk: 29}, v2Signed, schemes{v1: true, v2: true}},
+		{"old", SchemesAuto, &ApkInfo{MinSdk: 21, TargetSdk: 29}, nil, schemes{v1: true}},
+		{"explicit", "v2", &ApkInfo{MinSdk: 21, TargetSdk: 29}, nil, schemes{v2: true}},
+	}
+	for _, tt := range tests {
+		p := &packer{Options: Options{Schemes: tt.value, Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}}
+		s, err := p.selectSchemes(tt.info, tt.block)
+		if err != nil || s != tt.want {
+			t.Errorf("%s: %s, %v, want %s", tt.name, s, err, tt.want)
+		}
+	}
+}
+
+func TestRepackSchemes(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	opts.Schemes = "v1,v2,v3"
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	signed := objects["bucket/b.apk"]
+	if err := verifyAPK(t, signed); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadDirectory(bytes.NewReader(signed), int64(len(signed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ReadSigningBlock(bytes.NewReader(signed), d.Offset)
+	if err != nil || block == nil || block.Get(V2SignatureID) == nil || block.Get(V3SignatureID) == nil {
+		t.Fatalf("signing block %v: %v", block, err)
+	}
+}
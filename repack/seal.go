@@ -0,0 +1,86 @@
+package repack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// modes of -cpid-seal
+const (
+	SealAESGCM = "aes-gcm"
+	SealHMAC   = "hmac"
+)
+
+// sealer encrypts or signs the cpid content, so that client SDKs can tell
+// if it has been tampered with
+type sealer struct {
+	mode string
+	key  []byte
+}
+
+// loadSealer reads the hex encoded key of -cpid-key from local disk or OSS
+func (p *packer) loadSealer() (*sealer, error) {
+	if p.CPIDSeal == "" {
+		return nil, nil
+	}
+	if p.CPIDSeal != SealAESGCM && p.CPIDSeal != SealHMAC {
+		return nil, fmt.Errorf("unknown -cpid-seal: %s", p.CPIDSeal)
+	}
+	if p.CPIDKey == "" {
+		return nil, fmt.Errorf("-cpid-key is required by -cpid-seal")
+	}
+
+	var buf []byte
+	var err error
+	if strings.HasPrefix(p.CPIDKey, OSSScheme) {
+		buf, err = ReadObject(p.ossConfig(), strings.TrimPrefix(p.CPIDKey, OSSScheme))
+	} else {
+		buf, err = ioutil.ReadFile(p.CPIDKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: expect hex encoded key: %v", p.CPIDKey, err)
+	}
+
+	s := &sealer{mode: p.CPIDSeal, key: key}
+	if s.mode == SealAESGCM {
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.CPIDKey, err)
+		}
+	}
+	return s, nil
+}
+
+// seal returns base64(nonce || ciphertext) with the nonce from the HMAC of cpid
+// so that repacking stays idempotent, or cpid.base64url(HMAC-SHA256) in hmac mode
+func (s *sealer) seal(cpid string) (string, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(cpid))
+	sum := mac.Sum(nil)
+
+	if s.mode == SealHMAC {
+		return cpid + "." + base64.RawURLEncoding.EncodeToString(sum), nil
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := sum[:gcm.NonceSize()]
+	sealed := gcm.Seal(nonce[:len(nonce):len(nonce)], nonce, []byte(cpid), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
@@ -0,0 +1,86 @@
+package repack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "cpid.key")
+	ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f\n"), 0600)
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDKey = keyFile
+
+	p.CPIDSeal = SealAESGCM
+	s, err := p.loadSealer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.seal(`{"channel":"huawei"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.seal(`{"channel":"huawei"}`); again != sealed {
+		t.Errorf("sealed twice to %s and %s", sealed, again)
+	}
+	buf, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(s.key)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, buf[:gcm.NonceSize()], buf[gcm.NonceSize():], nil)
+	if err != nil || string(plain) != `{"channel":"huawei"}` {
+		t.Errorf("opened %q, %v", plain, err)
+	}
+
+	p.CPIDSeal = SealHMAC
+	s, err = p.loadSealer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err = s.seal("huawei")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("huawei"))
+	if want := "huawei." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)); sealed != want {
+		t.Errorf("signed %s, want %s", sealed, want)
+	}
+}
+
+func TestLoadSealer(t *testing.T) {
+	dir := t.TempDir()
+	p := &packer{Options: DefaultOptions()}
+	tests := []struct {
+		mode, key string
+		ok        bool
+	}{
+		{"", "", true},
+		{SealAESGCM, "000102030405060708090a0b0c0d0e0f", true},
+		{SealHMAC, "00", true},
+		{"rot13", "00", false},
+		{SealHMAC, "", false},
+		{SealHMAC, "not hex", false},
+		{SealAESGCM, "0001020304", false}, // not an aes key size
+	}
+	for i, tt := range tests {
+		p.CPIDSeal, p.CPIDKey = tt.mode, ""
+		if tt.key != "" {
+			p.CPIDKey = filepath.Join(dir, strings.Repeat("k", i+1))
+			ioutil.WriteFile(p.CPIDKey, []byte(tt.key), 0600)
+		}
+		if _, err := p.loadSealer(); (err == nil) != tt.ok {
+			t.Errorf("%s %q: %v, want ok %v", tt.mode, tt.key, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package repack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SecretTTL is how long a secret is used before it is read again, to pick
+// up a rotated version
+const SecretTTL = 5 * time.Minute
+
+// Secret is a version of a secret of Secrets Manager
+type Secret struct {
+	Name      string
+	VersionID string
+	Data      []byte
+}
+
+// GetSecretValue returns the current version of the secret name
+func (c *KMSClient) GetSecretValue(ctx context.Context, name string) (*Secret, error) {
+	var resp struct {
+		SecretName     string `json:"SecretName"`
+		VersionID      string `json:"VersionId"`
+		SecretData     string `json:"SecretData"`
+		SecretDataType string `json:"SecretDataType"` // text or binary
+	}
+	if err := c.do(ctx, "GetSecretValue", url.Values{"SecretName": {name}}, &resp); err != nil {
+		return nil, err
+	}
+	s := &Secret{Name: resp.SecretName, VersionID: resp.VersionID, Data: []byte(resp.SecretData)}
+	if resp.SecretDataType == "binary" {
+		data, err := base64.StdEncoding.DecodeString(resp.SecretData)
+		if err != nil {
+			return nil, fmt.Errorf("kms: invalid binary secret %s: %v", name, err)
+		}
+		s.Data = data
+	}
+	return s, nil
+}
+
+// cachedSecret is a secret read at some time
+type cachedSecret struct {
+	secret *Secret
+	read   time.Time
+}
+
+// secrets are the secrets read by the process, by the credentialsKey that
+// read them and name, so a job with other credentials reads them again
+var secrets = struct {
+	sync.Mutex
+	m map[string]cachedSecret
+}{m: make(map[string]cachedSecret)}
+
+// readSecret returns the data of the secret name, read again after SecretTTL
+// or the last version read if that fails, and not kept with PrivateSecrets
+func (p *packer) readSecret(name string) ([]byte, error) {
+	key := p.credentialsKey() + "\n" + name
+	var cached cachedSecret
+	var ok bool
+	if !p.PrivateSecrets {
+		secrets.Lock()
+		cached, ok = secrets.m[key]
+		secrets.Unlock()
+	}
+	if ok && time.Since(cached.read) < SecretTTL {
+		return cached.secret.Data, nil
+	}
+
+	end := p.trace("kms.get_secret_value")
+	s, err := p.kmsClient().GetSecretValue(p.jobContext(), name)
+	end(err)
+	if err != nil {
+		if ok {
+			p.log().Warn("read secret again, use the last version", "secret", name, "version", cached.secret.VersionID, "error", err)
+			return cached.secret.Data, nil
+		}
+		return nil, fmt.Errorf("read secret %s: %v", name, err)
+	}
+	if ok && s.VersionID != cached.secret.VersionID {
+		p.log().Info("secret rotated", "secret", name, "old_version", cached.secret.VersionID, "version", s.VersionID)
+	}
+	if !p.PrivateSecrets {
+		secrets.Lock()
+		secrets.m[key] = cachedSecret{secret: s, read: time.Now()}
+		secrets.Unlock()
+	}
+	return s.Data, nil
+}
+
+// credentialsKey returns the sha-256 of the KMS endpoint and the access key
+// with its secret and token, as the access key id alone is no secret
+func (p *packer) credentialsKey() string {
+	h := sha256.New()
+	for _, s := range []string{p.KMSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret, p.OSSSecurityToken} {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ForgetSecrets drops the secrets and the keys decrypted by KMS the process
+// keeps, so the next jobs read them again, e.g. after a key was rotated
+func ForgetSecrets() {
+	secrets.Lock()
+	secrets.m = make(map[string]cachedSecret)
+	secrets.Unlock()
+	openedKeys.Range(func(key, _ interface{}) bool {
+		openedKeys.Delete(key)
+		return true
+	})
+}
@@ -0,0 +1,212 @@
+package repack
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadSecret(t *testing.T) {
+	keyPEM, certPEM := writeKeyPair(t, t.TempDir())
+	key, _ := ioutil.ReadFile(keyPEM)
+	cert, _ := ioutil.ReadFile(certPEM)
+	var mu sync.Mutex
+	version, reads, fail := "v1", 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		reads++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(KMSError{Code: "ServiceUnavailable"})
+			return
+		}
+		switch name := r.PostForm.Get("SecretName"); name {
+		case "key":
+			json.NewEncoder(w).Encode(map[string]string{"SecretName": name, "VersionId": version, "SecretData": string(key), "SecretDataType": "text"})
+		case "cert":
+			json.NewEncoder(w).Encode(map[string]string{"SecretName": name, "VersionId": version,
+				"SecretData": base64.StdEncoding.EncodeToString(cert), "SecretDataType": "binary"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(KMSError{Code: "Forbidden.ResourceNotFound"})
+		}
+	}))
+	defer server.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return reads
+	}
+
+	opts := DefaultOptions()
+	opts.KMSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.KeySecretName, opts.CertSecretName = "key", "cert"
+	p := &packer{Options: opts, ctx: context.Background()}
+	var problems []string
+	p.checkKeys(func(format string, args ...interface{}) { problems = append(problems, format) })
+	if len(problems) != 0 || string(p.keyPEM) != string(key) || string(p.certPEM) != string(cert) {
+		t.Fatalf("problems %v", problems)
+	}
+	// both read once by the process
+	q := &packer{Options: opts, ctx: context.Background()}
+	q.readPrivateKey()
+	q.readCert()
+	if n := count(); n != 2 {
+		t.Errorf("%d reads", n)
+	}
+
+	// read again after the ttl, or the last version if that fails
+	expire := func() {
+		secrets.Lock()
+		for k, c := range secrets.m {
+			c.read = c.read.Add(-SecretTTL)
+			secrets.m[k] = c
+		}
+		secrets.Unlock()
+	}
+	expire()
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+	if _, err := (&packer{Options: opts}).readSecret("key"); err != nil || count() != 3 || secrets.m[(&packer{Options: opts}).credentialsKey()+"\nkey"].secret.VersionID != "v2" {
+		t.Errorf("%d reads: %v", count(), err)
+	}
+	expire()
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	if data, err := (&packer{Options: opts}).readSecret("key"); err != nil || string(data) != string(key) {
+		t.Errorf("last version: %v", err)
+	}
+	if _, err := (&packer{Options: opts}).readSecret("other"); err == nil || !strings.Contains(err.Error(), "read secret other") {
+		t.Errorf("not found: %v", err)
+	}
+
+	// the secrets need the kms endpoint
+	opts.KMSEndpoint = ""
+	problems = nil
+	(&packer{Options: opts}).checkKeys(func(format string, args ...interface{}) { problems = append(problems, format) })
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "-kms-ep is required") {
+		t.Errorf("problems %v", problems)
+	}
+}
+
+// fakeKMS is a Secrets Manager that checks the signature of each request
+// against the secrets of its access keys
+type fakeKMS struct {
+	secrets  map[string]string // access key secret by id
+	requests int32
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.requests, 1)
+	r.ParseForm()
+	params := url.Values{}
+	for k, v := range r.PostForm {
+		if k != "Signature" {
+			params[k] = v
+		}
+	}
+	secret, ok := f.secrets[params.Get("AccessKeyId")]
+	if !ok || rpcSignature("POST", params, secret) != r.PostForm.Get("Signature") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"Code":"SignatureDoesNotMatch"}`))
+		return
+	}
+	w.Write([]byte(`{"SecretName":"` + params.Get("SecretName") + `","VersionId":"v1","SecretData":"pem of ` + params.Get("AccessKeyId") + `","SecretDataType":"text"}`))
+}
+
+func TestReadSecretCredentials(t *testing.T) {
+	kms := &fakeKMS{secrets: map[string]string{"tenant-a": "secret-a", "tenant-b": "secret-b"}}
+	srv := httptest.NewServer(kms)
+	defer srv.Close()
+
+	newPacker := func(id, secret string, private bool) *packer {
+		return &packer{Options: Options{KMSEndpoint: srv.URL, OSSAccessKeyID: id, OSSAccessKeySecret: secret, PrivateSecrets: private}}
+	}
+	tests := []struct {
+		name     string
+		p        *packer
+		want     string // empty if the read fails
+		requests int32  // to KMS so far
+	}{
+		{"first read", newPacker("tenant-a", "secret-a", false), "pem of tenant-a", 1},
+		{"cached", newPacker("tenant-a", "secret-a", false), "pem of tenant-a", 1},
+		{"id of another tenant", newPacker("tenant-a", "guess", false), "", 2},
+		{"token of another tenant", &packer{Options: Options{KMSEndpoint: srv.URL, OSSAccessKeyID: "tenant-a", OSSAccessKeySecret: "secret-a", OSSSecurityToken: "t"}}, "pem of tenant-a", 3},
+		{"other credentials", newPacker("tenant-b", "secret-b", false), "pem of tenant-b", 4},
+		{"private", newPacker("tenant-a", "secret-a", true), "pem of tenant-a", 5},
+		{"private again", newPacker("tenant-a", "secret-a", true), "pem of tenant-a", 6},
+		{"private wrong secret", newPacker("tenant-a", "guess", true), "", 7},
+	}
+	for _, tt := range tests {
+		buf, err := tt.p.readSecret("signing-key")
+		if tt.want == "" && err == nil {
+			t.Errorf("%s: read %q, want an error", tt.name, buf)
+		}
+		if tt.want != "" && (err != nil || string(buf) != tt.want) {
+			t.Errorf("%s: read %q, %v, want %q", tt.name, buf, err, tt.want)
+		}
+		if n := atomic.LoadInt32(&kms.requests); n != tt.requests {
+			t.Errorf("%s: %d requests to kms, want %d", tt.name, n, tt.requests)
+		}
+	}
+}
+
+func TestOpenKeyCredentials(t *testing.T) {
+	kms := &fakeKMS{secrets: map[string]string{"tenant-a": "secret-a"}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("Action") != "Decrypt" {
+			t.Errorf("action %s, want Decrypt", r.PostForm.Get("Action"))
+		}
+		rec := httptest.NewRecorder()
+		kms.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+			return
+		}
+		w.Write([]byte(`{"Plaintext":"opened"}`))
+	}))
+	defer srv.Close()
+
+	owner := &packer{Options: Options{KMSEndpoint: srv.URL, OSSAccessKeyID: "tenant-a", OSSAccessKeySecret: "secret-a"}}
+	if buf, err := owner.openKey([]byte("blob")); err != nil || string(buf) != "opened" {
+		t.Fatalf("open key: %q, %v", buf, err)
+	}
+	other := &packer{Options: Options{KMSEndpoint: srv.URL, OSSAccessKeyID: "tenant-a", OSSAccessKeySecret: "guess"}}
+	if buf, err := other.openKey([]byte("blob")); err == nil {
+		t.Errorf("opened %q with the id of another tenant", buf)
+	}
+	if n := atomic.LoadInt32(&kms.requests); n != 2 {
+		t.Errorf("%d requests to kms, want 2", n)
+	}
+}
+
+func TestForgetSecrets(t *testing.T) {
+	kms := &fakeKMS{secrets: map[string]string{"id": "secret"}}
+	srv := httptest.NewServer(kms)
+	defer srv.Close()
+	p := &packer{Options: Options{KMSEndpoint: srv.URL, OSSAccessKeyID: "id", OSSAccessKeySecret: "secret"}}
+	for i := 0; i < 2; i++ {
+		if _, err := p.readSecret("signing-key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ForgetSecrets()
+	p.readSecret("signing-key")
+	if n := atomic.LoadInt32(&kms.requests); n != 2 {
+		t.Errorf("%d requests to kms, want 2", n)
+	}
+}
@@ -0,0 +1,146 @@
+package repack
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// Check is a check of SelfTest
+type Check struct {
+	Name       string `json:"name"` // oss, or sign with the key of the options or of a rule of the key map
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// selfTestMessage is signed and verified by SelfTest
+var selfTestMessage = []byte("repack self-test")
+
+// SelfTest lists an object under location, the bucket of probeLocation if
+// empty, and signs and verifies a message with each key, failing if any fails
+func SelfTest(ctx context.Context, opts Options, location string) ([]Check, error) {
+	p := &packer{Options: opts}
+	p.ctx = ctx
+	var checks []Check
+	run := func(name string, f func() error) {
+		start := time.Now()
+		err := f()
+		check := Check{Name: name, OK: err == nil, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			check.Error = err.Error()
+			p.log().Warn("self-test failed", "check", name, "error", err)
+		}
+		checks = append(checks, check)
+	}
+
+	if location == "" {
+		location = p.probeLocation()
+	}
+	if location != "" {
+		run("oss", func() error { return p.probeOSS(location) })
+	}
+
+	if p.KeyMap != "" {
+		var problems []string
+		p.loadKeyMap(func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		})
+		if len(problems) > 0 {
+			run("key map", func() error { return fmt.Errorf("%s", strings.Join(problems, "; ")) })
+		}
+	}
+	if p.hasKey() {
+		run("sign", p.signRoundTrip)
+	}
+	for i, r := range p.keyRules {
+		q := &packer{Options: p.Options, ctx: ctx}
+		r.applyTo(&q.Options)
+		run(fmt.Sprintf("sign: -key-map rule %d", i+1), q.signRoundTrip)
+	}
+
+	for _, check := range checks {
+		if !check.OK {
+			return checks, fmt.Errorf("self-test %s: %s", check.Name, check.Error)
+		}
+	}
+	return checks, nil
+}
+
+// probeLocation returns the bucket of the dest, or else of the source, or
+// empty if both are templates
+func (p *packer) probeLocation() string {
+	for _, location := range []string{p.DestAPK, p.SourceAPK} {
+		if i := strings.Index(location, "/"); i > 0 && !strings.Contains(location[:i], "{{") {
+			return location[:i+1]
+		}
+	}
+	return ""
+}
+
+// probeOSS lists an object under location
+func (p *packer) probeOSS(location string) error {
+	if !strings.Contains(location, "/") {
+		location += "/"
+	}
+	r, err := NewReader(p.ossConfig(), location)
+	if err != nil {
+		return err
+	}
+	_, err = r.Client.ListObjects(oss.Prefix(r.Object), oss.MaxKeys(1))
+	var ue *url.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &ue):
+		return fmt.Errorf("%s can't be reached: %v", p.destEndpoint(), ue.Err)
+	}
+	return fmt.Errorf("list %s: %v", location, err)
+}
+
+// signRoundTrip signs selfTestMessage with the private key, and verifies
+// the signature with the cert
+func (p *packer) signRoundTrip() error {
+	buf, err := p.readPrivateKey()
+	if err != nil {
+		return fmt.Errorf("private key: %v", err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return fmt.Errorf("no pem block in the private key")
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("private key: %v", err)
+	}
+	if buf, err = p.readCert(); err != nil {
+		return fmt.Errorf("cert: %v", err)
+	}
+	if block, _ = pem.Decode(buf); block == nil {
+		return fmt.Errorf("no pem block in the cert")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("cert: %v", err)
+	}
+	sum := sha256.Sum256(selfTestMessage)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	if err != nil {
+		return fmt.Errorf("sign: %v", err)
+	}
+	if err := cert.CheckSignature(x509.SHA256WithRSA, selfTestMessage, sig); err != nil {
+		return fmt.Errorf("the cert doesn't verify the signature of the private key: %v", err)
+	}
+	return nil
+}
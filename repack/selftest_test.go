@@ -0,0 +1,51 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/bucket") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code></Error>`)
+			return
+		}
+		fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated></ListBucketResult>`)
+	}))
+	defer server.Close()
+
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK = "bucket/a.apk", "{{.Channel}}/b.apk"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	checks, err := SelfTest(context.Background(), opts, "")
+	if err != nil || len(checks) != 2 || checks[0].Name != "oss" || checks[1].Name != "sign" {
+		t.Fatalf("checks %+v: %v", checks, err)
+	}
+
+	// the cert of another key
+	_, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	checks, err = SelfTest(context.Background(), opts, "denied/apks/")
+	if err == nil || len(checks) != 2 || checks[0].OK || checks[1].OK || !strings.Contains(checks[1].Error, "doesn't verify") {
+		t.Errorf("checks %+v: %v", checks, err)
+	}
+}
+
+func TestProbeLocation(t *testing.T) {
+	for _, c := range []struct{ source, dest, want string }{
+		{"src/a.apk", "dest/{{.Channel}}.apk", "dest/"},
+		{"src/a.apk", "{{.Channel}}/a.apk", "src/"},
+		{"{{.Dir}}/a.apk", "{{.Channel}}/a.apk", ""},
+	} {
+		p := &packer{Options: Options{SourceAPK: c.source, DestAPK: c.dest}}
+		if got := p.probeLocation(); got != c.want {
+			t.Errorf("%s %s: %q, want %q", c.source, c.dest, got, c.want)
+		}
+	}
+}
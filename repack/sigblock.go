@@ -0,0 +1,170 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// APK Signing Block consts, see
+// https://source.android.com/docs/security/features/apksigning/v2
+const (
+	sigBlockMagic     = "APK Sig Block 42"
+	sigBlockFooterLen = 24 // size + magic
+	sigBlockAlign     = 4096
+	sigBlockPaddingID = 0x42726577
+	WalleChannelID    = 0x71777777 // id of the channel info written by Walle
+	V2SignatureID     = 0x7109871a // id of the APK Signature Scheme v2 signers
+	V3SignatureID     = 0xf05368c0 // id of the APK Signature Scheme v3 signers
+	PlayFrostingID    = 0x2146444e // id of the metadata Google Play adds to the apks it delivers
+)
+
+// errNoSigningBlock is returned by ReadSigningBlock if the apk has none
+var errNoSigningBlock = errors.New("apk signing block not found")
+
+// SigningBlock is the APK Signing Block right before the central directory
+type SigningBlock struct {
+	Offset int64 // offset of the block in the apk
+	Size   int64 // size of the whole block
+	Pairs  []SigningPair
+	padded bool
+}
+
+// SigningPair is an id-value pair of the signing block
+type SigningPair struct {
+	ID    uint32
+	Value []byte
+}
+
+// ReadSigningBlock reads the APK Signing Block ending at the central
+// directory offset cdOffset
+func ReadSigningBlock(r io.ReaderAt, cdOffset int64) (*SigningBlock, error) {
+	if cdOffset < sigBlockFooterLen {
+		return nil, errNoSigningBlock
+	}
+	footer := make([]byte, sigBlockFooterLen)
+	if _, err := r.ReadAt(footer, cdOffset-sigBlockFooterLen); err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != sigBlockMagic {
+		return nil, errNoSigningBlock
+	}
+
+	size := int64(binary.LittleEndian.Uint64(footer)) + 8
+	if size < 8+sigBlockFooterLen || size > cdOffset {
+		return nil, fmt.Errorf("invalid apk signing block size: %d", size)
+	}
+	b := &SigningBlock{Offset: cdOffset - size, Size: size}
+	buf := make([]byte, size-8-sigBlockFooterLen)
+	if _, err := r.ReadAt(buf, b.Offset+8); err != nil {
+		return nil, err
+	}
+
+	for len(buf) > 0 {
+		if len(buf) < 12 {
+			return nil, fmt.Errorf("invalid apk signing block pair")
+		}
+		n := binary.LittleEndian.Uint64(buf)
+		if n < 4 || n > uint64(len(buf)-8) {
+			return nil, fmt.Errorf("invalid apk signing block pair size: %d", n)
+		}
+		id := binary.LittleEndian.Uint32(buf[8:])
+		if id == sigBlockPaddingID {
+			b.padded = true
+		} else {
+			b.Pairs = append(b.Pairs, SigningPair{ID: id, Value: buf[12 : 8+n]})
+		}
+		buf = buf[8+n:]
+	}
+	return b, nil
+}
+
+// Get returns the value of id, or nil if not found
+func (b *SigningBlock) Get(id uint32) []byte {
+	for _, p := range b.Pairs {
+		if p.ID == id {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+// Set adds or replaces the value of id
+func (b *SigningBlock) Set(id uint32, value []byte) {
+	for i, p := range b.Pairs {
+		if p.ID == id {
+			b.Pairs[i].Value = value
+			return
+		}
+	}
+	b.Pairs = append(b.Pairs, SigningPair{ID: id, Value: value})
+}
+
+// Bytes encodes the block, padded to sigBlockAlign like apksigner does if
+// the original block was
+func (b *SigningBlock) Bytes() []byte {
+	size := int64(8 + sigBlockFooterLen)
+	for _, p := range b.Pairs {
+		size += 12 + int64(len(p.Value))
+	}
+	pairs := b.Pairs
+	if b.padded {
+		pad := (sigBlockAlign - (size+12)%sigBlockAlign) % sigBlockAlign
+		pairs = append(pairs[:len(pairs):len(pairs)],
+			SigningPair{ID: sigBlockPaddingID, Value: make([]byte, pad)})
+		size += 12 + pad
+	}
+
+	var w bytes.Buffer
+	le(&w, uint64(size-8))
+	for _, p := range pairs {
+		le(&w, uint64(4+len(p.Value)), p.ID)
+		w.Write(p.Value)
+	}
+	le(&w, uint64(size-8))
+	w.WriteString(sigBlockMagic)
+	return w.Bytes()
+}
+
+// checkSigningBlock returns the APK Signing Block of the apk, nil if none,
+// rejecting an apk delivered by Google Play unless Force
+func (p *packer) checkSigningBlock(r io.ReaderAt, d *Directory) (*SigningBlock, error) {
+	b, err := ReadSigningBlock(r, d.Offset)
+	if err == errNoSigningBlock {
+		return nil, nil
+	}
+	if err != nil {
+		p.log().Warn("apk signing block", "phase", PhaseOpen, "error", err)
+		return nil, nil
+	}
+	if b.Get(PlayFrostingID) != nil {
+		if !p.Force {
+			return nil, errorOf(KindSource, fmt.Errorf("apk delivered by Google Play, whose metadata in the apk signing block the repack invalidates, pass -force to repack it anyway"))
+		}
+		p.log().Warn("apk delivered by Google Play, its metadata in the apk signing block is invalidated", "phase", PhaseOpen)
+	}
+	return b, nil
+}
+
+// walleChannel returns the channel info in the format of Walle
+func (p *packer) walleChannel() []byte {
+	buf, _ := json.Marshal(map[string]string{"channel": p.CPIDContent})
+	return buf
+}
+
+// changeSigningBlock sets the channel in the signing block, returning the
+// ranges of r before the block and the new block that ends at d.Offset
+func (p *packer) changeSigningBlock(r io.ReaderAt, d *Directory) ([]Segment, []byte, error) {
+	b, err := ReadSigningBlock(r, d.Offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.Set(WalleChannelID, p.walleChannel())
+	buf := b.Bytes()
+
+	d.Offset = b.Offset + int64(len(buf))
+	return []Segment{{Offset: 0, Size: b.Offset}}, buf, nil
+}
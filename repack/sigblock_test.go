@@ -0,0 +1,131 @@
+package repack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// withSigningBlock inserts a signing block of the pairs before the central
+// directory of apk
+func withSigningBlock(t *testing.T, apk []byte, padded bool, pairs ...SigningPair) []byte {
+	d, err := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := (&SigningBlock{Pairs: pairs, padded: padded}).Bytes()
+	var out bytes.Buffer
+	out.Write(apk[:d.Offset])
+	out.Write(block)
+	d.Offset += int64(len(block))
+	if err := d.Append(&out).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestReadSigningBlock(t *testing.T) {
+	apk := zipOf("classes.dex", "dex")
+	d, err := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSigningBlock(bytes.NewReader(apk), d.Offset); err == nil {
+		t.Error("no error without a signing block")
+	}
+
+	signed := withSigningBlock(t, apk, true, SigningPair{0x7109871a, []byte("v2")})
+	d, err = ReadDirectory(bytes.NewReader(signed), int64(len(signed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadSigningBlock(bytes.NewReader(signed), d.Offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Offset != d.Offset-b.Size || b.Size%sigBlockAlign != 0 || len(b.Pairs) != 1 || string(b.Get(0x7109871a)) != "v2" {
+		t.Errorf("block at %d of %d bytes, pairs %v", b.Offset, b.Size, b.Pairs)
+	}
+
+	tests := []struct {
+		name   string
+		change func(b []byte)
+	}{
+		{"bad magic", func(b []byte) { b[len(b)-1] = '0' }},
+		{"size too small", func(b []byte) { binary.LittleEndian.PutUint64(b[len(b)-sigBlockFooterLen:], 8) }},
+		{"size past the start", func(b []byte) { binary.LittleEndian.PutUint64(b[len(b)-sigBlockFooterLen:], 1<<20) }},
+		{"pair past the end", func(b []byte) { binary.LittleEndian.PutUint64(b[8:], 1<<20) }},
+	}
+	for _, tt := range tests {
+		buf := append([]byte(nil), signed[:d.Offset]...)
+		tt.change(buf[b.Offset:])
+		if _, err := ReadSigningBlock(bytes.NewReader(buf), d.Offset); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestV2Channel(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDContent, p.V2Channel, p.CPIDComment, p.MetaDataName, p.ExtraFiles = "c1", true, false, "", nil
+
+	for _, padded := range []bool{false, true} {
+		src := withSigningBlock(t, zipOf("classes.dex", "dex"), padded, SigningPair{0x7109871a, []byte("v2")})
+		apk, err := p.repackBytes(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+		if err != nil {
+			t.Fatalf("padded %v: %v", padded, err)
+		}
+		if len(r.File) != 1 {
+			t.Errorf("padded %v: %d entries", padded, len(r.File))
+		}
+		d, err := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ReadSigningBlock(bytes.NewReader(apk), d.Offset)
+		if err != nil {
+			t.Fatalf("padded %v: %v", padded, err)
+		}
+		if string(b.Get(0x7109871a)) != "v2" || !bytes.Equal(b.Get(WalleChannelID), p.walleChannel()) {
+			t.Errorf("padded %v: pairs %v", padded, b.Pairs)
+		}
+		if padded != (b.Size%sigBlockAlign == 0) {
+			t.Errorf("padded %v: block of %d bytes", padded, b.Size)
+		}
+	}
+}
+
+func TestCheckSigningBlock(t *testing.T) {
+	apk := zipOf("classes.dex", "dex")
+	p := &packer{Options: DefaultOptions()}
+	p.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	for name, tt := range map[string]struct {
+		apk   []byte
+		force bool
+		ok    bool
+	}{
+		"unsigned":    {apk, false, true},
+		"v2 signed":   {withSigningBlock(t, apk, true, SigningPair{V2SignatureID, []byte("v2")}), false, true},
+		"from play":   {withSigningBlock(t, apk, true, SigningPair{V2SignatureID, []byte("v2")}, SigningPair{PlayFrostingID, []byte("frosting")}), false, false},
+		"play forced": {withSigningBlock(t, apk, true, SigningPair{PlayFrostingID, []byte("frosting")}), true, true},
+	} {
+		d, err := ReadDirectory(bytes.NewReader(tt.apk), int64(len(tt.apk)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Force = tt.force
+		_, err = p.checkSigningBlock(bytes.NewReader(tt.apk), d)
+		if (err == nil) != tt.ok || (err != nil && KindOf(err) != KindSource) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
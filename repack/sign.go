@@ -1,18 +1,24 @@
-package main
+package repack
 
 import (
+	"container/list"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,15 +33,23 @@ func sha1Sum(msg []byte) string {
 	return base64.StdEncoding.EncodeToString(sha[:])
 }
 
-func signSF() ([]byte, error) {
-	sfFile := fmt.Sprintf("%s/%s.SF", g.WorkDir, g.SigFileName)
-	sfContent, err := ioutil.ReadFile(sfFile)
+func (p *packer) signSF() ([]byte, error) {
+	sfContent, err := p.readWorkFile(p.SigFileName + ".SF")
 	if err != nil {
 		return nil, err
 	}
 
-	// read private key from pem
-	buf, err := ioutil.ReadFile(g.PrivateKeyPEM)
+	privKey, err := p.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.signPKCS7(rand.Reader, privKey, sfContent)
+}
+
+// privateKey returns the RSA private key of the job
+func (p *packer) privateKey() (*rsa.PrivateKey, error) {
+	buf, err := p.readPrivateKey()
 	if err != nil {
 		return nil, err
 	}
@@ -45,12 +59,61 @@ func signSF() ([]byte, error) {
 		return nil, fmt.Errorf("failed to decode pem")
 	}
 
-	privKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// readPrivateKey returns the private key pem of KeySecretName, PrivateKeyBlob or
+// PrivateKeyPEM, decrypted by KMS unless a pem, read once per job across rotations
+func (p *packer) readPrivateKey() ([]byte, error) {
+	if p.keyPEM != nil {
+		return p.keyPEM, nil
+	}
+	var buf []byte
+	var err error
+	switch {
+	case p.KeySecretName != "":
+		// Secrets Manager decrypts the secret itself
+		if p.keyPEM, err = p.readSecret(p.KeySecretName); err != nil {
+			return nil, err
+		}
+		return p.keyPEM, nil
+	case p.PrivateKeyBlob != "":
+		buf = []byte(p.PrivateKeyBlob)
+	default:
+		if buf, err = p.readPEM(p.PrivateKeyPEM); err != nil {
+			return nil, err
+		}
+	}
+	if block, _ := pem.Decode(buf); block == nil && p.KMSEndpoint != "" {
+		if buf, err = p.openKey(buf); err != nil {
+			return nil, err
+		}
+	}
+	p.keyPEM = buf
+	return buf, nil
+}
+
+// readCert returns the cert pem: the secret of CertSecretName or the file
+// of CertPEM, read once per job like the private key
+func (p *packer) readCert() ([]byte, error) {
+	if p.certPEM != nil {
+		return p.certPEM, nil
 	}
+	var err error
+	if p.CertSecretName != "" {
+		p.certPEM, err = p.readSecret(p.CertSecretName)
+	} else {
+		p.certPEM, err = p.readPEM(p.CertPEM)
+	}
+	return p.certPEM, err
+}
 
-	return signPKCS7(rand.Reader, privKey, sfContent)
+// readPEM reads a pem file from local disk or OSS
+func (p *packer) readPEM(location string) ([]byte, error) {
+	if strings.HasPrefix(location, OSSScheme) {
+		return ReadObject(p.ossConfig(), strings.TrimPrefix(location, OSSScheme))
+	}
+	return ioutil.ReadFile(location)
 }
 
 // signPKCS7 does the minimal amount of work necessary to embed an RSA
@@ -58,31 +121,24 @@ func signSF() ([]byte, error) {
 //
 // We prepare the certificate using the x509 package, read it back in
 // to our custom data type and then write it back out with the signature.
-func signPKCS7(rand io.Reader, priv *rsa.PrivateKey, msg []byte) ([]byte, error) {
-	buf, err := ioutil.ReadFile(g.CertPEM)
+func (p *packer) signPKCS7(rand io.Reader, priv *rsa.PrivateKey, msg []byte) ([]byte, error) {
+	b, err := p.signingCert(rand, priv)
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(buf)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode pem: %s", g.CertPEM)
-	}
-
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
+	c := certificate{}
+	if _, err := asn1.Unmarshal(b, &c); err != nil {
 		return nil, err
 	}
 
-	b, err := x509.CreateCertificate(rand, cert, cert, priv.Public(), priv)
+	// fingerprint of the cert as embedded below
+	der, err := asn1.Marshal(c)
 	if err != nil {
 		return nil, err
 	}
-
-	c := certificate{}
-	if _, err := asn1.Unmarshal(b, &c); err != nil {
-		return nil, err
-	}
+	sum := sha256.Sum256(der)
+	p.certSHA256 = hex.EncodeToString(sum[:])
 
 	h := sha1.New()
 	h.Write(msg)
@@ -106,8 +162,8 @@ func signPKCS7(rand io.Reader, priv *rsa.PrivateKey, msg []byte) ([]byte, error)
 			SignerInfos: []signerInfo{{
 				Version: 1,
 				IssuerAndSerialNumber: issuerAndSerialNumber{
-					Issuer:       cert.Issuer.ToRDNSequence(),
-					SerialNumber: int(cert.SerialNumber.Int64()),
+					Issuer:       c.TBSCertificate.Issuer,
+					SerialNumber: c.TBSCertificate.SerialNumber,
 				},
 				DigestAlgorithm: pkix.AlgorithmIdentifier{
 					Algorithm:  oidSHA1,
@@ -125,6 +181,72 @@ func signPKCS7(rand io.Reader, priv *rsa.PrivateKey, msg []byte) ([]byte, error)
 	return asn1.Marshal(content)
 }
 
+// signingCert returns the cert of the signatures, the cert of the job
+// signed again by priv, see selfSign
+func (p *packer) signingCert(rand io.Reader, priv *rsa.PrivateKey) ([]byte, error) {
+	buf, err := p.readCert()
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode the cert pem")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return selfSign(rand, cert, priv)
+}
+
+// selfSignedCerts is the number of certs signed again kept by the process
+const selfSignedCerts = 16
+
+// selfSigned are the certs signed again by their keys, by the cert and public
+// key, the most recent first
+var selfSigned = struct {
+	sync.Mutex
+	m   map[string]*list.Element
+	lru *list.List // of *selfSignedCert
+}{m: make(map[string]*list.Element), lru: list.New()}
+
+type selfSignedCert struct {
+	key string
+	der []byte
+}
+
+// selfSign returns cert signed again by priv with its serial, validity and
+// extensions, the same bytes for the same cert and key with PKCS#1 v1.5
+func selfSign(rand io.Reader, cert *x509.Certificate, priv *rsa.PrivateKey) ([]byte, error) {
+	key := string(cert.Raw) + string(x509.MarshalPKCS1PublicKey(&priv.PublicKey))
+	selfSigned.Lock()
+	if e, ok := selfSigned.m[key]; ok {
+		selfSigned.lru.MoveToFront(e)
+		selfSigned.Unlock()
+		return e.Value.(*selfSignedCert).der, nil
+	}
+	selfSigned.Unlock()
+
+	der, err := x509.CreateCertificate(rand, cert, cert, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+	selfSigned.Lock()
+	defer selfSigned.Unlock()
+	if _, ok := selfSigned.m[key]; !ok {
+		selfSigned.m[key] = selfSigned.lru.PushFront(&selfSignedCert{key: key, der: der})
+	}
+	for selfSigned.lru.Len() > selfSignedCerts {
+		e := selfSigned.lru.Back()
+		delete(selfSigned.m, e.Value.(*selfSignedCert).key)
+		selfSigned.lru.Remove(e)
+	}
+	return der, nil
+}
+
 type pkcs7SignedData struct {
 	ContentType asn1.ObjectIdentifier
 	Content     signedData `asn1:"tag:0,explicit"`
@@ -154,7 +276,7 @@ type certificate struct {
 // tbsCertificate is defined in rfc2459, section 4.1.
 type tbsCertificate struct {
 	Version      int `asn1:"tag:0,default:2,explicit"`
-	SerialNumber int
+	SerialNumber *big.Int
 	Signature    pkix.AlgorithmIdentifier
 	Issuer       pkix.RDNSequence // pkix.Name
 	Validity     validity
@@ -185,7 +307,7 @@ type signerInfo struct {
 
 type issuerAndSerialNumber struct {
 	Issuer       pkix.RDNSequence // pkix.Name
-	SerialNumber int
+	SerialNumber *big.Int
 }
 
 // Various ASN.1 Object Identifies, mostly from rfc3852.
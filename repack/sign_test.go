@@ -0,0 +1,95 @@
+package repack
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newCert returns a new key and its self signed cert of serial
+func newCert(t *testing.T, serial *big.Int) (*rsa.PrivateKey, *x509.Certificate) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: serial, Subject: pkix.Name{CommonName: "repack test"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), BasicConstraintsValid: true, IsCA: true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, cert
+}
+
+func TestSignPKCS7Deterministic(t *testing.T) {
+	// a 20-byte serial like those of openssl req -x509
+	serial := new(big.Int).SetBytes(bytes.Repeat([]byte{0x7f}, 20))
+	priv, cert := newCert(t, serial)
+	certPEM := filepath.Join(t.TempDir(), "cert.pem")
+	ioutil.WriteFile(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+
+	var sigs [][]byte
+	for i := 0; i < 2; i++ {
+		p := &packer{Options: DefaultOptions()}
+		p.CertPEM = certPEM
+		sig, err := p.signPKCS7(rand.Reader, priv, []byte("Signature-Version: 1.0\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	if !bytes.Equal(sigs[0], sigs[1]) {
+		t.Error("signatures of the same input differ")
+	}
+	if !bytes.Contains(sigs[0], serial.Bytes()) {
+		t.Error("serial not in the signature")
+	}
+}
+
+func TestSelfSign(t *testing.T) {
+	priv, cert := newCert(t, big.NewInt(1))
+
+	// signed once by concurrent channels
+	var wg sync.WaitGroup
+	ders := make([][]byte, 8)
+	for i := range ders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ders[i], _ = selfSign(rand.Reader, cert, priv)
+		}(i)
+	}
+	wg.Wait()
+	for _, der := range ders[1:] {
+		if !bytes.Equal(der, ders[0]) {
+			t.Fatal("signed certs differ")
+		}
+	}
+
+	// the cache keeps the most recent certs only
+	for i := 0; i < selfSignedCerts+4; i++ {
+		k, c := newCert(t, big.NewInt(int64(10+i)))
+		if _, err := selfSign(rand.Reader, c, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	selfSigned.Lock()
+	n, m := selfSigned.lru.Len(), len(selfSigned.m)
+	selfSigned.Unlock()
+	if n != selfSignedCerts || m != selfSignedCerts {
+		t.Errorf("%d certs in the lru, %d in the map", n, m)
+	}
+}
@@ -0,0 +1,744 @@
+package repack
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// verifySignatures checks the signatures of the apk in ra as Android does on
+// install, with sample only the digests of its entries, not of the whole apk
+func (p *packer) verifySignatures(ra io.ReaderAt, size int64, dir *Directory, r *zip.Reader, sample map[string]bool) error {
+	if err := p.verifyV1(ra, r, sample); err != nil {
+		return fmt.Errorf("v1 signature: %v", err)
+	}
+
+	block, err := ReadSigningBlock(ra, dir.Offset)
+	if err == errNoSigningBlock {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if v2 := block.Get(V2SignatureID); v2 != nil {
+		if err := p.verifyV2(ra, size, dir, block.Offset, v2, false, sample == nil); err != nil {
+			return fmt.Errorf("v2 signature: %v", err)
+		}
+	}
+	if v3 := block.Get(V3SignatureID); v3 != nil {
+		if err := p.verifyV2(ra, size, dir, block.Offset, v3, true, sample == nil); err != nil {
+			return fmt.Errorf("v3 signature: %v", err)
+		}
+	}
+	return nil
+}
+
+// verifyV1 checks the entry digests of the manifest, of sample only if not
+// nil, and the signature files, passing an apk without both as not v1 signed
+func (p *packer) verifyV1(ra io.ReaderAt, r *zip.Reader, sample map[string]bool) error {
+	var sigFiles []*zip.File
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, MetaInfoPath) && strings.HasSuffix(f.Name, ".SF") &&
+			!strings.Contains(f.Name[len(MetaInfoPath):], "/") {
+			sigFiles = append(sigFiles, f)
+		}
+	}
+	mf := findFile(r, ManifestPath)
+	if mf == nil && len(sigFiles) == 0 {
+		return nil
+	}
+	if mf == nil {
+		return fmt.Errorf("%s not found", ManifestPath)
+	}
+	if len(sigFiles) == 0 {
+		return fmt.Errorf("no signature file")
+	}
+	buf, err := readEntry(mf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ManifestPath, err)
+	}
+	m, err := parseManifest(buf)
+	if err != nil {
+		return err
+	}
+	for _, f := range sigFiles {
+		if err := verifySignatureFile(r, f, buf, m); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+
+	// every entry but the dirs and those in META-INF, as Android checks them
+	sections := make(map[string]*section)
+	for _, s := range m.entries() {
+		sections[s.get("Name")] = s
+	}
+	var files []*zip.File
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") || strings.HasPrefix(f.Name, MetaInfoPath) {
+			continue
+		}
+		if sections[f.Name] == nil {
+			return fmt.Errorf("%s is not in the manifest", f.Name)
+		}
+		if sample == nil || sample[f.Name] {
+			files = append(files, f)
+		}
+	}
+	fetch := p.newFetcher(ra)
+	return p.parallel(len(files), func(i int) error {
+		f := files[i]
+		s := sections[f.Name]
+		var names []string
+		var hashes []hash.Hash
+		var writers []io.Writer
+		for _, a := range s.attrs {
+			if newHash := digestHashes[strings.ToUpper(a.name)]; newHash != nil {
+				h := newHash()
+				names = append(names, a.name)
+				hashes = append(hashes, h)
+				writers = append(writers, h)
+			}
+		}
+		if len(hashes) == 0 {
+			return fmt.Errorf("%s has no digest in the manifest", f.Name)
+		}
+		if err := hashEntry(fetch, f, io.MultiWriter(writers...)); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		for i, h := range hashes {
+			if digest := base64Sum(h); digest != s.get(names[i]) {
+				return fmt.Errorf("%s: %s %s does not match the manifest: %s", f.Name, names[i], digest, s.get(names[i]))
+			}
+		}
+		return nil
+	})
+}
+
+// verifySignatureFile checks the signature of sf, and its digests of the
+// whole manifest mf or of each section of m
+func verifySignatureFile(r *zip.Reader, sf *zip.File, mf []byte, m *manifest) error {
+	content, err := readEntry(sf)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(sf.Name, ".SF")
+	var block *zip.File
+	for _, ext := range []string{".RSA", ".DSA", ".EC"} {
+		if block = findFile(r, base+ext); block != nil {
+			break
+		}
+	}
+	if block == nil {
+		return fmt.Errorf("signature block not found")
+	}
+	sig, err := readEntry(block)
+	if err != nil {
+		return fmt.Errorf("%s: %v", block.Name, err)
+	}
+	if err := verifyPKCS7(sig, content); err != nil {
+		return fmt.Errorf("%s: %v", block.Name, err)
+	}
+
+	s, err := parseManifest(content)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, a := range s.sections[0].attrs {
+		name := strings.ToUpper(a.name)
+		if !strings.HasSuffix(name, "-DIGEST-MANIFEST") {
+			continue
+		}
+		newHash := digestHashes[strings.TrimSuffix(name, "-MANIFEST")]
+		if newHash == nil {
+			continue
+		}
+		h := newHash()
+		h.Write(mf)
+		if base64Sum(h) != a.value {
+			found = false
+			break
+		}
+		found = true
+	}
+	if found {
+		return nil
+	}
+	// the manifest was changed after signing, or the signature file has no
+	// digest of it: its sections must still be those signed
+	for _, e := range m.entries() {
+		name := e.get("Name")
+		signed := s.entry(name)
+		if signed == nil || !signed.hasDigests(e.bytes()) {
+			return fmt.Errorf("digest of the section of %s does not match the manifest", name)
+		}
+	}
+	return nil
+}
+
+// checkSignatureFile checks, with both parsed again, that sf has the digests
+// of mf and of each of its sections, and no other section
+func checkSignatureFile(sf, mf []byte) error {
+	m, err := parseManifest(mf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ManifestPath, err)
+	}
+	s, err := parseManifest(sf)
+	if err != nil {
+		return err
+	}
+	if digest := s.sections[0].get("SHA1-Digest-Manifest"); digest != sha1Sum(mf) {
+		return fmt.Errorf("SHA1-Digest-Manifest %s is not the digest of the manifest: %s", digest, sha1Sum(mf))
+	}
+	if len(s.entries()) != len(m.entries()) {
+		return fmt.Errorf("%d sections for %d in the manifest", len(s.entries()), len(m.entries()))
+	}
+	for _, e := range m.entries() {
+		name := e.get("Name")
+		signed := s.entry(name)
+		if signed == nil {
+			return fmt.Errorf("no section of %s", name)
+		}
+		if !signed.hasDigests(e.bytes()) {
+			return fmt.Errorf("digest of the section of %s does not match the manifest", name)
+		}
+	}
+	return nil
+}
+
+// base64Sum returns the digest of h in base64, as in manifests
+func base64Sum(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// OIDs of the digest algorithms of PKCS#7 signer infos
+var (
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	pkcs7Digests     = []struct {
+		oid  asn1.ObjectIdentifier
+		hash crypto.Hash
+	}{
+		{oidSHA1, crypto.SHA1},
+		{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256},
+		{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384},
+		{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512},
+		{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 4}, crypto.SHA224},
+	}
+)
+
+// pkcs7SignerInfo is signerInfo with the optional fields of other signers
+type pkcs7SignerInfo struct {
+	Version               int
+	IssuerAndSerialNumber struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// verifyPKCS7 checks that every signer of sig, a PKCS#7 SignedData without
+// its content, signed content with its certificate
+func verifyPKCS7(sig, content []byte) error {
+	certs, signers, err := parsePKCS7(sig)
+	if err != nil {
+		return err
+	}
+	for _, si := range signers {
+		cert, err := signerCert(certs, si)
+		if err != nil {
+			return err
+		}
+		digest := crypto.Hash(0)
+		for _, d := range pkcs7Digests {
+			if d.oid.Equal(si.DigestAlgorithm.Algorithm) {
+				digest = d.hash
+			}
+		}
+		if digest == 0 {
+			return fmt.Errorf("unsupported digest algorithm: %v", si.DigestAlgorithm.Algorithm)
+		}
+		algo := signatureAlgorithm(cert.PublicKeyAlgorithm, digest)
+		if algo == x509.UnknownSignatureAlgorithm {
+			return fmt.Errorf("unsupported signature algorithm: %v with %v", cert.PublicKeyAlgorithm, digest)
+		}
+
+		// with authenticated attributes, these are signed instead, with the
+		// digest of content
+		signed := content
+		if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+			h := digest.New()
+			h.Write(content)
+			if err := checkMessageDigest(si.AuthenticatedAttributes.Bytes, h.Sum(nil)); err != nil {
+				return err
+			}
+			signed = append([]byte(nil), si.AuthenticatedAttributes.FullBytes...)
+			signed[0] = 0x31 // SET OF, as the tag is implicit
+		}
+		if err := cert.CheckSignature(algo, signed, si.EncryptedDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePKCS7 returns the certificates and signer infos of sig, a detached
+// PKCS#7 SignedData, tagged [0] or not like signPKCS7's
+func parsePKCS7(sig []byte) ([]*x509.Certificate, []pkcs7SignerInfo, error) {
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(sig, &ci); err != nil {
+		return nil, nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, fmt.Errorf("not a signed data: %v", ci.ContentType)
+	}
+
+	// version, digest algorithms and content info, then the optional
+	// certificates and crls, and the signer infos
+	var sd asn1.RawValue
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, err
+	}
+	var certs []*x509.Certificate
+	var signers []pkcs7SignerInfo
+	rest := sd.Bytes
+	for i := 0; len(rest) > 0; i++ {
+		var v asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &v); err != nil {
+			return nil, nil, err
+		}
+		if i < 3 {
+			continue
+		}
+		switch {
+		case v.Class == asn1.ClassContextSpecific && v.Tag == 0:
+			if certs, err = x509.ParseCertificates(v.Bytes); err != nil {
+				return nil, nil, err
+			}
+		case v.Class == asn1.ClassUniversal && v.Tag == asn1.TagSequence:
+			cert, err := x509.ParseCertificate(v.FullBytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case v.Class == asn1.ClassUniversal && v.Tag == asn1.TagSet:
+			for b := v.Bytes; len(b) > 0; {
+				var si pkcs7SignerInfo
+				if b, err = asn1.Unmarshal(b, &si); err != nil {
+					return nil, nil, fmt.Errorf("signer info: %v", err)
+				}
+				signers = append(signers, si)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, nil, fmt.Errorf("no signer")
+	}
+
+	return certs, signers, nil
+}
+
+// signerCert returns the certificate of si among certs
+func signerCert(certs []*x509.Certificate, si pkcs7SignerInfo) (*x509.Certificate, error) {
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("certificate of signer %v not found", si.IssuerAndSerialNumber.SerialNumber)
+}
+
+// checkMessageDigest checks the message digest in the authenticated
+// attributes of a signer info
+func checkMessageDigest(attrs []byte, digest []byte) error {
+	for len(attrs) > 0 {
+		var a struct {
+			Type   asn1.ObjectIdentifier
+			Values asn1.RawValue `asn1:"set"`
+		}
+		var err error
+		if attrs, err = asn1.Unmarshal(attrs, &a); err != nil {
+			return fmt.Errorf("authenticated attributes: %v", err)
+		}
+		if !a.Type.Equal(oidMessageDigest) {
+			continue
+		}
+		var value []byte
+		if _, err := asn1.Unmarshal(a.Values.Bytes, &value); err != nil {
+			return fmt.Errorf("message digest: %v", err)
+		}
+		if !bytes.Equal(value, digest) {
+			return fmt.Errorf("message digest does not match the signature file")
+		}
+		return nil
+	}
+	return fmt.Errorf("message digest not found")
+}
+
+// signatureAlgorithm returns the x509 algorithm of a key and digest
+func signatureAlgorithm(key x509.PublicKeyAlgorithm, digest crypto.Hash) x509.SignatureAlgorithm {
+	switch key {
+	case x509.RSA:
+		switch digest {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA
+		case crypto.SHA256:
+			return x509.SHA256WithRSA
+		case crypto.SHA384:
+			return x509.SHA384WithRSA
+		case crypto.SHA512:
+			return x509.SHA512WithRSA
+		}
+	case x509.ECDSA:
+		switch digest {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512
+		}
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// v2 signature algorithms, see
+// https://source.android.com/docs/security/features/apksigning/v2
+var v2Algorithms = map[uint32]struct {
+	hash   crypto.Hash // of the signed data and content digest
+	pss    bool
+	ecdsa  bool
+	digest func() hash.Hash
+}{
+	0x0101: {hash: crypto.SHA256, pss: true, digest: sha256.New},
+	0x0102: {hash: crypto.SHA512, pss: true, digest: sha512.New},
+	0x0103: {hash: crypto.SHA256, digest: sha256.New},
+	0x0104: {hash: crypto.SHA512, digest: sha512.New},
+	0x0201: {hash: crypto.SHA256, ecdsa: true, digest: sha256.New},
+	0x0202: {hash: crypto.SHA512, ecdsa: true, digest: sha512.New},
+}
+
+// v2ChunkSize is the size of the chunks of the content digest
+const v2ChunkSize = 1 << 20
+
+// verifyV2 checks the signatures of every v2 signer in value, of the signing
+// block at blockOffset, or v3 signer with v3, and with content its digests
+func (p *packer) verifyV2(ra io.ReaderAt, size int64, dir *Directory, blockOffset int64, value []byte, v3, content bool) error {
+	seq, _, err := readLengthPrefixed(value)
+	if err != nil {
+		return err
+	}
+	signers, err := splitLengthPrefixed(seq)
+	if err != nil {
+		return err
+	}
+	if len(signers) == 0 {
+		return fmt.Errorf("no signer")
+	}
+
+	// the content digests, computed once for all signers
+	digests := make(map[uint32][]byte)
+	var checks []uint32
+	for i, signer := range signers {
+		signedData, rest, err := readLengthPrefixed(signer)
+		if err != nil {
+			return fmt.Errorf("signer %d: %v", i, err)
+		}
+		if v3 {
+			// the min and max sdk versions of the signer
+			if len(rest) < 8 {
+				return fmt.Errorf("signer %d: truncated sdk versions", i)
+			}
+			rest = rest[8:]
+		}
+		sigs, rest, err := readLengthPrefixed(rest)
+		if err != nil {
+			return fmt.Errorf("signer %d: %v", i, err)
+		}
+		publicKey, _, err := readLengthPrefixed(rest)
+		if err != nil {
+			return fmt.Errorf("signer %d: %v", i, err)
+		}
+		signed, err := verifyV2Signer(signedData, sigs, publicKey)
+		if err != nil {
+			return fmt.Errorf("signer %d: %v", i, err)
+		}
+		for algo, digest := range signed {
+			if d, ok := digests[algo]; ok && !bytes.Equal(d, digest) {
+				return fmt.Errorf("signers have different digests of algorithm %#x", algo)
+			}
+			if _, ok := digests[algo]; !ok {
+				checks = append(checks, algo)
+			}
+			digests[algo] = digest
+		}
+	}
+
+	if !content {
+		return nil
+	}
+	newHashes := make([]func() hash.Hash, len(checks))
+	for i, algo := range checks {
+		newHashes[i] = v2Algorithms[algo].digest
+	}
+	computed, err := p.contentDigests(ra, size, dir, blockOffset, newHashes)
+	if err != nil {
+		return err
+	}
+	for i, algo := range checks {
+		if !bytes.Equal(computed[i], digests[algo]) {
+			return fmt.Errorf("content digest of algorithm %#x does not match", algo)
+		}
+	}
+	return nil
+}
+
+// verifyV2Signer checks the signatures of signedData with publicKey, and
+// returns the content digests in it by their signature algorithm
+func verifyV2Signer(signedData, sigs, publicKey []byte) (map[uint32][]byte, error) {
+	key, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %v", err)
+	}
+	records, err := splitLengthPrefixed(sigs)
+	if err != nil {
+		return nil, err
+	}
+	verified := make(map[uint32]bool)
+	for _, record := range records {
+		if len(record) < 4 {
+			return nil, fmt.Errorf("invalid signature record")
+		}
+		id := binary.LittleEndian.Uint32(record)
+		algo, ok := v2Algorithms[id]
+		if !ok {
+			continue
+		}
+		sig, _, err := readLengthPrefixed(record[4:])
+		if err != nil {
+			return nil, err
+		}
+		h := algo.hash.New()
+		h.Write(signedData)
+		hashed := h.Sum(nil)
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if algo.ecdsa {
+				return nil, fmt.Errorf("algorithm %#x with an rsa key", id)
+			}
+			if algo.pss {
+				err = rsa.VerifyPSS(key, algo.hash, hashed, sig, &rsa.PSSOptions{SaltLength: algo.hash.Size()})
+			} else {
+				err = rsa.VerifyPKCS1v15(key, algo.hash, hashed, sig)
+			}
+		case *ecdsa.PublicKey:
+			if !algo.ecdsa {
+				return nil, fmt.Errorf("algorithm %#x with an ecdsa key", id)
+			}
+			if !ecdsa.VerifyASN1(key, hashed, sig) {
+				err = fmt.Errorf("ecdsa verification error")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported public key: %T", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("signature of algorithm %#x: %v", id, err)
+		}
+		verified[id] = true
+	}
+	if len(verified) == 0 {
+		return nil, fmt.Errorf("no signature of a supported algorithm")
+	}
+
+	digestSeq, rest, err := readLengthPrefixed(signedData)
+	if err != nil {
+		return nil, err
+	}
+	certSeq, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := splitLengthPrefixed(certSeq)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, fmt.Errorf("certificate: %v", err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, publicKey) {
+		return nil, fmt.Errorf("public key is not that of the certificate")
+	}
+
+	records, err = splitLengthPrefixed(digestSeq)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[uint32][]byte)
+	for _, record := range records {
+		if len(record) < 4 {
+			return nil, fmt.Errorf("invalid digest record")
+		}
+		id := binary.LittleEndian.Uint32(record)
+		if !verified[id] {
+			continue
+		}
+		digest, _, err := readLengthPrefixed(record[4:])
+		if err != nil {
+			return nil, err
+		}
+		digests[id] = digest
+	}
+	for id := range verified {
+		if digests[id] == nil {
+			return nil, fmt.Errorf("no digest of algorithm %#x", id)
+		}
+	}
+	return digests, nil
+}
+
+// contentDigests returns the v2 content digest of the apk with each hash,
+// over the 1MB chunks of its sections with the signing block at blockOffset
+func (p *packer) contentDigests(ra io.ReaderAt, size int64, dir *Directory, blockOffset int64, newHashes []func() hash.Hash) ([][]byte, error) {
+	endOffset := size - directoryEndLen - int64(len(dir.Comment))
+	if dir.Offset+dir.Size != endOffset {
+		return nil, fmt.Errorf("zip64 apks can't be v2 signed")
+	}
+	end := make([]byte, size-endOffset)
+	if _, err := ra.ReadAt(end, endOffset); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(end[16:], uint32(blockOffset))
+
+	var chunks []digestChunk
+	chunks = append(chunks, splitChunks(ra, 0, blockOffset)...)
+	chunks = append(chunks, splitChunks(ra, dir.Offset, dir.Size)...)
+	chunks = append(chunks, splitChunks(bytes.NewReader(end), 0, int64(len(end)))...)
+	sums, err := p.chunkSums(chunks, newHashes)
+	if err != nil {
+		return nil, err
+	}
+	return joinChunkSums(sums, newHashes), nil
+}
+
+// digestChunk is a chunk of the content digest, of up to v2ChunkSize bytes
+type digestChunk struct {
+	r      io.ReaderAt
+	offset int64
+	size   int64
+}
+
+// splitChunks splits size bytes of r at offset into chunks
+func splitChunks(r io.ReaderAt, offset, size int64) []digestChunk {
+	var chunks []digestChunk
+	for start := offset; start < offset+size; start += v2ChunkSize {
+		n := offset + size - start
+		if n > v2ChunkSize {
+			n = v2ChunkSize
+		}
+		chunks = append(chunks, digestChunk{r, start, n})
+	}
+	return chunks
+}
+
+// chunkSums returns the digests of the chunks by each hash, reading up to
+// DigestJobs chunks at a time
+func (p *packer) chunkSums(chunks []digestChunk, newHashes []func() hash.Hash) ([][][]byte, error) {
+	sums := make([][][]byte, len(newHashes))
+	for i := range sums {
+		sums[i] = make([][]byte, len(chunks))
+	}
+	err := p.parallel(len(chunks), func(i int) error {
+		c := chunks[i]
+		buf := make([]byte, c.size)
+		if _, err := c.r.ReadAt(buf, c.offset); err != nil {
+			return err
+		}
+		prefix := make([]byte, 5)
+		prefix[0] = 0xa5
+		binary.LittleEndian.PutUint32(prefix[1:], uint32(c.size))
+		for j, newHash := range newHashes {
+			h := newHash()
+			h.Write(prefix)
+			h.Write(buf)
+			sums[j][i] = h.Sum(nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// joinChunkSums returns the content digest of each hash, of the digests of
+// all the chunks of the apk
+func joinChunkSums(sums [][][]byte, newHashes []func() hash.Hash) [][]byte {
+	digests := make([][]byte, len(newHashes))
+	for j, newHash := range newHashes {
+		h := newHash()
+		prefix := make([]byte, 5)
+		prefix[0] = 0x5a
+		binary.LittleEndian.PutUint32(prefix[1:], uint32(len(sums[j])))
+		h.Write(prefix)
+		for _, sum := range sums[j] {
+			h.Write(sum)
+		}
+		digests[j] = h.Sum(nil)
+	}
+	return digests
+}
+
+// readLengthPrefixed returns the value of buf prefixed with its uint32
+// length, and the rest of buf
+func readLengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("truncated length prefixed value")
+	}
+	n := binary.LittleEndian.Uint32(buf)
+	if uint64(n) > uint64(len(buf)-4) {
+		return nil, nil, fmt.Errorf("invalid length prefixed value size: %d", n)
+	}
+	return buf[4 : 4+n], buf[4+n:], nil
+}
+
+// splitLengthPrefixed splits buf into values prefixed with their length
+func splitLengthPrefixed(buf []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(buf) > 0 {
+		value, rest, err := readLengthPrefixed(buf)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		buf = rest
+	}
+	return values, nil
+}
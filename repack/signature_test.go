@@ -0,0 +1,176 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// verifyAPK verifies the signatures of apk
+func verifyAPK(t *testing.T, apk []byte) error {
+	ra := bytes.NewReader(apk)
+	dir, err := ReadDirectory(ra, int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(ra, int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packer{Options: DefaultOptions(), ctx: context.Background()}
+	return p.verifySignatures(ra, int64(len(apk)), dir, r, nil)
+}
+
+func TestVerifyV1(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex", "res/a.png", "png")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	signed := objects["bucket/b.apk"]
+	if err := verifyAPK(t, signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// not signed at all
+	if err := verifyAPK(t, zipOf("classes.dex", "dex")); err != nil {
+		t.Errorf("unsigned: %v", err)
+	}
+
+	// the same entries with another classes.dex
+	r, _ := zip.NewReader(bytes.NewReader(signed), int64(len(signed)))
+	var files []string
+	for _, f := range r.File {
+		content, _ := readEntry(f)
+		if f.Name == "classes.dex" {
+			content = []byte("xed")
+		}
+		files = append(files, f.Name, string(content))
+	}
+	if err := verifyAPK(t, zipOf(files...)); err == nil || !strings.Contains(err.Error(), "classes.dex: SHA") {
+		t.Errorf("changed entry: %v", err)
+	}
+}
+
+// lp returns the values prefixed with their length
+func lp(values ...[]byte) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// signV2 returns apk with a v2 signature of RSASSA-PKCS1-v1_5 with SHA2-256
+func signV2(t *testing.T, apk []byte) []byte {
+	d, err := ReadDirectory(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one chunk of each section, as the apk is small
+	top := []byte{0x5a, 3, 0, 0, 0}
+	for _, section := range [][]byte{apk[:d.Offset], apk[d.Offset : d.Offset+d.Size], apk[d.Offset+d.Size:]} {
+		sum := sha256.Sum256(append(binary.LittleEndian.AppendUint32([]byte{0xa5}, uint32(len(section))), section...))
+		top = append(top, sum[:]...)
+	}
+	digest := sha256.Sum256(top)
+
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "repack test"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(priv.Public())
+
+	algo := binary.LittleEndian.AppendUint32(nil, 0x0103)
+	signedData := lp(lp(append(algo, lp(digest[:])...)), lp(cert), nil)
+	hashed := sha256.Sum256(signedData)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := lp(signedData, lp(append(algo, lp(sig)...)), publicKey)
+	return withSigningBlock(t, apk, true, SigningPair{V2SignatureID, lp(lp(signer))})
+}
+
+func TestVerifyV2(t *testing.T) {
+	apk := zipOf("classes.dex", "dex", "res/a.png", "png")
+	signed := signV2(t, apk)
+	if err := verifyAPK(t, signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// a signing block without v2 signature, e.g. a Walle channel only
+	if err := verifyAPK(t, withSigningBlock(t, apk, true, SigningPair{WalleChannelID, []byte("{}")})); err != nil {
+		t.Errorf("without v2: %v", err)
+	}
+
+	// a byte of the entries changed
+	i := bytes.Index(signed, []byte("png"))
+	changed := append([]byte(nil), signed...)
+	changed[i] = 'P'
+	if err := verifyAPK(t, changed); err == nil || !strings.Contains(err.Error(), "content digest") {
+		t.Errorf("changed entry: %v", err)
+	}
+
+	// a garbled signer
+	if err := verifyAPK(t, withSigningBlock(t, apk, true, SigningPair{V2SignatureID, lp(lp([]byte("signer")))})); err == nil ||
+		!strings.HasPrefix(err.Error(), "v2 signature") {
+		t.Errorf("garbled signer: %v", err)
+	}
+}
+
+func TestCheckSignatureFile(t *testing.T) {
+	const section = "Name: a\r\nSHA1-Digest: x\r\n\r\n"
+	const mf = "Manifest-Version: 1.0\r\n\r\n" + section
+	sf := func(manifest string, sections ...string) string {
+		s := "Signature-Version: 1.0\r\nSHA1-Digest-Manifest: " + sha1Sum([]byte(manifest)) + "\r\n\r\n"
+		for _, name := range sections {
+			s += "Name: " + name + "\r\nSHA1-Digest: " + sha1Sum([]byte(section)) + "\r\n\r\n"
+		}
+		return s
+	}
+	tests := []struct {
+		name string
+		sf   string
+		err  string // empty if valid
+	}{
+		{"valid", sf(mf, "a"), ""},
+		{"other manifest", sf(mf+"\r\n", "a"), "SHA1-Digest-Manifest"},
+		{"missing section", sf(mf), "0 sections for 1"},
+		{"other section", sf(mf, "b"), "no section of a"},
+		{"other digest", strings.Replace(sf(mf, "a"), sha1Sum([]byte(section)), sha1Sum([]byte("x")), 1), "digest of the section of a"},
+	}
+	for _, tt := range tests {
+		err := checkSignatureFile([]byte(tt.sf), []byte(mf))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
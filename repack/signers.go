@@ -0,0 +1,228 @@
+package repack
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// Signer is the certificate of a signature of an apk
+type Signer struct {
+	Scheme     string `json:"scheme"`         // v1, v2 or v3
+	File       string `json:"file,omitempty"` // signature block file of v1
+	CertSHA256 string `json:"cert_sha256"`
+	KeySHA256  string `json:"key_sha256"` // of the public key of the cert
+	Subject    string `json:"subject"`
+}
+
+// SignerComparison is the signers of two apks, see CompareSigners
+type SignerComparison struct {
+	Source       string   `json:"source"`
+	Other        string   `json:"other"`
+	Signers      []Signer `json:"signers"` // of Source
+	OtherSigners []Signer `json:"other_signers"`
+	Match        bool     `json:"match"` // both are signed with the same certs
+}
+
+// CompareSigners compares the signing certs of opts.SourceAPK and other with
+// ranged reads, failing with KindVerify unless both are signed with the same
+func CompareSigners(ctx context.Context, opts Options, other string) (SignerComparison, error) {
+	p := &packer{Options: opts}
+	c := SignerComparison{Source: p.SourceAPK, Other: other}
+	var err error
+	if c.Signers, err = p.readSigners(p.SourceAPK); err != nil {
+		return c, errorOf(KindSource, fmt.Errorf("%s: %v", p.SourceAPK, err))
+	}
+	if c.OtherSigners, err = p.readSigners(other); err != nil {
+		return c, errorOf(KindSource, fmt.Errorf("%s: %v", other, err))
+	}
+	certs, otherCerts := signerCerts(c.Signers), signerCerts(c.OtherSigners)
+	for location, certs := range map[string][]string{p.SourceAPK: certs, other: otherCerts} {
+		if len(certs) == 0 {
+			return c, errorOf(KindVerify, fmt.Errorf("%s is not signed", location))
+		}
+	}
+	c.Match = strings.Join(certs, ",") == strings.Join(otherCerts, ",")
+	if !c.Match {
+		// Android compares the certs, so another cert of the same key is
+		// another signer too
+		which := "other certs"
+		if keys(c.Signers) == keys(c.OtherSigners) {
+			which = "other certs of the same keys"
+		}
+		return c, errorOf(KindVerify, fmt.Errorf("signed with %s: %s by %s, %s by %s", which,
+			p.SourceAPK, strings.Join(certs, ", "), other, strings.Join(otherCerts, ", ")))
+	}
+	p.log().Info("same signers", "source", p.SourceAPK, "other", other, "certs", certs)
+	return c, nil
+}
+
+// signerCerts returns the sorted sha256 of the certs of signers, once each
+func signerCerts(signers []Signer) []string {
+	seen := make(map[string]bool)
+	var certs []string
+	for _, s := range signers {
+		if !seen[s.CertSHA256] {
+			seen[s.CertSHA256] = true
+			certs = append(certs, s.CertSHA256)
+		}
+	}
+	sort.Strings(certs)
+	return certs
+}
+
+// keys returns the sorted sha256 of the public keys of signers, once each
+func keys(signers []Signer) string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, s := range signers {
+		if !seen[s.KeySHA256] {
+			seen[s.KeySHA256] = true
+			keys = append(keys, s.KeySHA256)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// readSigners returns the signers of the apk at location, those of v1 then
+// of v2 and v3. An apk without signature has none.
+func (p *packer) readSigners(location string) ([]Signer, error) {
+	r, err := p.openCached(location)
+	if err != nil {
+		return nil, err
+	}
+	size := r.Size()
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+	dir, err := ReadDirectory(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("central directory: %v", err)
+	}
+	signers, err := v1Signers(zipReader)
+	if err != nil {
+		return nil, err
+	}
+	more, err := blockSigners(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(signers, more...), nil
+}
+
+// v1Signers returns the signers of the signature block files of r
+func v1Signers(r *zip.Reader) ([]Signer, error) {
+	var signers []Signer
+	for _, f := range r.File {
+		name := strings.TrimPrefix(f.Name, MetaInfoPath)
+		upper := strings.ToUpper(name)
+		if !strings.HasPrefix(f.Name, MetaInfoPath) || strings.Contains(name, "/") || !isSignatureFile(upper) || strings.HasSuffix(upper, ".SF") {
+			continue
+		}
+		buf, err := readEntry(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		certs, infos, err := parsePKCS7(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		for _, si := range infos {
+			cert, err := signerCert(certs, si)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name, err)
+			}
+			signers = append(signers, newSigner(SchemeV1, f.Name, cert))
+		}
+	}
+	return signers, nil
+}
+
+// blockSigners returns the v2 and v3 signers of the signing block of the
+// apk in ra, none if it has no block
+func blockSigners(ra io.ReaderAt, dir *Directory) ([]Signer, error) {
+	block, err := ReadSigningBlock(ra, dir.Offset)
+	if err == errNoSigningBlock {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("apk signing block: %v", err)
+	}
+	var signers []Signer
+	for _, scheme := range []struct {
+		id   uint32
+		name string
+	}{{V2SignatureID, SchemeV2}, {V3SignatureID, SchemeV3}} {
+		value := block.Get(scheme.id)
+		if value == nil {
+			continue
+		}
+		certs, err := schemeCerts(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s signature: %v", scheme.name, err)
+		}
+		for _, cert := range certs {
+			signers = append(signers, newSigner(scheme.name, "", cert))
+		}
+	}
+	return signers, nil
+}
+
+// schemeCerts returns the first certificate of each signer of value, the
+// v2 or v3 signers of the signing block, that of its key
+func schemeCerts(value []byte) ([]*x509.Certificate, error) {
+	seq, _, err := readLengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := splitLengthPrefixed(seq)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for i, signer := range signers {
+		signedData, _, err := readLengthPrefixed(signer)
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %v", i, err)
+		}
+		// the digests, then the certificates
+		_, rest, err := readLengthPrefixed(signedData)
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %v", i, err)
+		}
+		seq, _, err := readLengthPrefixed(rest)
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %v", i, err)
+		}
+		encoded, err := splitLengthPrefixed(seq)
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %v", i, err)
+		}
+		if len(encoded) == 0 {
+			return nil, fmt.Errorf("signer %d: no certificate", i)
+		}
+		cert, err := x509.ParseCertificate(encoded[0])
+		if err != nil {
+			return nil, fmt.Errorf("signer %d: %v", i, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// newSigner returns the signer of scheme with cert, of the signature
+// block file of v1
+func newSigner(scheme, file string, cert *x509.Certificate) Signer {
+	sum := sha256.Sum256(cert.Raw)
+	key := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return Signer{Scheme: scheme, File: file, CertSHA256: hex.EncodeToString(sum[:]), KeySHA256: hex.EncodeToString(key[:]), Subject: cert.Subject.String()}
+}
@@ -0,0 +1,51 @@
+package repack
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCompareSigners(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.CPIDContent = "bucket/a.apk", "c1"
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	key, cert := writeKeyPair(t, t.TempDir())
+	otherKey, otherCert := writeKeyPair(t, t.TempDir())
+	for _, dest := range []struct {
+		name, key, cert, schemes string
+	}{{"v1.apk", key, cert, "v1"}, {"v2.apk", key, cert, "v1,v2"}, {"other.apk", otherKey, otherCert, "v1"}} {
+		o := opts
+		o.DestAPK, o.PrivateKeyPEM, o.CertPEM, o.Schemes = "bucket/"+dest.name, dest.key, dest.cert, dest.schemes
+		if _, err := Repack(context.Background(), o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		source, other string
+		signers       int // of source
+		err           string
+	}{
+		{"v1.apk", "v2.apk", 1, ""},
+		{"v2.apk", "v1.apk", 2, ""},
+		{"v1.apk", "other.apk", 1, "signed with other certs"},
+		{"a.apk", "v1.apk", 0, "bucket/a.apk is not signed"},
+	}
+	for _, tt := range tests {
+		opts.SourceAPK = "bucket/" + tt.source
+		c, err := CompareSigners(context.Background(), opts, "bucket/"+tt.other)
+		if tt.err == "" && (err != nil || !c.Match) || tt.err != "" && (err == nil || KindOf(err) != KindVerify || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s %s: %v, want %q", tt.source, tt.other, err, tt.err)
+		}
+		if len(c.Signers) != tt.signers {
+			t.Errorf("%s: signers %+v", tt.source, c.Signers)
+		}
+	}
+}
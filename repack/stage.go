@@ -0,0 +1,62 @@
+package repack
+
+import (
+	"fmt"
+	"time"
+)
+
+// prefixStage is an object of the ranges of the source kept in every dest
+// apk of a fan-out, copied once so that they copy a single range of it
+type prefixStage struct {
+	location string
+	segments []Segment // of the source
+	size     int64
+}
+
+// newStage copies the segments of first, the writer of the first dest, to an
+// object next to dest, or returns nil if they are a single range of the source
+func (p *packer) newStage(dest string, first *Writer) (*prefixStage, error) {
+	segments := first.segments
+	if len(segments) < 2 {
+		p.log().Info("prefix is a single range of the source, not staged", "phase", PhaseStage)
+		return nil, nil
+	}
+	s := &prefixStage{location: dest + ".stage-" + newTempID(), segments: segments}
+	for _, seg := range segments {
+		s.size += seg.Size
+	}
+
+	start := time.Now()
+	w, err := NewWriter(p.copyConfig(), s.location, p.SourceAPK, segments)
+	if err != nil {
+		return nil, err
+	}
+	w.Log = p.log()
+	w.Context = p.jobContext()
+	w.memory = p.memory
+	w.srcLocal = first.srcLocal
+	w.SrcETag = first.SrcETag
+	if err := w.Flush(); err != nil {
+		p.removeTemp(s.location)
+		return nil, err
+	}
+	p.log().Info("prefix staged", "phase", PhaseStage, "stage", s.location, "ranges", len(segments), "bytes", s.size, "duration", time.Since(start))
+	return s, nil
+}
+
+// use makes w copy its prefix from the stage, if it is made of the same
+// ranges of the source
+func (s *prefixStage) use(p *packer, w *Writer) (bool, error) {
+	if len(w.segments) != len(s.segments) {
+		return false, nil
+	}
+	for i, seg := range w.segments {
+		if seg != s.segments[i] {
+			return false, nil
+		}
+	}
+	if err := w.copyFrom(p.ossConfig(), s.location); err != nil {
+		return false, fmt.Errorf("copy from stage: %v", err)
+	}
+	return true, nil
+}
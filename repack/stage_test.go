@@ -0,0 +1,53 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPrefixStage(t *testing.T) {
+	source := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	objects := map[string][]byte{"bucket/a.apk": source}
+	server := newOSSServer(objects)
+	defer server.Close()
+	p := &packer{Options: DefaultOptions(), ctx: context.Background()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.SourceAPK = "bucket/a.apk"
+	p.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	if s, err := p.newStage("bucket/b.apk", &Writer{segments: []Segment{{0, 20}}}); s != nil || err != nil {
+		t.Errorf("single range staged: %v", err)
+	}
+
+	segments := []Segment{{0, 10}, {20, 10}}
+	s, err := p.newStage("bucket/b.apk", &Writer{segments: segments})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s.location, "bucket/b.apk.stage-") || !bytes.Equal(objects[s.location], []byte("0123456789klmnopqrst")) {
+		t.Errorf("stage %s: %q", s.location, objects[s.location])
+	}
+
+	newWriter := func(segments []Segment) *Writer {
+		w, err := NewWriter(p.ossConfig(), "bucket/c.apk", p.SourceAPK, segments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	w := newWriter([]Segment{{0, 10}, {20, 11}})
+	if ok, err := s.use(p, w); ok || err != nil || w.SrcObject != "a.apk" {
+		t.Errorf("other ranges: used %v, %v", ok, err)
+	}
+	w = newWriter(segments)
+	if ok, err := s.use(p, w); !ok || err != nil {
+		t.Fatalf("same ranges: used %v, %v", ok, err)
+	}
+	if w.SrcBucket+"/"+w.SrcObject != s.location || len(w.segments) != 1 || w.segments[0] != (Segment{0, 20}) {
+		t.Errorf("copied from %s/%s %v", w.SrcBucket, w.SrcObject, w.segments)
+	}
+}
@@ -0,0 +1,162 @@
+package repack
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats are the counters of the OSS requests of all repacks in the process
+type Stats struct {
+	Requests      map[string]int64 // by operation, including retries
+	Errors        map[string]int64 // by operation
+	Retries       map[string]int64 // by operation
+	RetryWait     map[string]int64 // milliseconds slept before the retries, by operation
+	BytesCopied   int64            // copied on the OSS side by UploadPartCopy
+	BytesUploaded int64            // uploaded by UploadPart and PutObject
+	BytesRead     int64            // downloaded by the ranged reads of the apks
+}
+
+var stats struct {
+	sync.Mutex
+	requests map[string]int64
+	errors   map[string]int64
+	retries  map[string]int64
+	wait     map[string]int64
+	copied   int64
+	uploaded int64
+	read     int64
+}
+
+func countOp(m *map[string]int64, op string) {
+	stats.Lock()
+	defer stats.Unlock()
+	if *m == nil {
+		*m = make(map[string]int64)
+	}
+	(*m)[op]++
+}
+
+func countRequest(op string) { countOp(&stats.requests, op) }
+func countError(op string)   { countOp(&stats.errors, op) }
+
+// countRetry counts a retry of op after delay
+func countRetry(op string, delay time.Duration) {
+	countOp(&stats.retries, op)
+	stats.Lock()
+	defer stats.Unlock()
+	if stats.wait == nil {
+		stats.wait = make(map[string]int64)
+	}
+	stats.wait[op] += delay.Milliseconds()
+}
+
+func countBytes(counter *int64, n int64) {
+	stats.Lock()
+	*counter += n
+	stats.Unlock()
+}
+
+// ReadStats returns a copy of the counters
+func ReadStats() Stats {
+	stats.Lock()
+	defer stats.Unlock()
+	s := Stats{
+		Requests:      make(map[string]int64),
+		Errors:        make(map[string]int64),
+		Retries:       make(map[string]int64),
+		RetryWait:     make(map[string]int64),
+		BytesCopied:   stats.copied,
+		BytesUploaded: stats.uploaded,
+		BytesRead:     stats.read,
+	}
+	for op, n := range stats.requests {
+		s.Requests[op] = n
+	}
+	for op, n := range stats.errors {
+		s.Errors[op] = n
+	}
+	for op, n := range stats.retries {
+		s.Retries[op] = n
+	}
+	for op, n := range stats.wait {
+		s.RetryWait[op] = n
+	}
+	return s
+}
+
+// usage are the counters of the OSS requests of a job, see Result
+type usage struct {
+	phase    string           // current phase of the job
+	requests map[string]int64 // by operation
+	phases   map[string]int64 // requests by phase
+	read     int64
+	copied   int64
+	uploaded int64
+}
+
+// addRequest counts a request of op in the result of the job
+func (p *packer) addRequest(op string) {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	u := &p.usage
+	if u.requests == nil {
+		u.requests = make(map[string]int64)
+		u.phases = make(map[string]int64)
+	}
+	u.requests[op]++
+	phase := u.phase
+	if phase == "" {
+		phase = PhaseOpen
+	}
+	u.phases[phase]++
+}
+
+// addBytes counts the n bytes transferred by a request of op in the result
+// of the job
+func (p *packer) addBytes(op string, n int64) {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	switch op {
+	case "GetObject":
+		p.usage.read += n
+	case "UploadPartCopy":
+		p.usage.copied += n
+	default:
+		p.usage.uploaded += n
+	}
+}
+
+// addUsage adds the counters of the OSS requests of the job to result
+func (p *packer) addUsage(result *Result) {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	u := &p.usage
+	if len(u.requests) > 0 {
+		result.Requests = make(map[string]int64)
+		result.PhaseRequests = make(map[string]int64)
+		for op, n := range u.requests {
+			result.Requests[op] = n
+		}
+		for phase, n := range u.phases {
+			result.PhaseRequests[phase] = n
+		}
+	}
+	result.BytesRead, result.BytesCopied, result.BytesUploaded = u.read, u.copied, u.uploaded
+}
+
+// addUsage adds the counters of the OSS requests of other to r
+func (r *Result) addUsage(other Result) {
+	if r.Requests == nil {
+		r.Requests = make(map[string]int64)
+		r.PhaseRequests = make(map[string]int64)
+	}
+	for op, n := range other.Requests {
+		r.Requests[op] += n
+	}
+	for phase, n := range other.PhaseRequests {
+		r.PhaseRequests[phase] += n
+	}
+	r.BytesRead += other.BytesRead
+	r.BytesCopied += other.BytesCopied
+	r.BytesUploaded += other.BytesUploaded
+}
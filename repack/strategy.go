@@ -0,0 +1,114 @@
+package repack
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// strategies of -copy-strategy, how the ranges of the source kept in a dest
+// apk are copied to it
+const (
+	CopyAuto   = "auto"   // choose from the size kept and the number of dests, the default
+	CopyParts  = "parts"  // server side copy of parts of CopyPartSizeInBytes, in parallel
+	CopySingle = "single" // server side copy of each range as a single part, up to MaxPartSizeInBytes
+	CopyLocal  = "local"  // read the ranges and upload them from this process
+)
+
+// thresholds of CopyAuto
+const (
+	// LocalCopyMaxBytes is the most bytes kept that are read and put in one
+	// request rather than copied in a multipart upload
+	LocalCopyMaxBytes = 4 * 1024 * 1024
+	// SingleCopyMinOutputs is the number of dests of a source from which
+	// the fewest requests per dest matter more than the latency of each
+	SingleCopyMinOutputs = 10
+)
+
+// checkCopyStrategy checks the strategy of -copy-strategy
+func checkCopyStrategy(strategy string) error {
+	switch strategy {
+	case "", CopyAuto, CopyParts, CopySingle, CopyLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown %q, expect auto, parts, single or local", strategy)
+}
+
+// chooseCopyStrategy sets the FlushStrategy of w, with CopyAuto local if small,
+// else single parts for many dests to save requests and parallel parts
+func (p *packer) chooseCopyStrategy(w *Writer) {
+	outputs := p.outputs
+	if outputs < 1 {
+		outputs = 1
+	}
+	strategy, reason := p.CopyStrategy, "-copy-strategy"
+	if strategy == "" || strategy == CopyAuto {
+		switch {
+		case w.offset <= LocalCopyMaxBytes && w.Callback == nil:
+			strategy, reason = CopyLocal, "small prefix, put in one request"
+		case outputs >= SingleCopyMinOutputs:
+			strategy, reason = CopySingle, "many dests, fewest requests per dest"
+		default:
+			strategy, reason = CopyParts, "few dests, parallel parts"
+		}
+	}
+	w.Strategy = w.flushStrategy(strategy)
+	p.log().Info("copy strategy", "phase", PhaseUpload, "strategy", strategy, "reason", reason,
+		"bytes", w.offset, "ranges", len(w.segments), "dests", outputs,
+		slog.Group("requests", CopyParts, w.requests(CopyParts), CopySingle, w.requests(CopySingle), CopyLocal, w.requests(CopyLocal)))
+}
+
+// flushStrategy returns the FlushStrategy writing the dest of w with
+// strategy
+func (w *Writer) flushStrategy(strategy string) FlushStrategy {
+	switch {
+	case w.putsOnce(strategy):
+		return LocalPut{}
+	case strategy == CopyLocal:
+		return StreamedUpload{}
+	}
+	return MultipartCopy{PartSize: w.partSize(strategy)}
+}
+
+// requests estimates the OSS requests w takes to write the dest with
+// strategy, counting a request for the data written after the ranges
+func (w *Writer) requests(strategy string) int {
+	if w.putsOnce(strategy) {
+		return w.reads(w.segments) + 1
+	}
+	planned, leftover := w.planParts(w.partSize(strategy))
+	n := 3 + w.reads(leftover) // initiate, last part and complete
+	for _, part := range planned {
+		if len(part) == 1 && strategy != CopyLocal {
+			n++
+		} else {
+			n += w.reads(part) + 1
+		}
+	}
+	return n
+}
+
+// reads returns the requests reading segments of the source take, none
+// from its copy on disk
+func (w *Writer) reads(segments []Segment) int {
+	if w.srcLocal != nil {
+		return 0
+	}
+	return len(segments)
+}
+
+// putsOnce reports whether w writes the dest with a single PutObject with
+// strategy, rather than a multipart upload
+func (w *Writer) putsOnce(strategy string) bool {
+	if w.Callback != nil {
+		return false
+	}
+	return w.offset < MinPartSizeInBytes || strategy == CopyLocal && w.offset <= LocalCopyMaxBytes
+}
+
+// partSize returns the size of the parts copied with strategy
+func (w *Writer) partSize(strategy string) int64 {
+	if strategy == CopySingle {
+		return MaxPartSizeInBytes
+	}
+	return CopyPartSizeInBytes
+}
@@ -0,0 +1,53 @@
+package repack
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"testing"
+)
+
+func TestChooseCopyStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		size     int64
+		outputs  int
+		callback bool
+		want     FlushStrategy
+	}{
+		{"small", "", 1 << 20, 100, false, LocalPut{}},
+		{"small with callback", CopyAuto, 1 << 20, 1, true, MultipartCopy{PartSize: CopyPartSizeInBytes}},
+		{"many dests", "", 1 << 30, SingleCopyMinOutputs, false, MultipartCopy{PartSize: MaxPartSizeInBytes}},
+		{"few dests", "", 1 << 30, 1, false, MultipartCopy{PartSize: CopyPartSizeInBytes}},
+		{"explicit", CopyLocal, 1 << 30, 100, false, StreamedUpload{}},
+	}
+	for _, tt := range tests {
+		p := &packer{Options: Options{CopyStrategy: tt.strategy, Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}, outputs: tt.outputs}
+		w := &Writer{segments: []Segment{{0, tt.size}}, offset: tt.size}
+		if tt.callback {
+			w.Callback = &Callback{}
+		}
+		p.chooseCopyStrategy(w)
+		if w.Strategy != tt.want {
+			t.Errorf("%s: %#v, want %#v", tt.name, w.Strategy, tt.want)
+		}
+	}
+
+	// a 1GB prefix in one range takes a part copy per part
+	w := &Writer{segments: []Segment{{0, 1 << 30}}, offset: 1 << 30}
+	parts, single := w.requests(CopyParts), w.requests(CopySingle)
+	if single >= parts || single != 4 {
+		t.Errorf("%d requests with parts, %d with single", parts, single)
+	}
+	if n := (&Writer{segments: []Segment{{0, 1 << 20}}, offset: 1 << 20}).requests(CopyLocal); n != 2 {
+		t.Errorf("%d requests of a small prefix", n)
+	}
+	for _, s := range []string{"", CopyAuto, CopyParts, CopySingle, CopyLocal} {
+		if err := checkCopyStrategy(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	if err := checkCopyStrategy("fast"); err == nil {
+		t.Error("fast: no error")
+	}
+}
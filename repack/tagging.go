@@ -0,0 +1,138 @@
+package repack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tag is a tag of an OSS object
+type Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// limits of the tags of an object
+const (
+	maxTags     = 10
+	maxTagKey   = 128
+	maxTagValue = 256
+)
+
+// DeleteAfterTag is the tag of the time after which clean deletes a dest
+// of DeleteAfter, in RFC 3339
+const DeleteAfterTag = "delete-after"
+
+// tagValue replaces the characters OSS doesn't allow in a tag with _, and
+// truncates it to maxTagValue
+func tagValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/", r):
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > maxTagValue {
+		s = s[:maxTagValue]
+	}
+	return s
+}
+
+// tagging is the body of PutObjectTagging and GetObjectTagging
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []Tag    `xml:"TagSet>Tag"`
+}
+
+// taggingXML returns the body of a PutObjectTagging request
+func taggingXML(tags []Tag) ([]byte, error) {
+	return xml.Marshal(tagging{Tags: tags})
+}
+
+// parseTags parses tags like env=test,team=games
+func parseTags(s string) ([]Tag, error) {
+	var tags []Tag
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expect key=value: %s", pair)
+		}
+		tag := Tag{Key: pair[:i], Value: pair[i+1:]}
+		if len(tag.Key) > maxTagKey || tagValue(tag.Key) != tag.Key || tagValue(tag.Value) != tag.Value {
+			return nil, fmt.Errorf("invalid tag %s: expect letters, digits, spaces and +-=._:/", pair)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// checkTags checks Tags and DeleteAfter, and that the tags of a dest are
+// within maxTags
+func (p *packer) checkTags(add func(format string, args ...interface{})) {
+	tags, err := parseTags(p.Tags)
+	if err != nil {
+		add("-tags: %v", err)
+	}
+	n := len(tags)
+	if p.Tagging {
+		n += 4
+	}
+	if p.DeleteAfter < 0 {
+		add("-delete-after must not be negative: %v", p.DeleteAfter)
+	} else if p.DeleteAfter > 0 {
+		n++
+	}
+	if n > maxTags {
+		add("%d tags of each dest with -tag, -tags and -delete-after, OSS allows %d", n, maxTags)
+	}
+}
+
+// tagsOfDest returns the tags of the dest apk: its channel, source version,
+// cert and job id with Tagging, then Tags, and DeleteAfterTag with DeleteAfter
+func (p *packer) tagsOfDest(channel string, result Result) []Tag {
+	var tags []Tag
+	if p.Tagging {
+		for _, tag := range []Tag{
+			{"channel", channel},
+			{"source-version", result.SourceVersion},
+			{"cert-sha256", p.certSHA256},
+			{"job-id", p.JobID},
+		} {
+			if tag.Value != "" {
+				tags = append(tags, Tag{tag.Key, tagValue(tag.Value)})
+			}
+		}
+	}
+	extra, _ := parseTags(p.Tags) // checked by checkTags
+	tags = append(tags, extra...)
+	if p.DeleteAfter > 0 {
+		deleteAfter := time.Now().Add(p.DeleteAfter).UTC().Format(time.RFC3339)
+		tags = append(tags, Tag{DeleteAfterTag, deleteAfter})
+	}
+	return tags
+}
+
+// tagDest tags the dest apk with tagsOfDest, so lifecycle rules and
+// inventories can group the apks of a channel, and expire them
+func (p *packer) tagDest(channel string, result Result) error {
+	tags := p.tagsOfDest(channel, result)
+	if len(tags) == 0 {
+		return nil
+	}
+	r, err := NewReader(p.ossConfig(), result.Dest)
+	if err != nil {
+		return err
+	}
+	if err := r.Client.PutObjectTagging(r.Object, tags); err != nil {
+		return fmt.Errorf("tag %s: %v", result.Dest, err)
+	}
+	p.log().Info("tagged dest", "dest", result.Dest, "tags", len(tags))
+	return nil
+}
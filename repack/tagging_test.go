@@ -0,0 +1,96 @@
+package repack
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagValue(t *testing.T) {
+	for s, want := range map[string]string{
+		"huawei":                 "huawei",
+		"a/b c+d=e.f_g:h-i":      "a/b c+d=e.f_g:h-i",
+		"华为":                     "__",
+		"\"etag\"":               "_etag_",
+		strings.Repeat("a", 300): strings.Repeat("a", maxTagValue),
+	} {
+		if got := tagValue(s); got != want {
+			t.Errorf("%q: %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestTagDest(t *testing.T) {
+	var path, query string
+	var tagging struct {
+		Tags []Tag `xml:"TagSet>Tag"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.RawQuery
+		body, _ := ioutil.ReadAll(r.Body)
+		xml.Unmarshal(body, &tagging)
+	}))
+	defer server.Close()
+
+	p := &packer{Options: DefaultOptions()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+	p.Tagging, p.JobID = true, "job 1"
+	if err := p.tagDest("huawei", Result{Dest: "bucket/qq-huawei.apk", SourceVersion: "CAEQ"}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bucket/qq-huawei.apk" || query != "tagging" {
+		t.Errorf("request %s?%s", path, query)
+	}
+	// the empty cert is not a tag
+	want := []Tag{{"channel", "huawei"}, {"source-version", "CAEQ"}, {"job-id", "job 1"}}
+	if len(tagging.Tags) != len(want) {
+		t.Fatalf("tags %v", tagging.Tags)
+	}
+	for i, tag := range want {
+		if tagging.Tags[i] != tag {
+			t.Errorf("tag %d: %v, want %v", i, tagging.Tags[i], tag)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" env=test, team=games:a ,")
+	if err != nil || len(tags) != 2 || tags[0] != (Tag{"env", "test"}) || tags[1] != (Tag{"team", "games:a"}) {
+		t.Errorf("tags %v: %v", tags, err)
+	}
+	for _, s := range []string{"env", "=test", "env=t?st", strings.Repeat("k", maxTagKey+1) + "=v"} {
+		if _, err := parseTags(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func TestTagsOfDest(t *testing.T) {
+	p := &packer{Options: DefaultOptions()}
+	if tags := p.tagsOfDest("huawei", Result{}); len(tags) != 0 {
+		t.Errorf("no tags by default: %v", tags)
+	}
+	p.Tags, p.DeleteAfter = "env=test", 72*time.Hour
+	tags := p.tagsOfDest("huawei", Result{})
+	if len(tags) != 2 || tags[0] != (Tag{"env", "test"}) || tags[1].Key != DeleteAfterTag {
+		t.Fatalf("tags %v", tags)
+	}
+	if d, err := time.Parse(time.RFC3339, tags[1].Value); err != nil || time.Until(d) < 71*time.Hour {
+		t.Errorf("delete after %s: %v", tags[1].Value, err)
+	}
+
+	var problems []string
+	add := func(format string, args ...interface{}) { problems = append(problems, fmt.Sprintf(format, args...)) }
+	p.Tagging, p.Tags = true, "a=1,b=2,c=3,d=4,e=5,f=6"
+	p.checkTags(add)
+	p.DeleteAfter, p.Tags = -time.Hour, "a"
+	p.checkTags(add)
+	if len(problems) != 3 {
+		t.Errorf("problems %q", problems)
+	}
+}
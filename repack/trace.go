@@ -0,0 +1,152 @@
+package repack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Tracer starts a span under the span in ctx, returning the context of the
+// new span and a func to end it, e.g. an adapted OpenTelemetry tracer
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, func(error))
+}
+
+// SpanContext is the W3C trace context of a span
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// ParseTraceparent parses a W3C traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(s string) (SpanContext, error) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return c, fmt.Errorf("invalid traceparent: %s", s)
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return c, fmt.Errorf("invalid traceparent: %s", s)
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return c, fmt.Errorf("invalid traceparent: %s", s)
+	}
+	return c, nil
+}
+
+// Traceparent returns the W3C traceparent header of c
+func (c SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", c.TraceID, c.SpanID)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns ctx with the span c, the parent of the spans
+// started with ctx
+func ContextWithSpan(ctx context.Context, c SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, c)
+}
+
+// SpanFromContext returns the span in ctx
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	c, ok := ctx.Value(spanKey{}).(SpanContext)
+	return c, ok
+}
+
+// LogTracer logs each span as it ends, with the W3C trace and span ids
+type LogTracer struct {
+	Logger *slog.Logger // slog.Default() if nil
+}
+
+// Start implements Tracer
+func (t LogTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, func(error)) {
+	parent, ok := SpanFromContext(ctx)
+	span := parent
+	if !ok {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+
+	logger := t.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	start := time.Now()
+	return ContextWithSpan(ctx, span), func(err error) {
+		args := []any{
+			"span", name,
+			"trace_id", hex.EncodeToString(span.TraceID[:]),
+			"span_id", hex.EncodeToString(span.SpanID[:]),
+			"duration", time.Since(start),
+		}
+		if ok {
+			args = append(args, "parent_id", hex.EncodeToString(parent.SpanID[:]))
+		}
+		for _, a := range attrs {
+			args = append(args, a)
+		}
+		if err != nil {
+			args = append(args, "error", err)
+		}
+		logger.Info("span", args...)
+	}
+}
+
+// startJob starts the span of a dest apk under ctx. The returned func ends
+// it with the span of the current phase.
+func (p *packer) startJob(ctx context.Context, attrs ...slog.Attr) func(error) {
+	p.ctx = ctx
+	if p.Tracer == nil {
+		return func(error) {}
+	}
+	var end func(error)
+	p.ctx, end = p.Tracer.Start(ctx, "repack", attrs...)
+	return func(err error) {
+		p.endPhase(err)
+		end(err)
+	}
+}
+
+// startPhase ends the span of the current phase and starts the next one,
+// or none if done
+func (p *packer) startPhase(phase, dest string) {
+	if p.Tracer == nil {
+		return
+	}
+	p.endPhase(nil)
+	if phase != PhaseDone {
+		p.phaseCtx, p.phaseEnd = p.Tracer.Start(p.jobContext(), "repack."+phase, slog.String("dest", dest))
+	}
+}
+
+func (p *packer) endPhase(err error) {
+	if p.phaseEnd != nil {
+		p.phaseEnd(err)
+		p.phaseCtx, p.phaseEnd = nil, nil
+	}
+}
+
+func (p *packer) jobContext() context.Context {
+	if p.ctx != nil {
+		return p.ctx
+	}
+	return context.Background()
+}
+
+// trace starts a span under the current phase, and returns the func to end it
+func (p *packer) trace(name string, attrs ...slog.Attr) func(error) {
+	if p.Tracer == nil {
+		return func(error) {}
+	}
+	ctx := p.phaseCtx
+	if ctx == nil {
+		ctx = p.jobContext()
+	}
+	_, end := p.Tracer.Start(ctx, name, attrs...)
+	return end
+}
@@ -0,0 +1,48 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const h = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, err := ParseTraceparent(h)
+	if err != nil || c.Traceparent() != h {
+		t.Errorf("%s: %v %v", h, c.Traceparent(), err)
+	}
+	for _, bad := range []string{"", "00-4bf92f35-00f067aa0ba902b7-01", "00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	var logs bytes.Buffer
+	p := &packer{Options: DefaultOptions()}
+	p.Tracer = LogTracer{Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	end := p.startJob(ContextWithSpan(context.Background(), parent))
+	p.progress(PhaseBuild, "bucket/dest.apk")
+	p.trace("oss.PutObject")(nil)
+	p.progress(PhaseDone, "bucket/dest.apk")
+	end(nil)
+
+	spans := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(spans) != 3 {
+		t.Fatalf("spans:\n%s", logs.String())
+	}
+	for i, name := range []string{"oss.PutObject", "repack.build", "repack"} {
+		if !strings.Contains(spans[i], "span="+name+" ") || !strings.Contains(spans[i], "trace_id=4bf92f3577b34da6a3ce929d0e0e4736") {
+			t.Errorf("span %d: %s, want %s", i, spans[i], name)
+		}
+	}
+	if !strings.Contains(spans[2], "parent_id=00f067aa0ba902b7") {
+		t.Errorf("job span not under the parent: %s", spans[2])
+	}
+}
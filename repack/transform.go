@@ -0,0 +1,103 @@
+package repack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// Entry is an entry appended to a dest apk, see EntryTransformer
+type Entry struct {
+	Header  *zip.FileHeader
+	Content []byte // uncompressed
+
+	unlisted bool // not in MANIFEST.MF, such as a cpid file in META-INF
+}
+
+// EntryTransformer changes an entry appended to a dest apk signed again before
+// it is signed, its content and header but not its name
+type EntryTransformer interface {
+	TransformEntry(e *Entry) error
+}
+
+// EntryTransformerFunc is a func as an EntryTransformer
+type EntryTransformerFunc func(e *Entry) error
+
+// TransformEntry calls f(e)
+func (f EntryTransformerFunc) TransformEntry(e *Entry) error {
+	return f(e)
+}
+
+// newEntries returns the cpid files, AndroidManifest.xml and extra files
+// appended to the dest apk built from r, changed by EntryTransformers
+func (p *packer) newEntries(r *zip.Reader) ([]*Entry, error) {
+	var entries []*Entry
+	for _, path := range p.cpidPaths() {
+		header := &zip.FileHeader{
+			Name:   path,
+			Method: p.entryMethod(path),
+		}
+		header.SetModTime(p.modTime())
+		// entries in META-INF are not listed in the manifest
+		entries = append(entries, &Entry{Header: header, Content: []byte(p.CPIDContent), unlisted: strings.HasPrefix(path, MetaInfoPath)})
+	}
+
+	if p.MetaDataName != "" {
+		e, err := p.androidManifestEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	for _, f := range p.ExtraFiles {
+		header := &zip.FileHeader{
+			Name:   f.Path,
+			Method: p.entryMethod(f.Path),
+		}
+		header.SetModTime(p.modTime())
+		old := findFile(r, f.Path)
+		if f.Replace && old == nil {
+			return nil, fmt.Errorf("entry to replace not found: %s", f.Path)
+		}
+		// keep stored entries stored and the attributes of the replaced entry
+		if f.Replace {
+			inheritHeader(header, old)
+			header.Method = p.replaceMethod(f.Path, old)
+		}
+		entries = append(entries, &Entry{Header: header, Content: f.Content})
+	}
+
+	for _, e := range entries {
+		name := e.Header.Name
+		for i, t := range p.EntryTransformers {
+			if err := t.TransformEntry(e); err != nil {
+				return nil, fmt.Errorf("entry transformer %d: %s: %v", i, name, err)
+			}
+			if e.Header.Name != name {
+				return nil, fmt.Errorf("entry transformer %d: %s renamed to %s", i, name, e.Header.Name)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// androidManifestEntry returns the AndroidManifest.xml of the apk in r with
+// the meta-data of MetaDataName, with the header of the source entry
+func (p *packer) androidManifestEntry(r *zip.Reader) (*Entry, error) {
+	content, err := p.changeAndroidManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	old := findFile(r, AndroidManifestPath)
+	if old == nil {
+		return nil, fmt.Errorf("%s not found", AndroidManifestPath)
+	}
+	header := &zip.FileHeader{
+		Name:   AndroidManifestPath,
+		Method: p.replaceMethod(AndroidManifestPath, old),
+	}
+	inheritHeader(header, old)
+	return &Entry{Header: header, Content: content}, nil
+}
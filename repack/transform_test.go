@@ -0,0 +1,94 @@
+package repack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestNewEntriesTransformers(t *testing.T) {
+	src := zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")
+	r, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packer{Options: DefaultOptions()}
+	p.CPIDContent = "c1"
+	p.ExtraFiles = ExtraFiles{{Path: "assets/channel.json", Content: []byte("{}")}}
+	p.EntryTransformers = []EntryTransformer{
+		EntryTransformerFunc(func(e *Entry) error {
+			if e.Header.Name == "assets/channel.json" {
+				e.Content, e.Header.Method = []byte(`{"build":1}`), zip.Store
+			}
+			return nil
+		}),
+	}
+	entries, err := p.newEntries(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := entries[len(entries)-1]
+	if e.Header.Name != "assets/channel.json" || string(e.Content) != `{"build":1}` || e.Header.Method != zip.Store {
+		t.Errorf("entry %s: %q, method %d", e.Header.Name, e.Content, e.Header.Method)
+	}
+
+	// renaming an entry and errors fail
+	for _, f := range []EntryTransformerFunc{
+		func(e *Entry) error { e.Header.Name += ".bak"; return nil },
+		func(e *Entry) error { return errors.New("no watermark") },
+	} {
+		p.EntryTransformers = []EntryTransformer{f}
+		if _, err := p.newEntries(r); err == nil || !strings.Contains(err.Error(), "entry transformer 0") {
+			t.Errorf("error %v", err)
+		}
+	}
+}
+
+func TestRepackTransformersSkipped(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	extra := filepath.Join(t.TempDir(), "channel.json")
+	ioutil.WriteFile(extra, []byte("{}"), 0644)
+	opts.ExtraFiles.Set("assets/channel.json=" + extra)
+	build := "1"
+	opts.EntryTransformers = []EntryTransformer{
+		EntryTransformerFunc(func(e *Entry) error {
+			e.Content = append(e.Content, build...)
+			return nil
+		}),
+	}
+
+	if result, err := Repack(context.Background(), opts); err != nil || result.Skipped {
+		t.Fatalf("result %+v: %v", result, err)
+	}
+	// the same entries again
+	if result, err := Repack(context.Background(), opts); err != nil || !result.Skipped {
+		t.Errorf("repacked again: %+v, %v", result, err)
+	}
+	// other entries
+	build = "2"
+	if result, err := Repack(context.Background(), opts); err != nil || result.Skipped {
+		t.Fatalf("skipped: %+v, %v", result, err)
+	}
+	apk := objects["bucket/b.apk"]
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := readEntry(findFile(r, "assets/channel.json")); err != nil || string(content) != "{}2" {
+		t.Errorf("extra file %q, %v", content, err)
+	}
+}
@@ -0,0 +1,181 @@
+package repack
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// Verify checks opts.SourceAPK as -validate checks a dest apk, and that it is
+// signed with opts.CPIDContent if set
+func Verify(ctx context.Context, opts Options) error {
+	p := &packer{Options: opts, ctx: ctx}
+	r, err := p.openCached(p.SourceAPK)
+	if err != nil {
+		return errorOf(KindSource, err)
+	}
+	zipReader, err := zip.NewReader(r, r.Size())
+	if err != nil {
+		return errorOf(KindVerify, err)
+	}
+	if err := p.validateDest(p.SourceAPK, p.verifiedEntries(zipReader)); err != nil {
+		return errorOf(KindVerify, err)
+	}
+	return p.verifyCPID()
+}
+
+// VerifyRemote checks the apk of opts.SourceAPK like Verify with ranged reads
+// of its signature, cpid and manifest entries and VerifySample others only
+func VerifyRemote(ctx context.Context, opts Options) error {
+	p := &packer{Options: opts}
+	read := ReadStats().BytesRead
+	r, err := p.openCached(p.SourceAPK)
+	if err != nil {
+		return errorOf(KindSource, err)
+	}
+	size := r.Size()
+	dir, err := ReadDirectory(r, size)
+	if err != nil {
+		return errorOf(KindVerify, fmt.Errorf("central directory: %v", err))
+	}
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return errorOf(KindVerify, err)
+	}
+	names := p.verifiedEntries(zipReader)
+	if err := checkEntries(zipReader, names); err != nil {
+		return errorOf(KindVerify, err)
+	}
+
+	sample := map[string]bool{AndroidManifestPath: true}
+	for _, name := range names {
+		sample[name] = true
+	}
+	var others []string
+	for _, f := range zipReader.File {
+		if !sample[f.Name] && !strings.HasSuffix(f.Name, "/") && !strings.HasPrefix(f.Name, MetaInfoPath) {
+			others = append(others, f.Name)
+		}
+	}
+	n := p.VerifySample
+	if n == 0 {
+		n = DefaultVerifySample
+	}
+	for i, j := range rand.Perm(len(others)) {
+		if i == n {
+			break
+		}
+		sample[others[j]] = true
+		p.log().Debug("sampled", "phase", PhaseValidate, "name", others[j])
+	}
+	if err := p.verifySignatures(r, size, dir, zipReader, sample); err != nil {
+		return errorOf(KindVerify, err)
+	}
+	p.log().Info("verified remotely", "phase", PhaseValidate, "entries", len(zipReader.File), "checked", len(sample), "size", size, "bytes_read", ReadStats().BytesRead-read)
+	return p.verifyCPID()
+}
+
+// verifiedEntries returns the entries Verify checks as the appended ones:
+// those of META-INF and the cpid entries
+func (p *packer) verifiedEntries(r *zip.Reader) []string {
+	var names []string
+	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, MetaInfoPath) && !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	for _, path := range p.cpidPaths() {
+		if !strings.HasPrefix(path, MetaInfoPath) && findFile(r, path) != nil {
+			names = append(names, path)
+		}
+	}
+	return names
+}
+
+// verifyCPID checks that the apk of SourceAPK is signed with CPIDContent,
+// if set
+func (p *packer) verifyCPID() error {
+	if p.CPIDContent == "" {
+		return nil
+	}
+	p.DestAPK = p.SourceAPK
+	repacked, err := p.isRepacked()
+	if err != nil {
+		return errorOf(KindVerify, err)
+	}
+	if !repacked {
+		return errorOf(KindVerify, fmt.Errorf("%s is not signed with cpid %q", p.SourceAPK, p.CPIDContent))
+	}
+	return nil
+}
+
+// validate re-opens the apk at location and checks its central directory,
+// that no entry is listed twice, the appended CRC32s and VerifySignature
+func (p *packer) validateDest(location string, appended []string) error {
+	r, err := p.openCached(location)
+	if err != nil {
+		return err
+	}
+	size := r.Size()
+
+	dir, err := ReadDirectory(r, size)
+	if err != nil {
+		return fmt.Errorf("central directory: %v", err)
+	}
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if err := checkEntries(zipReader, appended); err != nil {
+		return err
+	}
+
+	if p.VerifySignature {
+		start := time.Now()
+		if err := p.verifySignatures(r, size, dir, zipReader, nil); err != nil {
+			return err
+		}
+		p.log().Info("signatures verified", "phase", PhaseValidate, "dest", location, "duration", time.Since(start))
+	}
+
+	p.log().Info("validated", "phase", PhaseValidate, "dest", location, "entries", len(zipReader.File), "appended", len(appended))
+	return nil
+}
+
+// checkEntries checks that no entry of r is listed twice, and the CRC32 of
+// the appended entries
+func checkEntries(r *zip.Reader, appended []string) error {
+	seen := make(map[string]bool)
+	for _, f := range r.File {
+		if seen[f.Name] {
+			return fmt.Errorf("duplicate entry: %s", f.Name)
+		}
+		seen[f.Name] = true
+	}
+
+	// reading the whole entry checks its CRC32
+	for _, name := range appended {
+		f := findFile(r, name)
+		if f == nil {
+			return fmt.Errorf("appended entry not found: %s", name)
+		}
+		if _, err := readEntry(f); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// openCached returns a CachedReader of the object at location, with the
+// blocks on disk under CacheDir if set
+func (p *packer) openCached(location string) (*CachedReader, error) {
+	r, err := NewReader(p.ossConfig(), location)
+	if err != nil {
+		return nil, err
+	}
+	return NewCachedReader(r, p.CacheDir)
+}
@@ -0,0 +1,94 @@
+package repack
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+func TestValidate(t *testing.T) {
+	var badCRC bytes.Buffer
+	w := stdzip.NewWriter(&badCRC)
+	f, _ := w.CreateRaw(&stdzip.FileHeader{Name: CPIDPath, Method: stdzip.Store, CRC32: 1, CompressedSize64: 2, UncompressedSize64: 2})
+	f.Write([]byte("c1"))
+	w.Close()
+
+	server := newOSSServer(map[string][]byte{
+		"bucket/ok.apk":        zipOf("classes.dex", "dex", CPIDPath, "c1"),
+		"bucket/duplicate.apk": zipOf(CPIDPath, "c0", "classes.dex", "dex", CPIDPath, "c1"),
+		"bucket/crc.apk":       badCRC.Bytes(),
+		"bucket/truncated.apk": zipOf(CPIDPath, "c1")[:20],
+	})
+	defer server.Close()
+	p := &packer{Options: DefaultOptions()}
+	p.OSSEndpoint, p.OSSAccessKeyID, p.OSSAccessKeySecret = server.URL, "id", "secret"
+
+	tests := []struct {
+		dest     string
+		appended []string
+		ok       bool
+	}{
+		{"ok.apk", []string{CPIDPath}, true},
+		{"ok.apk", []string{CPIDPath, "assets/channel.json"}, false},
+		{"duplicate.apk", []string{CPIDPath}, false},
+		{"crc.apk", []string{CPIDPath}, false},
+		{"truncated.apk", nil, false},
+		{"missing.apk", nil, false},
+	}
+	for _, tt := range tests {
+		err := p.validateDest("bucket/"+tt.dest, tt.appended)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %v: %v, want ok %v", tt.dest, tt.appended, err, tt.ok)
+		}
+	}
+}
+
+func TestVerifyRemote(t *testing.T) {
+	objects := map[string][]byte{"bucket/a.apk": zipOf(AndroidManifestPath, "axml", "classes.dex", "dex", "res/a.png", "png")}
+	server := newOSSServer(objects)
+	defer server.Close()
+	opts := DefaultOptions()
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = server.URL, "id", "secret"
+	opts.SourceAPK, opts.DestAPK, opts.CPIDContent = "bucket/a.apk", "bucket/b.apk", "c1"
+	opts.PrivateKeyPEM, opts.CertPEM = writeKeyPair(t, t.TempDir())
+	opts.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	if _, err := Repack(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same entries with another classes.dex
+	signed := objects["bucket/b.apk"]
+	r, _ := zip.NewReader(bytes.NewReader(signed), int64(len(signed)))
+	var files []string
+	for _, f := range r.File {
+		content, _ := readEntry(f)
+		if f.Name == "classes.dex" {
+			content = []byte("xed")
+		}
+		files = append(files, f.Name, string(content))
+	}
+	objects["bucket/changed.apk"] = zipOf(files...)
+
+	tests := []struct {
+		apk, cpid string
+		err       string // empty if verified
+	}{
+		{"b.apk", "c1", ""},
+		{"b.apk", "c2", "not signed with cpid"},
+		{"changed.apk", "", "classes.dex: SHA"},
+		{"missing.apk", "", "404"},
+	}
+	for _, tt := range tests {
+		opts.SourceAPK, opts.CPIDContent = "bucket/"+tt.apk, tt.cpid
+		err := VerifyRemote(context.Background(), opts)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s %s: %v, want %q", tt.apk, tt.cpid, err, tt.err)
+		}
+	}
+}
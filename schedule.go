@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errors of scheduler.push, returned as status 429
+var (
+	errQueueFull  = errors.New("too many jobs")
+	errTenantFull = errors.New("too many jobs of the tenant")
+)
+
+// scheduler hands the queued jobs to the workers in order, skipping those
+// of a tenant already running tenantWorkers jobs
+type scheduler struct {
+	size          int // of the queue
+	tenantWorkers int // running jobs of a tenant, no limit if 0
+	tenantJobs    int // queued and running jobs of a tenant, no limit if 0
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*job
+	running map[string]int // by tenant
+	jobs    map[string]int // queued and running, by tenant
+	closed  bool
+}
+
+func newScheduler(size, tenantWorkers, tenantJobs int) *scheduler {
+	s := &scheduler{
+		size:          size,
+		tenantWorkers: tenantWorkers,
+		tenantJobs:    tenantJobs,
+		running:       make(map[string]int),
+		jobs:          make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// push queues j, errQueueFull or errTenantFull if over the limits
+func (s *scheduler) push(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.queue) >= s.size:
+		return errQueueFull
+	case s.tenantJobs > 0 && s.jobs[j.Tenant] >= s.tenantJobs:
+		return errTenantFull
+	}
+	s.queue = append(s.queue, j)
+	s.jobs[j.Tenant]++
+	s.cond.Signal()
+	return nil
+}
+
+// next waits for the first queued job whose tenant can run one more, and
+// returns it, nil once closed and the queue is empty
+func (s *scheduler) next() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for i, j := range s.queue {
+			if s.tenantWorkers == 0 || s.running[j.Tenant] < s.tenantWorkers {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				s.running[j.Tenant]++
+				return j
+			}
+		}
+		if s.closed && len(s.queue) == 0 {
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// done releases the slot of j, returned by next
+func (s *scheduler) done(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[j.Tenant]--; s.running[j.Tenant] == 0 {
+		delete(s.running, j.Tenant)
+	}
+	if s.jobs[j.Tenant]--; s.jobs[j.Tenant] == 0 {
+		delete(s.jobs, j.Tenant)
+	}
+	s.cond.Broadcast()
+}
+
+// close wakes up the workers to return once the queue is empty
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// rateLimiter is a token bucket of rate requests per second, with a burst
+// of one second of them
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait blocks until a request can be made
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens--
+	// a negative balance is the wait of this request, behind the others
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limiterIdle is how long the limiter of a tenant without jobs is kept
+const limiterIdle = time.Minute
+
+// rateLimiters are the limiters of the OSS requests, global and by tenant
+type rateLimiters struct {
+	global    *rateLimiter // nil if no limit
+	perTenant float64      // rate of each tenant, no limit if 0
+
+	mu      sync.Mutex
+	tenants map[string]*tenantLimiter
+}
+
+// tenantLimiter is the limiter of a tenant, with its running jobs
+type tenantLimiter struct {
+	*rateLimiter
+	jobs int
+	idle time.Time // since the last job released it
+}
+
+// throttle returns the Throttle of a job of tenant, nil if no limit, and
+// release to call once the job is done
+func (r *rateLimiters) throttle(tenant string) (throttle func(op string), release func()) {
+	var l *tenantLimiter
+	if r.perTenant > 0 {
+		r.mu.Lock()
+		r.evict()
+		if r.tenants == nil {
+			r.tenants = make(map[string]*tenantLimiter)
+		}
+		l = r.tenants[tenant]
+		if l == nil {
+			l = &tenantLimiter{rateLimiter: newRateLimiter(r.perTenant)}
+			r.tenants[tenant] = l
+		}
+		l.jobs++
+		r.mu.Unlock()
+	}
+	release = func() {
+		if l != nil {
+			r.mu.Lock()
+			l.jobs, l.idle = l.jobs-1, time.Now()
+			r.mu.Unlock()
+		}
+	}
+	if r.global == nil && l == nil {
+		return nil, release
+	}
+	return func(op string) {
+		if l != nil {
+			l.wait()
+		}
+		if r.global != nil {
+			r.global.wait()
+		}
+	}, release
+}
+
+// evict drops the limiters of the tenants without jobs for limiterIdle
+func (r *rateLimiters) evict() {
+	for tenant, l := range r.tenants {
+		if l.jobs == 0 && time.Since(l.idle) > limiterIdle {
+			delete(r.tenants, tenant)
+		}
+	}
+}
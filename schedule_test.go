@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(4, 1, 2)
+	a1, a2, a3, b1 := &job{ID: "a1", Tenant: "a"}, &job{ID: "a2", Tenant: "a"}, &job{ID: "a3", Tenant: "a"}, &job{ID: "b1", Tenant: "b"}
+	for _, j := range []*job{a1, a2, b1} {
+		if err := s.push(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.push(a3); err != errTenantFull {
+		t.Errorf("third job of a: %v", err)
+	}
+	// a2 waits for a1, as a runs one job at a time
+	if j := s.next(); j != a1 {
+		t.Errorf("first %s", j.ID)
+	}
+	if j := s.next(); j != b1 {
+		t.Errorf("second %s, want b1", j.ID)
+	}
+	s.done(a1)
+	if j := s.next(); j != a2 {
+		t.Errorf("third %s", j.ID)
+	}
+	s.close()
+	if j := s.next(); j != nil {
+		t.Errorf("closed: %s", j.ID)
+	}
+
+	full := newScheduler(1, 0, 0)
+	full.push(a1)
+	if err := full.push(b1); err != errQueueFull {
+		t.Errorf("full queue: %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	start := time.Now()
+	// a burst of one second, then 100 per second
+	for i := 0; i < 105; i++ {
+		l.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("105 requests in %v", elapsed)
+	}
+}
+
+func TestRateLimiters(t *testing.T) {
+	r := &rateLimiters{}
+	if throttle, release := r.throttle("a"); throttle != nil {
+		t.Error("throttle without limits")
+	} else {
+		release()
+	}
+
+	r.perTenant = 10
+	throttle, release := r.throttle("a")
+	_, releaseB := r.throttle("b")
+	if throttle == nil || len(r.tenants) != 2 {
+		t.Fatalf("limiters %v", r.tenants)
+	}
+	throttle("GetObject")
+	release()
+	releaseB()
+	// a running job keeps its limiter, idle ones are dropped
+	_, release = r.throttle("a")
+	r.tenants["b"].idle = time.Now().Add(-2 * limiterIdle)
+	r.tenants["a"].idle = time.Now().Add(-2 * limiterIdle)
+	r.throttle("c")
+	if _, ok := r.tenants["b"]; ok || r.tenants["a"] == nil || len(r.tenants) != 2 {
+		t.Errorf("limiters %v", r.tenants)
+	}
+	release()
+}
+
+func TestTenantOf(t *testing.T) {
+	defer func(header string) { tenantHeader = header }(tenantHeader)
+	event := repack.Event{Dest: "games/a.apk"}
+	r := httptest.NewRequest("POST", "/repack", nil)
+	r.Header.Set("X-Tenant", "t1")
+	tenantHeader = ""
+	if tenant := tenantOf(r, event); tenant != "games" {
+		t.Errorf("tenant %s, want the bucket as the header is off", tenant)
+	}
+	tenantHeader = "X-Tenant"
+	if tenant := tenantOf(r, event); tenant != "t1" {
+		t.Errorf("tenant %s", tenant)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// headers of the OSS credentials of a job, used instead of those of the
+// server, e.g. an STS token of the tenant
+const (
+	ossAccessKeyIDHeader     = "X-Oss-Access-Key-Id"
+	ossAccessKeySecretHeader = "X-Oss-Access-Key-Secret"
+	ossSecurityTokenHeader   = "X-Oss-Security-Token"
+)
+
+// credentialsOf returns the OSS credentials of r, empty if none
+func credentialsOf(r *http.Request) (repack.Credentials, error) {
+	creds := repack.Credentials{
+		AccessKeyID:     r.Header.Get(ossAccessKeyIDHeader),
+		AccessKeySecret: r.Header.Get(ossAccessKeySecretHeader),
+		SecurityToken:   r.Header.Get(ossSecurityTokenHeader),
+	}
+	if (creds.AccessKeyID == "") != (creds.AccessKeySecret == "") || (creds.SecurityToken != "" && creds.AccessKeyID == "") {
+		return creds, fmt.Errorf("%s and %s are required together", ossAccessKeyIDHeader, ossAccessKeySecretHeader)
+	}
+	return creds, nil
+}
+
+// bucketScopes are the patterns of the buckets each caller may use, like
+// games-*, by caller
+type bucketScopes map[string][]string
+
+// loadBucketScopes reads the json of -bucket-scopes, nil if not set
+func loadBucketScopes() (bucketScopes, error) {
+	if bucketScopesPath == "" {
+		return nil, nil
+	}
+	if hmacKeysPath == "" && oidcIssuer == "" {
+		return nil, fmt.Errorf("-bucket-scopes needs -hmac-keys or -oidc-issuer to know the callers")
+	}
+	buf, err := ioutil.ReadFile(bucketScopesPath)
+	if err != nil {
+		return nil, fmt.Errorf("-bucket-scopes: %v", err)
+	}
+	var scopes bucketScopes
+	if err := json.Unmarshal(buf, &scopes); err != nil {
+		return nil, fmt.Errorf("-bucket-scopes: %v", err)
+	}
+	for caller, patterns := range scopes {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("-bucket-scopes: %s: %q: %v", caller, pattern, err)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// secretScope is the prefix of the patterns of the secrets a caller may
+// use, like secret:games-*, rather than buckets
+const secretScope = "secret:"
+
+// check checks that the keys of e are in OSS and its endpoints of OSS, and
+// with scopes that its buckets and secrets are in those of caller
+func (s bucketScopes) check(caller string, e repack.Event, creds repack.Credentials) error {
+	locations := make(map[string]string)
+	for name, location := range map[string]string{"cert_pem": e.CertPEM, "priv_pem": e.PrivateKeyPEM} {
+		if location == "" {
+			continue
+		}
+		if !strings.HasPrefix(location, repack.OSSScheme) {
+			return fmt.Errorf("%s must be in OSS: %s", name, location)
+		}
+		locations[name] = strings.TrimPrefix(location, repack.OSSScheme)
+	}
+	for name, endpoint := range map[string]string{"oss_endpoint": e.OSSEndpoint, "source_oss_endpoint": e.SourceEndpoint} {
+		if endpoint != "" && !isOSSEndpoint(endpoint) {
+			return fmt.Errorf("%s must be an endpoint of OSS: %s", name, endpoint)
+		}
+	}
+	if s == nil {
+		return nil
+	}
+	patterns, ok := s[caller]
+	if !ok {
+		return fmt.Errorf("no bucket scope of %s", caller)
+	}
+	// KMS decrypts a blob for whoever sends it, and reads secrets too
+	own := creds.AccessKeyID != ""
+	if e.PrivateKeyBlob != "" && !own {
+		return fmt.Errorf("priv_blob needs the OSS credentials of the request")
+	}
+	for name, secret := range map[string]string{"key_secret_name": e.KeySecretName, "cert_secret_name": e.CertSecretName} {
+		if secret != "" && !own && !matchesAny(patterns, secretScope+secret) {
+			return fmt.Errorf("secret %s of %s is out of the scope of %s", secret, name, caller)
+		}
+	}
+	dest := e.Dest
+	if dest == "" {
+		dest = opts.DestAPK
+	}
+	locations["source"], locations["dest"] = e.Source, dest
+	for name, location := range locations {
+		bucket := strings.SplitN(location, "/", 2)[0]
+		if strings.Contains(bucket, "{{") {
+			return fmt.Errorf("the bucket of %s must not be a template: %s", name, location)
+		}
+		if !matchesAny(patterns, bucket) {
+			return fmt.Errorf("bucket %s of %s is out of the scope of %s", bucket, name, caller)
+		}
+	}
+	return nil
+}
+
+// isOSSEndpoint reports whether endpoint, with or without a scheme and
+// port, is a host of aliyuncs.com
+func isOSSEndpoint(endpoint string) bool {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil || strings.Trim(u.Path, "/") != "" {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Hostname()), ".aliyuncs.com")
+}
+
+// matchesAny reports whether s matches any of patterns
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+func TestCredentialsOf(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		ok      bool
+	}{
+		{nil, true},
+		{map[string]string{ossAccessKeyIDHeader: "id", ossAccessKeySecretHeader: "secret", ossSecurityTokenHeader: "token"}, true},
+		{map[string]string{ossAccessKeyIDHeader: "id"}, false},
+		{map[string]string{ossAccessKeySecretHeader: "secret"}, false},
+		{map[string]string{ossSecurityTokenHeader: "token"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/repack", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		creds, err := credentialsOf(r)
+		if (err == nil) != tt.ok || creds.AccessKeyID != tt.headers[ossAccessKeyIDHeader] {
+			t.Errorf("%v: %+v, %v", tt.headers, creds, err)
+		}
+	}
+}
+
+func TestBucketScopesCheck(t *testing.T) {
+	scopes := bucketScopes{"hmac:games": {"games-*", "secret:games/*"}}
+	own := repack.Credentials{AccessKeyID: "id", AccessKeySecret: "secret"}
+	event := func(f func(*repack.Event)) repack.Event {
+		e := repack.Event{Source: "games-src/a.apk", Dest: "games-dst/b.apk"}
+		if f != nil {
+			f(&e)
+		}
+		return e
+	}
+	tests := []struct {
+		name   string
+		scopes bucketScopes
+		caller string
+		event  repack.Event
+		creds  repack.Credentials
+		ok     bool
+	}{
+		{"in scope", scopes, "hmac:games", event(nil), repack.Credentials{}, true},
+		{"unknown caller", scopes, "hmac:other", event(nil), repack.Credentials{}, false},
+		{"source out of scope", scopes, "hmac:games", event(func(e *repack.Event) { e.Source = "music/a.apk" }), repack.Credentials{}, false},
+		{"dest template bucket", scopes, "hmac:games", event(func(e *repack.Event) { e.Dest = "{{.Channel}}/b.apk" }), repack.Credentials{}, false},
+		{"key in scope", scopes, "hmac:games", event(func(e *repack.Event) { e.PrivateKeyPEM = "oss://games-keys/k.pem" }), repack.Credentials{}, true},
+		{"key out of scope", scopes, "hmac:games", event(func(e *repack.Event) { e.CertPEM = "oss://music-keys/c.pem" }), repack.Credentials{}, false},
+		{"local key", scopes, "hmac:games", event(func(e *repack.Event) { e.PrivateKeyPEM = "/etc/keys/k.pem" }), repack.Credentials{}, false},
+		{"local key without scopes", nil, "", event(func(e *repack.Event) { e.CertPEM = "/etc/keys/c.pem" }), repack.Credentials{}, false},
+		{"oss key without scopes", nil, "", event(func(e *repack.Event) { e.CertPEM = "oss://any/c.pem" }), repack.Credentials{}, true},
+		{"secret in scope", scopes, "hmac:games", event(func(e *repack.Event) { e.KeySecretName = "games/key" }), repack.Credentials{}, true},
+		{"secret out of scope", scopes, "hmac:games", event(func(e *repack.Event) { e.CertSecretName = "music/cert" }), repack.Credentials{}, false},
+		{"secret with own credentials", scopes, "hmac:games", event(func(e *repack.Event) { e.KeySecretName = "music/key" }), own, true},
+		{"blob", scopes, "hmac:games", event(func(e *repack.Event) { e.PrivateKeyBlob = "blob" }), repack.Credentials{}, false},
+		{"blob with own credentials", scopes, "hmac:games", event(func(e *repack.Event) { e.PrivateKeyBlob = "blob" }), own, true},
+		{"oss endpoint", scopes, "hmac:games", event(func(e *repack.Event) { e.OSSEndpoint = "oss-cn-hangzhou-internal.aliyuncs.com" }), repack.Credentials{}, true},
+		{"https oss endpoint", nil, "", event(func(e *repack.Event) { e.SourceEndpoint = "https://oss-us-west-1.aliyuncs.com" }), repack.Credentials{}, true},
+		{"other endpoint", nil, "", event(func(e *repack.Event) { e.OSSEndpoint = "http://169.254.169.254" }), repack.Credentials{}, false},
+		{"endpoint suffix", scopes, "hmac:games", event(func(e *repack.Event) { e.SourceEndpoint = "evil.com/.aliyuncs.com" }), repack.Credentials{}, false},
+		{"endpoint user", scopes, "hmac:games", event(func(e *repack.Event) { e.OSSEndpoint = "http://x.aliyuncs.com@evil.com" }), repack.Credentials{}, false},
+	}
+	for _, tt := range tests {
+		err := tt.scopes.check(tt.caller, tt.event, tt.creds)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: check = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+const (
+	jobTTL         = time.Hour // finished jobs are kept for this long
+	maxRequestBody = 1 << 20   // of a posted job
+)
+
+// the checks of /readyz are run again after this long
+const readyTTL = 10 * time.Second
+
+// job is a repack request of the service
+type job struct {
+	ID       string         `json:"id"`
+	State    string         `json:"state"`
+	Phase    string         `json:"phase,omitempty"` // current or failed phase
+	Event    repack.Event   `json:"event"`
+	Result   *repack.Result `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Kind     string         `json:"error_kind,omitempty"`
+	Tenant   string         `json:"tenant,omitempty"` // of the limits, -tenant-header or the dest bucket
+	Caller   string         `json:"caller,omitempty"` // who posted the job, if authenticated
+	Created  time.Time      `json:"created"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+
+	// phase of each dest, to show the progress of the channels
+	Dests map[string]string `json:"dests,omitempty"`
+	// instance running the job and its last save, see jobLease
+	Owner     string    `json:"owner,omitempty"`
+	Heartbeat time.Time `json:"heartbeat,omitempty"`
+	// the job runs with the OSS credentials of its request, which are not
+	// saved to the store
+	OwnCredentials bool `json:"own_credentials,omitempty"`
+
+	ctx    context.Context    // with the span of the request
+	feed   *progressFeed      // to the gRPC call that posted the job, nil if none
+	saveMu *sync.Mutex        // orders the saves of the job
+	creds  repack.Credentials // of the request, empty for those of the server
+}
+
+// server runs the posted jobs with up to -workers at the same time, the
+// jobs waiting in a queue of -queue
+type server struct {
+	ctx      context.Context // of all jobs, done on shutdown
+	mu       sync.Mutex
+	jobs     map[string]*job
+	queue    *scheduler
+	limiters *rateLimiters // of the OSS requests of the jobs
+	metrics  *metrics
+	store    jobStore       // nil to keep the jobs in memory only
+	scopes   bucketScopes   // nil if the callers may use any bucket, guarded by mu
+	auth     *authenticator // nil if the API is open
+	locker   destLocker     // nil to not lock the dests
+
+	readyMu sync.Mutex
+	ready   readiness // of the last checks of /readyz
+}
+
+// readiness is the outcome of the checks of /readyz
+type readiness struct {
+	Ready   bool           `json:"ready"`
+	Checks  []repack.Check `json:"checks"`
+	Error   string         `json:"error,omitempty"`
+	Checked time.Time      `json:"checked"`
+}
+
+func newServer(ctx context.Context) *server {
+	s := &server{
+		ctx:      ctx,
+		jobs:     make(map[string]*job),
+		queue:    newScheduler(serveQueue, tenantWorkers, tenantJobs),
+		limiters: &rateLimiters{perTenant: tenantOSSQPS},
+		metrics:  newMetrics(),
+	}
+	if ossQPS > 0 {
+		s.limiters.global = newRateLimiter(ossQPS)
+	}
+	return s
+}
+
+// serve runs the REST API on -listen until ctx is done, then cancels the
+// jobs and waits for them to clean up
+func serve(ctx context.Context) error {
+	s := newServer(ctx)
+	if jobStoreURL != "" {
+		store, err := newJobStore(jobStoreURL)
+		if err != nil {
+			return fmt.Errorf("-job-store: %v", err)
+		}
+		s.store = store
+	}
+	if lockURL != "" {
+		locker, err := newDestLocker(lockURL)
+		if err != nil {
+			return fmt.Errorf("-lock: %v", err)
+		}
+		s.locker = locker
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < serveWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
+
+	s.resume()
+	go s.heartbeat()
+
+	auth, err := newAuthenticator()
+	if err != nil {
+		return err
+	}
+	s.auth = auth
+	if s.scopes, err = loadBucketScopes(); err != nil {
+		return err
+	}
+	go s.watch(ctx, auth)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/repack", auth.wrap(s.handleRepack))
+	mux.HandleFunc("/jobs/", auth.wrap(s.handleJob))
+	grpcDone := make(chan struct{})
+	if grpcListen != "" {
+		lis, err := net.Listen("tcp", grpcListen)
+		if err != nil {
+			return fmt.Errorf("-grpc-listen: %v", err)
+		}
+		go func() {
+			defer close(grpcDone)
+			if err := serveGRPC(ctx, s, lis); err != nil {
+				slog.Error("grpc", "error", err)
+			}
+		}()
+	} else {
+		close(grpcDone)
+	}
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	slog.Info("serving", "listen", serveListen, "workers", serveWorkers)
+	err = listenAndServe(ctx, &http.Server{Addr: serveListen, Handler: mux})
+	// no more jobs are posted once the server is shut down
+	s.queue.close()
+	wg.Wait()
+	<-grpcDone
+	return err
+}
+
+// listenAndServe runs srv until ctx is done, then waits for the running
+// requests
+func listenAndServe(ctx context.Context, srv *http.Server) error {
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
+
+// handleReady runs repack.SelfTest at most once in readyTTL, with status 503
+// if a check fails or the server is shutting down
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	s.readyMu.Lock()
+	if time.Since(s.ready.Checked) > readyTTL {
+		checks, err := repack.SelfTest(s.ctx, opts, probePrefix)
+		s.ready = readiness{Ready: err == nil, Checks: checks, Checked: time.Now()}
+		if err != nil {
+			s.ready.Error = err.Error()
+		}
+	}
+	ready := s.ready
+	s.readyMu.Unlock()
+
+	if s.ctx.Err() != nil {
+		ready.Ready, ready.Error = false, "shutting down"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
+func (s *server) handleRepack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event, err := repack.ParseEvent(buf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	creds, err := credentialsOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requireCredentials && creds.AccessKeyID == "" {
+		http.Error(w, fmt.Sprintf("the OSS credentials of the job are required: set %s and %s", ossAccessKeyIDHeader, ossAccessKeySecretHeader), http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	scopes := s.scopes
+	s.mu.Unlock()
+	if err := scopes.check(callerOf(r.Context()), event, creds); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	j := &job{ID: newJobID(), State: jobQueued, Event: event, Created: time.Now(), Tenant: tenantOf(r, event), Caller: callerOf(r.Context())}
+	j.creds, j.OwnCredentials = creds, creds.AccessKeyID != ""
+	j.ctx = s.jobContext(traceContext(r))
+	if err := s.enqueue(j); err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	s.writeJob(w, http.StatusAccepted, j)
+}
+
+// jobContext returns the context of a job posted with ctx, which outlives
+// the request but not the server
+func (s *server) jobContext(ctx context.Context) context.Context {
+	if span, ok := repack.SpanFromContext(ctx); ok {
+		return repack.ContextWithSpan(s.ctx, span)
+	}
+	return s.ctx
+}
+
+// enqueue queues the new job j, or fails if over the limits of the queue
+func (s *server) enqueue(j *job) error {
+	if err := s.queue.push(j); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for id, old := range s.jobs {
+		if !old.Finished.IsZero() && time.Since(old.Finished) > jobTTL {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	s.save(j)
+	slog.Info("job queued", "job-id", j.ID, "caller", j.Caller, "source", j.Event.Source, "dest", j.Event.Dest)
+	return nil
+}
+
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok && s.store != nil {
+		// posted to another server, or before a restart
+		stored, err := s.store.load(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		j, ok = stored, stored != nil
+	}
+	if ok && j.Caller != callerOf(r.Context()) {
+		// the jobs of other callers are not shown
+		ok = false
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.writeJob(w, http.StatusOK, j)
+}
+
+// writeJob writes j as json, holding the lock as workers update it
+func (s *server) writeJob(w http.ResponseWriter, status int, j *job) {
+	s.mu.Lock()
+	buf, _ := json.Marshal(j)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// work runs the queued jobs one by one
+func (s *server) work() {
+	for j := s.queue.next(); j != nil; j = s.queue.next() {
+		s.mu.Lock()
+		j.State, j.Started = jobRunning, time.Now()
+		s.mu.Unlock()
+		s.save(j)
+
+		result, err := s.runJob(j)
+
+		s.mu.Lock()
+		j.Finished = time.Now()
+		switch {
+		case errors.Is(err, errLocked), errors.Is(err, errLockLost):
+			j.State, j.Error, j.Kind = jobFailed, err.Error(), "locked"
+		case err != nil:
+			j.State, j.Error, j.Kind = jobFailed, err.Error(), repack.KindOf(err).String()
+		default:
+			j.State, j.Result = jobDone, &result
+		}
+		s.mu.Unlock()
+		if j.feed != nil {
+			j.feed.finish()
+		}
+		s.queue.done(j)
+		s.save(j)
+		s.metrics.finish(j)
+		slog.Info("job finished", append([]interface{}{"job-id", j.ID, "state", j.State, "duration", j.Finished.Sub(j.Started)}, repack.RequestAttrs(err)...)...)
+	}
+}
+
+func (s *server) runJob(j *job) (repack.Result, error) {
+	o := j.Event.Options(opts, j.creds)
+	o.Logger = slog.Default().With("job-id", j.ID)
+	if j.Caller != "" {
+		o.Logger = o.Logger.With("caller", j.Caller)
+	}
+	o.JobID = j.ID
+	if j.Caller != "" {
+		o.Caller = j.Caller
+	} else {
+		o.Caller = "serve"
+	}
+	ctx, cancel := context.WithCancelCause(j.ctx)
+	defer cancel(nil)
+	throttle, release := s.limiters.throttle(j.Tenant)
+	defer release()
+	o.Throttle = throttle
+	// the secrets read with the credentials of a request are not kept for
+	// the jobs of other requests
+	o.PrivateSecrets = j.OwnCredentials
+	if s.locker != nil {
+		o.LockDest = destLock(ctx, s.locker, o.Logger, cancel)
+	}
+	o.Progress = func(p repack.Progress) {
+		s.mu.Lock()
+		changed := j.Dests[p.Dest] != p.Phase
+		j.Phase = p.Phase
+		if j.Dests == nil {
+			j.Dests = make(map[string]string)
+		}
+		j.Dests[p.Dest] = p.Phase
+		s.mu.Unlock()
+		if j.feed != nil {
+			j.feed.add(p)
+		}
+		if changed {
+			s.save(j)
+		}
+	}
+	result, err := repack.Repack(ctx, o)
+	if err != nil && errors.Is(context.Cause(ctx), errLockLost) {
+		err = fmt.Errorf("%w: %v", errLockLost, err)
+	}
+	return result, err
+}
+
+// save writes a copy of j to the store, if any. A failed save is logged
+// rather than failing the job.
+func (s *server) save(j *job) {
+	if s.store == nil {
+		return
+	}
+	s.mu.Lock()
+	if j.saveMu == nil {
+		j.saveMu = new(sync.Mutex)
+	}
+	mu := j.saveMu
+	s.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	s.mu.Lock()
+	c := *j
+	c.Dests = make(map[string]string, len(j.Dests))
+	for dest, phase := range j.Dests {
+		c.Dests[dest] = phase
+	}
+	s.mu.Unlock()
+	if err := saveJob(s.store, &c); err != nil {
+		slog.Warn("save job", "job-id", j.ID, "state", j.State, "error", err)
+	}
+}
+
+// heartbeat saves the unfinished jobs every jobLease/3 until shutdown, so
+// other instances don't resume them
+func (s *server) heartbeat() {
+	if s.store == nil {
+		return
+	}
+	t := time.NewTicker(jobLease / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		}
+		var jobs []*job
+		s.mu.Lock()
+		for _, j := range s.jobs {
+			if !j.finished() {
+				jobs = append(jobs, j)
+			}
+		}
+		s.mu.Unlock()
+		for _, j := range jobs {
+			s.save(j)
+		}
+	}
+}
+
+// resume queues again the pending jobs of the store whose owner is gone.
+// Those that don't fit in the queue stay pending until the next start.
+func (s *server) resume() {
+	if s.store == nil {
+		return
+	}
+	jobs, err := s.store.pending()
+	if err != nil {
+		slog.Error("list pending jobs", "error", err)
+	}
+	for _, j := range jobs {
+		if !j.ownerGone() {
+			slog.Info("job left to its owner", "job-id", j.ID, "owner", j.Owner)
+			continue
+		}
+		if j.OwnCredentials {
+			// never run with the credentials of the server instead
+			j.State, j.Error, j.Finished = jobFailed, "the OSS credentials of the request were lost on restart", time.Now()
+			s.save(j)
+			slog.Warn("job not resumed", "job-id", j.ID, "error", j.Error)
+			continue
+		}
+		j.State, j.Phase, j.Dests, j.ctx = jobQueued, "", nil, s.ctx
+		if err := s.queue.push(j); err != nil {
+			slog.Warn("job left pending", "job-id", j.ID, "error", err)
+			continue
+		}
+		s.mu.Lock()
+		s.jobs[j.ID] = j
+		s.mu.Unlock()
+		s.save(j)
+		slog.Info("job resumed", "job-id", j.ID, "source", j.Event.Source, "dest", j.Event.Dest)
+	}
+}
+
+// tenantOf returns the tenant of a job posted with r, its authenticated
+// caller, or the -tenant-header of r, or else the bucket of the dest
+func tenantOf(r *http.Request, event repack.Event) string {
+	if caller := callerOf(r.Context()); caller != "" {
+		return caller
+	}
+	if tenant := r.Header.Get(tenantHeader); tenantHeader != "" && tenant != "" {
+		return tenant
+	}
+	dest := event.Dest
+	if dest == "" {
+		dest = opts.DestAPK
+	}
+	return strings.SplitN(dest, "/", 2)[0]
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleRepack(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{"POST", `{"source":"bucket/a.apk","dest":"bucket/b.apk"}`, http.StatusAccepted},
+		{"POST", `{"source":"bucket/a.apk"}`, http.StatusBadRequest},
+		{"POST", `{"cpid":"` + strings.Repeat("x", maxRequestBody) + `"}`, http.StatusRequestEntityTooLarge},
+		{"GET", "", http.StatusMethodNotAllowed},
+	}
+	s := newServer(context.Background())
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.handleRepack(w, httptest.NewRequest(tt.method, "/repack", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %.40s: %d, want %d", tt.method, tt.body, w.Code, tt.status)
+		}
+	}
+
+	if len(s.queue.queue) != 1 {
+		t.Fatalf("%d jobs queued", len(s.queue.queue))
+	}
+	queued := s.queue.next()
+	w := httptest.NewRecorder()
+	s.handleJob(w, httptest.NewRequest("GET", "/jobs/"+queued.ID, nil))
+	var j job
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil || j.State != jobQueued || j.Event.Dest != "bucket/b.apk" {
+		t.Errorf("job %+v: %v", j, err)
+	}
+	w = httptest.NewRecorder()
+	s.handleJob(w, httptest.NewRequest("GET", "/jobs/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: %d", w.Code)
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newServer(ctx)
+	// nothing to check without a bucket or a key
+	w := httptest.NewRecorder()
+	s.handleReady(w, httptest.NewRequest("GET", "/readyz", nil))
+	var ready readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &ready); err != nil || w.Code != http.StatusOK || !ready.Ready {
+		t.Errorf("%d %s: %v", w.Code, w.Body, err)
+	}
+	checked := ready.Checked
+
+	cancel()
+	w = httptest.NewRecorder()
+	s.handleReady(w, httptest.NewRequest("GET", "/readyz", nil))
+	json.Unmarshal(w.Body.Bytes(), &ready)
+	if w.Code != http.StatusServiceUnavailable || ready.Error != "shutting down" || !ready.Checked.Equal(checked) {
+		t.Errorf("shutting down: %d %s", w.Code, w.Body)
+	}
+}
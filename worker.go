@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// mnsWait is the long polling time of a receive, 30s at most
+const mnsWait = 30 * time.Second
+
+// worker consumes repack events from an MNS queue
+type worker struct {
+	queue  *mnsQueue
+	dead   *mnsQueue  // nil to drop failed messages
+	store  jobStore   // nil to not persist the jobs
+	locker destLocker // nil to not lock the dests
+}
+
+// runWorker long-polls -mns-queue with -workers consumers until ctx is done,
+// retrying a failed message up to -retries times before -mns-dead-queue
+func runWorker(ctx context.Context) error {
+	if mnsEndpoint == "" || mnsQueueName == "" {
+		return fmt.Errorf("-mns-ep and -mns-queue are required")
+	}
+	newQueue := func(name string) *mnsQueue {
+		return &mnsQueue{
+			Endpoint:        mnsEndpoint,
+			Name:            name,
+			AccessKeyID:     opts.OSSAccessKeyID,
+			AccessKeySecret: opts.OSSAccessKeySecret,
+			SecurityToken:   opts.OSSSecurityToken,
+		}
+	}
+	w := &worker{queue: newQueue(mnsQueueName)}
+	if mnsDeadQueue != "" {
+		w.dead = newQueue(mnsDeadQueue)
+	}
+	if jobStoreURL != "" {
+		store, err := newJobStore(jobStoreURL)
+		if err != nil {
+			return fmt.Errorf("-job-store: %v", err)
+		}
+		w.store = store
+	}
+	if lockURL != "" {
+		locker, err := newDestLocker(lockURL)
+		if err != nil {
+			return fmt.Errorf("-lock: %v", err)
+		}
+		w.locker = locker
+	}
+	slog.Info("consuming", "queue", mnsQueueName, "workers", serveWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < serveWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.consume(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// consume receives and handles messages one at a time until ctx is done
+func (w *worker) consume(ctx context.Context) {
+	for ctx.Err() == nil {
+		m, err := w.queue.receive(ctx, mnsWait)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("receive", "queue", w.queue.Name, "error", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if m != nil {
+			w.handle(ctx, m)
+		}
+	}
+}
+
+func (w *worker) handle(ctx context.Context, m *mnsMessage) {
+	logger := slog.Default().With("message-id", m.MessageID)
+	body := messageBody(m.MessageBody)
+	event, err := repack.ParseEvent(body)
+	if err == nil {
+		logger.Info("repack", "source", event.Source, "dest", event.Dest, "dequeue_count", m.DequeueCount)
+		o := event.Options(opts, repack.Credentials{})
+		o.Logger = logger
+		o.JobID = m.MessageID
+		o.Caller = "mns:" + w.queue.Name
+		err = w.repack(ctx, m, event, o, logger)
+	}
+	if errors.Is(err, errLocked) || errors.Is(err, errLockLost) {
+		w.requeue(m, body, logger)
+		return
+	}
+	if err == nil {
+		if err := w.queue.delete(m); err != nil {
+			logger.Error("delete message", "error", err)
+		}
+		return
+	}
+
+	kind := repack.KindOf(err)
+	logger.Error("message failed", append([]interface{}{"kind", kind.String(), "error", err}, repack.RequestAttrs(err)...)...)
+	switch kind {
+	case repack.KindCanceled:
+		// received again by another worker
+		return
+	case repack.KindConfig, repack.KindSource, repack.KindSign:
+	default:
+		if m.DequeueCount <= opts.Retries {
+			// received again after the visibility timeout
+			return
+		}
+	}
+	if w.dead != nil {
+		if err := w.dead.send(string(body), 0); err != nil {
+			// keep it in the queue rather than losing it
+			logger.Error("dead-letter message", "queue", w.dead.Name, "error", err)
+			return
+		}
+		logger.Info("dead-lettered message", "queue", w.dead.Name)
+	}
+	if err := w.queue.delete(m); err != nil {
+		logger.Error("delete message", "error", err)
+	}
+}
+
+// repack runs the job of m, holding the lock of its dest if -lock is set
+func (w *worker) repack(ctx context.Context, m *mnsMessage, event repack.Event, o repack.Options, logger *slog.Logger) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if w.locker != nil {
+		o.LockDest = destLock(ctx, w.locker, logger, cancel)
+	}
+	j := &job{ID: m.MessageID, Event: event, Created: time.Now()}
+	stop := w.track(j, &o, logger)
+	result, err := repack.Repack(ctx, o)
+	stop()
+	if err != nil && errors.Is(context.Cause(ctx), errLockLost) {
+		err = fmt.Errorf("%w: %v", errLockLost, err)
+	}
+	w.finish(j, result, err, logger)
+	return err
+}
+
+// requeue sends body again delayed by lockTTL and deletes m, as another job
+// holds the lock of its dest, so that its DequeueCount doesn't count it
+func (w *worker) requeue(m *mnsMessage, body []byte, logger *slog.Logger) {
+	if err := w.queue.send(string(body), lockTTL); err != nil {
+		// received again after the visibility timeout
+		logger.Warn("requeue locked message", "error", err)
+		return
+	}
+	logger.Info("dest locked, message sent again", "delay", lockTTL)
+	if err := w.queue.delete(m); err != nil {
+		logger.Error("delete message", "error", err)
+	}
+}
+
+// track saves j as running, again as each dest of o changes phase and every
+// jobLease/3 until stop is called
+func (w *worker) track(j *job, o *repack.Options, logger *slog.Logger) (stop func()) {
+	if w.store == nil {
+		return func() {}
+	}
+	j.State, j.Started, j.saveMu = jobRunning, time.Now(), new(sync.Mutex)
+	w.save(j, logger)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(jobLease / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				w.save(j, logger)
+			}
+		}
+	}()
+	o.Progress = func(p repack.Progress) {
+		j.saveMu.Lock()
+		defer j.saveMu.Unlock()
+		if j.Dests[p.Dest] == p.Phase {
+			return
+		}
+		if j.Dests == nil {
+			j.Dests = make(map[string]string)
+		}
+		j.Phase, j.Dests[p.Dest] = p.Phase, p.Phase
+		if err := saveJob(w.store, j); err != nil {
+			logger.Warn("save job", "state", j.State, "error", err)
+		}
+	}
+	return func() { close(done) }
+}
+
+// finish saves j as done or failed
+func (w *worker) finish(j *job, result repack.Result, err error, logger *slog.Logger) {
+	if w.store == nil {
+		return
+	}
+	j.saveMu.Lock()
+	j.Finished = time.Now()
+	if err != nil {
+		j.State, j.Error, j.Kind = jobFailed, err.Error(), repack.KindOf(err).String()
+	} else {
+		j.State, j.Result = jobDone, &result
+	}
+	j.saveMu.Unlock()
+	w.save(j, logger)
+}
+
+// save writes j to the store, logging a failure rather than failing the
+// message
+func (w *worker) save(j *job, logger *slog.Logger) {
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+	if err := saveJob(w.store, j); err != nil {
+		logger.Warn("save job", "state", j.State, "error", err)
+	}
+}
+
+// messageBody returns the event of body, which SDKs may have base64 encoded
+func messageBody(body string) []byte {
+	if !json.Valid([]byte(body)) {
+		if buf, err := base64.StdEncoding.DecodeString(body); err == nil && json.Valid(buf) {
+			return buf
+		}
+	}
+	return []byte(body)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun-fc/repack-apk/repack"
+)
+
+// mnsServer is a fake MNS API recording the requests to its queues
+type mnsServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string // like DELETE /queues/q/messages
+	bodies   []string // of the sent messages
+}
+
+func newMNSServer(messages map[string]string) *mnsServer {
+	s := &mnsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case "GET":
+			if m, ok := messages[r.URL.Path]; ok {
+				fmt.Fprint(w, m)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>MessageNotExist</Code><Message>empty</Message></Error>")
+		case "POST":
+			buf, _ := ioutil.ReadAll(r.Body)
+			s.bodies = append(s.bodies, string(buf))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	return s
+}
+
+func (s *mnsServer) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func TestMNSReceive(t *testing.T) {
+	server := newMNSServer(map[string]string{"/queues/full/messages": "<Message><MessageId>m1</MessageId><ReceiptHandle>h1</ReceiptHandle><MessageBody>{}</MessageBody><DequeueCount>2</DequeueCount></Message>"})
+	defer server.Close()
+
+	m, err := (&mnsQueue{Endpoint: server.URL, Name: "full"}).receive(context.Background(), time.Second)
+	if err != nil || m == nil || m.ReceiptHandle != "h1" || m.DequeueCount != 2 {
+		t.Errorf("message %+v: %v", m, err)
+	}
+	if m, err := (&mnsQueue{Endpoint: server.URL, Name: "empty"}).receive(context.Background(), time.Second); m != nil || err != nil {
+		t.Errorf("empty queue: %+v %v", m, err)
+	}
+}
+
+func TestWorkerHandle(t *testing.T) {
+	defer func(o repack.Options) { opts = o }(opts)
+	// OSS throttles every request, with no retry in the job
+	oss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer oss.Close()
+	opts.Retries, opts.Retry = 2, &repack.RetryPolicy{}
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = oss.URL, "id", "secret"
+	opts.CPIDFile, opts.CPIDComment = false, true
+	opts.WorkDir = t.TempDir()
+	server := newMNSServer(nil)
+	defer server.Close()
+	w := &worker{
+		queue: &mnsQueue{Endpoint: server.URL, Name: "repack"},
+		dead:  &mnsQueue{Endpoint: server.URL, Name: "dead"},
+	}
+
+	event := `{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1"}`
+	tests := []struct {
+		name     string
+		body     string
+		count    int
+		requests []string
+	}{
+		{"retried", event, 2, nil},
+		{"retries used up", event, 3, []string{"POST /queues/dead/messages", "DELETE /queues/repack/messages"}},
+		{"invalid event", base64.StdEncoding.EncodeToString([]byte(`{"source":"bucket/a.apk"}`)), 1, []string{"POST /queues/dead/messages", "DELETE /queues/repack/messages"}},
+	}
+	for _, tt := range tests {
+		w.handle(context.Background(), &mnsMessage{MessageID: "m1", ReceiptHandle: "h1", MessageBody: tt.body, DequeueCount: tt.count})
+		if got := server.log(); strings.Join(got, ",") != strings.Join(tt.requests, ",") {
+			t.Errorf("%s: requests %v, want %v", tt.name, got, tt.requests)
+		}
+	}
+	if len(server.bodies) != 2 || !strings.Contains(server.bodies[1], `{&#34;source&#34;:&#34;bucket/a.apk&#34;}`) {
+		t.Errorf("dead letters %v, want the decoded events", server.bodies)
+	}
+}
+
+// heldLocker is a destLocker whose locks are all held by another job
+type heldLocker struct{}
+
+func (heldLocker) acquire(key, holder string) error { return errLocked }
+func (heldLocker) refresh(key, holder string) error { return errLockLost }
+func (heldLocker) release(key, holder string) error { return nil }
+
+func TestWorkerHandleLocked(t *testing.T) {
+	defer func(o repack.Options) { opts = o }(opts)
+	var apk bytes.Buffer
+	zw := zip.NewWriter(&apk)
+	for _, name := range []string{repack.AndroidManifestPath, "classes.dex"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte(name))
+	}
+	zw.Close()
+	oss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/a.apk" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(apk.Bytes()))
+	}))
+	defer oss.Close()
+	opts.Retries, opts.Retry = 2, &repack.RetryPolicy{}
+	opts.OSSEndpoint, opts.OSSAccessKeyID, opts.OSSAccessKeySecret = oss.URL, "id", "secret"
+	opts.CPIDFile, opts.CPIDComment = false, true
+	opts.WorkDir = t.TempDir()
+	server := newMNSServer(nil)
+	defer server.Close()
+	w := &worker{queue: &mnsQueue{Endpoint: server.URL, Name: "repack"}, locker: heldLocker{}}
+
+	// past -retries, yet sent again rather than dead-lettered
+	w.handle(context.Background(), &mnsMessage{MessageID: "m1", ReceiptHandle: "h1", MessageBody: `{"source":"bucket/a.apk","dest":"bucket/b.apk","cpid":"c1"}`, DequeueCount: 5})
+	if got := strings.Join(server.log(), ","); got != "POST /queues/repack/messages,DELETE /queues/repack/messages" {
+		t.Errorf("requests %s", got)
+	}
+	if len(server.bodies) != 1 || !strings.Contains(server.bodies[0], "<DelaySeconds>60</DelaySeconds>") {
+		t.Errorf("sent %v, want the event delayed by lockTTL", server.bodies)
+	}
+}